@@ -1,11 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,12 +18,13 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/widget"
 	"github.com/gorilla/websocket"
+	"ondeso/protocol"
 )
 
 var (
 	wsConn    *websocket.Conn
 	exitChan  = make(chan bool)
-	logField  *widget.MultiLineEntry
+	logField  *widget.Entry
 	serverURL = "ws://85.215.147.108:8765"
 )
 
@@ -31,6 +36,63 @@ func writeLog(message string) {
 	logField.SetText(logField.Text + "\n" + logMsg)
 }
 
+// Version der GUI. Sie spricht protocol.CurrentVersion, zeigt aber nur
+// Nachrichten an und meldet daher keine Fähigkeiten; der Server schickt ihr
+// keine Skripte.
+const clientVersion = "gui-1.0.0"
+
+// Einmaliges Enrollment-Token, mit dem sich die GUI beim ersten Start anmeldet
+var enrollToken = flag.String("enroll", "", "Einmaliges Enrollment-Token für die Erstanmeldung am Server")
+
+// Pfad einer Datei der GUI im Benutzerprofil
+func configPath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "ondeso", name)
+}
+
+// Liest die Client-ID aus dem Benutzerprofil oder erzeugt eine neue
+func getClientID() string {
+	path := configPath("gui_client_id")
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id
+		}
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := fmt.Sprintf("%08x-%04x-%04x-%04x-%12x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = os.WriteFile(path, []byte(id), 0600)
+	}
+	if err != nil {
+		writeLog(fmt.Sprintf("⚠️ Client-ID konnte nicht gespeichert werden: %v", err))
+	}
+	return id
+}
+
+// Liest das beim Enrollment ausgestellte Client-Secret aus dem Benutzerprofil
+func loadClientSecret() string {
+	data, err := os.ReadFile(configPath("gui_client_secret"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Speichert das Client-Secret nur für den aktuellen Benutzer lesbar
+func saveClientSecret(secret string) error {
+	path := configPath("gui_client_secret")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(secret), 0600)
+}
+
 // WebSocket-Verbindung aufbauen
 func connectWebSocket() {
 	for {
@@ -52,30 +114,64 @@ func connectWebSocket() {
 	}
 }
 
-// Registriert den Client beim Server
+// Registriert den Client beim Server. Wie der websock-client meldet sich die
+// GUI beim ersten Start mit dem Enrollment-Token (-enroll) an und danach mit
+// dem gespeicherten Client-Secret.
 func registerClient() bool {
-	data := map[string]string{
-		"action":   "register",
-		"hostname": os.Getenv("COMPUTERNAME"),
-		"ip":       getIPAddress(),
+	clientID := getClientID()
+	register := &protocol.Register{
+		ClientID:        clientID,
+		Hostname:        os.Getenv("COMPUTERNAME"),
+		IP:              getIPAddress(),
+		ProtocolVersion: protocol.CurrentVersion,
+		ClientVersion:   clientVersion,
+	}
+	secret := loadClientSecret()
+	if secret == "" && *enrollToken != "" {
+		register.EnrollmentToken = *enrollToken
+		writeLog("🎟️ Kein Client-Secret vorhanden, melde mit Enrollment-Token an")
 	}
-	jsonData, _ := json.Marshal(data)
 
-	err := wsConn.WriteMessage(websocket.TextMessage, jsonData)
+	response, err := protocol.ClientHandshake(register, secret, sendMessage, readResponse)
+	if errors.Is(err, protocol.ErrNoClientSecret) {
+		writeLog("❌ Server verlangt Anmeldung, aber es ist kein Client-Secret vorhanden (Start mit -enroll <Token>)")
+		return false
+	}
+	if errors.Is(err, protocol.ErrRegistrationRejected) {
+		writeLog(fmt.Sprintf("❌ Registrierung abgelehnt: %s", response.Message))
+		return false
+	}
 	if err != nil {
 		writeLog(fmt.Sprintf("❌ Fehler bei Registrierung: %v", err))
 		return false
 	}
 
-	_, msg, err := wsConn.ReadMessage()
+	if response.ClientSecret != "" {
+		if err := saveClientSecret(response.ClientSecret); err != nil {
+			writeLog(fmt.Sprintf("❌ Fehler beim Speichern des Client-Secrets: %v", err))
+			return false
+		}
+		writeLog("🔑 Enrollment abgeschlossen, Client-Secret gespeichert")
+	}
+	return true
+}
+
+// Sendet eine Nachricht an den Server
+func sendMessage(msg protocol.Message) error {
+	jsonData, err := protocol.Encode(msg)
 	if err != nil {
-		writeLog(fmt.Sprintf("❌ Fehler bei Serverantwort: %v", err))
-		return false
+		return err
 	}
+	return wsConn.WriteMessage(websocket.TextMessage, jsonData)
+}
 
-	var response map[string]string
-	json.Unmarshal(msg, &response)
-	return response["status"] == "registered"
+// Liest eine JSON-Antwort des Servers
+func readResponse() (protocol.Response, error) {
+	_, msg, err := wsConn.ReadMessage()
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	return protocol.DecodeResponse(msg)
 }
 
 // Lauscht auf WebSocket-Nachrichten
@@ -88,7 +184,16 @@ func listenWebSocket() {
 			connectWebSocket()
 			return
 		}
-		writeLog(fmt.Sprintf("📩 Nachricht empfangen: %s", string(msg)))
+		message, err := protocol.Decode(msg)
+		if err != nil {
+			writeLog(fmt.Sprintf("⚠️ Ungültige Nachricht: %v", err))
+			continue
+		}
+		if text, ok := message.(*protocol.ContentMessage); ok {
+			writeLog(fmt.Sprintf("📩 Nachricht empfangen: %s", text.Content))
+		} else {
+			writeLog(fmt.Sprintf("📩 Nachricht empfangen: %s", message.Action()))
+		}
 	}
 }
 
@@ -141,6 +246,7 @@ func createUI() {
 
 // Startet die Anwendung
 func main() {
+	flag.Parse()
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
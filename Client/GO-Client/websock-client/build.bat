@@ -1,4 +1,4 @@
-windres main.rc -O coff -o rsrc.syso
+windres main.rc -O coff -o rsrc_windows_amd64.syso
 
 go build -ldflags "-s -w" -o ondeso_websock.exe
 
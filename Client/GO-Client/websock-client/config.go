@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/ini.v1"
+	"ondeso/protocol"
+)
+
+// Fehlversuche mit einer per set_config gesetzten Server-URL, nach denen die
+// vorherige URL wiederhergestellt wird
+const serverFallbackAttempts = 3
+
+// Zustand nach einem Wechsel der Server-URL. Wird nur von der Goroutine
+// von connectWebSocket/listenWebSocket verwendet.
+var (
+	previousServerURL    string // Bis zur ersten erfolgreichen Registrierung
+	serverChangeID       string // request_id des set_config mit der neuen URL
+	failedServerAttempts int
+	revertedChangeID     string // Dem vorherigen Server als fehlgeschlagen melden
+)
+
+// Verarbeitet set_config: alle Werte sind bereits von protocol.Decode
+// geprüft, werden gespeichert und soweit möglich sofort übernommen. Eine
+// neue Server-URL wird durch einen Neuaufbau der Verbindung übernommen.
+func handleSetConfig(request *protocol.SetConfig) {
+	writeLog(fmt.Sprintf("⚙️ Server ändert Konfiguration (%s): %v", request.RequestID, request.Settings))
+
+	// Ein Wechsel von wss:// auf ws:// würde TLS abschalten
+	if err := protocol.CheckServerChange(serverURL, request.Settings); err != nil {
+		reportConfigResult(request.RequestID, protocol.ConfigRejected, err.Error(), false)
+		return
+	}
+
+	cfg, err := ini.Load(clientCfg)
+	if err != nil {
+		reportConfigResult(request.RequestID, protocol.ConfigFailed, "INI-Datei nicht lesbar: "+err.Error(), false)
+		return
+	}
+	section := cfg.Section("CLIENT")
+	for key, value := range request.Settings {
+		section.Key(key).SetValue(value)
+	}
+	if err := cfg.SaveTo(clientCfg); err != nil {
+		reportConfigResult(request.RequestID, protocol.ConfigFailed, "INI-Datei nicht gespeichert: "+err.Error(), false)
+		return
+	}
+
+	newServerURL, reconnect := request.Settings[protocol.ConfigWebsockServer]
+	reconnect = reconnect && newServerURL != serverURL
+	applyConfig(request.Settings)
+	reportConfigResult(request.RequestID, protocol.ConfigApplied, "", reconnect)
+
+	if reconnect {
+		writeLog(fmt.Sprintf("🔄 Neue Server-URL %s, baue Verbindung neu auf", newServerURL))
+		previousServerURL, serverChangeID, failedServerAttempts = serverURL, request.RequestID, 0
+		serverURL = newServerURL
+
+		// Schließen beendet listenWebSocket, das die Verbindung neu aufbaut
+		wsWriteMutex.Lock()
+		wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "reconnect"), time.Now().Add(time.Second))
+		wsConn.Close()
+		wsWriteMutex.Unlock()
+	}
+}
+
+// Übernimmt Einstellungen, die ohne Neustart wirken
+func applyConfig(settings map[string]string) {
+	if value, ok := settings[protocol.ConfigLogging]; ok {
+		loggingLevel = value
+		setupLogging()
+		writeLog(fmt.Sprintf("✅ Logging-Level gesetzt: %v", loggingLevel))
+	}
+	if value, ok := settings[protocol.ConfigOldLogfiles]; ok {
+		if num, err := strconv.Atoi(value); err == nil && num > 0 {
+			oldLogFiles = num
+			cleanupOldLogs()
+			writeLog(fmt.Sprintf("✅ Anzahl alter Logdateien gesetzt: %d", oldLogFiles))
+		}
+	}
+	if value, ok := settings[protocol.ConfigHideScriptWindow]; ok {
+		HideScriptWindow = value == "1" || value == "true"
+		writeLog(fmt.Sprintf("✅ HideScriptWindow gesetzt: %v", HideScriptWindow))
+	}
+}
+
+// Zählt fehlgeschlagene Verbindungen mit einer neuen Server-URL und stellt
+// nach serverFallbackAttempts Versuchen die vorherige wieder her
+func serverConnectFailed() {
+	if previousServerURL == "" {
+		return
+	}
+	failedServerAttempts++
+	if failedServerAttempts < serverFallbackAttempts {
+		return
+	}
+
+	writeLog(fmt.Sprintf("⚠️ Neue Server-URL %s nach %d Versuchen nicht erreichbar, verwende wieder %s", serverURL, failedServerAttempts, previousServerURL))
+	serverURL = previousServerURL
+	revertedChangeID = serverChangeID
+	previousServerURL, serverChangeID, failedServerAttempts = "", "", 0
+	if err := saveConfigValue(protocol.ConfigWebsockServer, serverURL); err != nil {
+		writeLog(fmt.Sprintf("❌ Vorherige Server-URL nicht gespeichert: %v", err))
+	}
+}
+
+// Nach erfolgreicher Registrierung: eine neue Server-URL gilt als bestätigt,
+// eine zurückgenommene wird dem Server gemeldet
+func serverConnected() {
+	if previousServerURL != "" {
+		writeLog(fmt.Sprintf("✅ Neue Server-URL %s bestätigt", serverURL))
+		previousServerURL, serverChangeID, failedServerAttempts = "", "", 0
+	}
+	if revertedChangeID != "" {
+		reportConfigResult(revertedChangeID, protocol.ConfigFailed, "Neue Server-URL nicht erreichbar, vorherige URL wiederhergestellt", false)
+		revertedChangeID = ""
+	}
+}
+
+// Speichert einen Wert im Abschnitt [CLIENT]
+func saveConfigValue(key string, value string) error {
+	cfg, err := ini.Load(clientCfg)
+	if err != nil {
+		return err
+	}
+	cfg.Section("CLIENT").Key(key).SetValue(value)
+	return cfg.SaveTo(clientCfg)
+}
+
+// Meldet dem Server das Ergebnis eines set_config
+func reportConfigResult(requestID string, status string, message string, reconnect bool) {
+	if status != protocol.ConfigApplied {
+		writeLog(fmt.Sprintf("❌ Konfiguration nicht übernommen: %s", message))
+	}
+	err := sendMessage(&protocol.ConfigResult{RequestID: requestID, Status: status, Message: message, Reconnect: reconnect})
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden des Konfigurationsergebnisses: %v", err))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+var enrollToken = flag.String("enroll", "", "Einmaliges Enrollment-Token für die Erstanmeldung am Server")
+
+// Liest das beim Enrollment ausgestellte Client-Secret (neben client_config.ini)
+func loadClientSecret() string {
+	data, err := os.ReadFile(clientSecretPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			writeLog(fmt.Sprintf("❌ Fehler beim Lesen des Client-Secrets: %v", err))
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Speichert das Client-Secret nur für den aktuellen Benutzer lesbar
+func saveClientSecret(secret string) error {
+	return os.WriteFile(clientSecretPath, []byte(secret), 0600)
+}
+
+// Liefert das Enrollment-Token aus CLI-Parameter oder INI-Datei
+func getEnrollmentToken() string {
+	if *enrollToken != "" {
+		return *enrollToken
+	}
+	cfg, err := ini.Load(clientCfg)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(cfg.Section("CLIENT").Key("enrollment_token").String())
+}
+
+// Entfernt das verbrauchte Enrollment-Token aus der INI-Datei
+func clearEnrollmentToken() {
+	cfg, err := ini.Load(clientCfg)
+	if err != nil {
+		return
+	}
+	section := cfg.Section("CLIENT")
+	if !section.HasKey("enrollment_token") {
+		return
+	}
+	section.DeleteKey("enrollment_token")
+	if err := cfg.SaveTo(clientCfg); err != nil {
+		writeLog("❌ Fehler beim Speichern der INI-Datei: " + err.Error())
+	}
+}
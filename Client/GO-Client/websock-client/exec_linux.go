@@ -0,0 +1,98 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"ondeso/protocol"
+)
+
+// PowerShell (Core) für powershell und powershell-base64, falls installiert
+const powershellExecutable = "pwsh"
+
+// Ein BOM vor "#!" würde die Shebang-Zeile unbrauchbar machen
+const scriptBOM = false
+
+// Standard-Workplace, wenn -workplace fehlt
+func defaultBaseDir() string {
+	return "/var/lib/ondeso/workplace"
+}
+
+// Setzt die Prozessattribute für Skripte, Binärdateien und Shells. Jeder
+// Prozess erhält eine eigene Prozessgruppe, damit killProcessTree auch
+// gestartete Kindprozesse erreicht; Fenster gibt es nicht.
+func setProcessAttributes(cmd *exec.Cmd, hideWindow bool) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Beendet einen Prozess samt seiner Prozessgruppe
+func killProcessTree(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// Erstellt den Befehl für ein gespeichertes Skript. Der Interpreter wird
+// direkt gestartet, stdout und stderr landen in outputLog; die Datei
+// schließt executeScript nach dem Start.
+func scriptCommand(scriptType string, filePath string, outputLog string, arguments []protocol.ScriptArgument) (*exec.Cmd, error) {
+	var interpreter []string
+	switch scriptType {
+	case "linuxshell":
+		if _, err := exec.LookPath("bash"); err == nil {
+			interpreter = []string{"bash", filePath}
+		} else {
+			interpreter = []string{"sh", filePath}
+		}
+	case "python":
+		interpreter = []string{"python3", filePath}
+	case "powershell":
+		interpreter = []string{powershellExecutable, "-NoProfile", "-NonInteractive", "-File", filePath}
+	case "bat":
+		return nil, fmt.Errorf("Skripttyp bat wird unter Linux nicht unterstützt")
+	default:
+		return nil, fmt.Errorf("unbekannter Skripttyp: %s", scriptType)
+	}
+	if _, err := exec.LookPath(interpreter[0]); err != nil {
+		return nil, fmt.Errorf("Interpreter %s ist nicht installiert", interpreter[0])
+	}
+
+	output, err := os.Create(outputLog)
+	if err != nil {
+		return nil, fmt.Errorf("Log-Datei nicht erstellt: %v", err)
+	}
+	cmd := exec.Command(interpreter[0], append(interpreter[1:], scriptCommandArgs(scriptType, arguments)...)...)
+	cmd.Dir = scriptDir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd, nil
+}
+
+// Befehl für eine Shell-Sitzung ("" = sh). -i sorgt für Eingabeaufforderungen,
+// obwohl stdin eine Pipe ist.
+func shellCommand(shell string) (*exec.Cmd, error) {
+	switch shell {
+	case "", "sh":
+		return exec.Command("/bin/sh", "-i"), nil
+	case "powershell":
+		if _, err := exec.LookPath(powershellExecutable); err == nil {
+			return exec.Command(powershellExecutable, "-NoLogo", "-NoProfile", "-Command", "-"), nil
+		}
+	}
+	return nil, fmt.Errorf("Shell %q ist auf diesem System nicht verfügbar", shell)
+}
+
+// Unter Linux sind Programme meist ohne Endung; Windows-Dateien werden abgelehnt
+func isExecutableBinary(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".exe", ".msi", ".bat", ".cmd", ".ps1", ".dll":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"ondeso/protocol"
+)
+
+// PowerShell für powershell und powershell-base64
+const powershellExecutable = "powershell.exe"
+
+// Skripte werden mit UTF-8 BOM gespeichert, damit PowerShell und cmd.exe
+// Umlaute richtig lesen
+const scriptBOM = true
+
+// Standard-Workplace, wenn -workplace fehlt
+func defaultBaseDir() string {
+	return filepath.Join(os.Getenv("PROGRAMDATA"), "ondeso", "workplace")
+}
+
+// Setzt die Prozessattribute für Skripte, Binärdateien und Shells
+func setProcessAttributes(cmd *exec.Cmd, hideWindow bool) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: hideWindow}
+}
+
+// Beendet einen Prozess samt Kindprozessen. cmd.exe startet Skripte und
+// Befehle als Kindprozesse, daher den ganzen Baum beenden.
+func killProcessTree(cmd *exec.Cmd) {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// Erstellt den Befehl für ein gespeichertes Skript. cmd.exe startet das
+// Skript und leitet die Ausgabe in outputLog um.
+func scriptCommand(scriptType string, filePath string, outputLog string, arguments []protocol.ScriptArgument) (*exec.Cmd, error) {
+	var interpreter []string
+	switch scriptType {
+	case "powershell":
+		interpreter = []string{powershellExecutable, "-ExecutionPolicy", "Bypass", "-File", filePath}
+	case "bat":
+		interpreter = []string{filePath}
+	case "python":
+		interpreter = []string{"python", filePath}
+	case "linuxshell":
+		interpreter = []string{"bash", filePath}
+	default:
+		return nil, fmt.Errorf("unbekannter Skripttyp: %s", scriptType)
+	}
+
+	cmdArgs := []string{"/c", "start"}
+	if HideScriptWindow {
+		cmdArgs = append(cmdArgs, "/b")
+	}
+	cmdArgs = append(cmdArgs, "/wait")
+	cmdArgs = append(cmdArgs, interpreter...)
+	cmdArgs = append(cmdArgs, scriptCommandArgs(scriptType, arguments)...)
+	cmdArgs = append(cmdArgs, ">", outputLog, "2>&1", "&", "exit")
+	return exec.Command("cmd.exe", cmdArgs...), nil
+}
+
+// Befehl für eine Shell-Sitzung ("" = cmd)
+func shellCommand(shell string) (*exec.Cmd, error) {
+	switch shell {
+	case "", "cmd":
+		// UTF-8-Codepage, damit die Ausgabe im Browser lesbar ist
+		return exec.Command("cmd.exe", "/Q", "/K", "chcp 65001 >nul"), nil
+	case "powershell":
+		return exec.Command(powershellExecutable, "-NoLogo", "-NoProfile", "-ExecutionPolicy", "Bypass", "-Command", "-"), nil
+	default:
+		return nil, fmt.Errorf("Shell %q ist auf diesem System nicht verfügbar", shell)
+	}
+}
+
+// Ausführbare Binärdateien erkennt Windows an der Endung .exe
+func isExecutableBinary(name string) bool {
+	return strings.ToLower(filepath.Ext(name)) == ".exe"
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ondeso/protocol"
+)
+
+// Größe der Datei-Chunks vor Base64 (base64 ≈ 350 KB, unter WS_MAX_MESSAGE_BYTES
+// des Servers) und Pause zwischen den Chunks wegen dessen Ratenbegrenzung
+const (
+	fileChunkSize  = 256 * 1024
+	fileChunkPause = 100 * time.Millisecond
+)
+
+// Prüft, ob path innerhalb von dir liegt
+func insideDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// Löst einen angeforderten Pfad im Workplace auf. Absolute Pfade, "..",
+// Symlinks nach außerhalb sowie Secret, Konfiguration und TLS-Schlüssel
+// werden abgelehnt.
+func resolveFetchPath(requested string) (string, error) {
+	name := filepath.FromSlash(requested)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", fmt.Errorf("nur Pfade relativ zum Workplace sind erlaubt")
+	}
+
+	base, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("Workplace nicht lesbar: %v", err)
+	}
+	full := filepath.Join(base, name)
+	if !insideDir(base, full) {
+		return "", fmt.Errorf("Pfad liegt außerhalb des Workplace")
+	}
+	// Symlinks und Junctions auflösen und erneut prüfen
+	resolved, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", fmt.Errorf("Datei nicht gefunden")
+	}
+	if !insideDir(base, resolved) {
+		return "", fmt.Errorf("Pfad liegt außerhalb des Workplace")
+	}
+
+	for _, denied := range []string{clientSecretPath, clientCfg, tlsClientKeyFile} {
+		if denied == "" {
+			continue
+		}
+		if deniedPath, err := filepath.EvalSymlinks(denied); err == nil && strings.EqualFold(deniedPath, resolved) {
+			return "", fmt.Errorf("Datei darf nicht abgerufen werden")
+		}
+	}
+	return resolved, nil
+}
+
+// Liest eine angeforderte Datei (höchstens maxSize Bytes, 0 = unbegrenzt)
+func readFetchFile(path string, maxSize int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Datei kann nicht geöffnet werden: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("keine reguläre Datei")
+	}
+	if maxSize > 0 && info.Size() > maxSize {
+		return nil, fmt.Errorf("Datei ist %d Bytes groß, erlaubt sind %d", info.Size(), maxSize)
+	}
+
+	// Die Datei kann während des Lesens wachsen (z.B. Logdateien)
+	reader := io.Reader(file)
+	if maxSize > 0 {
+		reader = io.LimitReader(file, maxSize+1)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Lesen: %v", err)
+	}
+	if maxSize > 0 && int64(len(content)) > maxSize {
+		return nil, fmt.Errorf("Datei ist größer als %d Bytes", maxSize)
+	}
+	return content, nil
+}
+
+// Beantwortet einen fetch_file-Befehl des Servers
+func handleFetchFile(request *protocol.FetchFile) {
+	writeLog(fmt.Sprintf("📤 Server fordert Datei an: %s (Anfrage %s)", request.Path, request.RequestID))
+
+	if !policy.allowFetch {
+		reportFetchFailed(request, fmt.Errorf("Dateiabruf ist durch die Richtlinie nicht erlaubt"))
+		return
+	}
+	path, err := resolveFetchPath(request.Path)
+	if err != nil {
+		reportFetchFailed(request, err)
+		return
+	}
+	content, err := readFetchFile(path, request.MaxSize)
+	if err != nil {
+		reportFetchFailed(request, err)
+		return
+	}
+
+	if err := sendFetchedFile(request, content); err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Senden von %s: %v", request.Path, err))
+		return
+	}
+	writeLog(fmt.Sprintf("✅ Datei %s gesendet (%d Bytes)", request.Path, len(content)))
+}
+
+// Sendet eine Datei in Chunks; eine leere Datei als ein leerer Chunk
+func sendFetchedFile(request *protocol.FetchFile, content []byte) error {
+	sum := sha256.Sum256(content)
+	fileHash := hex.EncodeToString(sum[:])
+
+	totalChunks := (len(content) + fileChunkSize - 1) / fileChunkSize
+	if totalChunks == 0 {
+		totalChunks = 1
+	}
+
+	for index := 0; index < totalChunks; index++ {
+		start := index * fileChunkSize
+		end := start + fileChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := base64.StdEncoding.EncodeToString(content[start:end])
+		chunkSum := sha256.Sum256([]byte(chunk))
+
+		err := sendMessage(&protocol.FileChunk{
+			RequestID: request.RequestID,
+			Path:      request.Path,
+			FileChunk: chunk,
+			Size:      int64(len(content)),
+			SHA256:    fileHash,
+			ChunkInfo: protocol.ChunkInfo{
+				ChunkIndex:  index,
+				TotalChunks: totalChunks,
+				ChunkSHA256: hex.EncodeToString(chunkSum[:]),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Chunk %d/%d: %v", index+1, totalChunks, err)
+		}
+		if index+1 < totalChunks {
+			time.Sleep(fileChunkPause)
+		}
+	}
+	return nil
+}
+
+// Meldet dem Server einen abgelehnten oder fehlgeschlagenen Dateiabruf
+func reportFetchFailed(request *protocol.FetchFile, reason error) {
+	writeLog(fmt.Sprintf("⛔ Dateiabruf %s abgelehnt: %v", request.Path, reason))
+	err := sendMessage(&protocol.FetchFailed{
+		RequestID: request.RequestID,
+		Path:      request.Path,
+		Reason:    reason.Error(),
+	})
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden des fehlgeschlagenen Dateiabrufs: %v", err))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Legt einen Workplace mit Secret, Konfiguration und TLS-Schlüssel sowie eine
+// Datei außerhalb davon an
+func setupFetchWorkplace(t *testing.T) (outside string) {
+	t.Helper()
+	root := t.TempDir()
+	workplace := filepath.Join(root, "workplace")
+	for _, dir := range []string{filepath.Join(workplace, "logs"), filepath.Join(root, "secret")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(workplace, "logs", "output.log"):      "log",
+		filepath.Join(workplace, "client_config.ini"):       "[CLIENT]",
+		filepath.Join(workplace, "client_secret.key"):       "secret",
+		filepath.Join(workplace, "tls", "client.key"):       "key",
+		filepath.Join(root, "secret", "passwords.txt"):      "outside",
+		filepath.Join(root, "workplace-other", "notes.txt"): "sibling",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldBase, oldCfg, oldSecret, oldKey := baseDir, clientCfg, clientSecretPath, tlsClientKeyFile
+	t.Cleanup(func() { baseDir, clientCfg, clientSecretPath, tlsClientKeyFile = oldBase, oldCfg, oldSecret, oldKey })
+	baseDir = workplace
+	clientCfg = filepath.Join(workplace, "client_config.ini")
+	clientSecretPath = filepath.Join(workplace, "client_secret.key")
+	tlsClientKeyFile = filepath.Join(workplace, "tls", "client.key")
+	return filepath.Join(root, "secret")
+}
+
+func TestResolveFetchPath(t *testing.T) {
+	setupFetchWorkplace(t)
+
+	tests := []struct {
+		requested string
+		wantErr   bool
+	}{
+		{"logs/output.log", false},
+		{`logs\output.log`, runtime.GOOS != "windows"}, // Backslash trennt nur unter Windows
+		{"logs/../logs/output.log", false},
+		{"../secret/passwords.txt", true},
+		{"logs/../../secret/passwords.txt", true},
+		{"../workplace-other/notes.txt", true},
+		{"..", true},
+		{"/etc/passwd", true},
+		{`C:\Windows\win.ini`, true},
+		{`C:Windows\win.ini`, true},
+		{`\\server\share\file.txt`, true},
+		{`\Windows\win.ini`, true},
+		{"logs/missing.log", true},
+		{"client_config.ini", true},
+		{"./client_secret.key", true},
+		{"tls/client.key", true},
+		{"logs/../client_secret.key", true},
+	}
+	for _, tt := range tests {
+		_, err := resolveFetchPath(tt.requested)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveFetchPath(%q) error = %v, want error %v", tt.requested, err, tt.wantErr)
+		}
+	}
+}
+
+// Symlinks (unter Windows auch Junctions) dürfen nicht aus dem Workplace
+// herausführen und nicht auf gesperrte Dateien zeigen
+func TestResolveFetchPathSymlinks(t *testing.T) {
+	outside := setupFetchWorkplace(t)
+
+	links := map[string]string{
+		"outside-file.txt": filepath.Join(outside, "passwords.txt"),
+		"outside-dir":      outside,
+		"secret-link.txt":  clientSecretPath,
+		"config-link.ini":  clientCfg,
+		"log-link.txt":     filepath.Join(baseDir, "logs", "output.log"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(baseDir, name)); err != nil {
+			t.Skipf("Symlinks werden nicht unterstützt: %v", err)
+		}
+	}
+
+	tests := []struct {
+		requested string
+		wantErr   bool
+	}{
+		{"log-link.txt", false},
+		{"outside-file.txt", true},
+		{"outside-dir/passwords.txt", true},
+		{"secret-link.txt", true},
+		{"config-link.ini", true},
+	}
+	for _, tt := range tests {
+		_, err := resolveFetchPath(tt.requested)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveFetchPath(%q) error = %v, want error %v", tt.requested, err, tt.wantErr)
+		}
+	}
+
+	// Ein Workplace, der selbst ein Symlink ist, bleibt erlaubt
+	link := filepath.Join(filepath.Dir(baseDir), "workplace-link")
+	if err := os.Symlink(baseDir, link); err != nil {
+		t.Fatal(err)
+	}
+	baseDir = link
+	if _, err := resolveFetchPath("logs/output.log"); err != nil {
+		t.Errorf("resolveFetchPath() über verlinkten Workplace: %v", err)
+	}
+	if _, err := resolveFetchPath("client_secret.key"); err == nil {
+		t.Error("resolveFetchPath() über verlinkten Workplace gibt client_secret.key frei")
+	}
+}
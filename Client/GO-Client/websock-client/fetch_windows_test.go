@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Junctions brauchen anders als Symlinks keine Rechte und müssen genauso
+// abgelehnt werden, wenn sie aus dem Workplace herausführen
+func TestResolveFetchPathJunction(t *testing.T) {
+	outside := setupFetchWorkplace(t)
+
+	junction := filepath.Join(baseDir, "outside-junction")
+	if output, err := exec.Command("cmd.exe", "/c", "mklink", "/J", junction, outside).CombinedOutput(); err != nil {
+		t.Skipf("Junction nicht angelegt: %v: %s", err, output)
+	}
+	if _, err := resolveFetchPath(`outside-junction\passwords.txt`); err == nil {
+		t.Error("resolveFetchPath() folgt einer Junction aus dem Workplace")
+	}
+	if _, err := resolveFetchPath(`CLIENT_SECRET.KEY`); err == nil {
+		t.Error("resolveFetchPath() gibt client_secret.key in anderer Schreibweise frei")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"ondeso/protocol"
+)
+
+// Legt eine per transfer_start angekündigte Übertragung an
+// (Art, Namen und Anzahl der Frames hat protocol.Decode geprüft)
+func startFrameTransfer(start *protocol.TransferStart) {
+	name, payloadType := start.BinaryName, "binary"
+	switch start.Kind {
+	case protocol.KindScript:
+		name, payloadType = start.ScriptName, start.ScriptType
+	case protocol.KindAgent:
+		payloadType = "agent"
+	}
+
+	transfersMutex.Lock()
+	transfers[start.TransferID] = &incomingTransfer{
+		transferID:  start.TransferID,
+		name:        name,
+		payloadType: payloadType,
+		executionID: start.ExecutionID,
+		chunks:      make(map[int]string),
+		total:       start.TotalChunks,
+		updated:     time.Now(),
+		start:       start,
+	}
+	transfersMutex.Unlock()
+	writeLog(fmt.Sprintf("📂 Neue Übertragung %s: %s, %d Frames", start.TransferID, name, start.TotalChunks))
+}
+
+// Verarbeitet einen Binär-Frame (Aufbau siehe protocol.EncodeFrame)
+func processTransferFrame(msg []byte) {
+	frame, err := protocol.DecodeFrame(msg)
+	if err != nil {
+		writeLog(fmt.Sprintf("⚠️ Frame wird nicht unterstützt: %v", err))
+		return
+	}
+	transferID := uuid.UUID(frame.TransferID).String()
+	index, chunk := frame.Index, frame.Data
+
+	transfersMutex.Lock()
+	transfer, ok := transfers[transferID]
+	var start *protocol.TransferStart
+	var name, payloadType string
+	if ok {
+		start, name, payloadType = transfer.start, transfer.name, transfer.payloadType
+	}
+	transfersMutex.Unlock()
+	if start == nil {
+		writeLog(fmt.Sprintf("⚠️ Frame für unbekannte Übertragung %s verworfen", transferID))
+		return
+	}
+
+	if !frame.Verify() || index >= start.TotalChunks || frame.Offset != int64(index)*int64(start.ChunkSize) {
+		writeLog(fmt.Sprintf("⚠️ Frame %d von %s ist beschädigt", index, name))
+		requestChunks(transferID, []int{index})
+		return
+	}
+
+	info := protocol.ChunkInfo{ChunkIndex: index, TotalChunks: start.TotalChunks, TransferID: transferID}
+	chunks, complete := receiveChunk(info, start.ExecutionID, name, payloadType, string(chunk))
+	if !complete {
+		return
+	}
+
+	writeLog(fmt.Sprintf("🔄 Alle %d Frames von %s empfangen", len(chunks), name))
+	content, err := assembleFrames(chunks, start)
+	if payloadType == "agent" {
+		handleAgentPayload(transferID, name, content, err)
+	} else if payloadType == "binary" {
+		handleBinaryPayload(&protocol.BinaryChunk{
+			BinaryName:       start.BinaryName,
+			ChunkInfo:        info,
+			PayloadSignature: start.PayloadSignature,
+		}, content, err)
+	} else {
+		handleScriptPayload(&protocol.ScriptChunk{
+			ScriptName:       start.ScriptName,
+			ScriptType:       start.ScriptType,
+			ChunkInfo:        info,
+			ScriptMeta:       start.ScriptMeta,
+			PayloadSignature: start.PayloadSignature,
+		}, content, err)
+	}
+}
+
+// Setzt die Frames zusammen und entpackt sie bei encoding "gzip"
+func assembleFrames(chunks map[int]string, start *protocol.TransferStart) ([]byte, error) {
+	var payload bytes.Buffer
+	for i := 0; i < len(chunks); i++ {
+		chunk, ok := chunks[i]
+		if !ok {
+			return nil, fmt.Errorf("Frame %d fehlt", i)
+		}
+		payload.WriteString(chunk)
+	}
+
+	size := start.Size
+	switch start.Encoding {
+	case "":
+		if payload.Len() != int(size) {
+			return nil, fmt.Errorf("Größe stimmt nicht (erwartet %d, erhalten %d)", int(size), payload.Len())
+		}
+		return payload.Bytes(), nil
+	case protocol.EncodingGzip:
+		reader, err := gzip.NewReader(&payload)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		// Nicht mehr entpacken als angekündigt
+		content, err := io.ReadAll(io.LimitReader(reader, size+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) != int(size) {
+			return nil, fmt.Errorf("Größe stimmt nicht (erwartet %d, erhalten %d)", int(size), len(content))
+		}
+		return content, nil
+	default:
+		return nil, fmt.Errorf("unbekannte Kodierung %q", start.Encoding)
+	}
+}
@@ -3,12 +3,17 @@ module websocket_client
 go 1.24.0
 
 require (
+	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
+	golang.org/x/sys v0.30.0
 	golang.org/x/text v0.22.0
 )
 
+require fyne.io/fyne/v2 v2.5.4 // indirect
+
 require (
-	fyne.io/fyne/v2 v2.5.4 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	gopkg.in/ini.v1 v1.67.0 // indirect
+	gopkg.in/ini.v1 v1.67.0
+	ondeso/protocol v0.0.0
 )
+
+replace ondeso/protocol => ../../../Shared/GO-Protocol
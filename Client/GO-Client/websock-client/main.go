@@ -3,7 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,9 +14,11 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -25,6 +27,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"gopkg.in/ini.v1"
+	"ondeso/protocol"
 )
 
 //const serverURL = "ws://85.215.147.108:8765"
@@ -35,23 +38,29 @@ var (
 	logDir           string
 	scriptDir        string
 	clientCfg        string
+	clientSecretPath string
 	logFilePath      string
+	logFile          *os.File
 	clientID         string
 	loggingLevel     = "normal" // Default: normal
 	oldLogFiles      = 10       // Default: 10 Logfiles
 	wsConn           *websocket.Conn
-	scriptChunks     = make(map[string]map[int]string)
-	scriptTotal      = make(map[string]int)
+	wsWriteMutex     sync.Mutex
 	exitChan         = make(chan bool)
 	serverURL        = "wss://ondeso.online:8765"
 	HideScriptWindow bool
 )
 
 var defaultConfig = map[string]string{
-	"logging":          "normal",
-	"oldLogfiles":      "10",
-	"websockserver":    "wss://ondeso.online:8765",
-	"HideScriptWindow": "1",
+	"logging":            "normal",
+	"oldLogfiles":        "10",
+	"websockserver":      "wss://ondeso.online:8765",
+	"HideScriptWindow":   "1",
+	"ca_file":            "",
+	"pinned_sha256":      "",
+	"client_cert":        "",
+	"client_key":         "",
+	"signing_public_key": "",
 }
 
 // **Initialisiert Pfade basierend auf CLI-Parameter**
@@ -60,19 +69,20 @@ func setupPaths() {
 	if *workplacePath != "" {
 		baseDir = *workplacePath
 	} else {
-		baseDir = filepath.Join(os.Getenv("PROGRAMDATA"), "ondeso", "workplace")
+		baseDir = defaultBaseDir()
 	}
 
 	// Abhängige Pfade neu setzen
 	logDir = filepath.Join(baseDir, "logs")
 	scriptDir = filepath.Join(baseDir, "scriptfiles")
 	clientCfg = filepath.Join(baseDir, "client_config.ini")
+	clientSecretPath = filepath.Join(baseDir, "client_secret.key")
 	logFilePath = filepath.Join(logDir, "client_stream.log")
 }
 
-// Initialisiert Logs, Verzeichnisse und Client-ID
-func init() {
-	flag.Parse()
+// Initialisiert Logs, Verzeichnisse und Client-ID. Wird von main aufgerufen
+// statt als init(), damit Tests ohne Workplace und INI-Datei laufen.
+func initClient() {
 	setupPaths()
 
 	createDirs()
@@ -98,6 +108,13 @@ func createDefaultIniValues() {
 		}
 	}
 
+	policySection := cfg.Section("POLICY")
+	for key, defaultValue := range defaultPolicyConfig {
+		if !policySection.HasKey(key) {
+			policySection.Key(key).SetValue(defaultValue)
+		}
+	}
+
 	err = cfg.SaveTo(clientCfg)
 	if err != nil {
 		log.Fatalf("❌ Fehler beim Speichern der INI-Datei: %v", err)
@@ -154,6 +171,31 @@ func readConfig() {
 		writeLog(fmt.Sprintf("⚠️ Kein HideScriptWindow-Wert gefunden, Standardwert wird verwendet: %v", HideScriptWindow))
 	}
 
+	// TLS: CA-Pinning und Client-Zertifikat
+	tlsCAFile = section.Key("ca_file").String()
+	tlsPinnedSHA256 = section.Key("pinned_sha256").String()
+	tlsClientCertFile = section.Key("client_cert").String()
+	tlsClientKeyFile = section.Key("client_key").String()
+	if tlsCAFile != "" || tlsPinnedSHA256 != "" {
+		writeLog(fmt.Sprintf("✅ TLS-Pinning aktiv (CA: %q, Pins: %q)", tlsCAFile, tlsPinnedSHA256))
+	}
+	if tlsClientCertFile != "" {
+		writeLog("✅ Client-Zertifikat gesetzt: " + tlsClientCertFile)
+	}
+
+	// Gepinnter Public Key für signierte Skripte und Binärdateien
+	if value := section.Key("signing_public_key").String(); value != "" {
+		if key, err := parseSigningPublicKey(value); err == nil {
+			signingPublicKey = key
+			writeLog("✅ Signaturprüfung aktiv, unsignierte Payloads werden abgelehnt")
+		} else {
+			signingKeyError = err
+			writeLog(fmt.Sprintf("❌ Ungültiger signing_public_key: %v. Alle Skripte, Binärdateien und Updates werden abgelehnt", err))
+		}
+	} else {
+		writeLog("⚠️ Kein signing_public_key gesetzt, Signaturen werden nicht geprüft")
+	}
+
 	// Anzahl der alten Logdateien
 	if value := section.Key("oldLogfiles").String(); value != "" {
 		if num, err := strconv.Atoi(value); err == nil && num > 0 {
@@ -166,21 +208,30 @@ func readConfig() {
 		writeLog(fmt.Sprintf("⚠️ Kein oldLogfiles-Wert gefunden, Standardwert wird verwendet: %d", oldLogFiles))
 	}
 
+	// Ausführungsrichtlinie
+	readPolicy(cfg)
+
 	writeLog("✅ Konfigurationsdatei erfolgreich geladen.")
 }
 
-// Setzt Logging
+// Setzt Logging; bei erneutem Aufruf (set_config) wird die bisherige
+// Log-Datei geschlossen
 func setupLogging() {
+	previous := logFile
+	logFile = nil
 	if loggingLevel == "off" {
 		log.SetOutput(io.Discard)
-		return
+	} else {
+		file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("❌ Konnte Log-Datei nicht öffnen: %v", err)
+		}
+		logFile = file
+		log.SetOutput(file)
 	}
-
-	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("❌ Konnte Log-Datei nicht öffnen: %v", err)
+	if previous != nil {
+		previous.Close()
 	}
-	log.SetOutput(file)
 }
 
 // Löscht alte Log-Dateien
@@ -260,6 +311,16 @@ func getIPAddress() string {
 	return "Unknown"
 }
 
+// Ruft den Rechnernamen ab
+func getHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		writeLog(fmt.Sprintf("⚠️ Rechnername nicht ermittelbar: %v", err))
+		return "Unknown"
+	}
+	return hostname
+}
+
 // Schreibt Logs
 func writeLog(message string) {
 	logEntry := fmt.Sprintf("%s - %s", time.Now().Format("2006-01-02 15:04:05"), message)
@@ -270,20 +331,35 @@ func writeLog(message string) {
 // WebSocket-Verbindung aufbauen
 func connectWebSocket() {
 	for {
+		waitWhileUpdating()
+		if clientStopping.Load() {
+			return
+		}
 		var err error
 		writeLog(fmt.Sprintf("ServerURL: %v", serverURL))
-		wsConn, _, err = websocket.DefaultDialer.Dial(serverURL, nil)
+		dialer, err := newDialer()
+		if err != nil {
+			writeLog(fmt.Sprintf("❌ TLS-Konfiguration ungültig: %v. Neuer Versuch in 5 Sekunden...", err))
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		wsConn, _, err = dialer.Dial(serverURL, nil)
 		if err != nil {
 			writeLog(fmt.Sprintf("❌ Verbindung fehlgeschlagen: %v. Neuer Versuch in 5 Sekunden...", err))
+			serverConnectFailed()
 			time.Sleep(5 * time.Second)
 			continue
 		}
 		writeLog("✅ Erfolgreich mit WebSocket verbunden!")
 
 		if registerClient() {
+			serverConnected()
+			agentUpdateConnected()
+			resumeTransfers() // Nach Verbindungsabbruch fehlende Chunks nachfordern
 			listenWebSocket()
 		} else {
 			writeLog("❌ Registrierung fehlgeschlagen, neuer Versuch in 5 Sekunden...")
+			serverConnectFailed()
 			time.Sleep(5 * time.Second)
 		}
 	}
@@ -291,29 +367,115 @@ func connectWebSocket() {
 
 // Registriert den Client
 func registerClient() bool {
-	data := map[string]string{
-		"action":    "register",
-		"client_id": clientID,
-		"hostname":  os.Getenv("COMPUTERNAME"),
-		"ip":        getIPAddress(),
+	register := &protocol.Register{
+		ClientID: clientID,
+		Hostname: getHostname(),
+		IP:       getIPAddress(),
+	}
+	protocolFields(register)
+
+	// Ohne Client-Secret meldet sich der Client mit dem Enrollment-Token an
+	secret := loadClientSecret()
+	if secret == "" {
+		if token := getEnrollmentToken(); token != "" {
+			register.EnrollmentToken = token
+			writeLog("🎟️ Kein Client-Secret vorhanden, melde mit Enrollment-Token an")
+		}
 	}
-	jsonData, _ := json.Marshal(data)
 
-	err := wsConn.WriteMessage(websocket.TextMessage, jsonData)
+	// Enrollte Clients beweisen den Besitz des Secrets per HMAC
+	response, err := protocol.ClientHandshake(register, secret, sendMessage, readResponse)
+	if errors.Is(err, protocol.ErrNoClientSecret) {
+		writeLog("❌ Server verlangt Anmeldung, aber es ist kein Client-Secret vorhanden")
+		return false
+	}
+	if errors.Is(err, protocol.ErrRegistrationRejected) {
+		writeLog(fmt.Sprintf("❌ Registrierung abgelehnt: %s", response.Message))
+		return false
+	}
 	if err != nil {
 		writeLog(fmt.Sprintf("❌ Fehler bei Registrierung: %v", err))
 		return false
 	}
 
+	if response.ProtocolVersion != 0 {
+		writeLog(fmt.Sprintf("🤝 Protokollversion %d (Client %s)", response.ProtocolVersion, clientVersion))
+	}
+	if response.TransferMode != "" {
+		writeLog(fmt.Sprintf("📦 Übertragungsmodus: %s, Kompression: %s", response.TransferMode, response.Compression))
+	}
+
+	if newSecret := response.ClientSecret; newSecret != "" {
+		if err := saveClientSecret(newSecret); err != nil {
+			writeLog(fmt.Sprintf("❌ Fehler beim Speichern des Client-Secrets: %v", err))
+			return false
+		}
+		clearEnrollmentToken()
+		writeLog("🔑 Enrollment abgeschlossen, Client-Secret gespeichert: " + clientSecretPath)
+	}
+	return true
+}
+
+// Liest eine JSON-Antwort des Servers
+func readResponse() (protocol.Response, error) {
 	_, msg, err := wsConn.ReadMessage()
 	if err != nil {
-		writeLog(fmt.Sprintf("❌ Fehler bei Antwort des Servers: %v", err))
-		return false
+		return protocol.Response{}, err
 	}
+	return protocol.DecodeResponse(msg)
+}
 
-	var response map[string]string
-	json.Unmarshal(msg, &response)
-	return response["status"] == "registered"
+// Sendet eine Nachricht an den Server (Schreibzugriffe werden serialisiert)
+func sendMessage(msg protocol.Message) error {
+	jsonData, err := protocol.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	wsWriteMutex.Lock()
+	defer wsWriteMutex.Unlock()
+	if wsConn == nil {
+		return fmt.Errorf("keine WebSocket-Verbindung")
+	}
+	return wsConn.WriteMessage(websocket.TextMessage, jsonData)
+}
+
+// Meldet das Ergebnis einer Skriptausführung an den Server
+func reportScriptResult(executionID string, scriptName string, exitCode int, runErr error) {
+	result := &protocol.ScriptResult{
+		ExecutionID: executionID,
+		ScriptName:  scriptName,
+		ExitCode:    exitCode,
+		Status:      "success",
+	}
+	if runErr != nil {
+		result.Status = "failed"
+		result.Error = runErr.Error()
+	} else if exitCode != 0 {
+		result.Status = "failed"
+	}
+	status := result.Status
+
+	if err := sendMessage(result); err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden des Skriptergebnisses für %s: %v", scriptName, err))
+		return
+	}
+	writeLog(fmt.Sprintf("📤 Skriptergebnis gemeldet: %s (Exit-Code: %d, Status: %s)", scriptName, exitCode, status))
+}
+
+// Wartet auf das Ende eines gestarteten Prozesses und meldet den Exit-Code
+func waitAndReport(cmd *exec.Cmd, executionID string, scriptName string, limit time.Duration) {
+	defer work.end()
+	timedOut, err := waitWithTimeout(cmd, limit)
+	exitCode := cmd.ProcessState.ExitCode()
+	if _, isExitErr := err.(*exec.ExitError); isExitErr {
+		err = nil // Exit-Code != 0 ist kein Startfehler
+	}
+	if timedOut {
+		err = fmt.Errorf("maximale Laufzeit von %v überschritten", limit)
+	}
+	writeLog(fmt.Sprintf("🏁 Skript beendet: %s (Exit-Code: %d)", scriptName, exitCode))
+	reportScriptResult(executionID, scriptName, exitCode, err)
 }
 
 // Lauscht auf WebSocket-Nachrichten
@@ -321,7 +483,11 @@ func listenWebSocket() {
 	for {
 		messageType, msg, err := wsConn.ReadMessage()
 		if err != nil {
+			if clientStopping.Load() {
+				return
+			}
 			writeLog(fmt.Sprintf("⚠️ Verbindung verloren: %v", err))
+			closeAllShells("Verbindung verloren")
 			time.Sleep(5 * time.Second)
 			connectWebSocket()
 			return
@@ -350,125 +516,167 @@ func sanitizeFilename(name string) string {
 
 // Verarbeitet Nachrichten
 func processMessage(msg []byte) {
-	var data map[string]interface{}
-	err := json.Unmarshal(msg, &data)
+	message, err := protocol.Decode(msg)
 	if err != nil {
 		writeLog(fmt.Sprintf("❌ Fehler beim Entpacken der Nachricht: %v, Inhalt: %s", err, string(msg)))
 		return
 	}
 
 	// Loggen der gesamten empfangenen JSON-Nachricht
-	log.Printf("📥 Empfangene JSON-Nachricht: %v", data)
-
-	if action, ok := data["action"].(string); ok {
-		writeLog(fmt.Sprintf("📥 Empfangene Aktion: %v", action)) // Loggen der empfangenen Aktion
-
-		switch action {
-		case "message":
-			if content, ok := data["content"].(string); ok {
-				writeLog(fmt.Sprintf("📩 Nachricht: %s", content))
-
-				if content == "STOP" {
-					writeLog("🛑 STOP-Befehl erhalten. Beende Programm...")
-					exitChan <- true
-				}
-			} else {
-				writeLog("⚠️ Fehler: 'content' ist kein String oder fehlt.")
-			}
-
-		case "upload_script_chunk":
-			writeLog("🛑 upload_script_chunk")
-			processIncomingChunk(data)
+	log.Printf("📥 Empfangene JSON-Nachricht: %+v", message)
+	writeLog(fmt.Sprintf("📥 Empfangene Aktion: %v", message.Action())) // Loggen der empfangenen Aktion
 
-		case "upload_binary_chunk": // 🔥 Neuer Handler für Binärdateien
-			writeLog("🛑 upload_binary_chunk aufgerufen")
-			processIncomingBinaryChunk(data)
+	switch message := message.(type) {
+	case *protocol.ContentMessage:
+		writeLog(fmt.Sprintf("📩 Nachricht: %s", message.Content))
 
-		default:
-			writeLog(fmt.Sprintf("⚠️ Unbekannte Aktion empfangen: %v", action))
+		if message.Content == "STOP" {
+			writeLog("🛑 STOP-Befehl erhalten. Beende Programm...")
+			exitChan <- true
 		}
-	} else {
-		writeLog("⚠️ Fehler: 'action' ist kein String oder fehlt.")
+
+	case *protocol.ScriptChunk:
+		writeLog("🛑 upload_script_chunk")
+		processIncomingChunk(message)
+
+	case *protocol.BinaryChunk: // 🔥 Neuer Handler für Binärdateien
+		writeLog("🛑 upload_binary_chunk aufgerufen")
+		processIncomingBinaryChunk(message)
+
+	case *protocol.TransferStart:
+		startFrameTransfer(message)
+
+	case *protocol.TransferUnavailable:
+		dropTransfer(message.TransferID, "Server kann die Übertragung nicht fortsetzen: "+message.Message)
+
+	case *protocol.FetchFile:
+		// Im Hintergrund senden, damit weitere Nachrichten empfangen werden
+		go handleFetchFile(message)
+
+	case *protocol.ShellOpen:
+		openShell(message)
+
+	case *protocol.ShellInput:
+		writeShellInput(message)
+
+	case *protocol.ShellClose:
+		closeShell(message.SessionID, "vom Server beendet: "+message.Reason)
+
+	case *protocol.SetConfig:
+		handleSetConfig(message)
+
+	case *protocol.UpdateAgent:
+		handleUpdateAgent(message)
+
+	default:
+		writeLog(fmt.Sprintf("⚠️ Unbekannte Aktion empfangen: %v", message.Action()))
 	}
 }
 
 func processBinaryMessage(msg []byte) {
 	writeLog(fmt.Sprintf("🔍 Verarbeitung von Binärdaten (%d Bytes)...", len(msg)))
 
-	var data map[string]interface{}
-	err := json.Unmarshal(msg, &data)
+	if protocol.IsFrame(msg) {
+		processTransferFrame(msg)
+		return
+	}
+
+	message, err := protocol.Decode(msg)
 	if err != nil {
 		writeLog(fmt.Sprintf("❌ Fehler beim JSON-Parsing von Binärdaten: %v", err))
 		return
 	}
 
-	if action, ok := data["action"].(string); ok {
-		if action == "upload_binary_chunk" {
-			processIncomingBinaryChunk(data)
-		} else {
-			writeLog(fmt.Sprintf("⚠️ Unbekannte Binär-Aktion: %s", action))
-		}
+	if chunk, ok := message.(*protocol.BinaryChunk); ok {
+		processIncomingBinaryChunk(chunk)
 	} else {
-		writeLog("⚠️ Fehler: 'action' fehlt in Binärdaten")
+		writeLog(fmt.Sprintf("⚠️ Unbekannte Binär-Aktion: %s", message.Action()))
 	}
 }
 
-func processIncomingBinaryChunk(data map[string]interface{}) {
-	binaryName, okName := data["binary_name"].(string)
-	chunkIndexFloat, okIndex := data["chunk_index"].(float64)
-	totalChunksFloat, okTotal := data["total_chunks"].(float64)
-	binaryChunk, okChunk := data["binary_chunk"].(string)
-
-	if !okName || !okIndex || !okTotal || !okChunk {
-		writeLog("❌ Fehler: Fehlende oder falsche Felder in upload_binary_chunk Nachricht.")
-		log.Printf("Fehlende/falsche Felder: okName=%v, okIndex=%v, okTotal=%v, okChunk=%v", okName, okIndex, okTotal, okChunk)
-		return
-	}
-
-	chunkIndex := int(chunkIndexFloat)
-	totalChunks := int(totalChunksFloat)
+func processIncomingBinaryChunk(chunk *protocol.BinaryChunk) {
+	chunkIndex := chunk.ChunkIndex
+	totalChunks := chunk.TotalChunks
+	binaryChunk := chunk.BinaryChunk
 
-	binaryName = sanitizeFilename(binaryName)
+	rawName := chunk.BinaryName
+	binaryName := sanitizeFilename(rawName)
 
 	writeLog(fmt.Sprintf("📥 Empfange Binär-Chunk: %s, Chunk: %d/%d, Länge: %d", binaryName, chunkIndex, totalChunks, len(binaryChunk)))
 	log.Printf("📥 Binär-Chunk Daten: binaryName=%s, chunkIndex=%d, totalChunks=%d, chunkLength=%d", binaryName, chunkIndex, totalChunks, len(binaryChunk))
 
-	if _, exists := scriptChunks[binaryName]; !exists {
-		scriptChunks[binaryName] = make(map[int]string)
-		scriptTotal[binaryName] = totalChunks
-		writeLog(fmt.Sprintf("📂 Starte Binär-Download: %s, Gesamt-Chunks: %d", binaryName, totalChunks))
-		log.Printf("📂 Neuer Binär-Download gestartet: %s, totalChunks=%d", binaryName, totalChunks)
+	chunks, complete := receiveChunk(chunk.ChunkInfo, "", rawName, "binary", binaryChunk)
+	if complete {
+		writeLog(fmt.Sprintf("🔄 Alle %d Chunks von %s empfangen. Datei wird gespeichert.", totalChunks, binaryName))
+		log.Printf("🔄 Alle Chunks empfangen, speichere Binärdatei: %s", binaryName)
+		binaryContent, err := assembleChunks(chunks)
+		handleBinaryPayload(chunk, binaryContent, err)
 	}
+}
 
-	scriptChunks[binaryName][chunkIndex] = binaryChunk
+// Prüft und speichert eine vollständig empfangene Binärdatei (JSON-Chunks
+// oder Binär-Frames)
+func handleBinaryPayload(chunk *protocol.BinaryChunk, binaryContent []byte, err error) {
+	rawName := chunk.BinaryName
+	binaryName := sanitizeFilename(rawName)
+	transferID := chunk.TransferID
+	confirmTransfer(transferID)
 
-	if len(scriptChunks[binaryName]) == totalChunks {
-		writeLog(fmt.Sprintf("🔄 Alle %d Chunks von %s empfangen. Datei wird gespeichert.", totalChunks, binaryName))
-		log.Printf("🔄 Alle Chunks empfangen, speichere Binärdatei: %s", binaryName)
-		saveBinary(binaryName, scriptChunks[binaryName])
-		delete(scriptChunks, binaryName)
-		delete(scriptTotal, binaryName)
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Dekodieren von %s: %v", binaryName, err))
+		reportBinaryResult(transferID, rawName, "failed", nil, err)
+		return
 	}
+
+	// Signatur prüfen, bevor irgendetwas geschrieben oder ausgeführt wird
+	if err := verifyPayload(binaryContent, rawName, "binary", "", signatureFromMessage(chunk.PayloadSignature)); err != nil {
+		reportPayloadRejected(rawName, "binary", transferID, err)
+		return
+	}
+	if err := checkBinaryPolicy(rawName, binaryContent); err != nil {
+		reportPolicyRefused(rawName, "binary", transferID, err)
+		return
+	}
+	if !work.begin() {
+		reportBinaryResult(transferID, rawName, "failed", nil, errShuttingDown)
+		return
+	}
+	defer work.end()
+	saveBinary(binaryName, binaryContent, transferID)
 }
 
-func saveBinary(binaryName string, chunks map[int]string) {
-	fullBinaryBase64 := ""
-	for i := 0; i < len(chunks); i++ {
-		fullBinaryBase64 += chunks[i]
+// Meldet den Stand einer Binärdatei-Auslieferung an den Server
+func reportBinaryResult(transferID string, binaryName string, status string, exitCode *int, runErr error) {
+	if transferID == "" {
+		return // Ältere Server verfolgen Auslieferungen nicht
 	}
-	binaryContent, err := base64.StdEncoding.DecodeString(fullBinaryBase64)
-	if err != nil {
-		writeLog(fmt.Sprintf("❌ Fehler beim Base64-Dekodieren von %s: %v", binaryName, err))
+	result := &protocol.BinaryResult{
+		TransferID: transferID,
+		BinaryName: binaryName,
+		Status:     status,
+		ExitCode:   exitCode,
+	}
+	if runErr != nil {
+		result.Error = runErr.Error()
+	}
+	if err := sendMessage(result); err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden des Binär-Status für %s: %v", binaryName, err))
 		return
 	}
+	writeLog(fmt.Sprintf("📤 Binär-Status gemeldet: %s (%s)", binaryName, status))
+}
+
+func saveBinary(binaryName string, binaryContent []byte, transferID string) {
+	var err error
 
 	filePath := filepath.Join(scriptDir, binaryName)
 	writeLog(fmt.Sprintf("💾 Speichere Binärdatei unter: %s", filePath)) // Hinzugefügt
 
-	if strings.ToLower(filepath.Ext(filePath)) == ".exe" {
+	if isExecutableBinary(filePath) {
 		err = os.WriteFile(filePath, binaryContent, 0755)
 		if err != nil {
 			writeLog(fmt.Sprintf("❌ Fehler beim Speichern der Binärdatei %s: %v", filePath, err))
+			reportBinaryResult(transferID, binaryName, "failed", nil, err)
 			return
 		}
 		writeLog(fmt.Sprintf("💾 Binärdatei erfolgreich gespeichert: %s", filePath)) // Hinzugefügt
@@ -476,61 +684,111 @@ func saveBinary(binaryName string, chunks map[int]string) {
 		err = os.Chmod(filePath, 0755)
 		if err != nil {
 			writeLog(fmt.Sprintf("❌ Fehler beim Setzen von Ausführungsrechten für %s: %v", filePath, err))
+			reportBinaryResult(transferID, binaryName, "failed", nil, err)
 			return
 		}
 		writeLog(fmt.Sprintf("🔑 Ausführungsrechte gesetzt für: %s", filePath)) // Hinzugefügt
+		reportBinaryResult(transferID, binaryName, "received", nil, nil)
 
-		executeBinary(filePath)
+		executeBinary(filePath, transferID)
 	} else {
-		writeLog(fmt.Sprintf("⚠️ Binärdatei %s ist keine ausführbare Windows-Datei (.exe).", filePath))
+		writeLog(fmt.Sprintf("⚠️ Binärdatei %s ist unter %s nicht ausführbar.", filePath, runtime.GOOS))
+		reportBinaryResult(transferID, binaryName, "failed", nil, fmt.Errorf("keine ausführbare Datei für %s", runtime.GOOS))
 		return
 	}
 }
 
-func executeBinary(filePath string) {
+func executeBinary(filePath string, transferID string) {
+	binaryName := filepath.Base(filePath)
 	writeLog(fmt.Sprintf("🚀 Versuche Binärdatei auszuführen: %s", filePath)) // Hinzugefügt
 
 	cmd := exec.Command(filePath)
-	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: HideScriptWindow}
+	cmd.Dir = scriptDir
+	setProcessAttributes(cmd, HideScriptWindow)
 
 	err := cmd.Start()
 	if err != nil {
 		writeLog(fmt.Sprintf("❌ Fehler beim Ausführen der Binärdatei %s: %v", filePath, err))
+		reportBinaryResult(transferID, binaryName, "failed", nil, err)
 		return
 	}
 	writeLog(fmt.Sprintf("🚀 Binärdatei ausgeführt: %s", filePath)) // Hinzugefügt
+	reportBinaryResult(transferID, binaryName, "started", nil, nil)
+
+	// Laufzeitbegrenzung der Richtlinie durchsetzen und Ergebnis melden
+	work.add()
+	go func() {
+		defer work.end()
+		timedOut, err := waitWithTimeout(cmd, policy.maxRuntime)
+		exitCode := cmd.ProcessState.ExitCode()
+		if _, isExitErr := err.(*exec.ExitError); isExitErr {
+			err = nil // Exit-Code != 0 ist kein Startfehler
+		}
+		if timedOut {
+			writeLog(fmt.Sprintf("⏱️ Binärdatei %s nach maximaler Laufzeit beendet", filePath))
+			err = fmt.Errorf("maximale Laufzeit von %v überschritten", policy.maxRuntime)
+		}
+		status := "finished"
+		if err != nil || exitCode != 0 {
+			status = "failed"
+		}
+		reportBinaryResult(transferID, binaryName, status, &exitCode, err)
+	}()
 }
 
 // Verarbeitet Skript-Chunks
-func processIncomingChunk(data map[string]interface{}) {
-	scriptName := sanitizeFilename(data["script_name"].(string))
-	chunkIndex := int(data["chunk_index"].(float64))
-	totalChunks := int(data["total_chunks"].(float64))
-	scriptChunk := data["script_chunk"].(string)
-	scriptType := data["script_type"].(string)
-
-	if _, exists := scriptChunks[scriptName]; !exists {
-		scriptChunks[scriptName] = make(map[int]string)
-		scriptTotal[scriptName] = totalChunks
+func processIncomingChunk(chunk *protocol.ScriptChunk) {
+	chunks, complete := receiveChunk(chunk.ChunkInfo, chunk.ExecutionID, chunk.ScriptName, chunk.ScriptType, chunk.ScriptChunk)
+	if complete {
+		scriptContent, err := assembleChunks(chunks)
+		handleScriptPayload(chunk, scriptContent, err)
 	}
-	scriptChunks[scriptName][chunkIndex] = scriptChunk
+}
 
-	if len(scriptChunks[scriptName]) == totalChunks {
-		executeScript(scriptName, scriptChunks[scriptName], scriptType)
-		delete(scriptChunks, scriptName)
-		delete(scriptTotal, scriptName)
+// Prüft und startet ein vollständig empfangenes Skript (JSON-Chunks oder
+// Binär-Frames)
+func handleScriptPayload(chunk *protocol.ScriptChunk, scriptContent []byte, err error) {
+	rawName := chunk.ScriptName
+	scriptName := sanitizeFilename(rawName)
+	scriptType := chunk.ScriptType
+	executionID := chunk.ExecutionID
+	targetOS := chunk.TargetOS
+	parameters := chunk.Parameters
+	confirmTransfer(chunk.TransferID)
+
+	if err == nil {
+		// Signatur prüfen, bevor irgendetwas geschrieben oder ausgeführt wird
+		err = verifyPayload(scriptContent, rawName, scriptType, parameters, signatureFromMessage(chunk.PayloadSignature))
+	}
+	if err != nil {
+		reportPayloadRejected(rawName, scriptType, executionID, err)
+		return
 	}
+	if err := checkScriptPolicy(rawName, scriptType, scriptContent); err != nil {
+		reportPolicyRefused(rawName, scriptType, executionID, err)
+		return
+	}
+	if err := checkTargetOS(targetOS); err != nil {
+		reportPolicyRefused(rawName, scriptType, executionID, err)
+		return
+	}
+	// Der Server prüft die Werte bereits; da sie über cmd.exe übergeben
+	// werden, wird hier erneut geprüft
+	arguments, err := protocol.DecodeArguments(parameters)
+	if err != nil {
+		reportPayloadRejected(rawName, scriptType, executionID, err)
+		return
+	}
+	if !work.begin() {
+		reportScriptResult(executionID, scriptName, -1, errShuttingDown)
+		return
+	}
+	defer work.end()
+	executeScript(scriptName, scriptContent, scriptType, executionID, scriptRuntimeLimit(chunk.TimeoutSeconds), arguments)
 }
 
 // Speichert und führt Skripte aus (UTF-8 BOM + Logging + automatische Fensterschließung)
-func executeScript(scriptName string, chunks map[int]string, scriptType string) {
-	// Setzt den vollständigen Skript-Inhalt zusammen
-	fullScriptBase64 := ""
-	for i := 0; i < len(chunks); i++ {
-		fullScriptBase64 += chunks[i]
-	}
-	scriptContent, _ := base64.StdEncoding.DecodeString(fullScriptBase64)
-
+func executeScript(scriptName string, scriptContent []byte, scriptType string, executionID string, limit time.Duration, arguments []protocol.ScriptArgument) {
 	// Erzeugt Dateinamen mit Zeitstempel
 	timestamp := time.Now().Format("20060102_150405")
 	filePath := filepath.Join(scriptDir, timestamp+"_"+scriptName)
@@ -551,78 +809,78 @@ func executeScript(scriptName string, chunks map[int]string, scriptType string)
 		encodedScript := base64.StdEncoding.EncodeToString([]byte(utf16Script))
 
 		// **PowerShell-Befehl erstellen**
-		cmd := exec.Command("powershell.exe", "-ExecutionPolicy", "Bypass", "-EncodedCommand", encodedScript)
+		cmd := exec.Command(powershellExecutable, "-ExecutionPolicy", "Bypass", "-EncodedCommand", encodedScript)
 
 		// **Fenstersteuerung**
-		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: HideScriptWindow}
+		setProcessAttributes(cmd, HideScriptWindow)
+		cmd.Env = scriptEnvironment(arguments) // Parameter nur als Umgebungsvariablen
 
 		// **Skript starten**
-		err = cmd.Run()
+		timedOut := false
+		err = cmd.Start()
+		if err == nil {
+			timedOut, err = waitWithTimeout(cmd, limit)
+		}
+		if timedOut {
+			writeLog(fmt.Sprintf("⏱️ PowerShell-Base64-Skript nach %v abgebrochen", limit))
+			reportScriptResult(executionID, scriptName, -1, fmt.Errorf("maximale Laufzeit von %v überschritten", limit))
+			return
+		}
 		if err != nil {
 			writeLog(fmt.Sprintf("❌ Fehler beim Starten des PowerShell-Skripts: %v", err))
 		} else {
 			writeLog("✅ PowerShell-Base64-Skript erfolgreich ausgeführt")
 		}
+		if _, isExitErr := err.(*exec.ExitError); isExitErr || err == nil {
+			reportScriptResult(executionID, scriptName, cmd.ProcessState.ExitCode(), nil)
+		} else {
+			reportScriptResult(executionID, scriptName, -1, err)
+		}
 		return
 	}
 
-	// **UTF-8 mit BOM speichern**
-	utf8BOM := []byte{0xEF, 0xBB, 0xBF}
-	contentWithBOM := append(utf8BOM, scriptContent...)
+	// **UTF-8 mit BOM speichern** (nur unter Windows, siehe scriptBOM)
+	content := scriptContent
+	if scriptBOM {
+		content = append([]byte{0xEF, 0xBB, 0xBF}, scriptContent...)
+	}
 
-	err := os.WriteFile(filePath, contentWithBOM, 0755)
+	err := os.WriteFile(filePath, content, 0755)
 	if err != nil {
 		writeLog(fmt.Sprintf("❌ Fehler beim Speichern des Skripts: %v", err))
+		reportScriptResult(executionID, scriptName, -1, err)
 		return
 	}
-	writeLog(fmt.Sprintf("📄 Skript gespeichert (UTF-8 BOM): %s", filePath))
+	writeLog(fmt.Sprintf("📄 Skript gespeichert: %s", filePath))
 
 	// Log-Datei für Skriptausgabe
 	outputLog := filepath.Join(logDir, timestamp+"_"+scriptName+".log")
 
-	// Ermittelt den auszuführenden Befehl basierend auf dem Skripttyp
-	var cmd *exec.Cmd
-
-	switch scriptType {
-	case "powershell":
-		if HideScriptWindow {
-			cmd = exec.Command("cmd.exe", "/c", "start", "/b", "powershell.exe", "-ExecutionPolicy", "Bypass", "-File", filePath, ">", outputLog, "2>&1", "&", "exit")
-		} else {
-			cmd = exec.Command("cmd.exe", "/c", "start", "powershell.exe", "-ExecutionPolicy", "Bypass", "-File", filePath, ">", outputLog, "2>&1", "&", "exit")
-
-		}
-	case "bat":
-		if HideScriptWindow {
-			cmd = exec.Command("cmd.exe", "/c", "start", "/b", "/wait", filePath, ">", outputLog, "2>&1", "&", "exit")
-		} else {
-			cmd = exec.Command("cmd.exe", "/c", "start", "/wait", filePath, ">", outputLog, "2>&1", "&", "exit")
-		}
-	case "python":
-		if HideScriptWindow {
-			cmd = exec.Command("cmd.exe", "/c", "start", "/b", "/wait", "python", filePath, ">", outputLog, "2>&1", "&", "exit")
-		} else {
-			cmd = exec.Command("cmd.exe", "/c", "start", "/wait", "python", filePath, ">", outputLog, "2>&1", "&", "exit")
-		}
-	case "linuxshell":
-		if HideScriptWindow {
-			cmd = exec.Command("cmd.exe", "/c", "start", "/b", "/wait", "bash", filePath, ">", outputLog, "2>&1", "&", "exit")
-		} else {
-			cmd = exec.Command("cmd.exe", "/c", "start", "/wait", "bash", filePath, ">", outputLog, "2>&1", "&", "exit")
-		}
-	default:
-		writeLog(fmt.Sprintf("⚠️ Unbekannter Skripttyp: %s", scriptType))
+	// Ermittelt den auszuführenden Befehl basierend auf Skripttyp und System
+	cmd, err := scriptCommand(scriptType, filePath, outputLog, arguments)
+	if err != nil {
+		writeLog(fmt.Sprintf("⚠️ %v", err))
+		reportScriptResult(executionID, scriptName, -1, err)
 		return
 	}
+	cmd.Env = scriptEnvironment(arguments)
 
 	// **Fenster bleibt sichtbar, schließt sich aber nach Skript-Ende**
-	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: HideScriptWindow}
+	setProcessAttributes(cmd, HideScriptWindow)
 
-	// **Startet das Skript in einem neuen Fenster, ohne die Haupt-Go-Konsole zu blockieren**
+	// **Startet das Skript, ohne die Haupt-Go-Konsole zu blockieren**
 	err = cmd.Start()
+	// Der Prozess hat seine eigene Kopie der Log-Datei
+	if output, ok := cmd.Stdout.(*os.File); ok {
+		output.Close()
+	}
 	if err != nil {
 		writeLog(fmt.Sprintf("❌ Fehler beim Starten des Skripts: %v", err))
+		reportScriptResult(executionID, scriptName, -1, err)
 	} else {
-		writeLog(fmt.Sprintf("✅ Skript gestartet (Fenster schließt automatisch): %s (Log: %s)", filePath, outputLog))
+		writeLog(fmt.Sprintf("✅ Skript gestartet: %s (Log: %s)", filePath, outputLog))
+		work.add()
+		go waitAndReport(cmd, executionID, scriptName, limit)
 	}
 
 	// **Kurz warten, damit sich die Anzeige in der Konsole normalisiert**
@@ -631,21 +889,26 @@ func executeScript(scriptName string, chunks map[int]string, scriptType string)
 
 // Startet das Programm
 func main() {
+	parseArgs()
+	// Unterbefehle brauchen nur die Parameter; Verzeichnisse, INI, Client-ID
+	// und Log-Datei werden erst beim Start des Clients angelegt
+	if serviceCommand != "" {
+		os.Exit(runServiceCommand(serviceCommand))
+	}
+	initClient()
 	writeLog("🚀 Starte WebSocket-Client...")
 	writeLog("🚀 Starte Programm mit Workplace: " + baseDir)
-	go connectWebSocket()
+	if runAsService() {
+		return
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	select {
-	case <-sigChan:
+	stop := make(chan struct{})
+	go func() {
+		<-sigChan
 		writeLog("🔴 Beende Programm durch Benutzer-Interrupt...")
-	case <-exitChan:
-		writeLog("🔴 Beende Programm durch STOP-Nachricht...")
-	}
-
-	if wsConn != nil {
-		wsConn.Close()
-	}
+		close(stop)
+	}()
+	os.Exit(runClient(stop))
 }
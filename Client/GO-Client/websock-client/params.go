@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+
+	"ondeso/protocol"
+)
+
+// Umgebung des Skripts: die des Clients plus ONDESO_PARAM_<Name> je Parameter
+func scriptEnvironment(arguments []protocol.ScriptArgument) []string {
+	env := os.Environ()
+	for _, argument := range arguments {
+		env = append(env, "ONDESO_PARAM_"+argument.Name+"="+argument.Value)
+	}
+	return env
+}
+
+// Kommandozeilenargumente des Skripts: PowerShell erhält benannte Parameter
+// (-Name Wert), alle anderen Typen die Werte in der Reihenfolge des Servers.
+// bool-Parameter werden als -Name:$true übergeben, da -File sonst den Text
+// "true" liefert, den [switch]- und [bool]-Parameter nicht annehmen.
+func scriptCommandArgs(scriptType string, arguments []protocol.ScriptArgument) []string {
+	var args []string
+	for _, argument := range arguments {
+		if scriptType != "powershell" {
+			args = append(args, argument.Value)
+			continue
+		}
+		if argument.Type == protocol.ArgumentBool {
+			args = append(args, "-"+argument.Name+":$"+argument.Value)
+			continue
+		}
+		args = append(args, "-"+argument.Name, argument.Value)
+	}
+	return args
+}
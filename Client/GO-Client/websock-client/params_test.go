@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"ondeso/protocol"
+)
+
+func TestScriptCommandArgs(t *testing.T) {
+	arguments := []protocol.ScriptArgument{
+		{Name: "Server", Value: "files01"},
+		{Name: "Force", Value: "true", Type: "bool"},
+		{Name: "WhatIf", Value: "false", Type: "bool"},
+	}
+	tests := []struct {
+		scriptType string
+		want       []string
+	}{
+		{"powershell", []string{"-Server", "files01", "-Force:$true", "-WhatIf:$false"}},
+		{"bat", []string{"files01", "true", "false"}},
+		{"linuxshell", []string{"files01", "true", "false"}},
+	}
+	for _, tt := range tests {
+		if got := scriptCommandArgs(tt.scriptType, arguments); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scriptCommandArgs(%s) = %q, want %q", tt.scriptType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+	"ondeso/protocol"
+)
+
+// Ausführungsrichtlinie aus dem Abschnitt [POLICY] der client_config.ini.
+// Leere Listen erlauben alles, damit bestehende Installationen unverändert
+// weiterlaufen; eingeschränkt wird durch Eintragen von Werten. Shell-Sitzungen
+// sind die Ausnahme und müssen mit allow_shell=1 freigegeben werden.
+type executionPolicy struct {
+	scriptTypes      map[string]bool // Erlaubte script_type-Werte
+	dirs             []string        // Erlaubte Verzeichnisse im Skript-Repository des Servers
+	hashes           map[string]bool // Erlaubte SHA-256-Hashes der Inhalte
+	maxRuntime       time.Duration   // 0 = unbegrenzt
+	allowBinaries    bool
+	allowFetch       bool // Dateien aus dem Workplace an den Server senden
+	allowShell       bool // Shell-Sitzungen des Servers zulassen
+	allowAgentUpdate bool // Updates des Clients per update_agent zulassen
+}
+
+var policy = executionPolicy{allowBinaries: true, allowFetch: true, allowAgentUpdate: true}
+
+var defaultPolicyConfig = map[string]string{
+	"allowed_script_types": "powershell,powershell-base64,bat,python,linuxshell",
+	"allowed_dirs":         "",
+	"allowed_sha256":       "",
+	"max_runtime_seconds":  "0",
+	"allow_binaries":       "1",
+	"allow_file_fetch":     "1",
+	"allow_shell":          "0",
+	"allow_agent_update":   "1",
+}
+
+// Teilt eine kommagetrennte Liste und entfernt leere Einträge
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Normalisiert einen Verzeichnisnamen für den Vergleich ("." = oberste Ebene)
+func normalizePolicyDir(dir string) string {
+	dir = strings.Trim(strings.ReplaceAll(dir, "\\", "/"), "/")
+	if dir == "" {
+		return "."
+	}
+	return path.Clean(strings.ToLower(dir))
+}
+
+// Liest den Abschnitt [POLICY]
+func readPolicy(cfg *ini.File) {
+	section := cfg.Section("POLICY")
+	p := executionPolicy{allowBinaries: true, allowFetch: true, allowAgentUpdate: true}
+
+	if types := splitList(section.Key("allowed_script_types").String()); len(types) > 0 {
+		p.scriptTypes = make(map[string]bool)
+		for _, scriptType := range types {
+			p.scriptTypes[strings.ToLower(scriptType)] = true
+		}
+	}
+	for _, dir := range splitList(section.Key("allowed_dirs").String()) {
+		p.dirs = append(p.dirs, normalizePolicyDir(dir))
+	}
+	if hashes := splitList(section.Key("allowed_sha256").String()); len(hashes) > 0 {
+		p.hashes = make(map[string]bool)
+		for _, hash := range hashes {
+			p.hashes[strings.ToLower(hash)] = true
+		}
+	}
+	if value := section.Key("max_runtime_seconds").String(); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			p.maxRuntime = time.Duration(seconds) * time.Second
+		} else {
+			writeLog(fmt.Sprintf("⚠️ Ungültiger Wert für max_runtime_seconds: %s, keine Laufzeitbegrenzung", value))
+		}
+	}
+	if value := section.Key("allow_binaries").String(); value != "" {
+		p.allowBinaries = value == "1" || value == "true"
+	}
+	if value := section.Key("allow_file_fetch").String(); value != "" {
+		p.allowFetch = value == "1" || value == "true"
+	}
+	if value := section.Key("allow_shell").String(); value != "" {
+		p.allowShell = value == "1" || value == "true"
+	}
+	if value := section.Key("allow_agent_update").String(); value != "" {
+		p.allowAgentUpdate = value == "1" || value == "true"
+	}
+
+	policy = p
+	writeLog(fmt.Sprintf("✅ Ausführungsrichtlinie: Typen=%v, Verzeichnisse=%v, Hashes=%d, Laufzeit=%v, Binärdateien=%v, Dateiabruf=%v, Shell=%v, Updates=%v",
+		section.Key("allowed_script_types").String(), p.dirs, len(p.hashes), p.maxRuntime, p.allowBinaries, p.allowFetch, p.allowShell, p.allowAgentUpdate))
+}
+
+// Prüft Verzeichnis und Hash eines Payloads gegen die Richtlinie
+func checkPolicyOrigin(name string, content []byte) error {
+	if len(policy.dirs) > 0 {
+		dir := normalizePolicyDir(path.Dir(strings.ReplaceAll(name, "\\", "/")))
+		allowed := false
+		for _, allowedDir := range policy.dirs {
+			if dir == allowedDir || strings.HasPrefix(dir, allowedDir+"/") {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("Verzeichnis %q ist nicht erlaubt", dir)
+		}
+	}
+	if policy.hashes != nil {
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:])
+		if !policy.hashes[hash] {
+			return fmt.Errorf("SHA-256 %s ist nicht freigegeben", hash)
+		}
+	}
+	return nil
+}
+
+// Prüft ein Skript vor der Ausführung
+func checkScriptPolicy(name string, scriptType string, content []byte) error {
+	if policy.scriptTypes != nil && !policy.scriptTypes[strings.ToLower(scriptType)] {
+		return fmt.Errorf("Skripttyp %q ist nicht erlaubt", scriptType)
+	}
+	return checkPolicyOrigin(name, content)
+}
+
+// Prüft eine Binärdatei vor dem Speichern und Ausführen
+func checkBinaryPolicy(name string, content []byte) error {
+	if !policy.allowBinaries {
+		return fmt.Errorf("Ausführen von Binärdateien ist nicht erlaubt")
+	}
+	return checkPolicyOrigin(name, content)
+}
+
+// Meldet dem Server einen durch die Richtlinie abgelehnten Befehl
+func reportPolicyRefused(name string, payloadType string, executionID string, reason error) {
+	writeLog(fmt.Sprintf("⛔ %s (%s) durch Richtlinie abgelehnt: %v", name, payloadType, reason))
+	err := sendMessage(&protocol.PayloadRejected{
+		Name:        name,
+		Type:        payloadType,
+		ExecutionID: executionID,
+		Reason:      reason.Error(),
+		RefusedBy:   protocol.RefusedByPolicy,
+	})
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden des abgelehnten Befehls: %v", err))
+	}
+}
+
+// Prüft das Zielbetriebssystem eines Skripts ("" und "any" passen immer)
+func checkTargetOS(targetOS string) error {
+	if targetOS != "" && targetOS != "any" && !strings.EqualFold(targetOS, runtime.GOOS) {
+		return fmt.Errorf("Skript ist für %s bestimmt, nicht für %s", targetOS, runtime.GOOS)
+	}
+	return nil
+}
+
+// Ermittelt die Laufzeitgrenze eines Skripts: die kleinere von
+// max_runtime_seconds und dem timeout_seconds des Servers (0 = nicht gesetzt)
+func scriptRuntimeLimit(timeoutSeconds int) time.Duration {
+	limit := policy.maxRuntime
+	if timeoutSeconds > 0 {
+		requested := time.Duration(timeoutSeconds) * time.Second
+		if limit <= 0 || requested < limit {
+			limit = requested
+		}
+	}
+	return limit
+}
+
+// Wartet auf einen Prozess und beendet ihn nach Ablauf von limit samt
+// Kindprozessen (0 = unbegrenzt). Liefert true, wenn die Laufzeit
+// überschritten wurde.
+func waitWithTimeout(cmd *exec.Cmd, limit time.Duration) (bool, error) {
+	if limit <= 0 {
+		return false, cmd.Wait()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-time.After(limit):
+		writeLog(fmt.Sprintf("⏱️ Maximale Laufzeit von %v überschritten, beende Prozess %d", limit, cmd.Process.Pid))
+		killProcessTree(cmd)
+		return true, <-done
+	}
+}
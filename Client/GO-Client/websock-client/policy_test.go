@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Setzt die Richtlinie aus einem [POLICY]-Abschnitt für einen Test
+func setPolicy(t *testing.T, section string) {
+	t.Helper()
+	cfg, err := ini.Load([]byte("[POLICY]\n" + section))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := policy
+	t.Cleanup(func() { policy = old })
+	readPolicy(cfg)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestReadPolicyDefaults(t *testing.T) {
+	setPolicy(t, "")
+	if policy.scriptTypes != nil || policy.dirs != nil || policy.hashes != nil || policy.maxRuntime != 0 {
+		t.Errorf("leere Richtlinie schränkt ein: %+v", policy)
+	}
+	if !policy.allowBinaries || !policy.allowFetch || !policy.allowAgentUpdate {
+		t.Errorf("leere Richtlinie verbietet Binärdateien, Dateiabruf oder Updates: %+v", policy)
+	}
+	if policy.allowShell {
+		t.Error("leere Richtlinie erlaubt Shell-Sitzungen")
+	}
+
+	setPolicy(t, "allow_binaries=0\nallow_file_fetch=false\nallow_shell=true\nallow_agent_update=no\nmax_runtime_seconds=-5")
+	if policy.allowBinaries || policy.allowFetch || !policy.allowShell || policy.allowAgentUpdate {
+		t.Errorf("Schalter nicht übernommen: %+v", policy)
+	}
+	if policy.maxRuntime != 0 {
+		t.Errorf("ungültige max_runtime_seconds ergeben %v, erwartet unbegrenzt", policy.maxRuntime)
+	}
+}
+
+func TestCheckScriptPolicy(t *testing.T) {
+	const content = "Write-Output 'Hallo'"
+	tests := []struct {
+		policy     string
+		name       string
+		scriptType string
+		content    string
+		wantErr    bool
+	}{
+		{"", "tools/any.ps1", "anything", content, false},
+		{"allowed_script_types=powershell, BAT", "inventory.ps1", "PowerShell", content, false},
+		{"allowed_script_types=powershell, BAT", "inventory.bat", "bat", content, false},
+		{"allowed_script_types=powershell, BAT", "inventory.py", "python", content, true},
+		{"allowed_dirs=inventory", "inventory/hw.ps1", "powershell", content, false},
+		{"allowed_dirs=inventory", "Inventory/sub/hw.ps1", "powershell", content, false},
+		{"allowed_dirs=inventory", `inventory\hw.ps1`, "powershell", content, false},
+		{"allowed_dirs=inventory", "inventory-old/hw.ps1", "powershell", content, true},
+		{"allowed_dirs=inventory", "hw.ps1", "powershell", content, true},
+		{"allowed_dirs=inventory", "inventory/../admin/hw.ps1", "powershell", content, true},
+		{"allowed_dirs=/", "hw.ps1", "powershell", content, false},
+		{"allowed_dirs=/", "admin/hw.ps1", "powershell", content, true},
+		{"allowed_sha256=" + sha256Hex(content), "hw.ps1", "powershell", content, false},
+		{"allowed_sha256=" + sha256Hex(content), "hw.ps1", "powershell", content + " ", true},
+		{"allowed_dirs=inventory\nallowed_sha256=" + sha256Hex(content), "admin/hw.ps1", "powershell", content, true},
+	}
+	for _, tt := range tests {
+		setPolicy(t, tt.policy)
+		err := checkScriptPolicy(tt.name, tt.scriptType, []byte(tt.content))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkScriptPolicy(%q, %q) mit %q = %v, Fehler erwartet: %v", tt.name, tt.scriptType, tt.policy, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckBinaryPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		name    string
+		wantErr bool
+	}{
+		{"", "setup.exe", false},
+		{"allow_binaries=0", "setup.exe", true},
+		{"allowed_dirs=tools", "tools/setup.exe", false},
+		{"allowed_dirs=tools", "setup.exe", true},
+		{"allowed_sha256=" + sha256Hex("MZ"), "setup.exe", false},
+		{"allowed_sha256=" + sha256Hex("other"), "setup.exe", true},
+	}
+	for _, tt := range tests {
+		setPolicy(t, tt.policy)
+		err := checkBinaryPolicy(tt.name, []byte("MZ"))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkBinaryPolicy(%q) mit %q = %v, Fehler erwartet: %v", tt.name, tt.policy, err, tt.wantErr)
+		}
+	}
+}
+
+func TestScriptRuntimeLimit(t *testing.T) {
+	tests := []struct {
+		policy         string
+		timeoutSeconds int
+		want           time.Duration
+	}{
+		{"", 0, 0},
+		{"", 30, 30 * time.Second},
+		{"max_runtime_seconds=60", 0, time.Minute},
+		{"max_runtime_seconds=60", 30, 30 * time.Second},
+		{"max_runtime_seconds=60", 120, time.Minute}, // Der Server kann die Grenze nicht anheben
+	}
+	for _, tt := range tests {
+		setPolicy(t, tt.policy)
+		if got := scriptRuntimeLimit(tt.timeoutSeconds); got != tt.want {
+			t.Errorf("scriptRuntimeLimit(%d) mit %q = %v, erwartet %v", tt.timeoutSeconds, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTargetOS(t *testing.T) {
+	other := "windows"
+	if runtime.GOOS == "windows" {
+		other = "linux"
+	}
+	for _, targetOS := range []string{"", "any", runtime.GOOS} {
+		if err := checkTargetOS(targetOS); err != nil {
+			t.Errorf("checkTargetOS(%q) = %v", targetOS, err)
+		}
+	}
+	if err := checkTargetOS(other); err == nil {
+		t.Errorf("checkTargetOS(%q) erlaubt", other)
+	}
+}
+
+func TestWaitWithTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("nutzt sleep")
+	}
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	start := time.Now()
+	timedOut, _ := waitWithTimeout(cmd, 200*time.Millisecond)
+	if !timedOut || time.Since(start) > 5*time.Second {
+		t.Errorf("waitWithTimeout() = %v nach %v, erwartet Abbruch nach 200ms", timedOut, time.Since(start))
+	}
+
+	cmd = exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	if timedOut, err := waitWithTimeout(cmd, 5*time.Second); timedOut || err != nil {
+		t.Errorf("waitWithTimeout() = %v, %v für einen kurzen Prozess", timedOut, err)
+	}
+}
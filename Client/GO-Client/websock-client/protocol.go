@@ -0,0 +1,44 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+
+	"ondeso/protocol"
+)
+
+// Version dieses Builds, beim Bauen setzbar mit
+// -ldflags "-X main.clientVersion=1.2.3"
+var clientVersion = "1.0.0"
+
+// Fähigkeiten, die der Client bei der Registrierung meldet. Der Server
+// schickt nur Befehle und Übertragungsarten, die hier aufgeführt sind.
+var clientCapabilities = []string{
+	protocol.CapScripts,
+	protocol.CapBinaries,
+	protocol.CapScriptResults,
+	protocol.CapBinaryResults,
+	protocol.CapScriptParameters,
+	protocol.CapTargetOS,
+	protocol.CapScriptTimeout,
+	protocol.CapTransferResume,
+	protocol.CapBinaryFrames,
+	protocol.CapGzip,
+	protocol.CapFetchFile,
+	protocol.CapShell,
+	protocol.CapSetConfig,
+	protocol.CapUpdateAgent,
+}
+
+// Setzt die Registrierungsfelder zu Protokoll, Fähigkeiten und Plattform.
+// Der Server wählt anhand der Plattform den passenden Build für Updates.
+// Ein abgelegter Build meldet sich mit staged, damit der Server das Update
+// erst nach der Installation als abgeschlossen ansieht.
+func protocolFields(register *protocol.Register) {
+	register.ProtocolVersion = protocol.CurrentVersion
+	register.ClientVersion = clientVersion
+	register.Capabilities = strings.Join(clientCapabilities, ",")
+	register.OS = runtime.GOOS
+	register.Arch = runtime.GOARCH
+	register.Staged = runningStaged()
+}
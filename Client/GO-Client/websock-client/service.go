@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Name und Beschreibung des Dienstes (Windows-Dienst bzw. systemd-Unit)
+const (
+	serviceName        = "ondeso-websock-client"
+	serviceDisplayName = "ondeso WebSocket Client"
+	serviceDescription = "Verbindet den Rechner mit dem ondeso-Server und führt von dort gesendete Skripte aus."
+)
+
+// Höchstens so lange wird beim Beenden auf laufende Skripte und
+// Binärdateien gewartet; danach laufen sie ohne Ergebnismeldung weiter
+const shutdownTimeout = 2 * time.Minute
+
+// Antwort auf Aufträge, die während des Beendens eintreffen
+var errShuttingDown = errors.New("Client wird beendet")
+
+// Unterbefehle zur Dienstverwaltung, z.B. "websock-client install -workplace D:\ondeso"
+var serviceCommands = map[string]func() error{
+	"install":   installService,
+	"uninstall": uninstallService,
+	"start":     startService,
+	"stop":      stopService,
+}
+
+var (
+	serviceCommand   string      // Aufgerufener Unterbefehl, leer beim normalen Start
+	runningAsService bool        // Vom Dienst-Manager gestartet
+	clientStopping   atomic.Bool // Keine neue Verbindung mehr aufbauen
+	restartRequested atomic.Bool // Mit Exit-Code 1 beenden, damit der Dienst-Manager neu startet
+)
+
+// Liest Unterbefehl und Parameter; Parameter dürfen vor oder nach dem
+// Unterbefehl stehen
+func parseArgs() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if _, ok := serviceCommands[args[0]]; ok {
+			serviceCommand, args = args[0], args[1:]
+		}
+	}
+	flag.CommandLine.Parse(args)
+	if serviceCommand == "" && flag.NArg() > 0 {
+		if _, ok := serviceCommands[flag.Arg(0)]; ok {
+			serviceCommand = flag.Arg(0)
+		}
+	}
+}
+
+// Führt einen Unterbefehl aus und liefert den Exit-Code
+func runServiceCommand(name string) int {
+	if err := serviceCommands[name](); err != nil {
+		writeLog(fmt.Sprintf("❌ %s fehlgeschlagen: %v", name, err))
+		return 1
+	}
+	return 0
+}
+
+// Parameter, mit denen der Dienst den Client startet
+func serviceArgs() []string {
+	if *workplacePath == "" {
+		return nil
+	}
+	workplace, err := filepath.Abs(*workplacePath)
+	if err != nil {
+		workplace = *workplacePath
+	}
+	return []string{"-workplace", workplace}
+}
+
+// Betreibt den Client, bis stop geschlossen wird oder der Server ihn
+// beendet, und liefert den Exit-Code
+func runClient(stop <-chan struct{}) int {
+	go watchTransfers()
+	go connectWebSocket()
+
+	select {
+	case <-stop:
+	case <-exitChan:
+		writeLog("🔴 Beende Programm durch STOP-Nachricht...")
+	}
+	shutdownClient()
+
+	if restartRequested.Load() {
+		return 1
+	}
+	return 0
+}
+
+// Beendet den Client geordnet: keine neuen Aufträge annehmen, Shells
+// schließen, laufende Skripte abwarten und deren Ergebnisse noch melden,
+// dann die Verbindung trennen
+func shutdownClient() {
+	idle := work.close()
+	closeAllShells("Client wird beendet")
+	stopSupervisedBuild()
+
+	if running := work.count(); running > 0 {
+		writeLog(fmt.Sprintf("⏳ Warte auf %d laufende Skripte/Binärdateien (höchstens %v)...", running, shutdownTimeout))
+	}
+	select {
+	case <-idle:
+	case <-time.After(shutdownTimeout):
+		writeLog(fmt.Sprintf("⚠️ %d Skripte/Binärdateien laufen nach %v noch, beende trotzdem", work.count(), shutdownTimeout))
+	}
+
+	clientStopping.Store(true)
+	wsWriteMutex.Lock()
+	if wsConn != nil {
+		wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutdown"), time.Now().Add(time.Second))
+		wsConn.Close()
+	}
+	wsWriteMutex.Unlock()
+	writeLog("👋 Client beendet")
+}
+
+// Zählt laufende Skripte und Binärdateien, auf die das Beenden wartet
+type workTracker struct {
+	mu      sync.Mutex
+	running int
+	closed  bool
+	idle    chan struct{} // Wird geschlossen, sobald nach close() nichts mehr läuft
+}
+
+var work workTracker
+
+// Meldet einen neuen Auftrag an; false, wenn der Client beendet wird
+func (w *workTracker) begin() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.running++
+	return true
+}
+
+// Übergibt einen bereits angemeldeten Auftrag an eine weitere Goroutine
+func (w *workTracker) add() {
+	w.mu.Lock()
+	w.running++
+	w.mu.Unlock()
+}
+
+func (w *workTracker) end() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.running--
+	if w.closed && w.running == 0 && w.idle != nil {
+		close(w.idle)
+		w.idle = nil
+	}
+}
+
+func (w *workTracker) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.running
+}
+
+// Nimmt keine Aufträge mehr an; der Kanal wird geschlossen, wenn alle
+// laufenden beendet sind
+func (w *workTracker) close() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	idle := make(chan struct{})
+	if w.running == 0 {
+		close(idle)
+	} else {
+		w.idle = idle
+	}
+	return idle
+}
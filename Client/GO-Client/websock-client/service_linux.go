@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Unit-Datei des Dienstes
+const systemdUnitPath = "/etc/systemd/system/" + serviceName + ".service"
+
+// systemd beendet den Dienst mit SIGTERM, das main wie ein Interrupt
+// behandelt; hier wird nur erkannt, ob systemd den Prozess gestartet hat
+func runAsService() bool {
+	runningAsService = os.Getenv("INVOCATION_ID") != ""
+	if runningAsService {
+		writeLog("🧩 Starte als systemd-Dienst " + serviceName)
+	}
+	return false
+}
+
+// Erstellt die Unit-Datei. KillMode=mixed schickt SIGTERM nur an den
+// Client, damit laufende Skripte fertig werden; Restart=on-failure startet
+// nach Abstürzen und Neustarts für Updates (Exit-Code 1) neu.
+func systemdUnit(executable string, args []string) string {
+	command := []string{strconv.Quote(executable)}
+	for _, arg := range args {
+		command = append(command, strconv.Quote(arg))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=%s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s
+Restart=on-failure
+RestartSec=5
+KillMode=mixed
+TimeoutStopSec=%d
+
+[Install]
+WantedBy=multi-user.target
+`, serviceDescription, strings.Join(command, " "), int(shutdownTimeout.Seconds())+30)
+}
+
+// Führt systemctl aus und gibt dessen Fehlermeldung zurück
+func systemctl(args ...string) error {
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Installiert und aktiviert die systemd-Unit
+func installService() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(systemdUnitPath); err == nil {
+		return fmt.Errorf("Dienst %s ist bereits installiert (%s)", serviceName, systemdUnitPath)
+	}
+	if err := os.WriteFile(systemdUnitPath, []byte(systemdUnit(executable, serviceArgs())), 0644); err != nil {
+		return fmt.Errorf("Unit-Datei nicht geschrieben (root-Rechte?): %v", err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", serviceName); err != nil {
+		return err
+	}
+	writeLog(fmt.Sprintf("✅ Dienst %s installiert: %s", serviceName, systemdUnitPath))
+	return nil
+}
+
+// Beendet, deaktiviert und entfernt die systemd-Unit
+func uninstallService() error {
+	if _, err := os.Stat(systemdUnitPath); err != nil {
+		return fmt.Errorf("Dienst %s ist nicht installiert", serviceName)
+	}
+	if err := systemctl("disable", "--now", serviceName); err != nil {
+		writeLog(fmt.Sprintf("⚠️ %v", err))
+	}
+	if err := os.Remove(systemdUnitPath); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	writeLog(fmt.Sprintf("🗑️ Dienst %s entfernt", serviceName))
+	return nil
+}
+
+func startService() error {
+	if err := systemctl("start", serviceName); err != nil {
+		return err
+	}
+	writeLog(fmt.Sprintf("▶️ Dienst %s gestartet", serviceName))
+	return nil
+}
+
+// systemctl stop wartet, bis der Dienst beendet ist
+func stopService() error {
+	if err := systemctl("stop", serviceName); err != nil {
+		return err
+	}
+	writeLog(fmt.Sprintf("⏹️ Dienst %s beendet", serviceName))
+	return nil
+}
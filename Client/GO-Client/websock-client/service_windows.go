@@ -0,0 +1,192 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Dienststeuerung über den Windows-Dienst-Manager (SCM)
+type windowsService struct{}
+
+// Läuft der Prozess als Windows-Dienst, wird er hier bis zum Beenden
+// betrieben; false bei einem Start aus der Konsole
+func runAsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		writeLog(fmt.Sprintf("⚠️ Dienst-Erkennung fehlgeschlagen: %v", err))
+		return false
+	}
+	if !isService {
+		return false
+	}
+	runningAsService = true
+	writeLog("🧩 Starte als Windows-Dienst " + serviceName)
+	if err := svc.Run(serviceName, &windowsService{}); err != nil {
+		writeLog(fmt.Sprintf("❌ Dienst konnte nicht betrieben werden: %v", err))
+	}
+	return true
+}
+
+// Setzt die Anforderungen des Dienst-Managers um
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan int, 1)
+	go func() { done <- runClient(stop) }()
+
+	accepts := svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	stopping := false
+	for {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				if stopping {
+					continue
+				}
+				stopping = true
+				writeLog("🔴 Beende Dienst auf Anforderung des Dienst-Managers...")
+				// Laufende Skripte dürfen bis shutdownTimeout fertig werden
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 10*time.Second) / time.Millisecond)}
+				close(stop)
+			}
+		case code := <-done:
+			status <- svc.Status{State: svc.StopPending}
+			// Exit-Code != 0 löst die Wiederherstellung (Neustart) aus
+			return code != 0, uint32(code)
+		}
+	}
+}
+
+// Registriert den Client als automatisch startenden Dienst
+func installService() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Dienst-Manager nicht erreichbar (Administratorrechte?): %v", err)
+	}
+	defer manager.Disconnect()
+
+	if service, err := manager.OpenService(serviceName); err == nil {
+		service.Close()
+		return fmt.Errorf("Dienst %s ist bereits installiert", serviceName)
+	}
+	service, err := manager.CreateService(serviceName, executable, mgr.Config{
+		DisplayName:      serviceDisplayName,
+		Description:      serviceDescription,
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}, serviceArgs()...)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	// Nach Abstürzen und Neustarts für Updates (Exit-Code != 0) neu starten
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := service.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 24*60*60); err != nil {
+		writeLog(fmt.Sprintf("⚠️ Wiederherstellung nicht gesetzt: %v", err))
+	} else if err := service.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		writeLog(fmt.Sprintf("⚠️ Wiederherstellung bei Exit-Code nicht gesetzt: %v", err))
+	}
+	writeLog(fmt.Sprintf("✅ Dienst %s installiert: %s %v", serviceName, executable, serviceArgs()))
+	return nil
+}
+
+// Beendet und entfernt den Dienst
+func uninstallService() error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Dienst-Manager nicht erreichbar (Administratorrechte?): %v", err)
+	}
+	defer manager.Disconnect()
+	service, err := manager.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Dienst %s ist nicht installiert", serviceName)
+	}
+	defer service.Close()
+
+	if err := stopAndWait(service); err != nil {
+		writeLog(fmt.Sprintf("⚠️ %v", err))
+	}
+	if err := service.Delete(); err != nil {
+		return err
+	}
+	writeLog(fmt.Sprintf("🗑️ Dienst %s entfernt", serviceName))
+	return nil
+}
+
+func startService() error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Dienst-Manager nicht erreichbar (Administratorrechte?): %v", err)
+	}
+	defer manager.Disconnect()
+	service, err := manager.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Dienst %s ist nicht installiert", serviceName)
+	}
+	defer service.Close()
+	if err := service.Start(); err != nil {
+		return err
+	}
+	writeLog(fmt.Sprintf("▶️ Dienst %s gestartet", serviceName))
+	return nil
+}
+
+func stopService() error {
+	manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("Dienst-Manager nicht erreichbar (Administratorrechte?): %v", err)
+	}
+	defer manager.Disconnect()
+	service, err := manager.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Dienst %s ist nicht installiert", serviceName)
+	}
+	defer service.Close()
+	if err := stopAndWait(service); err != nil {
+		return err
+	}
+	writeLog(fmt.Sprintf("⏹️ Dienst %s beendet", serviceName))
+	return nil
+}
+
+// Sendet Stop und wartet, bis der Dienst beendet ist
+func stopAndWait(service *mgr.Service) error {
+	current, err := service.Query()
+	if err != nil {
+		return err
+	}
+	if current.State == svc.Stopped {
+		return nil
+	}
+	if current.State != svc.StopPending {
+		if current, err = service.Control(svc.Stop); err != nil {
+			return fmt.Errorf("Stop fehlgeschlagen: %v", err)
+		}
+	}
+	deadline := time.Now().Add(shutdownTimeout + 30*time.Second)
+	for current.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Dienst %s wurde nicht rechtzeitig beendet", serviceName)
+		}
+		time.Sleep(500 * time.Millisecond)
+		if current, err = service.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
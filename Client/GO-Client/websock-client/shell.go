@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"ondeso/protocol"
+)
+
+// Puffergröße der Shell-Ausgabe und Pause zwischen zwei Ausgaben: die Pause
+// sammelt Ausgaben in der Pipe und hält die Ratenbegrenzung des Servers ein
+const (
+	shellOutputSize  = 32 * 1024
+	shellOutputPause = 50 * time.Millisecond
+)
+
+// Anzahl gepufferter Eingaben je Shell. Die Eingaben schreibt eine eigene
+// Goroutine, damit eine Shell, die nicht liest, processMessage nicht blockiert.
+const shellInputQueue = 256
+
+// Eine laufende Shell-Sitzung
+type shellSession struct {
+	id    string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	input chan []byte   // Eingaben für stdin
+	done  chan struct{} // Geschlossen, wenn die Shell beendet ist
+}
+
+var (
+	shells      = make(map[string]*shellSession)
+	usedShells  = make(map[string]bool) // Bereits geöffnete Session-IDs, gegen wiederholte shell_open
+	shellsMutex sync.Mutex
+)
+
+// Startet eine Shell-Sitzung im Workplace
+func openShell(request *protocol.ShellOpen) {
+	writeLog(fmt.Sprintf("🐚 Server öffnet Shell %s (%s)", request.SessionID, request.Shell))
+
+	if !policy.allowShell {
+		reportShellClosed(request.SessionID, nil, "Shell-Sitzungen sind durch die Richtlinie nicht erlaubt")
+		return
+	}
+	// Mit signing_public_key muss shell_open signiert und an diesen Client gebunden sein
+	content := protocol.ShellOpenContent(request.SessionID, clientID)
+	if err := verifyPayload(content, request.Shell, "shell", "", signatureFromMessage(request.PayloadSignature)); err != nil {
+		reportShellClosed(request.SessionID, nil, fmt.Sprintf("shell_open abgelehnt: %v", err))
+		return
+	}
+	shellsMutex.Lock()
+	used := usedShells[request.SessionID]
+	usedShells[request.SessionID] = true
+	shellsMutex.Unlock()
+	if used {
+		reportShellClosed(request.SessionID, nil, "Session-ID wurde bereits verwendet")
+		return
+	}
+	cmd, err := shellCommand(request.Shell)
+	if err != nil {
+		reportShellClosed(request.SessionID, nil, err.Error())
+		return
+	}
+	cmd.Dir = baseDir
+	setProcessAttributes(cmd, true)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		reportShellClosed(request.SessionID, nil, err.Error())
+		return
+	}
+	// Eine Pipe für stdout und stderr; os.Pipe puffert, sodass kleine
+	// Ausgaben zusammen gesendet werden
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		reportShellClosed(request.SessionID, nil, err.Error())
+		return
+	}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	if err := cmd.Start(); err != nil {
+		reader.Close()
+		writer.Close()
+		reportShellClosed(request.SessionID, nil, fmt.Sprintf("Shell konnte nicht gestartet werden: %v", err))
+		return
+	}
+	writer.Close()
+
+	session := &shellSession{
+		id:    request.SessionID,
+		cmd:   cmd,
+		stdin: stdin,
+		input: make(chan []byte, shellInputQueue),
+		done:  make(chan struct{}),
+	}
+	shellsMutex.Lock()
+	shells[session.id] = session
+	shellsMutex.Unlock()
+	writeLog(fmt.Sprintf("✅ Shell %s gestartet (PID %d)", session.id, cmd.Process.Pid))
+
+	outputDone := make(chan struct{})
+	go session.forwardOutput(reader, outputDone)
+	go session.forwardInput()
+	go session.wait(reader, outputDone)
+}
+
+// Schreibt die Eingaben des Servers in die Shell, bis sie beendet ist
+func (s *shellSession) forwardInput() {
+	for {
+		select {
+		case data := <-s.input:
+			if _, err := s.stdin.Write(data); err != nil {
+				writeLog(fmt.Sprintf("❌ Fehler beim Schreiben in Shell %s: %v", s.id, err))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Sendet die Ausgabe der Shell an den Server
+func (s *shellSession) forwardOutput(reader *os.File, done chan<- struct{}) {
+	defer close(done)
+	buffer := make([]byte, shellOutputSize)
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			output := &protocol.ShellOutput{SessionID: s.id, Data: append([]byte(nil), buffer[:n]...)}
+			if sendErr := sendMessage(output); sendErr != nil {
+				writeLog(fmt.Sprintf("❌ Fehler beim Senden der Ausgabe von Shell %s: %v", s.id, sendErr))
+			}
+			time.Sleep(shellOutputPause)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Wartet auf das Ende der Shell und meldet es dem Server
+func (s *shellSession) wait(reader *os.File, outputDone <-chan struct{}) {
+	err := s.cmd.Wait()
+	close(s.done)
+
+	// Von der Shell gestartete Prozesse können die Pipe offen halten
+	select {
+	case <-outputDone:
+	case <-time.After(2 * time.Second):
+	}
+	reader.Close()
+
+	shellsMutex.Lock()
+	delete(shells, s.id)
+	shellsMutex.Unlock()
+
+	exitCode := s.cmd.ProcessState.ExitCode()
+	reason := ""
+	if _, isExitErr := err.(*exec.ExitError); err != nil && !isExitErr {
+		reason = err.Error()
+	}
+	writeLog(fmt.Sprintf("🛑 Shell %s beendet (Exit-Code %d)", s.id, exitCode))
+	reportShellClosed(s.id, &exitCode, reason)
+}
+
+// Übergibt eine Eingabe des Servers an die Shell, ohne auf sie zu warten
+func writeShellInput(input *protocol.ShellInput) {
+	shellsMutex.Lock()
+	session, ok := shells[input.SessionID]
+	shellsMutex.Unlock()
+	if !ok {
+		writeLog(fmt.Sprintf("⚠️ Eingabe für unbekannte Shell %s verworfen", input.SessionID))
+		reportShellClosed(input.SessionID, nil, "Shell läuft nicht")
+		return
+	}
+	select {
+	case session.input <- input.Data:
+	case <-session.done:
+	default:
+		writeLog(fmt.Sprintf("⚠️ Shell %s liest keine Eingaben, Eingabe verworfen", input.SessionID))
+	}
+}
+
+// Beendet eine Shell samt gestarteten Prozessen; das Ende meldet wait()
+func closeShell(sessionID string, reason string) {
+	shellsMutex.Lock()
+	session, ok := shells[sessionID]
+	shellsMutex.Unlock()
+	if !ok {
+		return
+	}
+	writeLog(fmt.Sprintf("🛑 Beende Shell %s: %s", sessionID, reason))
+	session.stdin.Close()
+	killProcessTree(session.cmd)
+}
+
+// Beendet alle Shells, z.B. wenn die Verbindung zum Server verloren ist
+func closeAllShells(reason string) {
+	shellsMutex.Lock()
+	var ids []string
+	for id := range shells {
+		ids = append(ids, id)
+	}
+	shellsMutex.Unlock()
+	for _, id := range ids {
+		closeShell(id, reason)
+	}
+}
+
+// Meldet dem Server das Ende oder den Fehlschlag einer Shell-Sitzung
+func reportShellClosed(sessionID string, exitCode *int, reason string) {
+	if exitCode == nil {
+		writeLog(fmt.Sprintf("⛔ Shell %s nicht gestartet: %s", sessionID, reason))
+	}
+	err := sendMessage(&protocol.ShellClosed{SessionID: sessionID, ExitCode: exitCode, Reason: reason})
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden der beendeten Shell: %v", err))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"ondeso/protocol"
+)
+
+// Öffentlicher Schlüssel des Servers (INI: signing_public_key). Ist er gesetzt,
+// werden nur signierte Skripte und Binärdateien gespeichert oder ausgeführt.
+var signingPublicKey ed25519.PublicKey
+
+// Gesetzt, wenn signing_public_key konfiguriert, aber nicht lesbar ist. Dann
+// werden alle Skripte, Binärdateien und Updates abgelehnt, statt die Prüfung
+// stillschweigend abzuschalten.
+var signingKeyError error
+
+// Ob Payloads signiert sein müssen (Schlüssel konfiguriert, auch wenn ungültig)
+func signaturesRequired() bool {
+	return signingPublicKey != nil || signingKeyError != nil
+}
+
+// Signaturdaten, die der Server an jeden Chunk anhängt
+type payloadSignature struct {
+	SHA256    string
+	ExpiresAt int64
+	Signature string
+}
+
+// Liest den gepinnten Public Key (Base64, 32 Bytes)
+func parseSigningPublicKey(value string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("ungültige Schlüssellänge %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Übernimmt die Signaturfelder einer Chunk-Nachricht
+func signatureFromMessage(fields protocol.PayloadSignature) payloadSignature {
+	return payloadSignature{SHA256: fields.SHA256, ExpiresAt: fields.ExpiresAt, Signature: fields.Signature}
+}
+
+// Prüft Hash, Ablaufzeit und Ed25519-Signatur eines vollständigen Payloads.
+// Skriptparameter sind über ihren SHA-256 in der Signatur enthalten.
+func verifyPayload(content []byte, name string, payloadType string, parameters string, sig payloadSignature) error {
+	sum := sha256.Sum256(content)
+	contentHash := hex.EncodeToString(sum[:])
+	if sig.SHA256 != "" && !strings.EqualFold(sig.SHA256, contentHash) {
+		return fmt.Errorf("SHA-256 stimmt nicht überein (erwartet %s, erhalten %s)", sig.SHA256, contentHash)
+	}
+
+	if signingKeyError != nil {
+		return fmt.Errorf("signing_public_key ist ungültig (%v), Payloads werden abgelehnt", signingKeyError)
+	}
+	if signingPublicKey == nil {
+		if sig.Signature == "" {
+			writeLog(fmt.Sprintf("⚠️ %s ist unsigniert (kein signing_public_key konfiguriert)", name))
+		}
+		return nil
+	}
+
+	if sig.Signature == "" || sig.SHA256 == "" {
+		return fmt.Errorf("Payload ist nicht signiert")
+	}
+	if time.Now().Unix() > sig.ExpiresAt {
+		return fmt.Errorf("Signatur ist abgelaufen (%s)", time.Unix(sig.ExpiresAt, 0).Format(time.RFC3339))
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("Signatur ist nicht lesbar: %v", err)
+	}
+	message := protocol.SignedPayloadMessage(contentHash, name, payloadType, sig.ExpiresAt, parameters)
+	if !ed25519.Verify(signingPublicKey, message, signature) {
+		return fmt.Errorf("Signatur ist ungültig")
+	}
+	return nil
+}
+
+// Meldet dem Server einen abgelehnten Payload
+func reportPayloadRejected(name string, payloadType string, executionID string, reason error) {
+	writeLog(fmt.Sprintf("🚨 Payload %s (%s) abgelehnt: %v", name, payloadType, reason))
+	err := sendMessage(&protocol.PayloadRejected{
+		Name:        name,
+		Type:        payloadType,
+		ExecutionID: executionID,
+		Reason:      reason.Error(),
+	})
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden des abgelehnten Payloads: %v", err))
+	}
+}
+
+// Setzt Base64-Chunks in der richtigen Reihenfolge zusammen und dekodiert sie
+func assembleChunks(chunks map[int]string) ([]byte, error) {
+	var full strings.Builder
+	for i := 0; i < len(chunks); i++ {
+		chunk, ok := chunks[i]
+		if !ok {
+			return nil, fmt.Errorf("Chunk %d fehlt", i)
+		}
+		full.WriteString(chunk)
+	}
+	return base64.StdEncoding.DecodeString(full.String())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"ondeso/protocol"
+)
+
+// Schlüssel und Skript der Testvektoren in Shared/GO-Protocol/crypto_test.go
+const (
+	vectorContent    = "Write-Output 'Hallo'\r\n"
+	vectorPublicKey  = "A6EHv/POEL4dcN0Y50vAmWfk1jCbpQ1fHdyGZBJVMbg="
+	vectorExpiresAt  = 1767225600
+	vectorSignature  = "837TkX7JFeG5ks7b4aQmT+qse2MJ6gcNj3Qd+GyE19GdMcHszbze+APXEt71KoN0jkvyOIrlHpsgqv4C1XqkCg=="
+	vectorParameters = `[{"name":"Path","value":"C:\\Temp"}]`
+)
+
+// Privater Schlüssel der Testvektoren (Seed 00 01 02 ... 1f)
+func vectorKey() ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// Signiert content wie der Server
+func signForTest(key ed25519.PrivateKey, content, name, payloadType string, expiresAt int64, parameters string) payloadSignature {
+	sum := sha256.Sum256([]byte(content))
+	contentHash := hex.EncodeToString(sum[:])
+	message := protocol.SignedPayloadMessage(contentHash, name, payloadType, expiresAt, parameters)
+	return payloadSignature{
+		SHA256:    contentHash,
+		ExpiresAt: expiresAt,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, message)),
+	}
+}
+
+func TestVerifyPayload(t *testing.T) {
+	publicKey, err := parseSigningPublicKey(vectorPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKey.Equal(vectorKey().Public()) {
+		t.Fatal("Schlüssel passt nicht zu den Testvektoren")
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	oldKey, oldKeyError := signingPublicKey, signingKeyError
+	t.Cleanup(func() { signingPublicKey, signingKeyError = oldKey, oldKeyError })
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	valid := signForTest(vectorKey(), vectorContent, "inventory.ps1", "powershell", expiresAt, "")
+	withParameters := signForTest(vectorKey(), vectorContent, "inventory.ps1", "powershell", expiresAt, vectorParameters)
+	badSHA := valid
+	badSHA.SHA256 = strings.Repeat("0", 64)
+	badBase64 := valid
+	badBase64.Signature = "kein base64!"
+
+	tests := []struct {
+		name       string
+		key        ed25519.PublicKey
+		keyError   error
+		content    string
+		payload    string // Name des Payloads
+		parameters string
+		sig        payloadSignature
+		want       string // Teil der Fehlermeldung, leer wenn gültig
+	}{
+		{"gültig", publicKey, nil, vectorContent, "inventory.ps1", "", valid, ""},
+		{"gültig mit Parametern", publicKey, nil, vectorContent, "inventory.ps1", vectorParameters, withParameters, ""},
+		{"Testvektor abgelaufen", publicKey, nil, vectorContent, "inventory.ps1", "",
+			payloadSignature{SHA256: valid.SHA256, ExpiresAt: vectorExpiresAt, Signature: vectorSignature}, "abgelaufen"},
+		{"falscher Schlüssel", otherKey.Public().(ed25519.PublicKey), nil, vectorContent, "inventory.ps1", "", valid, "ungültig"},
+		{"Inhalt verändert", publicKey, nil, vectorContent + "Remove-Item C:\\", "inventory.ps1", "", valid, "SHA-256"},
+		{"SHA-256 verändert", publicKey, nil, vectorContent, "inventory.ps1", "", badSHA, "SHA-256"},
+		{"Parameter verändert", publicKey, nil, vectorContent, "inventory.ps1", `[{"name":"Path","value":"C:\\Windows"}]`, withParameters, "ungültig"},
+		{"Parameter entfernt", publicKey, nil, vectorContent, "inventory.ps1", "", withParameters, "ungültig"},
+		{"Name verändert", publicKey, nil, vectorContent, "cleanup.ps1", "", valid, "ungültig"},
+		{"unsigniert", publicKey, nil, vectorContent, "inventory.ps1", "", payloadSignature{}, "nicht signiert"},
+		{"Signatur nicht lesbar", publicKey, nil, vectorContent, "inventory.ps1", "", badBase64, "nicht lesbar"},
+		{"Schlüssel ungültig", nil, errors.New("ungültige Schlüssellänge 3"), vectorContent, "inventory.ps1", "", valid, "signing_public_key ist ungültig"},
+		{"ohne Schlüssel unsigniert", nil, nil, vectorContent, "inventory.ps1", "", payloadSignature{}, ""},
+	}
+	for _, tt := range tests {
+		signingPublicKey, signingKeyError = tt.key, tt.keyError
+		err := verifyPayload([]byte(tt.content), tt.payload, "powershell", tt.parameters, tt.sig)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: verifyPayload() = %v, want nil", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: verifyPayload() = %v, want error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
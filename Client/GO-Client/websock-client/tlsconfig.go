@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	tlsCAFile         string // Eigene CA-Datei statt System-Zertifikatsspeicher
+	tlsPinnedSHA256   string // SHA-256 des Server-Public-Keys (SPKI), kommagetrennt
+	tlsClientCertFile string // Client-Zertifikat für Mutual TLS
+	tlsClientKeyFile  string
+)
+
+// Erstellt den WebSocket-Dialer mit den TLS-Einstellungen aus der INI-Datei
+func newDialer() (*websocket.Dialer, error) {
+	dialer := *websocket.DefaultDialer
+	if !strings.HasPrefix(serverURL, "wss://") {
+		return &dialer, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if tlsCAFile != "" {
+		pem, err := os.ReadFile(tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("CA-Datei %s nicht lesbar: %v", tlsCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("keine Zertifikate in %s gefunden", tlsCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if tlsClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsClientCertFile, tlsClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Client-Zertifikat nicht lesbar: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsPinnedSHA256 != "" {
+		var pins [][]byte
+		for _, pin := range strings.Split(tlsPinnedSHA256, ",") {
+			decoded, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("ungültiger Pin: %s", pin)
+			}
+			pins = append(pins, decoded)
+		}
+
+		// Mindestens ein Zertifikat der geprüften Kette muss zum Pin passen
+		tlsConfig.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if bytes.Equal(sum[:], pin) {
+							return nil
+						}
+					}
+				}
+			}
+			return fmt.Errorf("Server-Zertifikat passt zu keinem Pin")
+		}
+	}
+
+	dialer.TLSClientConfig = tlsConfig
+	return &dialer, nil
+}
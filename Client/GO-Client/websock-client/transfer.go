@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ondeso/protocol"
+)
+
+const (
+	// Ohne neue Chunks für diese Zeit werden fehlende Chunks nachgefordert
+	transferStallTimeout = 30 * time.Second
+	// Unvollständige Übertragungen werden nach dieser Zeit verworfen
+	transferExpiry = 10 * time.Minute
+)
+
+// Teilweise empfangene Übertragung eines Skripts oder einer Binärdatei
+type incomingTransfer struct {
+	transferID  string // Leer bei älteren Servern
+	name        string
+	payloadType string
+	executionID string
+	chunks      map[int]string
+	total       int
+	updated     time.Time               // Letzter empfangener Chunk
+	requested   time.Time               // Letzte Nachforderung
+	start       *protocol.TransferStart // transfer_start bei Binär-Frames
+}
+
+var (
+	transfers      = make(map[string]*incomingTransfer)
+	transfersMutex sync.Mutex
+)
+
+// Fehlende Chunk-Indizes einer Übertragung, aufsteigend
+func (t *incomingTransfer) missing() []int {
+	var indexes []int
+	for i := 0; i < t.total; i++ {
+		if _, ok := t.chunks[i]; !ok {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// Fordert Chunks einer Übertragung erneut an (leere Liste = alle)
+func requestChunks(transferID string, indexes []int) {
+	if indexes == nil {
+		indexes = []int{}
+	}
+	err := sendMessage(&protocol.ResendChunks{TransferID: transferID, Chunks: indexes})
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Nachfordern von Chunks für %s: %v", transferID, err))
+		return
+	}
+	writeLog(fmt.Sprintf("🔁 %d Chunks von Übertragung %s nachgefordert", len(indexes), transferID))
+}
+
+// Bestätigt dem Server eine vollständig empfangene Übertragung
+func confirmTransfer(transferID string) {
+	if transferID == "" {
+		return
+	}
+	if err := sendMessage(&protocol.TransferComplete{TransferID: transferID}); err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Bestätigen der Übertragung %s: %v", transferID, err))
+	}
+}
+
+// Nimmt einen Chunk entgegen. Sind alle Chunks da, werden sie zurückgegeben
+// und die Übertragung wird entfernt. Beschädigte Chunks (chunk_sha256 passt
+// nicht) werden verworfen und sofort nachgefordert.
+// Indizes wurden bereits von protocol.Decode geprüft.
+func receiveChunk(info protocol.ChunkInfo, executionID string, name string, payloadType string, chunk string) (map[int]string, bool) {
+	index, totalChunks, transferID := info.ChunkIndex, info.TotalChunks, info.TransferID
+
+	key := transferID
+	if key == "" {
+		key = payloadType + ":" + name // Ältere Server ohne Transfer-ID
+	}
+
+	if expected := info.ChunkSHA256; expected != "" {
+		sum := sha256.Sum256([]byte(chunk))
+		if !strings.EqualFold(expected, hex.EncodeToString(sum[:])) {
+			writeLog(fmt.Sprintf("⚠️ Chunk %d von %s ist beschädigt", index, name))
+			if transferID != "" {
+				requestChunks(transferID, []int{index})
+			}
+			return nil, false
+		}
+	}
+
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+
+	transfer, exists := transfers[key]
+	if !exists || transfer.total != totalChunks {
+		transfer = &incomingTransfer{
+			transferID:  transferID,
+			name:        name,
+			payloadType: payloadType,
+			executionID: executionID,
+			chunks:      make(map[int]string),
+			total:       totalChunks,
+		}
+		transfers[key] = transfer
+		writeLog(fmt.Sprintf("📂 Neue Übertragung %s: %s, Gesamt-Chunks: %d", key, name, transfer.total))
+	}
+	transfer.chunks[index] = chunk
+	transfer.updated = time.Now()
+
+	if len(transfer.chunks) < transfer.total {
+		return nil, false
+	}
+	delete(transfers, key)
+	return transfer.chunks, true
+}
+
+// Fordert nach einem Reconnect die fehlenden Chunks aller offenen
+// Übertragungen an
+func resumeTransfers() {
+	transfersMutex.Lock()
+	pending := make(map[string][]int)
+	for _, transfer := range transfers {
+		if transfer.transferID != "" {
+			pending[transfer.transferID] = transfer.missing()
+			transfer.requested = time.Now()
+		}
+	}
+	transfersMutex.Unlock()
+
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		requestChunks(id, pending[id])
+	}
+}
+
+// Überwacht offene Übertragungen: stockende werden nachgefordert, abgelaufene
+// verworfen und dem Server als abgelehnt gemeldet
+func watchTransfers() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		stalled := make(map[string][]int)
+		var expired []*incomingTransfer
+
+		transfersMutex.Lock()
+		for key, transfer := range transfers {
+			switch {
+			case now.Sub(transfer.updated) > transferExpiry:
+				delete(transfers, key)
+				expired = append(expired, transfer)
+			case transfer.transferID != "" && now.Sub(transfer.updated) > transferStallTimeout &&
+				now.Sub(transfer.requested) > transferStallTimeout:
+				transfer.requested = now
+				stalled[transfer.transferID] = transfer.missing()
+			}
+		}
+		transfersMutex.Unlock()
+
+		for transferID, indexes := range stalled {
+			requestChunks(transferID, indexes)
+		}
+		for _, transfer := range expired {
+			transfer.abandon("Übertragung unvollständig abgelaufen")
+		}
+	}
+}
+
+// Verwirft eine Übertragung, die der Server nicht mehr liefern kann
+// (transfer_unavailable)
+func dropTransfer(transferID string, reason string) {
+	transfersMutex.Lock()
+	transfer, ok := transfers[transferID]
+	delete(transfers, transferID)
+	transfersMutex.Unlock()
+	if ok {
+		transfer.abandon(reason)
+	}
+}
+
+// Meldet eine aufgegebene Übertragung dem Server als abgelehnt
+func (t *incomingTransfer) abandon(reason string) {
+	writeLog(fmt.Sprintf("⌛ Übertragung von %s aufgegeben (%d/%d Chunks): %s", t.name, len(t.chunks), t.total, reason))
+	id := t.executionID
+	if t.payloadType == "binary" || t.payloadType == "agent" {
+		id = t.transferID // Binärdateien und Builds werden über die Transfer-ID verfolgt
+	}
+	reportPayloadRejected(t.name, t.payloadType, id, fmt.Errorf("%s", reason))
+	if t.payloadType == "agent" {
+		abandonAgentUpdate(t.transferID, reason)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ondeso/protocol"
+)
+
+// Zustand eines Updates in update_state.json. Der alte Prozess schreibt
+// "pending", der neue nach erfolgreicher Registrierung "confirmed". Als
+// Dienst schreibt der alte Prozess nach dem Austausch "installed".
+type updateState struct {
+	UpdateID        string `json:"update_id"`
+	Version         string `json:"version"`
+	PreviousVersion string `json:"previous_version"`
+	Executable      string `json:"executable"`
+	Backup          string `json:"backup"`
+	Staged          string `json:"staged,omitempty"` // Als Dienst: der neue Build, bis er installiert ist
+	Status          string `json:"status"`
+	Message         string `json:"message,omitempty"` // Grund einer Rücknahme
+}
+
+const (
+	updateStatePending   = "pending"
+	updateStateConfirmed = "confirmed"
+	// Als Dienst: der geprüfte Build ist installiert, der neu gestartete
+	// Dienst meldet "installed"
+	updateStateInstalled = "installed"
+
+	// Wartezeit auf die Registrierung des neuen Builds, wenn der Server
+	// keine confirm_seconds vorgibt
+	defaultUpdateConfirm = 300 * time.Second
+	// Größter akzeptierter Build
+	maxAgentSize = 200 * 1024 * 1024
+)
+
+var (
+	// Per Übertragung erwartete Builds nach Transfer-ID
+	pendingUpdates      = make(map[string]*protocol.UpdateAgent)
+	pendingUpdatesMutex sync.Mutex
+
+	updateRunning   atomic.Bool // Nur ein Update gleichzeitig
+	reconnectPaused atomic.Bool // Der neue Build ist verbunden, solange er geprüft wird
+
+	// Zurückgenommenes Update, dem Server nach der nächsten Registrierung melden
+	rolledBackUpdate atomic.Pointer[protocol.AgentUpdateStatus]
+
+	// Neuer Build, der gerade geprüft wird
+	supervisedBuild atomic.Pointer[exec.Cmd]
+)
+
+func updateStatePath() string {
+	return filepath.Join(baseDir, "update_state.json")
+}
+
+// Verarbeitet update_agent: der Build wird geladen oder per Übertragung
+// erwartet und danach installiert
+func handleUpdateAgent(request *protocol.UpdateAgent) {
+	writeLog(fmt.Sprintf("⬆️ Server bietet Version %s an (%s, aktuell %s)", request.Version, request.UpdateID, clientVersion))
+
+	switch {
+	case !policy.allowAgentUpdate:
+		reportUpdateStatus(request, protocol.UpdateRejected, "Updates sind durch die Richtlinie nicht erlaubt")
+		return
+	case signingKeyError != nil:
+		reportUpdateStatus(request, protocol.UpdateRejected, "signing_public_key ist ungültig: "+signingKeyError.Error())
+		return
+	case signingPublicKey == nil:
+		reportUpdateStatus(request, protocol.UpdateRejected, "Updates werden nur mit signing_public_key angenommen")
+		return
+	case request.Version == clientVersion:
+		reportUpdateStatus(request, protocol.UpdateRejected, "Version "+clientVersion+" läuft bereits")
+		return
+	case request.Size > maxAgentSize:
+		reportUpdateStatus(request, protocol.UpdateRejected, fmt.Sprintf("Build ist zu groß (%d Bytes)", request.Size))
+		return
+	case !updateRunning.CompareAndSwap(false, true):
+		reportUpdateStatus(request, protocol.UpdateRejected, "Es läuft bereits ein Update")
+		return
+	}
+	reportUpdateStatus(request, protocol.UpdateDownloading, "")
+
+	if request.URL != "" {
+		go func() {
+			content, err := downloadAgent(request)
+			installAgentUpdate(request, content, err)
+		}()
+		return
+	}
+	pendingUpdatesMutex.Lock()
+	pendingUpdates[request.TransferID] = request
+	pendingUpdatesMutex.Unlock()
+}
+
+// Lädt einen Build mit den TLS-Einstellungen der WebSocket-Verbindung
+func downloadAgent(request *protocol.UpdateAgent) ([]byte, error) {
+	dialer, err := newDialer()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Timeout:   10 * time.Minute,
+		Transport: &http.Transport{TLSClientConfig: dialer.TLSClientConfig, Proxy: http.ProxyFromEnvironment},
+	}
+	writeLog(fmt.Sprintf("📥 Lade Version %s von %s", request.Version, request.URL))
+	response, err := client.Get(request.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Download fehlgeschlagen: %s", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, request.Size+1))
+}
+
+// Nimmt einen per Übertragung empfangenen Build entgegen
+func handleAgentPayload(transferID string, name string, content []byte, err error) {
+	confirmTransfer(transferID)
+	pendingUpdatesMutex.Lock()
+	request, ok := pendingUpdates[transferID]
+	delete(pendingUpdates, transferID)
+	pendingUpdatesMutex.Unlock()
+	if !ok {
+		reportPayloadRejected(name, "agent", transferID, fmt.Errorf("kein update_agent zu dieser Übertragung"))
+		return
+	}
+	if expected := agentBuildName(request.Version); err == nil && name != expected {
+		err = fmt.Errorf("Build %s passt nicht zu diesem System (erwartet %s)", name, expected)
+	}
+	// Die Installation trennt die Verbindung, daher nicht in der Empfangsschleife
+	go installAgentUpdate(request, content, err)
+}
+
+// Dateiname des Builds einer Version für dieses System
+func agentBuildName(version string) string {
+	return protocol.AgentBuildName(version, runtime.GOOS, runtime.GOARCH)
+}
+
+// Bricht ein per Übertragung erwartetes Update ab
+func abandonAgentUpdate(transferID string, reason string) {
+	pendingUpdatesMutex.Lock()
+	request, ok := pendingUpdates[transferID]
+	delete(pendingUpdates, transferID)
+	pendingUpdatesMutex.Unlock()
+	if ok {
+		reportUpdateStatus(request, protocol.UpdateFailed, reason)
+		updateRunning.Store(false)
+	}
+}
+
+// Prüft und installiert einen Build: die laufende Datei wird als .old
+// gesichert, der neue Build gestartet und bis zu seiner Registrierung
+// überwacht. Registriert er sich nicht, wird die Sicherung wiederhergestellt.
+// Als Dienst wird der Build vor dem Installieren geprüft
+// (installServiceUpdate).
+func installAgentUpdate(request *protocol.UpdateAgent, content []byte, err error) {
+	defer updateRunning.Store(false)
+	if err == nil && int64(len(content)) != request.Size {
+		err = fmt.Errorf("Größe stimmt nicht (erwartet %d, erhalten %d)", request.Size, len(content))
+	}
+	if err != nil {
+		reportUpdateStatus(request, protocol.UpdateFailed, err.Error())
+		return
+	}
+	// Signatur prüfen, bevor irgendetwas geschrieben oder ausgeführt wird.
+	// Signiert ist der Dateiname mit Betriebssystem und Architektur, ein
+	// Build für ein anderes System wird daher abgelehnt.
+	name := agentBuildName(request.Version)
+	if err := verifyPayload(content, name, "agent", "", signatureFromMessage(request.PayloadSignature)); err != nil {
+		reportPayloadRejected(name, "agent", request.UpdateID, err)
+		reportUpdateStatus(request, protocol.UpdateRejected, err.Error())
+		return
+	}
+
+	confirm := defaultUpdateConfirm
+	if request.ConfirmSeconds > 0 {
+		confirm = time.Duration(request.ConfirmSeconds) * time.Second
+	}
+	if runningAsService {
+		installServiceUpdate(request, content, confirm)
+		return
+	}
+
+	state, err := replaceExecutable(request, content)
+	if err != nil {
+		reportUpdateStatus(request, protocol.UpdateFailed, err.Error())
+		return
+	}
+	reportUpdateStatus(request, protocol.UpdateInstalling, "")
+
+	pauseConnection()
+	if reason := superviseNewBuild(state.Executable, state, confirm, true); reason != "" {
+		rollbackUpdate(state, reason)
+		reconnectPaused.Store(false)
+		return
+	}
+	writeLog(fmt.Sprintf("✅ Version %s hat sich registriert, beende Version %s", request.Version, clientVersion))
+	exitChan <- true
+}
+
+// Als Dienst kann sich ein neuer Build nicht selbst überwachen: stürzt er
+// beim Start ab, läuft keine Prüfung. Daher startet der laufende Dienst den
+// Build aus dem Staging-Verzeichnis und überwacht ihn wie ohne Dienst. Erst
+// nach der Registrierung wird die Datei ersetzt und der Dienst-Manager startet
+// den neuen Build. Scheitert die Prüfung oder startet der Rechner währenddessen
+// neu, bleibt die installierte Version unverändert.
+func installServiceUpdate(request *protocol.UpdateAgent, content []byte, confirm time.Duration) {
+	executable, staged, err := stageBuild(request, content)
+	if err != nil {
+		reportUpdateStatus(request, protocol.UpdateFailed, err.Error())
+		return
+	}
+	state := newUpdateState(request, executable)
+	state.Staged = staged
+	if err := saveUpdateState(state); err != nil {
+		os.Remove(staged)
+		reportUpdateStatus(request, protocol.UpdateFailed, "Update-Status nicht gespeichert: "+err.Error())
+		return
+	}
+	reportUpdateStatus(request, protocol.UpdateInstalling, "")
+
+	pauseConnection()
+	reason := superviseNewBuild(staged, state, confirm, false)
+	if reason == "" {
+		if err := swapExecutable(state, staged, content); err != nil {
+			reason = err.Error()
+		}
+	}
+	if reason != "" {
+		rollbackUpdate(state, reason)
+		reconnectPaused.Store(false)
+		return
+	}
+	state.Status = updateStateInstalled
+	if err := saveUpdateState(state); err != nil {
+		writeLog(fmt.Sprintf("❌ Update-Status nicht gespeichert: %v", err))
+	}
+	writeLog(fmt.Sprintf("📦 Version %s hat sich registriert und ist installiert, Sicherung: %s", request.Version, state.Backup))
+	writeLog(fmt.Sprintf("🔄 Starte Dienst für Version %s neu", request.Version))
+	restartRequested.Store(true)
+	exitChan <- true
+}
+
+// Legt den Build im Workplace ab, damit ein Schreibfehler nichts zerstört.
+// Liefert die laufende Datei und den abgelegten Build.
+func stageBuild(request *protocol.UpdateAgent, content []byte) (string, string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return "", "", err
+	}
+
+	stageDir := filepath.Join(baseDir, "update")
+	if err := os.MkdirAll(stageDir, 0755); err != nil {
+		return "", "", err
+	}
+	staged := filepath.Join(stageDir, "websock-client-"+request.Version+filepath.Ext(executable))
+	if err := os.WriteFile(staged, content, 0755); err != nil {
+		return "", "", fmt.Errorf("Build nicht gespeichert: %v", err)
+	}
+	return executable, staged, nil
+}
+
+func newUpdateState(request *protocol.UpdateAgent, executable string) *updateState {
+	return &updateState{
+		UpdateID:        request.UpdateID,
+		Version:         request.Version,
+		PreviousVersion: clientVersion,
+		Executable:      executable,
+		Backup:          executable + ".old",
+		Status:          updateStatePending,
+	}
+}
+
+// Sichert die laufende Datei und ersetzt sie durch den neuen Build
+func replaceExecutable(request *protocol.UpdateAgent, content []byte) (*updateState, error) {
+	executable, staged, err := stageBuild(request, content)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(staged)
+
+	state := newUpdateState(request, executable)
+	if err := swapExecutable(state, staged, content); err != nil {
+		return nil, err
+	}
+	if err := saveUpdateState(state); err != nil {
+		os.Remove(executable)
+		os.Rename(state.Backup, executable)
+		return nil, fmt.Errorf("Update-Status nicht gespeichert: %v", err)
+	}
+	writeLog(fmt.Sprintf("📦 Version %s installiert, Sicherung: %s", request.Version, state.Backup))
+	return state, nil
+}
+
+// Sichert die installierte Datei als .old und setzt den abgelegten Build an
+// ihre Stelle. Eine laufende .exe kann unter Windows umbenannt, aber nicht
+// überschrieben werden.
+func swapExecutable(state *updateState, staged string, content []byte) error {
+	os.Remove(state.Backup) // Rest eines früheren Updates
+	if err := os.Rename(state.Executable, state.Backup); err != nil {
+		return fmt.Errorf("Sicherung fehlgeschlagen: %v", err)
+	}
+	// Verschieben klappt nur auf demselben Laufwerk, sonst neu schreiben
+	if err := os.Rename(staged, state.Executable); err != nil {
+		if err := os.WriteFile(state.Executable, content, 0755); err != nil {
+			os.Remove(state.Executable)
+			os.Rename(state.Backup, state.Executable)
+			return fmt.Errorf("Build nicht installiert: %v", err)
+		}
+	}
+	return nil
+}
+
+// Gibt die Verbindung frei, damit sich der neue Build registrieren kann
+func pauseConnection() {
+	reconnectPaused.Store(true)
+	wsWriteMutex.Lock()
+	if wsConn != nil {
+		wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "update"), time.Now().Add(time.Second))
+		wsConn.Close()
+	}
+	wsWriteMutex.Unlock()
+}
+
+// Startet den neuen Build aus path und wartet, bis er sich registriert hat.
+// Liefert den Grund, wenn er sich nicht registriert. Mit keepRunning läuft
+// er danach weiter, sonst wird er nach der Registrierung beendet.
+func superviseNewBuild(path string, state *updateState, confirm time.Duration, keepRunning bool) string {
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Dir = filepath.Dir(state.Executable)
+	cmd.Env = childEnv()
+	if err := cmd.Start(); err != nil {
+		return fmt.Sprintf("Neuer Build startet nicht: %v", err)
+	}
+	writeLog(fmt.Sprintf("🚀 Version %s gestartet (PID %d), warte bis zu %v auf Registrierung", state.Version, cmd.Process.Pid, confirm))
+	supervisedBuild.Store(cmd)
+	defer supervisedBuild.Store(nil)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	deadline := time.After(confirm)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Sprintf("Neuer Build hat sich beendet: %v", err)
+		case <-deadline:
+			killProcessTree(cmd)
+			<-exited
+			return fmt.Sprintf("Neuer Build hat sich nicht innerhalb von %v registriert", confirm)
+		case <-ticker.C:
+			if current, err := loadUpdateState(); err == nil && current.UpdateID == state.UpdateID && current.Status == updateStateConfirmed {
+				if !keepRunning {
+					killProcessTree(cmd)
+					<-exited
+				}
+				state.Status = updateStateConfirmed
+				return ""
+			}
+		}
+	}
+}
+
+// Umgebung des neuen Builds: er läuft als Kindprozess, nicht als Dienst
+// (systemd erkennt der Client an INVOCATION_ID)
+func childEnv() []string {
+	var env []string
+	for _, entry := range os.Environ() {
+		if !strings.HasPrefix(entry, "INVOCATION_ID=") {
+			env = append(env, entry)
+		}
+	}
+	return env
+}
+
+// Beendet einen noch geprüften Build, wenn der Dienst beendet wird
+func stopSupervisedBuild() {
+	if cmd := supervisedBuild.Load(); cmd != nil && runningAsService {
+		writeLog("🛑 Beende den noch nicht geprüften neuen Build")
+		killProcessTree(cmd)
+	}
+}
+
+// Stellt den vorherigen Build wieder her. Als Dienst ist er noch installiert,
+// dann wird nur der abgelegte Build entfernt.
+func rollbackUpdate(state *updateState, reason string) {
+	writeLog(fmt.Sprintf("⚠️ Update auf %s fehlgeschlagen: %s. Stelle Version %s wieder her", state.Version, reason, state.PreviousVersion))
+	// Der beendete Prozess gibt die Datei unter Windows verzögert frei
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if state.Staged != "" {
+			if err = os.Remove(state.Staged); err == nil || os.IsNotExist(err) {
+				err = nil
+				break
+			}
+		} else {
+			os.Remove(state.Executable)
+			if err = os.Rename(state.Backup, state.Executable); err == nil {
+				break
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		writeLog(fmt.Sprintf("❌ Vorherige Version nicht wiederhergestellt: %v", err))
+		reason += "; Wiederherstellung fehlgeschlagen: " + err.Error()
+	}
+	os.Remove(updateStatePath())
+	rolledBackUpdate.Store(&protocol.AgentUpdateStatus{UpdateID: state.UpdateID, Version: state.Version, Status: protocol.UpdateRolledBack, Message: reason})
+}
+
+// Läuft dieser Prozess aus path?
+func runningFrom(path string) bool {
+	executable, err := os.Executable()
+	if err != nil || path == "" {
+		return false
+	}
+	running, err := os.Stat(executable)
+	if err != nil {
+		return false
+	}
+	target, err := os.Stat(path)
+	return err == nil && os.SameFile(running, target)
+}
+
+// Nach erfolgreicher Registrierung: bestätigt ein laufendes Update oder
+// meldet ein zurückgenommenes
+func agentUpdateConnected() {
+	if status := rolledBackUpdate.Swap(nil); status != nil {
+		sendUpdateStatus(status)
+	}
+
+	state, err := loadUpdateState()
+	if err != nil || updateRunning.Load() {
+		return
+	}
+	if state.Version != clientVersion {
+		// Der vorherige Build läuft wieder, z.B. nach einem Neustart während der Prüfung
+		writeLog(fmt.Sprintf("⚠️ Update auf %s nicht abgeschlossen, Version %s läuft", state.Version, clientVersion))
+		os.Remove(updateStatePath())
+		if state.Staged != "" {
+			os.Remove(state.Staged)
+		}
+		if state.Status == updateStatePending {
+			message := state.Message
+			if message == "" {
+				message = "Vorherige Version läuft wieder"
+			}
+			sendUpdateStatus(&protocol.AgentUpdateStatus{UpdateID: state.UpdateID, Version: state.Version, Status: protocol.UpdateRolledBack, Message: message})
+		}
+		return
+	}
+
+	staged := runningFrom(state.Staged)
+	switch state.Status {
+	case updateStatePending:
+		state.Status = updateStateConfirmed
+		if err := saveUpdateState(state); err != nil {
+			writeLog(fmt.Sprintf("❌ Update-Bestätigung nicht gespeichert: %v", err))
+			return
+		}
+		writeLog(fmt.Sprintf("✅ Update von %s auf %s bestätigt", state.PreviousVersion, state.Version))
+		// Als Dienst ist der Build erst nach dem Austausch durch den Dienst installiert
+		status := protocol.UpdateInstalled
+		if staged {
+			status = protocol.UpdateInstalling
+		}
+		sendUpdateStatus(&protocol.AgentUpdateStatus{UpdateID: state.UpdateID, Version: state.Version, Status: status})
+	case updateStateInstalled:
+		// Der Dienst hat den geprüften Build installiert und neu gestartet
+		state.Status = updateStateConfirmed
+		if err := saveUpdateState(state); err != nil {
+			writeLog(fmt.Sprintf("❌ Update-Status nicht gespeichert: %v", err))
+		}
+		writeLog(fmt.Sprintf("✅ Version %s ist als Dienst installiert", state.Version))
+		sendUpdateStatus(&protocol.AgentUpdateStatus{UpdateID: state.UpdateID, Version: state.Version, Status: protocol.UpdateInstalled})
+	}
+	if staged {
+		return // Der Dienst beendet diesen Prozess und installiert den Build
+	}
+	go cleanupUpdate(state)
+}
+
+// Läuft dieser Prozess als abgelegter Build, den der Dienst noch prüft?
+func runningStaged() bool {
+	state, err := loadUpdateState()
+	return err == nil && runningFrom(state.Staged)
+}
+
+// Entfernt Sicherung und Status, sobald sich der alte Prozess beendet hat
+func cleanupUpdate(state *updateState) {
+	for attempt := 0; attempt < 60; attempt++ {
+		// Der alte Prozess prüft den Status alle 500 ms
+		time.Sleep(2 * time.Second)
+		if err := os.Remove(state.Backup); err == nil || os.IsNotExist(err) {
+			if state.Staged != "" {
+				os.Remove(state.Staged)
+			}
+			os.Remove(updateStatePath())
+			writeLog(fmt.Sprintf("🧹 Sicherung von Version %s entfernt", state.PreviousVersion))
+			return
+		}
+	}
+	writeLog(fmt.Sprintf("⚠️ Sicherung %s konnte nicht entfernt werden", state.Backup))
+}
+
+// Wartet, solange ein neuer Build die Verbindung zum Server hält
+func waitWhileUpdating() {
+	if !reconnectPaused.Load() {
+		return
+	}
+	writeLog("⏸️ Verbindung pausiert, bis das Update geprüft ist")
+	for reconnectPaused.Load() {
+		time.Sleep(time.Second)
+	}
+}
+
+func loadUpdateState() (*updateState, error) {
+	data, err := os.ReadFile(updateStatePath())
+	if err != nil {
+		return nil, err
+	}
+	var state updateState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Schreibt den Status über eine temporäre Datei, damit der andere Prozess
+// nie eine halbe Datei liest
+func saveUpdateState(state *updateState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := updateStatePath() + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, updateStatePath())
+}
+
+// Meldet dem Server den Stand eines Updates
+func reportUpdateStatus(request *protocol.UpdateAgent, status string, message string) {
+	if message != "" {
+		writeLog(fmt.Sprintf("⬆️ Update auf %s: %s (%s)", request.Version, status, message))
+	}
+	sendUpdateStatus(&protocol.AgentUpdateStatus{UpdateID: request.UpdateID, Version: request.Version, Status: status, Message: message})
+}
+
+func sendUpdateStatus(status *protocol.AgentUpdateStatus) {
+	if err := sendMessage(status); err != nil {
+		writeLog(fmt.Sprintf("❌ Fehler beim Melden des Update-Status: %v", err))
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"ondeso/protocol"
+)
+
+// Agent update states before the client reports, see also
+// protocol.UpdateInstalled and friends.
+const (
+	agentUpdatePending = "pending"
+	agentUpdateSent    = "sent"
+)
+
+// Delivery modes of /agent/update.
+const (
+	agentModeTransfer = "transfer" // Frame transfer over the WebSocket
+	agentModeURL      = "url"      // Download from AGENT_UPDATE_URL
+)
+
+// AgentUpdate is one update_agent sent to a client and its progress.
+type AgentUpdate struct {
+	BaseModel
+	UpdateID        string     `gorm:"column:update_id;size:64;unique_index"`
+	ClientID        string     `gorm:"column:client_id;size:255;index"`
+	Version         string     `gorm:"column:version;size:64"`
+	PreviousVersion string     `gorm:"column:previous_version;size:50"`
+	Platform        string     `gorm:"column:platform;size:50"`
+	Mode            string     `gorm:"column:mode;size:20"`
+	Status          string     `gorm:"column:status;size:50"`
+	Message         string     `gorm:"column:message;size:1024"`
+	RequestedBy     string     `gorm:"column:requested_by;size:255"`
+	CompletedAt     *time.Time `gorm:"column:completed_at"`
+}
+
+// agentBuildDir holds the client builds as
+// websock-client-<version>-<os>-<arch>[.exe] (AGENT_BUILD_DIR), set up in main.
+var agentBuildDir string
+
+// agentPlatform is the GOOS/GOARCH pair a client build is made for.
+type agentPlatform struct {
+	OS   string
+	Arch string
+}
+
+func (p agentPlatform) String() string {
+	return p.OS + "/" + p.Arch
+}
+
+// defaultPlatform is assumed for clients that do not announce their platform.
+var defaultPlatform = agentPlatform{OS: "windows", Arch: "amd64"}
+
+// agentBuildPath returns the file of a client build. Version and platform
+// must have been checked with protocol.ValidAgentVersion and
+// protocol.ValidPlatform.
+func agentBuildPath(version string, platform agentPlatform) string {
+	return filepath.Join(agentBuildDir, protocol.AgentBuildName(version, platform.OS, platform.Arch))
+}
+
+// parseAgentBuildName splits the file name of a client build into version
+// and platform. os and arch are taken from the end, as versions may contain
+// dashes.
+func parseAgentBuildName(name string) (version string, platform agentPlatform, ok bool) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "websock-client-"), ".exe"), "-")
+	if len(parts) < 3 {
+		return "", agentPlatform{}, false
+	}
+	version = strings.Join(parts[:len(parts)-2], "-")
+	platform = agentPlatform{OS: parts[len(parts)-2], Arch: parts[len(parts)-1]}
+	if !protocol.ValidAgentVersion(version) || !protocol.ValidPlatform(platform.OS, platform.Arch) ||
+		name != filepath.Base(agentBuildPath(version, platform)) {
+		return "", agentPlatform{}, false
+	}
+	return version, platform, true
+}
+
+// agentDownloadURL fills in the AGENT_UPDATE_URL template for a build.
+func agentDownloadURL(template, version string, platform agentPlatform) string {
+	return strings.NewReplacer("{version}", version, "{os}", platform.OS, "{arch}", platform.Arch).Replace(template)
+}
+
+// agentUpdateDone reports whether an update has reached a final state.
+func agentUpdateDone(status string) bool {
+	switch status {
+	case protocol.UpdateInstalled, protocol.UpdateRolledBack, protocol.UpdateRejected, protocol.UpdateFailed:
+		return true
+	}
+	return false
+}
+
+// clientWriter returns a messageWriter for a connected client. Each message
+// looks up the current connection; clientsMutex is released before the write,
+// which is serialized per connection.
+func clientWriter(clientID string) messageWriter {
+	return func(messageType int, data []byte) error {
+		client, ok := connectedClient(clientID)
+		if !ok {
+			return fmt.Errorf("client %s is not connected", clientID)
+		}
+		return client.Conn.WriteMessage(messageType, data)
+	}
+}
+
+// agentTransfer is a build prepared once for all clients of an update run:
+// they share the signature, the transfer ID and the frames.
+type agentTransfer struct {
+	content   []byte
+	signature payloadSignature
+	frames    *sharedFrameTransfer
+}
+
+// newAgentTransfer prepares the build of version for one platform of an
+// update run. The build is signed under its file name, so clients refuse
+// builds for another platform.
+func newAgentTransfer(version string, platform agentPlatform, content []byte) *agentTransfer {
+	name := protocol.AgentBuildName(version, platform.OS, platform.Arch)
+	signature := signPayload(content, name, "agent")
+	start := protocol.TransferStart{Kind: protocol.KindAgent, BinaryName: name, PayloadSignature: signature.message()}
+	return &agentTransfer{
+		content:   content,
+		signature: signature,
+		frames:    newSharedFrameTransfer(uuid.New(), start, content),
+	}
+}
+
+// sendAgentUpdate sends update_agent to a client, followed by the build as
+// frame transfer unless the client downloads it.
+func sendAgentUpdate(update AgentUpdate, client Client, build *agentTransfer, downloadURL string) error {
+	message := &protocol.UpdateAgent{
+		UpdateID:         update.UpdateID,
+		Version:          update.Version,
+		Size:             int64(len(build.content)),
+		URL:              downloadURL,
+		ConfirmSeconds:   getEnvInt("AGENT_UPDATE_CONFIRM_SECONDS", 300),
+		PayloadSignature: build.signature.message(),
+	}
+	if downloadURL != "" {
+		return sendToClient(client.ID, message)
+	}
+
+	message.TransferID = build.frames.transferID.String()
+	transfer, err := build.frames.get(client.compression())
+	if err != nil {
+		return err
+	}
+	if err := sendToClient(client.ID, message); err != nil {
+		return err
+	}
+	return sendFrameTransfer(clientWriter(client.ID), client.ID, build.frames.transferID, build.frames.start.BinaryName, transfer)
+}
+
+// runAgentUpdates sends every client of an update run the build for its
+// platform. With a urlTemplate the clients download the build instead.
+func runAgentUpdates(updates []AgentUpdate, targets map[string]Client, contents map[agentPlatform][]byte, urlTemplate string) {
+	builds := make(map[agentPlatform]*agentTransfer, len(contents))
+	for _, update := range updates {
+		client := targets[update.ClientID]
+		platform := client.Protocol.platform()
+		build, ok := builds[platform]
+		if !ok {
+			build = newAgentTransfer(update.Version, platform, contents[platform])
+			builds[platform] = build
+		}
+		downloadURL := ""
+		if urlTemplate != "" {
+			downloadURL = agentDownloadURL(urlTemplate, update.Version, platform)
+		}
+		if err := sendAgentUpdate(update, client, build, downloadURL); err != nil {
+			log.Printf("❌ Update auf %s an %s fehlgeschlagen: %v", update.Version, update.ClientID, err)
+			now := time.Now()
+			db.Model(&AgentUpdate{}).Where("id = ?", update.ID).Updates(map[string]interface{}{
+				"status":       protocol.UpdateFailed,
+				"message":      err.Error(),
+				"completed_at": now,
+			})
+			continue
+		}
+		// The client may already have reported back, so only move on from pending.
+		db.Model(&AgentUpdate{}).Where("id = ? AND status = ?", update.ID, agentUpdatePending).Update("status", agentUpdateSent)
+		log.Printf("📤 Update auf %s an %s gesendet (%s)", update.Version, update.ClientID, update.UpdateID)
+	}
+}
+
+// recordAgentUpdateStatus stores the agent_update_status of a client.
+func recordAgentUpdateStatus(clientID string, status *protocol.AgentUpdateStatus) {
+	updates := map[string]interface{}{"status": status.Status, "message": status.Message}
+	if agentUpdateDone(status.Status) {
+		updates["completed_at"] = time.Now()
+	}
+	result := db.Model(&AgentUpdate{}).Where("update_id = ? AND client_id = ?", status.UpdateID, clientID).Updates(updates)
+	if result.Error != nil {
+		log.Printf("❌ Fehler beim Speichern des Update-Status von %s: %v", clientID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("⚠️ Unerwarteter Update-Status von %s für %s verworfen", clientID, status.UpdateID)
+		return
+	}
+	switch status.Status {
+	case protocol.UpdateInstalled:
+		log.Printf("✅ Client %s läuft mit Version %s", clientID, status.Version)
+	case protocol.UpdateRolledBack, protocol.UpdateRejected, protocol.UpdateFailed:
+		log.Printf("❌ Update von %s auf %s: %s (%s)", clientID, status.Version, status.Status, status.Message)
+	default:
+		log.Printf("🔄 Update von %s auf %s: %s", clientID, status.Version, status.Status)
+	}
+}
+
+// confirmAgentUpdate marks the open update of a client as installed when it
+// registers with the version it was updated to. Staged builds do not count,
+// the service installs them only after they registered.
+func confirmAgentUpdate(clientID, clientVersion string) {
+	now := time.Now()
+	result := db.Model(&AgentUpdate{}).
+		Where("client_id = ? AND version = ? AND status NOT IN (?)", clientID, clientVersion,
+			[]string{protocol.UpdateInstalled, protocol.UpdateRolledBack, protocol.UpdateRejected, protocol.UpdateFailed}).
+		Updates(map[string]interface{}{"status": protocol.UpdateInstalled, "completed_at": now})
+	if result.Error != nil {
+		log.Printf("❌ Fehler beim Bestätigen des Updates von %s: %v", clientID, result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("✅ Client %s nach Update mit Version %s registriert", clientID, clientVersion)
+	}
+}
+
+// --- HTTP Handlers ---
+
+// agentBuildsHandler lists the client builds in AGENT_BUILD_DIR.
+func agentBuildsHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := ioutil.ReadDir(agentBuildDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading agent build dir: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	builds := make([]map[string]interface{}, 0, len(files))
+	for _, file := range files {
+		version, platform, ok := parseAgentBuildName(file.Name())
+		if file.IsDir() || !ok {
+			continue
+		}
+		content, err := ioutil.ReadFile(agentBuildPath(version, platform))
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(content)
+		builds = append(builds, map[string]interface{}{
+			"version":  version,
+			"os":       platform.OS,
+			"arch":     platform.Arch,
+			"size":     file.Size(),
+			"sha256":   hex.EncodeToString(sum[:]),
+			"modified": file.ModTime(),
+		})
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		if builds[i]["version"] != builds[j]["version"] {
+			return builds[i]["version"].(string) < builds[j]["version"].(string)
+		}
+		return fmt.Sprint(builds[i]["os"], "/", builds[i]["arch"]) < fmt.Sprint(builds[j]["os"], "/", builds[j]["arch"])
+	})
+	json.NewEncoder(w).Encode(builds)
+}
+
+// updateAgentHandler sends a client build (version) to the connected clients
+// of a target selector. mode "transfer" (default) sends the build over the
+// WebSocket, "url" lets the clients download it from AGENT_UPDATE_URL.
+// Every client gets the build for its platform; clients already running the
+// version or without a build for their platform are skipped.
+func updateAgentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := r.FormValue("target")
+	if clientID := r.FormValue("client_id"); target == "" && clientID != "" {
+		target = "client:" + clientID
+	}
+	version := strings.TrimSpace(r.FormValue("version"))
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = agentModeTransfer
+	}
+	auditDetail(r, "version=%s target=%s mode=%s", version, target, mode)
+	if target == "" || version == "" {
+		http.Error(w, "Target and version missing", http.StatusBadRequest)
+		return
+	}
+	if !protocol.ValidAgentVersion(version) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	urlTemplate := ""
+	switch mode {
+	case agentModeTransfer:
+	case agentModeURL:
+		urlTemplate = getEnv("AGENT_UPDATE_URL", "")
+		if urlTemplate == "" {
+			http.Error(w, "AGENT_UPDATE_URL is not configured", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return
+	}
+
+	targets, err := resolveTarget(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Builds are read per platform of the targets; nil marks a missing build.
+	contents := make(map[agentPlatform][]byte)
+	buildFor := func(platform agentPlatform) ([]byte, error) {
+		if content, ok := contents[platform]; ok {
+			return content, nil
+		}
+		content, err := ioutil.ReadFile(agentBuildPath(version, platform))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		contents[platform] = content
+		return content, nil
+	}
+
+	requestedBy := ""
+	if user := currentOperator(r); user != nil {
+		requestedBy = user.Username
+	}
+	results := make([]map[string]string, 0, len(targets))
+	updates := make([]AgentUpdate, 0, len(targets))
+	byID := make(map[string]Client, len(targets))
+	for _, client := range targets {
+		result := map[string]string{"client_id": client.ID}
+		results = append(results, result)
+		switch {
+		case !client.supports(protocol.CapUpdateAgent):
+			result["status"], result["message"] = "skipped", "client does not support update_agent"
+			continue
+		case mode == agentModeTransfer && !client.supports(protocol.CapBinaryFrames):
+			result["status"], result["message"] = "skipped", "client does not support binary frames, use mode url"
+			continue
+		case client.Protocol.ClientVersion == version:
+			result["status"], result["message"] = "skipped", "client already runs "+version
+			continue
+		}
+
+		platform := client.Protocol.platform()
+		content, err := buildFor(platform)
+		if err != nil {
+			log.Printf("Error reading agent build %s for %s: %v", version, platform, err)
+			http.Error(w, "Error reading build", http.StatusInternalServerError)
+			return
+		}
+		if content == nil {
+			result["status"], result["message"] = "skipped", "no build for "+platform.String()
+			continue
+		}
+
+		update := AgentUpdate{
+			UpdateID:        uuid.New().String(),
+			ClientID:        client.ID,
+			Version:         version,
+			PreviousVersion: client.Protocol.ClientVersion,
+			Platform:        platform.String(),
+			Mode:            mode,
+			Status:          agentUpdatePending,
+			RequestedBy:     requestedBy,
+		}
+		if err := db.Create(&update).Error; err != nil {
+			log.Printf("Error saving agent update: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result["status"], result["update_id"] = agentUpdatePending, update.UpdateID
+		updates = append(updates, update)
+		byID[client.ID] = client
+	}
+
+	platforms := make([]string, 0, len(contents))
+	var payload []byte
+	for platform, content := range contents {
+		if content != nil {
+			platforms = append(platforms, platform.String())
+			payload = content
+		}
+	}
+	if len(platforms) == 0 && len(contents) > 0 {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	sort.Strings(platforms)
+	auditDetail(r, "version=%s target=%s mode=%s platforms=%s", version, target, mode, strings.Join(platforms, ","))
+	auditClients(r, targets)
+	if len(platforms) == 1 {
+		auditPayload(r, payload) // Several builds have no single hash
+	}
+
+	log.Printf("📦 Update auf %s an %d Clients (%s), %d übersprungen", version, len(updates), target, len(targets)-len(updates))
+	go runAgentUpdates(updates, byID, contents, urlTemplate)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": version,
+		"target":  target,
+		"sent":    len(updates),
+		"skipped": len(targets) - len(updates),
+		"results": results,
+	})
+}
+
+// agentUpdatesHandler lists recent agent updates, optionally of one client
+// or one update.
+func agentUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	query := db.Order("id desc").Limit(100)
+	if clientID := r.FormValue("client_id"); clientID != "" {
+		query = query.Where("client_id = ?", clientID)
+	}
+	if updateID := r.FormValue("id"); updateID != "" {
+		query = query.Where("update_id = ?", updateID)
+	}
+	var updates []AgentUpdate
+	if err := query.Find(&updates).Error; err != nil {
+		log.Printf("Error loading agent updates: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(updates)
+}
+
+// agentDownloadHandler serves a client build on the WebSocket port, where
+// clients pass the same TLS checks as for /ws. The build is signed, the
+// client verifies it before installing.
+func agentDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	version := r.FormValue("version")
+	if !protocol.ValidAgentVersion(version) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	platform := agentPlatform{OS: r.FormValue("os"), Arch: r.FormValue("arch")}
+	if platform.OS == "" && platform.Arch == "" {
+		platform = defaultPlatform // URL templates without {os} and {arch}
+	}
+	if !protocol.ValidPlatform(platform.OS, platform.Arch) {
+		http.Error(w, "Invalid platform", http.StatusBadRequest)
+		return
+	}
+	path := agentBuildPath(version, platform)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("📥 Build %s (%s) wird von %s heruntergeladen", version, platform, sourceIP(r))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, path)
+}
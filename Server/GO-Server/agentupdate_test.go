@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAgentBuildNames(t *testing.T) {
+	tests := []struct {
+		version  string
+		platform agentPlatform
+		name     string
+	}{
+		{"1.2.0", agentPlatform{OS: "windows", Arch: "amd64"}, "websock-client-1.2.0-windows-amd64.exe"},
+		{"1.2.0", agentPlatform{OS: "linux", Arch: "arm64"}, "websock-client-1.2.0-linux-arm64"},
+		{"2.0.0-rc1", agentPlatform{OS: "linux", Arch: "amd64"}, "websock-client-2.0.0-rc1-linux-amd64"},
+	}
+	for _, tt := range tests {
+		if got := filepath.Base(agentBuildPath(tt.version, tt.platform)); got != tt.name {
+			t.Errorf("agentBuildPath(%q, %s) = %s, want %s", tt.version, tt.platform, got, tt.name)
+		}
+		version, platform, ok := parseAgentBuildName(tt.name)
+		if !ok || version != tt.version || platform != tt.platform {
+			t.Errorf("parseAgentBuildName(%q) = %q, %s, %v", tt.name, version, platform, ok)
+		}
+	}
+
+	for _, name := range []string{
+		"websock-client-1.2.0.exe",             // Builds before platform names
+		"websock-client-1.2.0-linux-amd64.exe", // .exe only for Windows
+		"websock-client-1.2.0-windows-amd64",   // Windows build without .exe
+		"websock-client-1.2.0-Linux-amd64",     // GOOS is lower case
+		"other-1.2.0-linux-amd64",
+	} {
+		if _, _, ok := parseAgentBuildName(name); ok {
+			t.Errorf("parseAgentBuildName(%q) accepted", name)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Audit outcomes.
+const (
+	auditSuccess = "success"
+	auditPartial = "partial"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+// AuditEntry records one operator action. Entries are only ever inserted.
+type AuditEntry struct {
+	ID            uint      `gorm:"primary_key"`
+	CreatedAt     time.Time `gorm:"column:created_at;index"`
+	Actor         string    `gorm:"column:actor;size:255;index"`
+	SourceIP      string    `gorm:"column:source_ip;size:64"`
+	Action        string    `gorm:"column:action;size:100;index"`
+	Targets       string    `gorm:"column:targets;type:text"`
+	PayloadSHA256 string    `gorm:"column:payload_sha256;size:64"`
+	Outcome       string    `gorm:"column:outcome;size:50"`
+	StatusCode    int       `gorm:"column:status_code"`
+	Detail        string    `gorm:"column:detail;size:1024"`
+}
+
+// BeforeUpdate keeps the audit trail append-only.
+func (AuditEntry) BeforeUpdate() error {
+	return fmt.Errorf("audit entries cannot be modified")
+}
+
+// BeforeDelete keeps the audit trail append-only.
+func (AuditEntry) BeforeDelete() error {
+	return fmt.Errorf("audit entries cannot be deleted")
+}
+
+// auditRecord collects what a handler reports about the action it performed.
+type auditRecord struct {
+	actor   string
+	targets []string
+	payload string
+	detail  string
+}
+
+type auditContextKey struct{}
+
+func auditFromRequest(r *http.Request) *auditRecord {
+	record, _ := r.Context().Value(auditContextKey{}).(*auditRecord)
+	return record
+}
+
+// auditTargets records the client IDs (or other objects) an action affected.
+func auditTargets(r *http.Request, targets ...string) {
+	if record := auditFromRequest(r); record != nil {
+		record.targets = append(record.targets, targets...)
+	}
+}
+
+// auditClients records the clients an action was sent to.
+func auditClients(r *http.Request, targets []Client) {
+	for _, client := range targets {
+		auditTargets(r, client.ID)
+	}
+}
+
+// auditPayload records the SHA-256 of the message or script that was sent.
+func auditPayload(r *http.Request, payload []byte) {
+	if record := auditFromRequest(r); record != nil {
+		sum := sha256.Sum256(payload)
+		record.payload = hex.EncodeToString(sum[:])
+	}
+}
+
+// auditDetail adds a short description, e.g. the script name.
+func auditDetail(r *http.Request, format string, args ...interface{}) {
+	if record := auditFromRequest(r); record != nil {
+		record.detail = fmt.Sprintf(format, args...)
+	}
+}
+
+// auditActor names the actor of requests without an operator, e.g. a login.
+func auditActor(r *http.Request, actor string) {
+	if record := auditFromRequest(r); record != nil {
+		record.actor = actor
+	}
+}
+
+// sourceIP returns the address of the connecting peer.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Byte limits of the audit columns. UTF-8 never has fewer bytes than
+// UTF-16 code units, so the limits also hold for nvarchar columns.
+const (
+	maxAuditActor   = 255
+	maxAuditSource  = 64
+	maxAuditAction  = 100
+	maxAuditTargets = 32 * 1024
+	maxAuditDetail  = 1024
+)
+
+// truncateAudit shortens s to at most max bytes without splitting a UTF-8
+// character and marks the cut with "…".
+func truncateAudit(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len("…")
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "…"
+}
+
+// joinAuditTargets joins targets up to max bytes and counts the rest, so a
+// send to thousands of clients still fits and shows how many were left out.
+func joinAuditTargets(targets []string, max int) string {
+	joined := strings.Join(targets, ",")
+	if len(joined) <= max {
+		return joined
+	}
+	var b strings.Builder
+	for i, target := range targets {
+		// Leave room for ",…+<count>".
+		if b.Len()+1+len(target)+len(",…+")+10 > max {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "…+%d", len(targets)-i)
+			break
+		}
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(target)
+	}
+	return b.String()
+}
+
+// writeAudit stores an entry; failures are logged but never block the action.
+// Operator-controlled values are truncated so an overlong value cannot make
+// the insert fail and the action go unaudited.
+func writeAudit(entry AuditEntry) {
+	entry.Actor = truncateAudit(entry.Actor, maxAuditActor)
+	entry.SourceIP = truncateAudit(entry.SourceIP, maxAuditSource)
+	entry.Action = truncateAudit(entry.Action, maxAuditAction)
+	entry.Targets = truncateAudit(entry.Targets, maxAuditTargets)
+	entry.Detail = truncateAudit(entry.Detail, maxAuditDetail)
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("❌ Fehler beim Schreiben des Audit-Eintrags %s von %s: %v", entry.Action, entry.Actor, err)
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// audited wraps a mutating handler and writes an audit entry for every
+// request that is not a GET or HEAD. The outcome follows the status code.
+func audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+
+		record := &auditRecord{}
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		outcome := auditSuccess
+		switch {
+		case status == http.StatusPartialContent:
+			outcome = auditPartial
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			outcome = auditDenied
+		case status >= 400:
+			outcome = auditFailure
+		}
+
+		actor := record.actor
+		if user := currentOperator(r); user != nil {
+			actor = user.Username
+		}
+		if actor == "" {
+			actor = "anonymous"
+		}
+		if len(record.targets) == 0 {
+			if clientID := r.FormValue("client_id"); clientID != "" {
+				record.targets = []string{clientID}
+			}
+		}
+
+		writeAudit(AuditEntry{
+			Actor:         actor,
+			SourceIP:      sourceIP(r),
+			Action:        action,
+			Targets:       joinAuditTargets(record.targets, maxAuditTargets),
+			PayloadSHA256: record.payload,
+			Outcome:       outcome,
+			StatusCode:    status,
+			Detail:        record.detail,
+		})
+	}
+}
+
+// csvSafe keeps spreadsheet programs from evaluating a field as a formula.
+func csvSafe(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
+
+// --- HTTP Handlers ---
+
+// auditHandler returns audit entries as JSON or, with format=csv, as CSV.
+// Filters: actor, action, client, outcome, since, until (RFC 3339) and limit.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := formInt(r, "limit", 500, 1, 100000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := db.Order("id desc").Limit(limit)
+	if actor := r.FormValue("actor"); actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if action := r.FormValue("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if outcome := r.FormValue("outcome"); outcome != "" {
+		query = query.Where("outcome = ?", outcome)
+	}
+	if client := r.FormValue("client"); client != "" {
+		query = query.Where("(',' + targets + ',') LIKE ?", "%,"+client+",%")
+	}
+	for _, bound := range []struct{ key, op string }{{"since", ">="}, {"until", "<"}} {
+		value := r.FormValue(bound.key)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s must be an RFC 3339 timestamp", bound.key), http.StatusBadRequest)
+			return
+		}
+		query = query.Where("created_at "+bound.op+" ?", t)
+	}
+
+	var entries []AuditEntry
+	if err := query.Find(&entries).Error; err != nil {
+		log.Printf("Error loading audit entries: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("format") != "csv" {
+		result := make([]map[string]interface{}, 0, len(entries))
+		for _, entry := range entries {
+			result = append(result, map[string]interface{}{
+				"id":             entry.ID,
+				"time":           entry.CreatedAt,
+				"actor":          entry.Actor,
+				"source_ip":      entry.SourceIP,
+				"action":         entry.Action,
+				"targets":        entry.Targets,
+				"payload_sha256": entry.PayloadSHA256,
+				"outcome":        entry.Outcome,
+				"status_code":    entry.StatusCode,
+				"detail":         entry.Detail,
+			})
+		}
+		if r.FormValue("format") == "json" {
+			w.Header().Set("Content-Disposition", `attachment; filename="audit.json"`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "time", "actor", "source_ip", "action", "targets", "payload_sha256", "outcome", "status_code", "detail"})
+	for _, entry := range entries {
+		writer.Write([]string{
+			strconv.FormatUint(uint64(entry.ID), 10),
+			entry.CreatedAt.Format(time.RFC3339),
+			csvSafe(entry.Actor),
+			csvSafe(entry.SourceIP),
+			csvSafe(entry.Action),
+			csvSafe(entry.Targets),
+			entry.PayloadSHA256,
+			entry.Outcome,
+			strconv.Itoa(entry.StatusCode),
+			csvSafe(entry.Detail),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing audit CSV: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateAudit(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"description too long", 10, "descrip…"},
+		{"Größenänderung", 8, "Grö…"},
+		{"ääää", 6, "ä…"},
+	}
+	for _, tt := range tests {
+		got := truncateAudit(tt.in, tt.max)
+		if got != tt.want || len(got) > tt.max || !utf8.ValidString(got) {
+			t.Errorf("truncateAudit(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+
+	long := strings.Repeat("x", 5000)
+	if got := truncateAudit(long, maxAuditDetail); len(got) != maxAuditDetail {
+		t.Errorf("truncateAudit(5000 bytes) has %d bytes, want %d", len(got), maxAuditDetail)
+	}
+}
+
+func TestJoinAuditTargets(t *testing.T) {
+	if got := joinAuditTargets([]string{"a", "b", "c"}, 100); got != "a,b,c" {
+		t.Errorf("joinAuditTargets(short) = %q", got)
+	}
+
+	targets := make([]string, 1000)
+	for i := range targets {
+		targets[i] = "client-0123456789"
+	}
+	got := joinAuditTargets(targets, 200)
+	if len(got) > 200 {
+		t.Errorf("joinAuditTargets() has %d bytes, want at most 200", len(got))
+	}
+	kept := strings.Count(got, "client-")
+	if !strings.HasSuffix(got, ",…+"+strconv.Itoa(1000-kept)) {
+		t.Errorf("joinAuditTargets() = %q, want the number of omitted targets at the end", got)
+	}
+
+	if got := joinAuditTargets([]string{strings.Repeat("y", 300)}, 200); got != "…+1" {
+		t.Errorf("joinAuditTargets(one overlong) = %q", got)
+	}
+}
+
+func TestCSVSafe(t *testing.T) {
+	tests := map[string]string{
+		"":                      "",
+		"admin":                 "admin",
+		"=HYPERLINK(\"x\")":     "'=HYPERLINK(\"x\")",
+		"+1":                    "'+1",
+		"-2+3":                  "'-2+3",
+		"@SUM(A1)":              "'@SUM(A1)",
+		"\t=1":                  "'\t=1",
+		"script=a.ps1 target=x": "script=a.ps1 target=x",
+	}
+	for in, want := range tests {
+		if got := csvSafe(in); got != want {
+			t.Errorf("csvSafe(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,844 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Operator roles, each one includes the rights of the previous ones.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+const sessionCookieName = "ws_session"
+
+// OperatorUser is a person using the web UI or the API. OIDC users are
+// identified by issuer and subject, never by a name the IdP reports, and have
+// no password.
+type OperatorUser struct {
+	BaseModel
+	Username     string `gorm:"column:username;size:255;unique_index"`
+	PasswordHash string `gorm:"column:password_hash;size:255"`      // empty for OIDC users
+	OIDCSubject  string `gorm:"column:oidc_subject;size:512;index"` // issuer + " " + sub, empty for local users
+	Role         string `gorm:"column:role;size:50"`
+	Disabled     bool   `gorm:"column:disabled"`
+}
+
+// OperatorSession is a browser login. Only the SHA-256 of the cookie is stored.
+type OperatorSession struct {
+	BaseModel
+	TokenHash string    `gorm:"column:token_hash;size:64;unique_index"`
+	Username  string    `gorm:"column:username;size:255"`
+	ExpiresAt time.Time `gorm:"column:expires_at"`
+	CSRFToken string    `gorm:"column:csrf_token;size:64"`
+}
+
+// APIToken authenticates scripts and integrations with "Authorization: Bearer".
+type APIToken struct {
+	BaseModel
+	TokenHash  string     `gorm:"column:token_hash;size:64;unique_index"`
+	Name       string     `gorm:"column:name;size:255"`
+	Username   string     `gorm:"column:username;size:255"`
+	ExpiresAt  *time.Time `gorm:"column:expires_at"`
+	RevokedAt  *time.Time `gorm:"column:revoked_at"`
+	LastUsedAt *time.Time `gorm:"column:last_used_at"`
+}
+
+type operatorContextKey struct{}
+
+// roleLevel orders the roles, unknown roles have no rights.
+func roleLevel(role string) int {
+	switch role {
+	case roleViewer:
+		return 1
+	case roleOperator:
+		return 2
+	case roleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// currentOperator returns the authenticated operator of a request.
+func currentOperator(r *http.Request) *OperatorUser {
+	user, _ := r.Context().Value(operatorContextKey{}).(*OperatorUser)
+	return user
+}
+
+// lookupOperator loads an enabled operator by name.
+func lookupOperator(username string) *OperatorUser {
+	var user OperatorUser
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Printf("❌ Fehler beim Laden von Benutzer %s: %v", username, err)
+		}
+		return nil
+	}
+	if user.Disabled {
+		return nil
+	}
+	return &user
+}
+
+// authenticateRequest resolves the operator from an API token or a session
+// cookie. The session is nil for API token requests.
+func authenticateRequest(r *http.Request) (*OperatorUser, *OperatorSession) {
+	now := time.Now()
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		var token APIToken
+		hash := hashToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		if err := db.Where("token_hash = ? AND revoked_at IS NULL", hash).First(&token).Error; err != nil {
+			return nil, nil
+		}
+		if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+			return nil, nil
+		}
+		db.Model(&token).Update("last_used_at", now)
+		return lookupOperator(token.Username), nil
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	var session OperatorSession
+	if err := db.Where("token_hash = ? AND expires_at > ?", hashToken(cookie.Value), now).First(&session).Error; err != nil {
+		return nil, nil
+	}
+	user := lookupOperator(session.Username)
+	if user == nil {
+		return nil, nil
+	}
+	return user, &session
+}
+
+// requireRole wraps a handler so it only runs for operators with at least the
+// given role. Browsers without a session are sent to the login page.
+func requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, session := authenticateRequest(r)
+		if user == nil {
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if roleLevel(user.Role) < roleLevel(role) {
+			log.Printf("🚫 %s (%s) fehlt die Rolle %s für %s", user.Username, user.Role, role, r.URL.Path)
+			writeAudit(AuditEntry{
+				Actor:      user.Username,
+				SourceIP:   sourceIP(r),
+				Action:     r.Method + " " + r.URL.Path,
+				Outcome:    auditDenied,
+				StatusCode: http.StatusForbidden,
+				Detail:     "role " + role + " required",
+			})
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !checkCSRF(r, session) {
+			log.Printf("🚫 CSRF-Prüfung für %s auf %s fehlgeschlagen (Origin: %q)", user.Username, r.URL.Path, r.Header.Get("Origin"))
+			writeAudit(AuditEntry{
+				Actor:      user.Username,
+				SourceIP:   sourceIP(r),
+				Action:     r.Method + " " + r.URL.Path,
+				Outcome:    auditDenied,
+				StatusCode: http.StatusForbidden,
+				Detail:     "CSRF check failed",
+			})
+			http.Error(w, "CSRF token missing or invalid, please reload the page", http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), operatorContextKey{}, user)))
+	}
+}
+
+// requireRoles uses readRole for GET and HEAD requests and writeRole for all
+// other methods, for handlers that both list and modify.
+func requireRoles(readRole, writeRole string, handler http.HandlerFunc) http.HandlerFunc {
+	read := requireRole(readRole, handler)
+	write := requireRole(writeRole, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read(w, r)
+		} else {
+			write(w, r)
+		}
+	}
+}
+
+// ensureAdminUser creates the first admin from ADMIN_USERNAME/ADMIN_PASSWORD
+// while no operator exists yet.
+func ensureAdminUser() {
+	var count int
+	if err := db.Model(&OperatorUser{}).Count(&count).Error; err != nil {
+		log.Printf("❌ Fehler beim Zählen der Benutzer: %v", err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+
+	username := getEnv("ADMIN_USERNAME", "admin")
+	password, err := getSecret("ADMIN_PASSWORD")
+	if err != nil {
+		log.Printf("❌ Admin-Passwort konnte nicht gelesen werden: %v", err)
+		return
+	}
+	if password == "" {
+		log.Println("⚠️ Keine Benutzer vorhanden und kein ADMIN_PASSWORD gesetzt, Anmeldung nur per OIDC möglich")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("❌ Fehler beim Hashen des Admin-Passworts: %v", err)
+		return
+	}
+	if err := db.Create(&OperatorUser{Username: username, PasswordHash: string(hash), Role: roleAdmin}).Error; err != nil {
+		log.Printf("❌ Fehler beim Anlegen des Admin-Benutzers: %v", err)
+		return
+	}
+	log.Printf("👤 Admin-Benutzer %s angelegt", username)
+}
+
+// startSession creates a session for the operator and sets the cookie.
+func startSession(w http.ResponseWriter, r *http.Request, username string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	csrfToken, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	hours := getEnvInt("SESSION_HOURS", 12)
+	session := OperatorSession{
+		TokenHash: hashToken(token),
+		Username:  username,
+		ExpiresAt: time.Now().Add(time.Duration(hours) * time.Hour),
+		CSRFToken: csrfToken,
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	setCSRFCookie(w, r, session)
+	return nil
+}
+
+// safeRedirect only allows local redirect targets after login.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// --- HTTP Handlers ---
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"next": safeRedirect(r.FormValue("next")),
+		"oidc": oidcEnabled(),
+	}
+
+	if r.Method == http.MethodPost {
+		username := strings.TrimSpace(r.FormValue("username"))
+		auditActor(r, username)
+		if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(origin, r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		user := lookupOperator(username)
+		if user != nil && user.PasswordHash != "" &&
+			bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(r.FormValue("password"))) == nil {
+			if err := startSession(w, r, user.Username); err != nil {
+				log.Printf("Error creating session: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("🔓 Anmeldung: %s (%s) von %s", user.Username, user.Role, r.RemoteAddr)
+			http.Redirect(w, r, safeRedirect(r.FormValue("next")), http.StatusFound)
+			return
+		}
+		log.Printf("🚫 Fehlgeschlagene Anmeldung für %q von %s", username, r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		data["error"] = "Benutzername oder Passwort falsch"
+	}
+
+	if err := templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		log.Printf("Error rendering login.html: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if user, _ := authenticateRequest(r); user != nil {
+		auditActor(r, user.Username)
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		db.Where("token_hash = ?", hashToken(cookie.Value)).Delete(&OperatorSession{})
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var users []OperatorUser
+		if err := db.Order("username").Find(&users).Error; err != nil {
+			log.Printf("Error loading users: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]interface{}, 0, len(users))
+		for _, user := range users {
+			result = append(result, map[string]interface{}{
+				"username": user.Username,
+				"role":     user.Role,
+				"disabled": user.Disabled,
+				"local":    user.PasswordHash != "",
+				"oidc":     user.OIDCSubject != "",
+			})
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		username := strings.TrimSpace(r.FormValue("username"))
+		role := r.FormValue("role")
+		if username == "" || roleLevel(role) == 0 {
+			http.Error(w, "Username or valid role (viewer, operator, admin) missing", http.StatusBadRequest)
+			return
+		}
+
+		var user OperatorUser
+		err := db.Where("username = ?", username).First(&user).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			log.Printf("Error loading user %s: %v", username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		auditTargets(r, "user:"+username)
+		auditDetail(r, "role=%s disabled=%s oidc_subject=%s", role, r.FormValue("disabled"), r.FormValue("oidc_subject"))
+		user.Username = username
+		user.Role = role
+		user.Disabled = r.FormValue("disabled") == "true"
+		// OIDC users are pre-provisioned with the sub claim of the IdP and
+		// are never linked to a password account.
+		if subject := strings.TrimSpace(r.FormValue("oidc_subject")); subject != "" {
+			if !oidcEnabled() {
+				http.Error(w, "OIDC is not configured", http.StatusBadRequest)
+				return
+			}
+			if user.PasswordHash != "" || r.FormValue("password") != "" {
+				http.Error(w, "OIDC users cannot have a password", http.StatusBadRequest)
+				return
+			}
+			key := oidcSubjectKey(oidcIssuer(), subject)
+			if other := lookupOIDCUser(key); other != nil && other.Username != username {
+				http.Error(w, "OIDC subject already belongs to user "+other.Username, http.StatusConflict)
+				return
+			}
+			user.OIDCSubject = key
+		}
+		if password := r.FormValue("password"); password != "" {
+			if user.OIDCSubject != "" {
+				http.Error(w, "OIDC users cannot have a password", http.StatusBadRequest)
+				return
+			}
+			if len(password) < 10 {
+				http.Error(w, "Password must have at least 10 characters", http.StatusBadRequest)
+				return
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				log.Printf("Error hashing password: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			user.PasswordHash = string(hash)
+		}
+		if err := db.Save(&user).Error; err != nil {
+			log.Printf("Error saving user %s: %v", username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled {
+			db.Where("username = ?", username).Delete(&OperatorSession{})
+		}
+
+		log.Printf("👤 Benutzer %s gespeichert (Rolle: %s)", username, role)
+		fmt.Fprint(w, `{"status": "success", "message": "Benutzer gespeichert"}`)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.FormValue("username")
+	auditTargets(r, "user:"+username)
+	if username == currentOperator(r).Username {
+		http.Error(w, "You cannot delete yourself", http.StatusBadRequest)
+		return
+	}
+	result := db.Where("username = ?", username).Delete(&OperatorUser{})
+	if result.Error != nil {
+		log.Printf("Error deleting user %s: %v", username, result.Error)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	db.Where("username = ?", username).Delete(&OperatorSession{})
+	db.Model(&APIToken{}).Where("username = ? AND revoked_at IS NULL", username).Update("revoked_at", time.Now())
+
+	log.Printf("🗑️ Benutzer %s gelöscht", username)
+	fmt.Fprint(w, `{"status": "success", "message": "Benutzer gelöscht"}`)
+}
+
+// apiTokensHandler lists and creates API tokens of the current operator.
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentOperator(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		var tokens []APIToken
+		if err := db.Where("username = ?", user.Username).Order("id desc").Find(&tokens).Error; err != nil {
+			log.Printf("Error loading API tokens: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]interface{}, 0, len(tokens))
+		for _, token := range tokens {
+			result = append(result, map[string]interface{}{
+				"id":           token.ID,
+				"name":         token.Name,
+				"created_at":   token.CreatedAt,
+				"expires_at":   token.ExpiresAt,
+				"revoked_at":   token.RevokedAt,
+				"last_used_at": token.LastUsedAt,
+			})
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			http.Error(w, "Token name is required", http.StatusBadRequest)
+			return
+		}
+		validDays, err := formInt(r, "valid_days", 0, 0, 3650)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		secret, err := randomToken(32)
+		if err != nil {
+			log.Printf("Error generating API token: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		auditDetail(r, "name=%s valid_days=%d", name, validDays)
+		token := APIToken{TokenHash: hashToken(secret), Name: name, Username: user.Username}
+		if validDays > 0 {
+			expires := time.Now().AddDate(0, 0, validDays)
+			token.ExpiresAt = &expires
+		}
+		if err := db.Create(&token).Error; err != nil {
+			log.Printf("Error saving API token: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🔑 API-Token %q für %s erstellt", name, user.Username)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":         token.ID,
+			"token":      secret, // Only shown once
+			"expires_at": token.ExpiresAt,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := currentOperator(r)
+	auditTargets(r, "api_token:"+r.FormValue("id"))
+	query := db.Model(&APIToken{}).Where("id = ? AND revoked_at IS NULL", r.FormValue("id"))
+	if user.Role != roleAdmin {
+		query = query.Where("username = ?", user.Username) // Admins may revoke any token
+	}
+	result := query.Update("revoked_at", time.Now())
+	if result.Error != nil {
+		log.Printf("Error revoking API token: %v", result.Error)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, `{"status": "success", "message": "Token widerrufen"}`)
+}
+
+// --- OIDC ---
+
+// oidcProvider holds the endpoints from the issuer's discovery document.
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+var (
+	oidcDiscovery   *oidcProvider
+	oidcDiscoveryMu sync.Mutex
+)
+
+// oidcEnabled reports whether an OIDC provider is configured.
+func oidcEnabled() bool {
+	return getEnv("OIDC_ISSUER", "") != "" && getEnv("OIDC_CLIENT_ID", "") != ""
+}
+
+// oidcIssuer returns OIDC_ISSUER without a trailing slash.
+func oidcIssuer() string {
+	return strings.TrimSuffix(getEnv("OIDC_ISSUER", ""), "/")
+}
+
+// oidcSubjectKey identifies an IdP account. Only issuer and sub are stable
+// and cannot be chosen by the user; names and e-mail addresses can.
+func oidcSubjectKey(issuer, subject string) string {
+	return issuer + " " + subject
+}
+
+// lookupOIDCUser loads the operator bound to an IdP account, including
+// disabled ones.
+func lookupOIDCUser(subjectKey string) *OperatorUser {
+	var user OperatorUser
+	if err := db.Where("oidc_subject = ?", subjectKey).First(&user).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Printf("❌ Fehler beim Laden des OIDC-Benutzers %s: %v", subjectKey, err)
+		}
+		return nil
+	}
+	return &user
+}
+
+// pkceChallenge returns the S256 code challenge of a PKCE verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// idTokenClaims are the ID token claims checked after the code exchange.
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"` // string or array
+	ExpiresAt         int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+}
+
+// parseIDToken decodes the claims of an ID token and checks issuer,
+// audience, expiry and nonce. The token comes directly from the token
+// endpoint over TLS, so its signature is not checked (OIDC Core 3.1.3.7).
+func parseIDToken(token, issuer, clientID, nonce string, now time.Time) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("ID token is malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("ID token is malformed: %v", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("ID token is malformed: %v", err)
+	}
+
+	var audiences []string
+	if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		var audience string
+		if err := json.Unmarshal(claims.Audience, &audience); err != nil {
+			return nil, fmt.Errorf("ID token has no audience")
+		}
+		audiences = []string{audience}
+	}
+	audienceOK := false
+	for _, audience := range audiences {
+		audienceOK = audienceOK || audience == clientID
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != issuer:
+		return nil, fmt.Errorf("ID token issuer %q does not match %q", claims.Issuer, issuer)
+	case !audienceOK:
+		return nil, fmt.Errorf("ID token is not issued for client %q", clientID)
+	case claims.ExpiresAt == 0 || now.Unix() > claims.ExpiresAt:
+		return nil, fmt.Errorf("ID token has expired")
+	case nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// discoverOIDC loads and caches the discovery document of OIDC_ISSUER.
+func discoverOIDC() (*oidcProvider, error) {
+	oidcDiscoveryMu.Lock()
+	defer oidcDiscoveryMu.Unlock()
+	if oidcDiscovery != nil {
+		return oidcDiscovery, nil
+	}
+
+	issuer := oidcIssuer()
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("discovery document of %s is incomplete", issuer)
+	}
+	oidcDiscovery = &provider
+	return oidcDiscovery, nil
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := discoverOIDC()
+	if err != nil {
+		log.Printf("Error loading OIDC discovery: %v", err)
+		http.Error(w, "OIDC provider not reachable", http.StatusBadGateway)
+		return
+	}
+
+	// state protects the callback, nonce binds the ID token to this login
+	// and the PKCE verifier binds the code to this browser.
+	var secrets [3]string
+	for i := range secrets {
+		if secrets[i], err = randomToken(32); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+	http.SetCookie(w, &http.Cookie{
+		Name:     "ws_oidc_state",
+		Value:    strings.Join([]string{state, nonce, verifier, safeRedirect(r.FormValue("next"))}, "|"),
+		Path:     "/auth/oidc/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {getEnv("OIDC_CLIENT_ID", "")},
+		"redirect_uri":          {getEnv("OIDC_REDIRECT_URL", "")},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// oidcCallbackHandler exchanges the code for tokens, checks the ID token and
+// maps issuer and subject to an operator. Unknown subjects get a new
+// "oidc:" user with OIDC_DEFAULT_ROLE; they are never linked to an existing
+// account by name or e-mail.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	cookie, err := r.Cookie("ws_oidc_state")
+	if err != nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(cookie.Value, "|", 4)
+	if len(parts) != 4 || parts[0] == "" || subtle.ConstantTimeCompare([]byte(r.FormValue("state")), []byte(parts[0])) != 1 {
+		http.Error(w, "Invalid OIDC state", http.StatusBadRequest)
+		return
+	}
+	nonce, verifier, next := parts[1], parts[2], parts[3]
+	http.SetCookie(w, &http.Cookie{Name: "ws_oidc_state", Value: "", Path: "/auth/oidc/", MaxAge: -1})
+
+	provider, err := discoverOIDC()
+	if err != nil {
+		log.Printf("Error loading OIDC discovery: %v", err)
+		http.Error(w, "OIDC provider not reachable", http.StatusBadGateway)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	clientSecret, err := getSecret("OIDC_CLIENT_SECRET")
+	if err != nil {
+		log.Printf("Error reading OIDC client secret: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	resp, err := client.PostForm(provider.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.FormValue("code")},
+		"redirect_uri":  {getEnv("OIDC_REDIRECT_URL", "")},
+		"client_id":     {getEnv("OIDC_CLIENT_ID", "")},
+		"client_secret": {clientSecret},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		log.Printf("Error exchanging OIDC code: %v", err)
+		http.Error(w, "OIDC login failed", http.StatusBadGateway)
+		return
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || tokens.AccessToken == "" || tokens.IDToken == "" {
+		log.Printf("Error exchanging OIDC code: status %s, %v", resp.Status, err)
+		http.Error(w, "OIDC login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := parseIDToken(tokens.IDToken, oidcIssuer(), getEnv("OIDC_CLIENT_ID", ""), nonce, time.Now())
+	if err != nil {
+		log.Printf("🚫 OIDC-Anmeldung abgelehnt: %v", err)
+		http.Error(w, "OIDC login failed", http.StatusForbidden)
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, provider.UserinfoEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	resp, err = client.Do(req)
+	if err != nil {
+		log.Printf("Error loading OIDC userinfo: %v", err)
+		http.Error(w, "OIDC login failed", http.StatusBadGateway)
+		return
+	}
+	var userinfo struct {
+		Subject           string `json:"sub"`
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&userinfo)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Error loading OIDC userinfo: status %s, %v", resp.Status, err)
+		http.Error(w, "OIDC login failed", http.StatusBadGateway)
+		return
+	}
+	if userinfo.Subject != claims.Subject {
+		log.Printf("🚫 OIDC-Anmeldung abgelehnt: userinfo sub %q passt nicht zum ID-Token (%q)", userinfo.Subject, claims.Subject)
+		http.Error(w, "OIDC login failed", http.StatusForbidden)
+		return
+	}
+
+	subjectKey := oidcSubjectKey(oidcIssuer(), claims.Subject)
+	user := lookupOIDCUser(subjectKey)
+	if user != nil && user.Disabled {
+		log.Printf("🚫 OIDC-Anmeldung für deaktivierten Benutzer %s abgelehnt", user.Username)
+		http.Error(w, "User is not allowed to log in", http.StatusForbidden)
+		return
+	}
+	if user == nil {
+		// Unknown subjects get OIDC_DEFAULT_ROLE, without it only users
+		// provisioned with their oidc_subject may log in. The name is only
+		// for display and may not collide with any existing user.
+		name := userinfo.PreferredUsername
+		if name == "" {
+			name = userinfo.Email
+		}
+		if name == "" {
+			name = claims.Subject
+		}
+		username := "oidc:" + name
+		role := getEnv("OIDC_DEFAULT_ROLE", "")
+		var existing int
+		db.Model(&OperatorUser{}).Where("LOWER(username) = LOWER(?)", username).Count(&existing)
+		if roleLevel(role) == 0 || existing > 0 {
+			log.Printf("🚫 OIDC-Anmeldung für %s (%s) abgelehnt", username, subjectKey)
+			http.Error(w, "User is not allowed to log in", http.StatusForbidden)
+			return
+		}
+		user = &OperatorUser{Username: username, OIDCSubject: subjectKey, Role: role}
+		if err := db.Create(user).Error; err != nil {
+			log.Printf("Error creating OIDC user %s: %v", username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("👤 OIDC-Benutzer %s angelegt (Rolle: %s)", username, role)
+	}
+
+	if err := startSession(w, r, user.Username); err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("🔓 OIDC-Anmeldung: %s (%s) von %s", user.Username, user.Role, r.RemoteAddr)
+	http.Redirect(w, r, safeRedirect(next), http.StatusFound)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testIDToken builds an unsigned ID token with the given claims.
+func testIDToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+func TestParseIDToken(t *testing.T) {
+	const issuer = "https://login.example.com/realms/ondeso"
+	now := time.Unix(1700000000, 0)
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":                issuer,
+			"sub":                "4f1c-77",
+			"aud":                "ondeso",
+			"exp":                now.Unix() + 60,
+			"nonce":              "n-123",
+			"preferred_username": "admin",
+		}
+	}
+
+	claims, err := parseIDToken(testIDToken(t, valid()), issuer, "ondeso", "n-123", now)
+	if err != nil || claims.Subject != "4f1c-77" {
+		t.Fatalf("parseIDToken(valid) = %+v, %v", claims, err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+		nonce  string
+		ok     bool
+	}{
+		{"audience array", func(c map[string]interface{}) { c["aud"] = []string{"other", "ondeso"} }, "n-123", true},
+		{"issuer with slash", func(c map[string]interface{}) { c["iss"] = issuer + "/" }, "n-123", true},
+		{"wrong nonce", func(map[string]interface{}) {}, "n-456", false},
+		{"empty expected nonce", func(c map[string]interface{}) { c["nonce"] = "" }, "", false},
+		{"missing nonce", func(c map[string]interface{}) { delete(c, "nonce") }, "n-123", false},
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, "n-123", false},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = []string{"other"} }, "n-123", false},
+		{"missing audience", func(c map[string]interface{}) { delete(c, "aud") }, "n-123", false},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Unix() - 1 }, "n-123", false},
+		{"missing expiry", func(c map[string]interface{}) { delete(c, "exp") }, "n-123", false},
+		{"missing subject", func(c map[string]interface{}) { delete(c, "sub") }, "n-123", false},
+	}
+	for _, tt := range tests {
+		claims := valid()
+		tt.change(claims)
+		_, err := parseIDToken(testIDToken(t, claims), issuer, "ondeso", tt.nonce, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: parseIDToken() error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	for _, token := range []string{"", "a.b", "a.!!!.c", "a." + base64.RawURLEncoding.EncodeToString([]byte("[]")) + ".c"} {
+		if _, err := parseIDToken(token, issuer, "ondeso", "n-123", now); err == nil {
+			t.Errorf("parseIDToken(%q) accepted a malformed token", token)
+		}
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636, Appendix B
+	if got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("pkceChallenge() = %q", got)
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
+	"ondeso/protocol"
+)
+
+// binaryChunkSize is the number of base64 characters per upload_binary_chunk
+// message. Binaries are much larger than scripts, so chunks are bigger.
+const binaryChunkSize = 512 * 1024
+
+// binaryExtensions are the files offered by /get_binaries. The client only
+// executes Windows executables.
+var binaryExtensions = map[string]string{
+	".exe": "binary",
+}
+
+// binaryRepo indexes BINARY_DIR, set up in main.
+var binaryRepo *scriptRepository
+
+// newBinaryRepository indexes the binaries below root with the same rules
+// as the script repository.
+func newBinaryRepository(root string) *scriptRepository {
+	return &scriptRepository{root: root, extensions: binaryExtensions}
+}
+
+// Distribution states.
+const (
+	distributionRunning   = "running"
+	distributionCompleted = "completed"
+)
+
+// Delivery states, reported by the client with binary_result.
+const (
+	deliveryPending     = "pending"
+	deliverySent        = "sent"
+	deliveryReceived    = "received"
+	deliveryStarted     = "started"
+	deliveryFinished    = "finished"
+	deliveryFailed      = "failed"
+	deliveryRejected    = "rejected"
+	deliveryUnreachable = "unreachable"
+	deliveryTimeout     = "timeout" // Received or started, but no result in time
+)
+
+// doneDeliveryStates are the states a delivery does not leave any more.
+var doneDeliveryStates = []string{deliveryFinished, deliveryFailed, deliveryRejected, deliveryUnreachable, deliveryTimeout}
+
+// BinaryDistribution is one /send_binary request.
+type BinaryDistribution struct {
+	BaseModel
+	BinaryName string `gorm:"column:binary_name;size:255"`
+	SHA256     string `gorm:"column:sha256;size:64"`
+	TransferID string `gorm:"column:transfer_id;size:64"` // Shared by all deliveries
+	Size       int64  `gorm:"column:size"`
+	Target     string `gorm:"column:target;size:1024"`
+	CreatedBy  string `gorm:"column:created_by;size:255"`
+	Status     string `gorm:"column:status;size:50"`
+}
+
+// BinaryDelivery tracks a distribution on one client.
+type BinaryDelivery struct {
+	BaseModel
+	DistributionID uint       `gorm:"column:distribution_id;index"`
+	ClientID       string     `gorm:"column:client_id;size:255;unique_index:uix_binary_deliveries_transfer_client"`
+	TransferID     string     `gorm:"column:transfer_id;size:64;unique_index:uix_binary_deliveries_transfer_client"`
+	Status         string     `gorm:"column:status;size:50"`
+	ExitCode       *int       `gorm:"column:exit_code"`
+	Error          string     `gorm:"column:error;size:1024"`
+	SentAt         *time.Time `gorm:"column:sent_at"`
+	FinishedAt     *time.Time `gorm:"column:finished_at"`
+}
+
+// deliveryDone reports whether a delivery will not change any more.
+func deliveryDone(status string) bool {
+	for _, done := range doneDeliveryStates {
+		if status == done {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryTimeoutDuration is how long a delivery may go without a status
+// change before it is given up (BINARY_DELIVERY_TIMEOUT_MINUTES).
+func deliveryTimeoutDuration() time.Duration {
+	return time.Duration(getEnvInt("BINARY_DELIVERY_TIMEOUT_MINUTES", 60)) * time.Minute
+}
+
+// binaryHashCache avoids hashing unchanged binaries on every listing.
+var binaryHashCache = struct {
+	sync.Mutex
+	entries map[string]binaryHash
+}{entries: make(map[string]binaryHash)}
+
+type binaryHash struct {
+	modTime time.Time
+	size    int64
+	sha256  string
+}
+
+// binaryInfo returns size and SHA-256 of an indexed binary.
+func binaryInfo(entry scriptEntry) (int64, string, error) {
+	info, err := os.Stat(entry.path)
+	if err != nil {
+		return 0, "", err
+	}
+
+	binaryHashCache.Lock()
+	cached, ok := binaryHashCache.entries[entry.path]
+	binaryHashCache.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.size, cached.sha256, nil
+	}
+
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return 0, "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	binaryHashCache.Lock()
+	binaryHashCache.entries[entry.path] = binaryHash{modTime: info.ModTime(), size: info.Size(), sha256: sum}
+	binaryHashCache.Unlock()
+	return info.Size(), sum, nil
+}
+
+// setDeliveryState updates a delivery and completes its distribution once
+// every delivery is done.
+func setDeliveryState(delivery BinaryDelivery, status string, updates map[string]interface{}) {
+	if updates == nil {
+		updates = make(map[string]interface{})
+	}
+	updates["status"] = status
+	if deliveryDone(status) {
+		updates["finished_at"] = time.Now()
+	}
+	if err := db.Model(&delivery).Updates(updates).Error; err != nil {
+		log.Printf("❌ Fehler beim Aktualisieren der Auslieferung %s: %v", delivery.TransferID, err)
+		return
+	}
+	if !deliveryDone(status) {
+		return
+	}
+
+	var open int
+	db.Model(&BinaryDelivery{}).
+		Where("distribution_id = ? AND status NOT IN (?)", delivery.DistributionID, doneDeliveryStates).
+		Count(&open)
+	if open == 0 {
+		db.Model(&BinaryDistribution{}).Where("id = ?", delivery.DistributionID).Update("status", distributionCompleted)
+		log.Printf("✅ Verteilung %d abgeschlossen", delivery.DistributionID)
+	}
+}
+
+// binaryTransfer is a binary prepared once for all deliveries of a
+// distribution. The deliveries share the transfer ID, so the JSON chunks and
+// the frames are built on first use and reused for every client.
+type binaryTransfer struct {
+	name       string
+	transferID string
+	content    []byte
+	signature  payloadSignature
+	chunks     [][]byte // upload_binary_chunk messages
+	frames     *sharedFrameTransfer
+}
+
+// newBinaryTransfer prepares a binary for the transfer transferID.
+func newBinaryTransfer(binaryName, transferID string, content []byte) *binaryTransfer {
+	transfer := &binaryTransfer{
+		name:       binaryName,
+		transferID: transferID,
+		content:    content,
+		signature:  signPayload(content, binaryName, "binary"),
+	}
+	if transferUUID, err := uuid.Parse(transferID); err == nil {
+		start := protocol.TransferStart{Kind: protocol.KindBinary, BinaryName: binaryName, PayloadSignature: transfer.signature.message()}
+		transfer.frames = newSharedFrameTransfer(transferUUID, start, content)
+	}
+	return transfer
+}
+
+// jsonChunks returns the upload_binary_chunk messages, encoding them on
+// first use.
+func (t *binaryTransfer) jsonChunks() ([][]byte, error) {
+	if t.chunks != nil {
+		return t.chunks, nil
+	}
+	encoded := base64.StdEncoding.EncodeToString(t.content)
+	totalChunks := (len(encoded) + binaryChunkSize - 1) / binaryChunkSize
+
+	chunks := make([][]byte, totalChunks)
+	for i := 0; i < totalChunks; i++ {
+		start := i * binaryChunkSize
+		end := start + binaryChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+
+		chunk, err := protocol.Encode(&protocol.BinaryChunk{
+			BinaryName:  t.name,
+			BinaryChunk: encoded[start:end],
+			ChunkInfo: protocol.ChunkInfo{
+				ChunkIndex:  i,
+				TotalChunks: totalChunks,
+				TransferID:  t.transferID,
+				ChunkSHA256: chunkSHA256(encoded[start:end]),
+			},
+			PayloadSignature: t.signature.message(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = chunk
+	}
+	t.chunks = chunks
+	return chunks, nil
+}
+
+// sendBinaryChunks sends a binary as signed upload_binary_chunk messages or
+// frames. clientsMutex is only held for the lookup; writes are serialized per
+// connection, so other messages are not blocked for the whole transfer.
+func sendBinaryChunks(clientID string, transfer *binaryTransfer) error {
+	client, ok := connectedClient(clientID)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	if !client.supports(protocol.CapBinaries) {
+		return fmt.Errorf("binaries: %w", errNotSupported)
+	}
+	if client.supports(protocol.CapBinaryFrames) && transfer.frames != nil {
+		frames, err := transfer.frames.get(client.compression())
+		if err != nil {
+			return err
+		}
+		return sendFrameTransfer(client.Conn.WriteMessage, clientID, transfer.frames.transferID, transfer.name, frames)
+	}
+
+	chunks, err := transfer.jsonChunks()
+	if err != nil {
+		return err
+	}
+	if client.supports(protocol.CapTransferResume) {
+		registerTransfer(transfer.transferID, clientID, transfer.name, chunks, false, transfer.signature.ExpiresAt)
+	}
+
+	for _, chunkJSON := range chunks {
+		if err := client.Conn.WriteMessage(websocket.TextMessage, chunkJSON); err != nil {
+			return err
+		}
+	}
+	log.Printf("📤 Binärdatei %s in %d Chunks an %s gesendet", transfer.name, len(chunks), clientID)
+	return nil
+}
+
+// runDistribution sends a binary to every delivery of a distribution.
+func runDistribution(distribution BinaryDistribution, deliveries []BinaryDelivery, content []byte) {
+	transfer := newBinaryTransfer(distribution.BinaryName, distribution.TransferID, content)
+	for _, delivery := range deliveries {
+		// Long distributions may outlast the delivery timeout.
+		var current BinaryDelivery
+		if db.First(&current, delivery.ID).Error == nil && deliveryDone(current.Status) {
+			continue
+		}
+		if err := sendBinaryChunks(delivery.ClientID, transfer); err != nil {
+			log.Printf("❌ Binärdatei %s an %s fehlgeschlagen: %v", distribution.BinaryName, delivery.ClientID, err)
+			state := deliveryUnreachable
+			if errors.Is(err, errNotSupported) {
+				state = deliveryRejected
+			}
+			setDeliveryState(delivery, state, map[string]interface{}{"error": err.Error()})
+			continue
+		}
+		// The client may already have reported back, so only move on from pending.
+		db.Model(&BinaryDelivery{}).Where("id = ?", delivery.ID).Update("sent_at", time.Now())
+		db.Model(&BinaryDelivery{}).Where("id = ? AND status = ?", delivery.ID, deliveryPending).Update("status", deliverySent)
+	}
+}
+
+// expireDeliveries gives up deliveries without a status change for
+// BINARY_DELIVERY_TIMEOUT_MINUTES, e.g. because the client disconnected or
+// the server restarted during the distribution. Deliveries that never reached
+// the client become unreachable, the others time out; the distribution
+// completes once all are done.
+func expireDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var deliveries []BinaryDelivery
+			cutoff := time.Now().Add(-deliveryTimeoutDuration())
+			if err := db.Where("status NOT IN (?) AND updated_at < ?", doneDeliveryStates, cutoff).Find(&deliveries).Error; err != nil {
+				log.Printf("❌ Fehler beim Laden offener Auslieferungen: %v", err)
+				continue
+			}
+			for _, delivery := range deliveries {
+				state := deliveryTimeout
+				if delivery.Status == deliveryPending || delivery.Status == deliverySent {
+					state = deliveryUnreachable
+				}
+				log.Printf("⌛ Auslieferung %s an %s seit %v ohne Rückmeldung (%s), jetzt %s", delivery.TransferID, delivery.ClientID, deliveryTimeoutDuration(), delivery.Status, state)
+				setDeliveryState(delivery, state, map[string]interface{}{"error": "no status from client within " + deliveryTimeoutDuration().String()})
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recordBinaryResult stores a binary_result message of a client.
+func recordBinaryResult(clientID string, result *protocol.BinaryResult) {
+	transferID, status := result.TransferID, result.Status
+	log.Printf("📦 Binär-Status von %s: %s (%s) %s", clientID, transferID, status, result.Error)
+	if transferID == "" {
+		return
+	}
+
+	switch status {
+	case deliveryReceived, deliveryStarted, deliveryFinished, deliveryFailed, deliveryRejected:
+	default:
+		log.Printf("⚠️ Unbekannter Binär-Status %q von %s", status, clientID)
+		return
+	}
+
+	var delivery BinaryDelivery
+	if err := db.Where("transfer_id = ? AND client_id = ?", transferID, clientID).First(&delivery).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Printf("❌ Fehler beim Laden der Auslieferung %s: %v", transferID, err)
+		}
+		return
+	}
+
+	updates := map[string]interface{}{"error": result.Error}
+	if result.ExitCode != nil {
+		updates["exit_code"] = *result.ExitCode
+	}
+	setDeliveryState(delivery, status, updates)
+}
+
+// --- HTTP Handlers ---
+
+func getBinariesHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := binaryRepo.list()
+	if os.IsNotExist(err) {
+		http.Error(w, "Binary directory not found", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("Error walking the binary directory: %v", err)
+		http.Error(w, "Error retrieving binaries", http.StatusInternalServerError)
+		return
+	}
+
+	binaries := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		size, sum, err := binaryInfo(entry)
+		if err != nil {
+			log.Printf("Error hashing binary %s: %v", entry.Name, err)
+			continue
+		}
+		binaries = append(binaries, map[string]interface{}{"name": entry.Name, "size": size, "sha256": sum})
+	}
+	json.NewEncoder(w).Encode(binaries)
+}
+
+func sendBinaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.FormValue("client_id")
+	target := r.FormValue("target")
+	binaryName := r.FormValue("binary_name")
+	if (clientID == "" && target == "") || binaryName == "" {
+		http.Error(w, "Client-ID or target, and binary name missing", http.StatusBadRequest)
+		return
+	}
+	if clientID != "" {
+		target = "client:" + clientID
+	}
+
+	entry, content, err := binaryRepo.read(binaryName)
+	if err == errScriptNotFound {
+		http.Error(w, "Binary not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading binary: %v", err)
+		http.Error(w, "Error reading binary", http.StatusInternalServerError)
+		return
+	}
+
+	targets, err := resolveTarget(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(targets) == 0 {
+		http.Error(w, "No connected client matches the target", http.StatusNotFound)
+		return
+	}
+	auditClients(r, targets)
+	auditPayload(r, content)
+	auditDetail(r, "binary=%s target=%s", entry.Name, target)
+
+	sum := sha256.Sum256(content)
+	distribution := BinaryDistribution{
+		BinaryName: entry.Name,
+		SHA256:     hex.EncodeToString(sum[:]),
+		Size:       int64(len(content)),
+		TransferID: uuid.New().String(),
+		Target:     target,
+		Status:     distributionRunning,
+	}
+	if user := currentOperator(r); user != nil {
+		distribution.CreatedBy = user.Username
+	}
+
+	tx := db.Begin()
+	if err := tx.Create(&distribution).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error saving distribution: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	deliveries := make([]BinaryDelivery, 0, len(targets))
+	for _, client := range targets {
+		delivery := BinaryDelivery{
+			DistributionID: distribution.ID,
+			ClientID:       client.ID,
+			TransferID:     distribution.TransferID,
+			Status:         deliveryPending,
+		}
+		if err := tx.Create(&delivery).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error saving delivery: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error saving distribution: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📦 Verteilung %d: %s an %d Clients (%s)", distribution.ID, entry.Name, len(deliveries), target)
+	go runDistribution(distribution, deliveries, content)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":          "success",
+		"message":         fmt.Sprintf("Binärdatei wird an %d Clients gesendet", len(deliveries)),
+		"distribution_id": distribution.ID,
+	})
+}
+
+// binaryDistributionsHandler lists recent distributions or, with id, the
+// deliveries of one distribution.
+func binaryDistributionsHandler(w http.ResponseWriter, r *http.Request) {
+	if idValue := r.FormValue("id"); idValue != "" {
+		id, err := strconv.Atoi(idValue)
+		if err != nil {
+			http.Error(w, "Invalid distribution ID", http.StatusBadRequest)
+			return
+		}
+		var distribution BinaryDistribution
+		if err := db.First(&distribution, id).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				http.Error(w, "Distribution not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error loading distribution %d: %v", id, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		var deliveries []BinaryDelivery
+		if err := db.Where("distribution_id = ?", id).Order("id").Find(&deliveries).Error; err != nil {
+			log.Printf("Error loading deliveries of %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		items := make([]map[string]interface{}, 0, len(deliveries))
+		for _, delivery := range deliveries {
+			items = append(items, map[string]interface{}{
+				"client_id":   delivery.ClientID,
+				"transfer_id": delivery.TransferID,
+				"status":      delivery.Status,
+				"exit_code":   delivery.ExitCode,
+				"error":       delivery.Error,
+				"sent_at":     delivery.SentAt,
+				"finished_at": delivery.FinishedAt,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":          distribution.ID,
+			"binary_name": distribution.BinaryName,
+			"sha256":      distribution.SHA256,
+			"size":        distribution.Size,
+			"target":      distribution.Target,
+			"created_by":  distribution.CreatedBy,
+			"created_at":  distribution.CreatedAt,
+			"status":      distribution.Status,
+			"deliveries":  items,
+		})
+		return
+	}
+
+	var distributions []BinaryDistribution
+	if err := db.Order("id desc").Limit(100).Find(&distributions).Error; err != nil {
+		log.Printf("Error loading distributions: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	result := make([]map[string]interface{}, 0, len(distributions))
+	for _, distribution := range distributions {
+		result = append(result, map[string]interface{}{
+			"id":          distribution.ID,
+			"binary_name": distribution.BinaryName,
+			"target":      distribution.Target,
+			"created_by":  distribution.CreatedBy,
+			"created_at":  distribution.CreatedAt,
+			"status":      distribution.Status,
+		})
+	}
+	json.NewEncoder(w).Encode(result)
+}
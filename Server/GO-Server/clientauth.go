@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
+	"ondeso/protocol"
+)
+
+// EnrollmentToken is a one-time token that lets a new client obtain its
+// secret. Only the SHA-256 of the token is stored.
+type EnrollmentToken struct {
+	BaseModel
+	TokenHash   string     `gorm:"column:token_hash;size:64;unique_index"`
+	Description string     `gorm:"column:description;size:1024"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at"`
+	UsedAt      *time.Time `gorm:"column:used_at"`
+	UsedBy      string     `gorm:"column:used_by;size:255"`
+}
+
+// ClientCredential holds the per-client secret issued at enrollment.
+type ClientCredential struct {
+	BaseModel
+	ClientID  string     `gorm:"column:client_id;size:255;unique_index"`
+	Secret    string     `gorm:"column:secret;size:255"`
+	RevokedAt *time.Time `gorm:"column:revoked_at"`
+}
+
+// clientAuthRequired reports whether clients without credentials are rejected.
+// It is on by default; see migrationAllows for registering clients that
+// cannot enroll yet.
+func clientAuthRequired() bool {
+	return getEnv("CLIENT_AUTH_REQUIRED", "true") != "false"
+}
+
+// migrationAllows reports whether a client without credential may register
+// while clients are moved to enrollment. It takes CLIENT_AUTH_REQUIRED=false
+// and either the client ID in CLIENT_AUTH_MIGRATION_CLIENTS (comma-separated)
+// or a CLIENT_AUTH_MIGRATION_UNTIL (RFC 3339) that has not passed yet. The
+// returned reason names the setting that admitted the client.
+func migrationAllows(clientID string, now time.Time) (bool, string) {
+	if clientAuthRequired() {
+		return false, ""
+	}
+	for _, allowed := range strings.Split(getEnv("CLIENT_AUTH_MIGRATION_CLIENTS", ""), ",") {
+		if strings.TrimSpace(allowed) == clientID {
+			return true, "CLIENT_AUTH_MIGRATION_CLIENTS"
+		}
+	}
+	if until, err := time.Parse(time.RFC3339, getEnv("CLIENT_AUTH_MIGRATION_UNTIL", "")); err == nil && now.Before(until) {
+		return true, "CLIENT_AUTH_MIGRATION_UNTIL " + until.Format(time.RFC3339)
+	}
+	return false, ""
+}
+
+// checkClientAuthSettings logs how clients without credentials are treated.
+func checkClientAuthSettings() {
+	if clientAuthRequired() {
+		return
+	}
+	until := getEnv("CLIENT_AUTH_MIGRATION_UNTIL", "")
+	if until != "" {
+		if _, err := time.Parse(time.RFC3339, until); err != nil {
+			log.Printf("⚠️ CLIENT_AUTH_MIGRATION_UNTIL ist ungültig (%v) und wird ignoriert", err)
+		}
+	}
+	if until == "" && getEnv("CLIENT_AUTH_MIGRATION_CLIENTS", "") == "" {
+		log.Println("⚠️ CLIENT_AUTH_REQUIRED=false ohne CLIENT_AUTH_MIGRATION_UNTIL oder CLIENT_AUTH_MIGRATION_CLIENTS, Clients ohne Enrollment werden weiterhin abgelehnt")
+		return
+	}
+	log.Println("⚠️ Migration aktiv: ausgewählte Clients ohne Enrollment werden zugelassen")
+}
+
+// randomToken returns n random bytes encoded as URL-safe base64.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex encoded SHA-256 of a token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// redeemEnrollmentToken marks a token as used and issues a new secret for the
+// client, replacing a revoked credential if there is one.
+func redeemEnrollmentToken(token, clientID string) (string, error) {
+	now := time.Now()
+	result := db.Model(&EnrollmentToken{}).
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), now).
+		Updates(map[string]interface{}{"used_at": now, "used_by": clientID})
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected != 1 {
+		return "", fmt.Errorf("enrollment token invalid, expired or already used")
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	var credential ClientCredential
+	err = db.Where("client_id = ?", clientID).First(&credential).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return "", err
+	}
+	credential.ClientID = clientID
+	credential.Secret = secret
+	credential.RevokedAt = nil
+	if err := db.Save(&credential).Error; err != nil {
+		return "", err
+	}
+
+	log.Printf("🔑 Client %s mit Enrollment-Token registriert", clientID)
+	return secret, nil
+}
+
+// authenticateClient checks that a registering client may use its client ID.
+// Enrolled clients answer an HMAC challenge with their secret; new clients
+// present an enrollment token and receive their secret in the registration
+// response. It returns the newly issued secret, if any.
+func authenticateClient(conn *clientConn, clientID string, register *protocol.Register) (string, error) {
+	var credential ClientCredential
+	err := db.Where("client_id = ?", clientID).First(&credential).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return verifyClient(conn, clientID, register, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	return verifyClient(conn, clientID, register, &credential)
+}
+
+// verifyClient does the work of authenticateClient with the stored
+// credential of the client, nil if it has none.
+func verifyClient(conn *clientConn, clientID string, register *protocol.Register, credential *ClientCredential) (string, error) {
+	if credential == nil || credential.RevokedAt != nil {
+		if register.EnrollmentToken != "" {
+			return redeemEnrollmentToken(register.EnrollmentToken, clientID)
+		}
+		if credential != nil {
+			return "", fmt.Errorf("credential of client %s has been revoked", clientID)
+		}
+		if allowed, reason := migrationAllows(clientID, time.Now()); allowed {
+			log.Printf("⚠️ Client %s ohne Anmeldedaten zugelassen (%s)", clientID, reason)
+			return "", nil
+		}
+		return "", fmt.Errorf("client %s is not enrolled", clientID)
+	}
+
+	nonce, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	challenge, _ := protocol.EncodeResponse(protocol.Response{Status: protocol.StatusChallenge, Nonce: nonce})
+	if err := conn.WriteMessage(websocket.TextMessage, challenge); err != nil {
+		return "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	_, message, err := conn.ReadMessage()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return "", err
+	}
+
+	answer, err := protocol.Decode(message)
+	if err != nil {
+		return "", fmt.Errorf("invalid challenge response: %v", err)
+	}
+	authenticate, ok := answer.(*protocol.Authenticate)
+	expected := protocol.ClientProof(credential.Secret, nonce, clientID)
+	if !ok || !hmac.Equal([]byte(authenticate.Proof), []byte(expected)) {
+		return "", fmt.Errorf("challenge response of client %s is invalid", clientID)
+	}
+	return "", nil
+}
+
+// --- HTTP Handlers ---
+
+func enrollmentTokensHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var tokens []EnrollmentToken
+		if err := db.Order("id desc").Find(&tokens).Error; err != nil {
+			log.Printf("Error loading enrollment tokens: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]interface{}, 0, len(tokens))
+		for _, token := range tokens {
+			result = append(result, map[string]interface{}{
+				"id":          token.ID,
+				"description": token.Description,
+				"created_at":  token.CreatedAt,
+				"expires_at":  token.ExpiresAt,
+				"used_at":     token.UsedAt,
+				"used_by":     token.UsedBy,
+			})
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		validHours, err := formInt(r, "valid_hours", 24, 1, 24*90)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, err := randomToken(24)
+		if err != nil {
+			log.Printf("Error generating enrollment token: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		auditDetail(r, "description=%s valid_hours=%d", r.FormValue("description"), validHours)
+		entry := EnrollmentToken{
+			TokenHash:   hashToken(token),
+			Description: r.FormValue("description"),
+			ExpiresAt:   time.Now().Add(time.Duration(validHours) * time.Hour),
+		}
+		if err := db.Create(&entry).Error; err != nil {
+			log.Printf("Error saving enrollment token: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🎟️ Enrollment-Token %d erstellt (gültig bis %s)", entry.ID, entry.ExpiresAt.Format(time.RFC3339))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":         entry.ID,
+			"token":      token, // Only shown once
+			"expires_at": entry.ExpiresAt,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func revokeClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := strings.TrimSpace(r.FormValue("client_id"))
+	if clientID == "" {
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	result := db.Model(&ClientCredential{}).Where("client_id = ? AND revoked_at IS NULL", clientID).Update("revoked_at", now)
+	if result.Error != nil {
+		log.Printf("Error revoking client %s: %v", clientID, result.Error)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "No active credential for client", http.StatusNotFound)
+		return
+	}
+
+	// Drop the live connection, the client has to re-enroll.
+	clientsMutex.Lock()
+	if client, ok := clients[clientID]; ok {
+		if client.Conn != nil {
+			client.Conn.Close()
+		}
+		delete(clients, clientID)
+	}
+	clientsMutex.Unlock()
+
+	log.Printf("🚫 Anmeldedaten von Client %s widerrufen", clientID)
+	fmt.Fprint(w, `{"status": "success", "message": "Client widerrufen"}`)
+}
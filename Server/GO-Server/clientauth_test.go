@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ondeso/protocol"
+)
+
+const testClientID = "2f1c9a4e-5b7d-4c1a-9e3f-8a6b0d2c4e1f"
+
+// authResult is the outcome of verifyClient on the server side.
+type authResult struct {
+	secret string
+	err    error
+}
+
+// runVerifyClient connects a test client to a server running verifyClient
+// with credential. answer computes the proof from the challenge nonce; it is
+// not called if the server sends no challenge.
+func runVerifyClient(t *testing.T, credential *ClientCredential, answer func(nonce string) string) (authResult, string) {
+	t.Helper()
+	results := make(chan authResult, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			results <- authResult{err: err}
+			return
+		}
+		defer wsConn.Close()
+		secret, err := verifyClient(&clientConn{Conn: wsConn}, testClientID, &protocol.Register{ClientID: testClientID}, credential)
+		results <- authResult{secret, err}
+	}))
+	defer server.Close()
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsConn.Close()
+
+	var nonce string
+	wsConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, message, err := wsConn.ReadMessage(); err == nil {
+		response, err := protocol.DecodeResponse(message)
+		if err != nil || response.Status != protocol.StatusChallenge {
+			t.Fatalf("got %s (%v), want a challenge", message, err)
+		}
+		nonce = response.Nonce
+		reply, _ := protocol.Encode(&protocol.Authenticate{Proof: answer(nonce)})
+		if err := wsConn.WriteMessage(websocket.TextMessage, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case result := <-results:
+		return result, nonce
+	case <-time.After(5 * time.Second):
+		t.Fatal("verifyClient did not return")
+		return authResult{}, ""
+	}
+}
+
+func TestVerifyClientChallenge(t *testing.T) {
+	credential := &ClientCredential{ClientID: testClientID, Secret: "s3cr3t-client-secret"}
+
+	var proof string
+	result, nonce := runVerifyClient(t, credential, func(nonce string) string {
+		proof = protocol.ClientProof(credential.Secret, nonce, testClientID)
+		return proof
+	})
+	if result.err != nil || nonce == "" {
+		t.Fatalf("valid proof: error %v, nonce %q", result.err, nonce)
+	}
+
+	result, _ = runVerifyClient(t, credential, func(nonce string) string {
+		return protocol.ClientProof("wrong-secret", nonce, testClientID)
+	})
+	if result.err == nil {
+		t.Error("wrong proof was accepted")
+	}
+
+	result, replayNonce := runVerifyClient(t, credential, func(string) string { return proof })
+	if result.err == nil || replayNonce == nonce {
+		t.Errorf("replayed proof: error %v, nonce reused %v", result.err, replayNonce == nonce)
+	}
+}
+
+func TestVerifyClientWithoutCredential(t *testing.T) {
+	revokedAt := time.Now()
+	revoked := &ClientCredential{ClientID: testClientID, Secret: "s3cr3t-client-secret", RevokedAt: &revokedAt}
+	noChallenge := func(string) string {
+		t.Error("client without valid credential was challenged")
+		return ""
+	}
+
+	if result, _ := runVerifyClient(t, revoked, noChallenge); result.err == nil {
+		t.Error("revoked credential was accepted")
+	}
+	if result, _ := runVerifyClient(t, nil, noChallenge); result.err == nil {
+		t.Error("client without credential was accepted by default")
+	}
+
+	t.Setenv("CLIENT_AUTH_REQUIRED", "false")
+	t.Setenv("CLIENT_AUTH_MIGRATION_CLIENTS", "other-client, "+testClientID)
+	if result, _ := runVerifyClient(t, nil, noChallenge); result.err != nil {
+		t.Errorf("allowlisted client without credential: %v", result.err)
+	}
+	if result, _ := runVerifyClient(t, revoked, noChallenge); result.err == nil {
+		t.Error("revoked credential was accepted during the migration")
+	}
+}
+
+func TestMigrationAllows(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		required, until, clients string
+		want                     bool
+	}{
+		{"", "", "", false},
+		{"true", "2026-12-31T00:00:00Z", testClientID, false},
+		{"false", "", "", false},
+		{"false", "2026-12-31T00:00:00Z", "", true},
+		{"false", "2026-10-19T11:59:59Z", "", false},
+		{"false", "2026-12-31", "", false},
+		{"false", "", "a," + testClientID + ",b", true},
+		{"false", "", "a,b", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("CLIENT_AUTH_REQUIRED", tt.required)
+		t.Setenv("CLIENT_AUTH_MIGRATION_UNTIL", tt.until)
+		t.Setenv("CLIENT_AUTH_MIGRATION_CLIENTS", tt.clients)
+		if got, _ := migrationAllows(testClientID, now); got != tt.want {
+			t.Errorf("migrationAllows(required=%q, until=%q, clients=%q) = %v, want %v", tt.required, tt.until, tt.clients, got, tt.want)
+		}
+	}
+}
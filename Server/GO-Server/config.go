@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"ondeso/protocol"
+)
+
+// Config change states, see also protocol.ConfigApplied and friends.
+const configPending = "pending"
+
+// ConfigProfile is a named set of client settings that /config/apply sends
+// to many clients at once. Settings is a JSON object of protocol.ConfigKeys.
+type ConfigProfile struct {
+	BaseModel
+	Name        string `gorm:"column:name;size:255;unique_index"`
+	Description string `gorm:"column:description;size:1024"`
+	Settings    string `gorm:"column:settings;type:text"`
+	UpdatedBy   string `gorm:"column:updated_by;size:255"`
+}
+
+// ConfigChange is one set_config sent to a client and its result.
+type ConfigChange struct {
+	BaseModel
+	RequestID   string     `gorm:"column:request_id;size:64;unique_index"`
+	ClientID    string     `gorm:"column:client_id;size:255;index"`
+	Profile     string     `gorm:"column:profile;size:255"`
+	Settings    string     `gorm:"column:settings;type:text"`
+	Status      string     `gorm:"column:status;size:50"`
+	Message     string     `gorm:"column:message;size:1024"`
+	Reconnect   bool       `gorm:"column:reconnect"`
+	RequestedBy string     `gorm:"column:requested_by;size:255"`
+	CompletedAt *time.Time `gorm:"column:completed_at"`
+}
+
+// parseConfigSettings reads and validates a JSON object of settings.
+func parseConfigSettings(data string) (map[string]string, error) {
+	var settings map[string]string
+	if err := json.Unmarshal([]byte(data), &settings); err != nil {
+		return nil, fmt.Errorf("settings must be a JSON object of strings: %v", err)
+	}
+	if err := protocol.ValidateConfig(settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// sendConfig sends set_config to a client and records the change. It
+// returns the request ID.
+func sendConfig(client Client, profile string, settings map[string]string, requestedBy string) (string, error) {
+	if !client.supports(protocol.CapSetConfig) {
+		return "", fmt.Errorf("client does not support set_config")
+	}
+	data, _ := json.Marshal(settings)
+	change := ConfigChange{
+		RequestID:   uuid.New().String(),
+		ClientID:    client.ID,
+		Profile:     profile,
+		Settings:    string(data),
+		Status:      configPending,
+		RequestedBy: requestedBy,
+	}
+	if err := db.Create(&change).Error; err != nil {
+		return "", err
+	}
+	if err := sendToClient(client.ID, &protocol.SetConfig{RequestID: change.RequestID, Settings: settings}); err != nil {
+		db.Model(&change).Updates(map[string]interface{}{"status": protocol.ConfigFailed, "message": err.Error()})
+		return "", err
+	}
+	log.Printf("⚙️ Konfiguration an %s gesendet (%s)", client.ID, change.RequestID)
+	return change.RequestID, nil
+}
+
+// recordConfigResult stores the config_result of a client.
+func recordConfigResult(clientID string, result *protocol.ConfigResult) {
+	now := time.Now()
+	update := db.Model(&ConfigChange{}).Where("request_id = ? AND client_id = ?", result.RequestID, clientID).Updates(map[string]interface{}{
+		"status":       result.Status,
+		"message":      result.Message,
+		"reconnect":    result.Reconnect,
+		"completed_at": now,
+	})
+	if update.Error != nil {
+		log.Printf("❌ Fehler beim Speichern des Konfigurationsergebnisses von %s: %v", clientID, update.Error)
+		return
+	}
+	if update.RowsAffected == 0 {
+		log.Printf("⚠️ Unerwartetes config_result von %s für %s verworfen", clientID, result.RequestID)
+		return
+	}
+	if result.Status == protocol.ConfigApplied {
+		log.Printf("✅ Konfiguration von %s übernommen (%s)", clientID, result.RequestID)
+	} else {
+		log.Printf("❌ Konfiguration von %s nicht übernommen (%s): %s", clientID, result.Status, result.Message)
+	}
+}
+
+// --- HTTP Handlers ---
+
+// configProfilesHandler lists the profiles (GET) or creates or replaces one
+// (POST name, description, settings as JSON object).
+func configProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var profiles []ConfigProfile
+		if err := db.Order("name").Find(&profiles).Error; err != nil {
+			log.Printf("Error loading config profiles: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]interface{}, 0, len(profiles))
+		for _, profile := range profiles {
+			var settings map[string]string
+			json.Unmarshal([]byte(profile.Settings), &settings)
+			result = append(result, map[string]interface{}{
+				"name":        profile.Name,
+				"description": profile.Description,
+				"settings":    settings,
+				"updated_by":  profile.UpdatedBy,
+				"updated_at":  profile.UpdatedAt,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"profiles": result,
+			"keys":     protocol.ConfigKeys(),
+		})
+
+	case http.MethodPost:
+		profile := ConfigProfile{
+			Name:        strings.TrimSpace(r.FormValue("name")),
+			Description: r.FormValue("description"),
+		}
+		auditDetail(r, "profile=%s", profile.Name)
+		if profile.Name == "" {
+			http.Error(w, "Profile name missing", http.StatusBadRequest)
+			return
+		}
+		settings, err := parseConfigSettings(r.FormValue("settings"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := json.Marshal(settings)
+		profile.Settings = string(data)
+		auditPayload(r, data)
+		if user := currentOperator(r); user != nil {
+			profile.UpdatedBy = user.Username
+		}
+
+		var existing ConfigProfile
+		err = db.Where("name = ?", profile.Name).First(&existing).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			log.Printf("Error loading config profile %s: %v", profile.Name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			profile.BaseModel = existing.BaseModel
+			err = db.Save(&profile).Error
+		} else {
+			err = db.Create(&profile).Error
+		}
+		if err != nil {
+			log.Printf("Error saving config profile %s: %v", profile.Name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✅ Konfigurationsprofil %s gespeichert", profile.Name)
+		fmt.Fprint(w, `{"status": "success", "message": "Profil gespeichert"}`)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deleteConfigProfileHandler deletes a profile by name.
+func deleteConfigProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	auditDetail(r, "profile=%s", name)
+	result := db.Where("name = ?", name).Delete(&ConfigProfile{})
+	if result.Error != nil {
+		log.Printf("Error deleting config profile %s: %v", name, result.Error)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("🗑️ Konfigurationsprofil %s gelöscht", name)
+	fmt.Fprint(w, `{"status": "success", "message": "Profil gelöscht"}`)
+}
+
+// applyConfigHandler sends a profile (profile) or settings given as JSON
+// object (settings) to the connected clients of a target selector.
+func applyConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := r.FormValue("target")
+	if clientID := r.FormValue("client_id"); target == "" && clientID != "" {
+		target = "client:" + clientID
+	}
+	if target == "" {
+		http.Error(w, "Target missing", http.StatusBadRequest)
+		return
+	}
+
+	profileName := strings.TrimSpace(r.FormValue("profile"))
+	var settings map[string]string
+	var err error
+	if profileName != "" {
+		var profile ConfigProfile
+		if err := db.Where("name = ?", profileName).First(&profile).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				http.Error(w, "Profile not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error loading config profile %s: %v", profileName, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		settings, err = parseConfigSettings(profile.Settings)
+	} else {
+		settings, err = parseConfigSettings(r.FormValue("settings"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	targets, err := resolveTarget(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, _ := json.Marshal(settings)
+	auditClients(r, targets)
+	auditPayload(r, data)
+	auditDetail(r, "target=%s profile=%s", target, profileName)
+
+	requestedBy := ""
+	if user := currentOperator(r); user != nil {
+		requestedBy = user.Username
+	}
+	results := make([]map[string]string, 0, len(targets))
+	failed := 0
+	for _, client := range targets {
+		requestID, err := sendConfig(client, profileName, settings, requestedBy)
+		result := map[string]string{"client_id": client.ID, "request_id": requestID, "status": configPending}
+		if err != nil {
+			failed++
+			result["status"], result["message"] = protocol.ConfigFailed, err.Error()
+			log.Printf("❌ Konfiguration nicht an %s gesendet: %v", client.ID, err)
+		}
+		results = append(results, result)
+	}
+	log.Printf("📤 Konfiguration an %d Clients (%s) gesendet, %d Fehler", len(targets)-failed, target, failed)
+
+	if failed > 0 && failed < len(targets) {
+		w.WriteHeader(http.StatusPartialContent) // 206 Partial Content
+	} else if failed > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"target":  target,
+		"sent":    len(targets) - failed,
+		"failed":  failed,
+		"results": results,
+	})
+}
+
+// configChangesHandler lists recent config changes, optionally of one client
+// or one request.
+func configChangesHandler(w http.ResponseWriter, r *http.Request) {
+	query := db.Order("id desc").Limit(100)
+	if clientID := r.FormValue("client_id"); clientID != "" {
+		query = query.Where("client_id = ?", clientID)
+	}
+	if requestID := r.FormValue("id"); requestID != "" {
+		query = query.Where("request_id = ?", requestID)
+	}
+	var changes []ConfigChange
+	if err := query.Find(&changes).Error; err != nil {
+		log.Printf("Error loading config changes: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(changes)
+}
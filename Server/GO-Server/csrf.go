@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// csrfCookieName holds the session's CSRF token for the page scripts, which
+// send it back in the X-CSRF-Token header.
+const csrfCookieName = "ws_csrf"
+
+// allowedOrigins returns the origins from ALLOWED_ORIGINS, e.g.
+// "https://server:5001,https://admin.example.com".
+func allowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(getEnv("ALLOWED_ORIGINS", ""), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// originAllowed checks an Origin header against ALLOWED_ORIGINS. Without a
+// list only pages served by the same host are accepted.
+func originAllowed(origin string, r *http.Request) bool {
+	origins := allowedOrigins()
+	if len(origins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		return strings.EqualFold(u.Hostname(), host)
+	}
+	for _, allowed := range origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebSocketOrigin is the upgrader's CheckOrigin. Agents do not send an
+// Origin header; browsers always do and must come from an allowed origin.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !originAllowed(origin, r) {
+		log.Printf("🚫 WebSocket-Verbindung von fremdem Origin %s (%s) abgelehnt", origin, r.RemoteAddr)
+		return false
+	}
+	return true
+}
+
+// setCSRFCookie hands the session's CSRF token to the page scripts.
+func setCSRFCookie(w http.ResponseWriter, r *http.Request, session OperatorSession) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    session.CSRFToken,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// isSafeMethod reports whether a request cannot change state.
+func isSafeMethod(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+}
+
+// checkCSRF verifies state-changing requests of a browser session: the Origin
+// (if sent) must be allowed and the X-CSRF-Token header or csrf_token form
+// field must match the session. API token requests have no session and are
+// not affected.
+func checkCSRF(r *http.Request, session *OperatorSession) bool {
+	if session == nil || isSafeMethod(r) {
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(origin, r) {
+		return false
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf_token")
+	}
+	return session.CSRFToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) == 1
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	tests := []struct {
+		allowed string // ALLOWED_ORIGINS
+		origin  string
+		want    bool
+	}{
+		{"", "", true}, // Agents send no Origin
+		{"", "https://server:5001", true},
+		{"", "https://SERVER", true},
+		{"", "https://evil.example.com", false},
+		{"", "https://server.evil.example.com", false},
+		{"", "::not a url", false},
+		{"https://admin.example.com, https://server:5001/", "https://server:5001", true},
+		{"https://admin.example.com", "https://ADMIN.example.com", true},
+		{"https://admin.example.com", "https://server:5001", false}, // The list replaces the same-host rule
+		{"https://admin.example.com", "http://admin.example.com", false},
+		{"https://admin.example.com", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("ALLOWED_ORIGINS", tt.allowed)
+		r := httptest.NewRequest(http.MethodGet, "http://server:8765/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkWebSocketOrigin(r); got != tt.want {
+			t.Errorf("checkWebSocketOrigin(origin %q, ALLOWED_ORIGINS %q) = %v, want %v", tt.origin, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	session := &OperatorSession{CSRFToken: "csrf-token-1"}
+	tests := []struct {
+		name    string
+		method  string
+		session *OperatorSession
+		origin  string
+		header  string // X-CSRF-Token
+		form    string // csrf_token
+		want    bool
+	}{
+		{"GET without token", http.MethodGet, session, "", "", "", true},
+		{"HEAD without token", http.MethodHead, session, "https://evil.example.com", "", "", true},
+		{"POST with header", http.MethodPost, session, "", "csrf-token-1", "", true},
+		{"POST with form field", http.MethodPost, session, "", "", "csrf-token-1", true},
+		{"POST same origin", http.MethodPost, session, "https://server:5001", "csrf-token-1", "", true},
+		{"POST without token", http.MethodPost, session, "", "", "", false},
+		{"POST wrong token", http.MethodPost, session, "", "csrf-token-2", "", false},
+		{"POST wrong form field", http.MethodPost, session, "", "", "csrf", false},
+		{"POST foreign origin", http.MethodPost, session, "https://evil.example.com", "csrf-token-1", "", false},
+		{"DELETE without token", http.MethodDelete, session, "", "", "", false},
+		{"session without token", http.MethodPost, &OperatorSession{}, "", "", "", false},
+		{"API token request", http.MethodPost, nil, "https://evil.example.com", "", "", true},
+	}
+	t.Setenv("ALLOWED_ORIGINS", "")
+	for _, tt := range tests {
+		var body *strings.Reader
+		if tt.form != "" {
+			body = strings.NewReader(url.Values{"csrf_token": {tt.form}}.Encode())
+		} else {
+			body = strings.NewReader("")
+		}
+		r := httptest.NewRequest(tt.method, "https://server:5001/send_message", body)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.header != "" {
+			r.Header.Set("X-CSRF-Token", tt.header)
+		}
+		if got := checkCSRF(r, tt.session); got != tt.want {
+			t.Errorf("checkCSRF(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
+	"ondeso/protocol"
+)
+
+// Fetch states.
+const (
+	fetchPending   = "pending"
+	fetchReceiving = "receiving"
+	fetchCompleted = "completed"
+	fetchFailed    = "failed"
+)
+
+// FetchedFile is a file requested from a client with /files/fetch. The
+// content is stored as FETCH_DIR/<request ID>.
+type FetchedFile struct {
+	BaseModel
+	RequestID   string     `gorm:"column:request_id;size:64;unique_index"`
+	ClientID    string     `gorm:"column:client_id;size:255;index"`
+	Path        string     `gorm:"column:path;size:1024"`
+	Status      string     `gorm:"column:status;size:50"`
+	Size        int64      `gorm:"column:size"`
+	SHA256      string     `gorm:"column:sha256;size:64"`
+	Error       string     `gorm:"column:error;size:1024"`
+	RequestedBy string     `gorm:"column:requested_by;size:255"`
+	CompletedAt *time.Time `gorm:"column:completed_at"`
+}
+
+// fetchDir holds the fetched files (FETCH_DIR), set up in main.
+var fetchDir string
+
+// fetchMaxBytes is the largest file a client may upload (FETCH_MAX_BYTES).
+func fetchMaxBytes() int64 {
+	return int64(getEnvInt("FETCH_MAX_BYTES", 50*1024*1024))
+}
+
+// incomingFetch is a fetch the server waits for. Chunks must arrive in
+// order; the file is written to a .part file and renamed when complete.
+type incomingFetch struct {
+	clientID string
+	path     string
+	file     *os.File
+	hash     hash.Hash
+	next     int // Expected chunk index
+	total    int
+	size     int64
+	sha256   string
+	written  int64
+	updated  time.Time
+}
+
+// incomingFetches holds the open fetches by request ID.
+var incomingFetches = struct {
+	sync.Mutex
+	byID map[string]*incomingFetch
+}{byID: make(map[string]*incomingFetch)}
+
+// storedFetchPath returns where the content of a fetch is stored.
+func storedFetchPath(requestID string) string {
+	return filepath.Join(fetchDir, requestID)
+}
+
+// cleanFetchPath normalizes a requested path. It must be relative and stay
+// within the workplace; the client checks this again against its directory.
+func cleanFetchPath(requested string) (string, error) {
+	cleaned := path.Clean(strings.ReplaceAll(strings.TrimSpace(requested), "\\", "/"))
+	switch {
+	case requested == "" || cleaned == ".":
+		return "", fmt.Errorf("path missing")
+	case strings.HasPrefix(cleaned, "/") || strings.Contains(cleaned, ":"):
+		return "", fmt.Errorf("path must be relative to the workplace")
+	case cleaned == ".." || strings.HasPrefix(cleaned, "../"):
+		return "", fmt.Errorf("path leaves the workplace")
+	}
+	return cleaned, nil
+}
+
+// receiveFileChunk appends a file_chunk to its fetch.
+func receiveFileChunk(clientID string, chunk *protocol.FileChunk) {
+	incomingFetches.Lock()
+	defer incomingFetches.Unlock()
+	fetch, ok := incomingFetches.byID[chunk.RequestID]
+	if !ok || fetch.clientID != clientID {
+		log.Printf("⚠️ Unerwarteter Datei-Chunk von %s für %s verworfen", clientID, chunk.RequestID)
+		return
+	}
+
+	err := fetch.append(chunk)
+	if err == nil && fetch.next < fetch.total {
+		return
+	}
+	delete(incomingFetches.byID, chunk.RequestID)
+	if err == nil {
+		err = fetch.complete(chunk.RequestID)
+	}
+	if err != nil {
+		fetch.fail(chunk.RequestID, err)
+	}
+}
+
+// append checks a chunk and writes its data.
+func (f *incomingFetch) append(chunk *protocol.FileChunk) error {
+	if chunk.ChunkIndex != f.next {
+		return fmt.Errorf("chunk %d received, expected %d", chunk.ChunkIndex, f.next)
+	}
+	if chunk.ChunkSHA256 != "" && !strings.EqualFold(chunk.ChunkSHA256, chunkSHA256(chunk.FileChunk)) {
+		return fmt.Errorf("chunk %d is damaged", chunk.ChunkIndex)
+	}
+	if f.next == 0 {
+		if chunk.Size > fetchMaxBytes() {
+			return fmt.Errorf("file has %d bytes, at most %d are accepted", chunk.Size, fetchMaxBytes())
+		}
+		f.total, f.size, f.sha256 = chunk.TotalChunks, chunk.Size, chunk.SHA256
+		if err := os.MkdirAll(fetchDir, 0750); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(storedFetchPath(chunk.RequestID)+".part", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		f.file = file
+		db.Model(&FetchedFile{}).Where("request_id = ?", chunk.RequestID).Update("status", fetchReceiving)
+	} else if chunk.TotalChunks != f.total || chunk.Size != f.size || chunk.SHA256 != f.sha256 {
+		return fmt.Errorf("chunk %d describes a different file", chunk.ChunkIndex)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(chunk.FileChunk)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %v", chunk.ChunkIndex, err)
+	}
+	if f.written+int64(len(data)) > f.size {
+		return fmt.Errorf("file is larger than announced (%d bytes)", f.size)
+	}
+	if _, err := f.file.Write(data); err != nil {
+		return err
+	}
+	f.hash.Write(data)
+	f.written += int64(len(data))
+	f.next++
+	f.updated = time.Now()
+	return nil
+}
+
+// complete checks size and hash of a received file and stores it.
+func (f *incomingFetch) complete(requestID string) error {
+	sum := hex.EncodeToString(f.hash.Sum(nil))
+	switch {
+	case f.written != f.size:
+		return fmt.Errorf("received %d of %d bytes", f.written, f.size)
+	case !strings.EqualFold(sum, f.sha256):
+		return fmt.Errorf("SHA-256 mismatch (expected %s, received %s)", f.sha256, sum)
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if err := os.Rename(storedFetchPath(requestID)+".part", storedFetchPath(requestID)); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	db.Model(&FetchedFile{}).Where("request_id = ?", requestID).Updates(map[string]interface{}{
+		"status":       fetchCompleted,
+		"size":         f.size,
+		"sha256":       sum,
+		"completed_at": now,
+	})
+	log.Printf("📥 Datei %s von %s empfangen (%d Bytes)", f.path, f.clientID, f.size)
+	return nil
+}
+
+// fail removes the partial file of a fetch and records the error.
+func (f *incomingFetch) fail(requestID string, reason error) {
+	if f.file != nil {
+		f.file.Close()
+	}
+	os.Remove(storedFetchPath(requestID) + ".part")
+
+	log.Printf("❌ Abruf %s von %s fehlgeschlagen: %v", f.path, f.clientID, reason)
+	now := time.Now()
+	db.Model(&FetchedFile{}).Where("request_id = ?", requestID).Updates(map[string]interface{}{
+		"status":       fetchFailed,
+		"error":        reason.Error(),
+		"completed_at": now,
+	})
+}
+
+// failFetch ends an open fetch with an error.
+func failFetch(requestID string, reason error) {
+	incomingFetches.Lock()
+	defer incomingFetches.Unlock()
+	if fetch, ok := incomingFetches.byID[requestID]; ok {
+		delete(incomingFetches.byID, requestID)
+		fetch.fail(requestID, reason)
+	}
+}
+
+// recordFetchFailure stores a fetch_failed message of a client.
+func recordFetchFailure(clientID string, failure *protocol.FetchFailed) {
+	incomingFetches.Lock()
+	defer incomingFetches.Unlock()
+	if fetch, ok := incomingFetches.byID[failure.RequestID]; ok && fetch.clientID == clientID {
+		delete(incomingFetches.byID, failure.RequestID)
+		fetch.fail(failure.RequestID, errors.New(failure.Reason))
+	}
+}
+
+// expireFetches fails fetches without progress for TRANSFER_TTL_MINUTES.
+func expireFetches(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var expired []string
+			now := time.Now()
+			incomingFetches.Lock()
+			for requestID, fetch := range incomingFetches.byID {
+				if now.Sub(fetch.updated) > transferTTL() {
+					expired = append(expired, requestID)
+				}
+			}
+			incomingFetches.Unlock()
+			for _, requestID := range expired {
+				failFetch(requestID, fmt.Errorf("no answer from the client"))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// --- HTTP Handlers ---
+
+// fetchFileHandler asks a client for a file of its workplace.
+func fetchFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clientID := r.FormValue("client_id")
+	filePath, err := cleanFetchPath(r.FormValue("path"))
+	if clientID == "" {
+		http.Error(w, "Client ID missing", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditDetail(r, "path=%s", filePath)
+
+	fetch := FetchedFile{
+		RequestID: uuid.New().String(),
+		ClientID:  clientID,
+		Path:      filePath,
+		Status:    fetchPending,
+	}
+	if user := currentOperator(r); user != nil {
+		fetch.RequestedBy = user.Username
+	}
+	request, err := protocol.Encode(&protocol.FetchFile{RequestID: fetch.RequestID, Path: filePath, MaxSize: fetchMaxBytes()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Insert and send run without clientsMutex, so a slow database or client
+	// does not block registrations.
+	client, ok := connectedClient(clientID)
+	if !ok {
+		http.Error(w, "Client not connected", http.StatusGone)
+		return
+	}
+	if !client.supports(protocol.CapFetchFile) {
+		http.Error(w, "Client does not support fetch_file", http.StatusConflict)
+		return
+	}
+	if err := db.Create(&fetch).Error; err != nil {
+		log.Printf("Error saving fetch: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	incomingFetches.Lock()
+	incomingFetches.byID[fetch.RequestID] = &incomingFetch{clientID: clientID, path: filePath, hash: sha256.New(), updated: time.Now()}
+	incomingFetches.Unlock()
+	if err := client.Conn.WriteMessage(websocket.TextMessage, request); err != nil {
+		failFetch(fetch.RequestID, err)
+		http.Error(w, "Error sending request", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("📤 Datei %s bei %s angefordert (%s)", filePath, clientID, fetch.RequestID)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "success",
+		"message":    "Datei angefordert",
+		"request_id": fetch.RequestID,
+	})
+}
+
+// fetchedFileInfo is the JSON form of a fetch.
+func fetchedFileInfo(fetch FetchedFile) map[string]interface{} {
+	return map[string]interface{}{
+		"request_id":   fetch.RequestID,
+		"client_id":    fetch.ClientID,
+		"path":         fetch.Path,
+		"status":       fetch.Status,
+		"size":         fetch.Size,
+		"sha256":       fetch.SHA256,
+		"error":        fetch.Error,
+		"requested_by": fetch.RequestedBy,
+		"created_at":   fetch.CreatedAt,
+		"completed_at": fetch.CompletedAt,
+	}
+}
+
+// filesHandler lists recent fetches, optionally of one client, or with id
+// returns one fetch.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	if requestID := r.FormValue("id"); requestID != "" {
+		var fetch FetchedFile
+		if err := db.Where("request_id = ?", requestID).First(&fetch).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				http.Error(w, "File not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error loading fetch %s: %v", requestID, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(fetchedFileInfo(fetch))
+		return
+	}
+
+	query := db.Order("id desc").Limit(100)
+	if clientID := r.FormValue("client_id"); clientID != "" {
+		query = query.Where("client_id = ?", clientID)
+	}
+	var fetches []FetchedFile
+	if err := query.Find(&fetches).Error; err != nil {
+		log.Printf("Error loading fetches: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	result := make([]map[string]interface{}, 0, len(fetches))
+	for _, fetch := range fetches {
+		result = append(result, fetchedFileInfo(fetch))
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// downloadFileHandler returns the content of a completed fetch.
+func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
+	var fetch FetchedFile
+	err := db.Where("request_id = ?", r.FormValue("id")).First(&fetch).Error
+	if gorm.IsRecordNotFoundError(err) || (err == nil && fetch.Status != fetchCompleted) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading fetch: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(storedFetchPath(fetch.RequestID))
+	if err != nil {
+		log.Printf("Error opening fetched file %s: %v", fetch.RequestID, err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	log.Printf("📄 Datei %s von %s heruntergeladen (%s)", fetch.Path, fetch.ClientID, sourceIP(r))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(fetch.Path)))
+	w.Header().Set("X-Content-SHA256", fetch.SHA256)
+	http.ServeContent(w, r, "", fetch.UpdatedAt, file)
+}
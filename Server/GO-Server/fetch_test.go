@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestCleanFetchPath(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      string
+		wantErr   bool
+	}{
+		{"logs/output.log", "logs/output.log", false},
+		{`logs\output.log`, "logs/output.log", false},
+		{" ./logs//output.log ", "logs/output.log", false},
+		{"logs/../client.log", "client.log", false},
+		{"", "", true},
+		{".", "", true},
+		{"logs/..", "", true},
+		{"..", "", true},
+		{"../secret.txt", "", true},
+		{`..\secret.txt`, "", true},
+		{"logs/../../secret.txt", "", true},
+		{"/etc/passwd", "", true},
+		{`\Windows\win.ini`, "", true},
+		{`\\server\share\file.txt`, "", true},
+		{`C:\Windows\win.ini`, "", true},
+		{`C:Windows\win.ini`, "", true},
+		{"c:/windows/win.ini", "", true},
+		{"logs/file.txt:stream", "", true}, // NTFS alternate data stream
+	}
+	for _, tt := range tests {
+		got, err := cleanFetchPath(tt.requested)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("cleanFetchPath(%q) = %q, %v, want %q, error %v", tt.requested, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"ondeso/protocol"
+)
+
+// compressionGzip is the compression a client can announce at registration
+// ("compression", comma-separated, next to "transfer_modes"). Clients without
+// frame support receive base64 JSON chunks.
+const compressionGzip = protocol.EncodingGzip
+
+// frameChunkSize is the size of the data in one transfer frame; the layout of
+// the frames is defined by protocol.EncodeFrame.
+const frameChunkSize = 256 * 1024
+
+// hasOption reports whether a comma-separated list contains an option.
+func hasOption(list, option string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), option) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateTransfer reads the transfer_modes and compression fields of a
+// registering client.
+func negotiateTransfer(register *protocol.Register) (frames bool, compression string) {
+	frames = hasOption(register.TransferModes, protocol.TransferModeFrames)
+	if frames && hasOption(register.Compression, compressionGzip) {
+		compression = compressionGzip
+	}
+	return frames, compression
+}
+
+// frameTransfer is a payload prepared for the binary-frame mode: a
+// transfer_start message with the metadata and the frames.
+type frameTransfer struct {
+	start       []byte
+	frames      [][]byte
+	signedUntil int64 // expires_at of the payload signature
+}
+
+// buildFrameTransfer splits a payload into frames. start holds the fields the
+// JSON chunks would carry apart from the chunk data (kind, name, type,
+// signature, ...); the sizes are filled in here. The payload is
+// gzip-compressed if requested and smaller that way.
+func buildFrameTransfer(transferID uuid.UUID, start protocol.TransferStart, content []byte, compression string) (frameTransfer, error) {
+	payload := content
+	encoding := ""
+	if compression == compressionGzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(content); err != nil {
+			return frameTransfer{}, err
+		}
+		if err := writer.Close(); err != nil {
+			return frameTransfer{}, err
+		}
+		if compressed.Len() < len(content) {
+			payload = compressed.Bytes()
+			encoding = compressionGzip
+		}
+	}
+
+	totalChunks := (len(payload) + frameChunkSize - 1) / frameChunkSize
+	if totalChunks == 0 {
+		totalChunks = 1 // Empty payloads still need one frame
+	}
+	start.TransferID = transferID.String()
+	start.TotalChunks = totalChunks
+	start.ChunkSize = frameChunkSize
+	start.Size = int64(len(content))
+	start.EncodedSize = int64(len(payload))
+	start.Encoding = encoding
+	startJSON, err := protocol.Encode(&start)
+	if err != nil {
+		return frameTransfer{}, err
+	}
+
+	transfer := frameTransfer{start: startJSON, frames: make([][]byte, totalChunks), signedUntil: start.ExpiresAt}
+	for i := 0; i < totalChunks; i++ {
+		from := i * frameChunkSize
+		to := from + frameChunkSize
+		if to > len(payload) {
+			to = len(payload)
+		}
+		transfer.frames[i] = protocol.EncodeFrame(transferID, i, int64(from), payload[from:to])
+	}
+	return transfer, nil
+}
+
+// sharedFrameTransfer prepares a payload sent to many clients, e.g. a binary
+// distribution or an agent update run. All clients receive it under one
+// transfer ID, so the frames are built once per compression and shared by the
+// transfers, including the copies kept for resend requests. Used by one
+// sending goroutine.
+type sharedFrameTransfer struct {
+	transferID uuid.UUID
+	start      protocol.TransferStart
+	content    []byte
+	built      map[string]frameTransfer // By compression
+}
+
+// newSharedFrameTransfer prepares content for frame transfers, see
+// buildFrameTransfer for start.
+func newSharedFrameTransfer(transferID uuid.UUID, start protocol.TransferStart, content []byte) *sharedFrameTransfer {
+	return &sharedFrameTransfer{transferID: transferID, start: start, content: content, built: make(map[string]frameTransfer)}
+}
+
+// get returns the frame transfer for a compression, building it on first use.
+func (s *sharedFrameTransfer) get(compression string) (frameTransfer, error) {
+	if transfer, ok := s.built[compression]; ok {
+		return transfer, nil
+	}
+	transfer, err := buildFrameTransfer(s.transferID, s.start, s.content, compression)
+	if err != nil {
+		return frameTransfer{}, err
+	}
+	s.built[compression] = transfer
+	return transfer, nil
+}
+
+// messageWriter writes one WebSocket message to a client.
+type messageWriter func(messageType int, data []byte) error
+
+// sendFrameTransfer registers a frame transfer for resend requests and writes
+// it with write.
+func sendFrameTransfer(write messageWriter, clientID string, transferID uuid.UUID, name string, transfer frameTransfer) error {
+	registerTransfer(transferID.String(), clientID, name, transfer.frames, true, transfer.signedUntil)
+	if err := write(websocket.TextMessage, transfer.start); err != nil {
+		return err
+	}
+	var size int
+	for i, frame := range transfer.frames {
+		if err := write(websocket.BinaryMessage, frame); err != nil {
+			return fmt.Errorf("frame %d: %v", i, err)
+		}
+		size += len(frame)
+	}
+	log.Printf("📤 %s in %d Frames (%d Bytes) an %s gesendet", name, len(transfer.frames), size, clientID)
+	return nil
+}
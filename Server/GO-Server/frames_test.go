@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"ondeso/protocol"
+)
+
+func TestSharedFrameTransfer(t *testing.T) {
+	content := bytes.Repeat([]byte("ab"), frameChunkSize)
+	shared := newSharedFrameTransfer(uuid.New(), protocol.TransferStart{Kind: protocol.KindBinary, BinaryName: "tool.exe"}, content)
+
+	gzipped, err := shared.get(compressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := shared.get(compressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &gzipped.frames[0][0] != &again.frames[0][0] {
+		t.Error("get() built the gzip frames twice")
+	}
+
+	plain, err := shared.get("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain.frames) != 2 || len(gzipped.frames) != 1 {
+		t.Errorf("got %d plain and %d gzip frames, want 2 and 1", len(plain.frames), len(gzipped.frames))
+	}
+}
+
+func TestTransfersArePerClient(t *testing.T) {
+	transferID := uuid.New().String()
+	chunks := [][]byte{[]byte("chunk")}
+	expires := time.Now().Add(time.Hour).Unix()
+	registerTransfer(transferID, "client-a", "tool.exe", chunks, false, expires)
+	registerTransfer(transferID, "client-b", "tool.exe", chunks, false, expires)
+
+	completeTransfer("client-a", transferID)
+	outgoingTransfers.Lock()
+	_, okA := outgoingTransfers.byKey[transferKey{"client-a", transferID}]
+	_, okB := outgoingTransfers.byKey[transferKey{"client-b", transferID}]
+	outgoingTransfers.Unlock()
+	if okA || !okB {
+		t.Errorf("after completing client-a: client-a kept %v, client-b kept %v, want false, true", okA, okB)
+	}
+	completeTransfer("client-b", transferID)
+}
+
+func TestResendLimits(t *testing.T) {
+	t.Setenv("TRANSFER_MAX_RESENDS", "2")
+	chunks := [][]byte{[]byte("chunk")}
+	request := func(transferID string) error {
+		return resendChunks("client-offline", &protocol.ResendChunks{TransferID: transferID})
+	}
+	kept := func(transferID string) bool {
+		outgoingTransfers.Lock()
+		defer outgoingTransfers.Unlock()
+		_, ok := outgoingTransfers.byKey[transferKey{"client-offline", transferID}]
+		return ok
+	}
+
+	// The client is not connected, so the resends fail after passing the limits.
+	limited := uuid.New().String()
+	registerTransfer(limited, "client-offline", "tool.exe", chunks, false, time.Now().Add(time.Hour).Unix())
+	for i := 0; i < 2; i++ {
+		if err := request(limited); err == nil || !strings.Contains(err.Error(), "not connected") {
+			t.Fatalf("resend %d: %v, want not connected", i+1, err)
+		}
+	}
+	if err := request(limited); err == nil || strings.Contains(err.Error(), "not connected") || kept(limited) {
+		t.Errorf("third resend: %v, transfer kept %v, want the limit and the transfer dropped", err, kept(limited))
+	}
+
+	signedUntil := time.Now().Add(time.Minute)
+	capped := uuid.New().String()
+	registerTransfer(capped, "client-offline", "tool.exe", chunks, false, signedUntil.Unix())
+	request(capped)
+	outgoingTransfers.Lock()
+	expires := outgoingTransfers.byKey[transferKey{"client-offline", capped}].expires
+	outgoingTransfers.Unlock()
+	if expires.After(signedUntil) {
+		t.Errorf("transfer kept until %v, after its signature expires at %v", expires, signedUntil)
+	}
+	completeTransfer("client-offline", capped)
+
+	expired := uuid.New().String()
+	registerTransfer(expired, "client-offline", "tool.exe", chunks, false, time.Now().Add(-time.Second).Unix())
+	if err := request(expired); err == nil || !strings.Contains(err.Error(), "expired") || kept(expired) {
+		t.Errorf("resend after the signature expired: %v, transfer kept %v", err, kept(expired))
+	}
+}
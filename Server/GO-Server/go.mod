@@ -6,6 +6,7 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/jinzhu/gorm v1.9.16
+	golang.org/x/crypto v0.0.0-20191205180655-e7c4368fe9dd
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
@@ -13,5 +14,11 @@ require (
 	github.com/denisenkom/go-mssqldb v0.0.0-20191124224453-732737034ffd // indirect
 	github.com/golang-sql/civil v0.0.0-20190719163853-cb61b32ac6fe // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20191205180655-e7c4368fe9dd // indirect
 )
+
+require (
+	github.com/joho/godotenv v1.5.1
+	ondeso/protocol v0.0.0
+)
+
+replace ondeso/protocol => ../../Shared/GO-Protocol
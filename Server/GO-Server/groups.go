@@ -0,0 +1,657 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ClientGroup is a named set of clients. A client belongs to a group when it is
+// a static member or when it matches all dynamic rules that are set.
+type ClientGroup struct {
+	BaseModel
+	Name            string `gorm:"column:name;size:255;unique_index"`
+	Description     string `gorm:"column:description;size:1024"`
+	HostnamePattern string `gorm:"column:hostname_pattern;size:255"` // e.g. "BUHA-*"
+	Subnet          string `gorm:"column:subnet;size:50"`            // e.g. "10.1.2.0/24"
+	Tag             string `gorm:"column:tag;size:255"`              // e.g. "kasse"
+	AttributeRule   string `gorm:"column:attribute_rule;size:1024"`  // e.g. "usr_user_info.Department=Buchhaltung"
+}
+
+// ClientGroupMember is a static group membership.
+type ClientGroupMember struct {
+	BaseModel
+	GroupID  uint   `gorm:"column:group_id;index"`
+	ClientID string `gorm:"column:client_id;size:255;index"`
+}
+
+// AssetTag is a tag attached to an asset. Tags are kept in their own table so
+// they survive the asset row being removed when a client disconnects.
+type AssetTag struct {
+	BaseModel
+	ClientID string `gorm:"column:client_id;size:255;index"`
+	Tag      string `gorm:"column:tag;size:255"`
+}
+
+// attributeRule is a parsed "table.column=value" inventory rule.
+type attributeRule struct {
+	Table  string
+	Column string
+	Value  string
+}
+
+// parseAttributeRule parses an inventory rule of the form "table.column=value".
+func parseAttributeRule(rule string) (attributeRule, error) {
+	field, value, ok := strings.Cut(rule, "=")
+	if !ok {
+		return attributeRule{}, fmt.Errorf("invalid attribute rule %q, expected table.column=value", rule)
+	}
+	table, column, ok := strings.Cut(strings.TrimSpace(field), ".")
+	if !ok || table == "" || column == "" {
+		return attributeRule{}, fmt.Errorf("invalid attribute rule %q, expected table.column=value", rule)
+	}
+	return attributeRule{Table: table, Column: column, Value: strings.TrimSpace(value)}, nil
+}
+
+// validateGroup checks the dynamic rules of a group before it is stored.
+func validateGroup(group ClientGroup) error {
+	if strings.TrimSpace(group.Name) == "" {
+		return fmt.Errorf("group name is required")
+	}
+	if strings.ContainsAny(group.Name, ",:") {
+		return fmt.Errorf("group name must not contain ',' or ':'")
+	}
+	if group.HostnamePattern != "" {
+		if _, err := path.Match(group.HostnamePattern, ""); err != nil {
+			return fmt.Errorf("invalid hostname pattern: %v", err)
+		}
+	}
+	if group.Subnet != "" {
+		if _, _, err := net.ParseCIDR(group.Subnet); err != nil {
+			return fmt.Errorf("invalid subnet: %v", err)
+		}
+	}
+	if group.AttributeRule != "" {
+		rule, err := parseAttributeRule(group.AttributeRule)
+		if err != nil {
+			return err
+		}
+		if err := checkAttributeColumns(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAttributeColumns makes sure the rule only references an existing table
+// with a client_id column, so the identifiers can be used in a query safely.
+func checkAttributeColumns(rule attributeRule) error {
+	tables, err := getTables(db)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, table := range tables {
+		if table == rule.Table {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("table '%s' not found", rule.Table)
+	}
+
+	var count int
+	if err := db.Raw(`
+        SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS
+        WHERE TABLE_NAME = ? AND COLUMN_NAME IN (?, 'client_id')`, rule.Table, rule.Column).Row().Scan(&count); err != nil {
+		return err
+	}
+	if count < requiredColumns(rule) {
+		return fmt.Errorf("table '%s' needs the columns 'client_id' and '%s'", rule.Table, rule.Column)
+	}
+	return nil
+}
+
+// requiredColumns returns how many of client_id and the rule's column
+// checkAttributeColumns must find: one if the rule matches on client_id
+// itself, two otherwise.
+func requiredColumns(rule attributeRule) int {
+	if rule.Column == "client_id" {
+		return 1
+	}
+	return 2
+}
+
+// matchesHostname reports whether hostname matches a glob pattern, ignoring case.
+func matchesHostname(pattern, hostname string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(hostname))
+	return err == nil && ok
+}
+
+// matchesSubnet reports whether ip lies in the given CIDR subnet.
+func matchesSubnet(cidr, ip string) bool {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && network.Contains(parsed)
+}
+
+// attributeMatches returns the clients whose row in the inventory table of a
+// rule holds the expected value. A rule that references a missing table or
+// column matches nobody.
+func attributeMatches(rule attributeRule) (map[string]bool, error) {
+	matches := make(map[string]bool)
+	if err := checkAttributeColumns(rule); err != nil {
+		log.Printf("⚠️ Ungültige Attributregel %s.%s: %v", rule.Table, rule.Column, err)
+		return matches, nil
+	}
+	query := fmt.Sprintf("SELECT client_id FROM [%s] WHERE [%s] = ?", rule.Table, rule.Column)
+	rows, err := db.Raw(query, rule.Value).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var clientID string
+		if err := rows.Scan(&clientID); err != nil {
+			return nil, err
+		}
+		matches[clientID] = true
+	}
+	return matches, rows.Err()
+}
+
+// clientTags returns the tags of a client.
+func clientTags(clientID string) []string {
+	var tags []AssetTag
+	if err := db.Where("client_id = ?", clientID).Find(&tags).Error; err != nil {
+		log.Printf("❌ Fehler beim Laden der Tags für %s: %v", clientID, err)
+		return nil
+	}
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		result = append(result, tag.Tag)
+	}
+	return result
+}
+
+// tagIndex holds the lower-case tags of every client.
+type tagIndex map[string]map[string]bool
+
+// loadTagIndex reads all asset tags at once.
+func loadTagIndex() (tagIndex, error) {
+	var tags []AssetTag
+	if err := db.Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	index := make(tagIndex)
+	for _, tag := range tags {
+		if index[tag.ClientID] == nil {
+			index[tag.ClientID] = make(map[string]bool)
+		}
+		index[tag.ClientID][strings.ToLower(tag.Tag)] = true
+	}
+	return index, nil
+}
+
+// has reports whether a client carries the given tag, ignoring case.
+func (index tagIndex) has(clientID, tag string) bool {
+	return index[clientID][strings.ToLower(tag)]
+}
+
+// groupData is what groupContains needs from the database for one group.
+type groupData struct {
+	members    map[string]bool // Static members
+	tags       tagIndex        // Set if the group has a tag rule
+	attributes map[string]bool // Clients matching the attribute rule, if any
+}
+
+// groupContains reports whether a client belongs to a group.
+func groupContains(group ClientGroup, client Client, data groupData) bool {
+	if data.members[client.ID] {
+		return true
+	}
+
+	hasRule := false
+	if group.HostnamePattern != "" {
+		hasRule = true
+		if !matchesHostname(group.HostnamePattern, client.Hostname) {
+			return false
+		}
+	}
+	if group.Subnet != "" {
+		hasRule = true
+		if !matchesSubnet(group.Subnet, client.IP) {
+			return false
+		}
+	}
+	if group.Tag != "" {
+		hasRule = true
+		if !data.tags.has(client.ID, group.Tag) {
+			return false
+		}
+	}
+	if group.AttributeRule != "" {
+		hasRule = true
+		if !data.attributes[client.ID] {
+			return false
+		}
+	}
+	return hasRule
+}
+
+// selectorTerm is one term of a target selector.
+type selectorTerm struct {
+	Kind  string // all, client, group, tag, host or subnet
+	Value string
+}
+
+// parseSelector splits a target selector into its terms, see resolveTarget.
+// Hostname patterns and subnets are checked here, groups when resolving.
+func parseSelector(selector string) ([]selectorTerm, error) {
+	var terms []selectorTerm
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		kind, value, hasKind := strings.Cut(term, ":")
+		if !hasKind {
+			kind, value = "group", term
+			if term == "all" || term == "*" {
+				kind = "all"
+			} else if _, _, err := net.ParseCIDR(term); err == nil {
+				kind = "subnet"
+			}
+		}
+		kind, value = strings.ToLower(kind), strings.TrimSpace(value)
+
+		switch kind {
+		case "all", "client", "tag", "group":
+		case "host":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("invalid hostname pattern %q", value)
+			}
+		case "subnet":
+			if _, _, err := net.ParseCIDR(value); err != nil {
+				return nil, fmt.Errorf("invalid subnet %q", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown selector %q", term)
+		}
+		terms = append(terms, selectorTerm{Kind: kind, Value: value})
+	}
+	return terms, nil
+}
+
+// targetResolver matches the terms of one selector. Tags are loaded once and
+// shared by all terms; groups load their members and attribute matches once,
+// not per client.
+type targetResolver struct {
+	tags tagIndex
+}
+
+// loadTags loads the asset tags on first use.
+func (r *targetResolver) loadTags() (tagIndex, error) {
+	if r.tags == nil {
+		tags, err := loadTagIndex()
+		if err != nil {
+			return nil, err
+		}
+		r.tags = tags
+	}
+	return r.tags, nil
+}
+
+// matcher returns the function selecting the clients of a term.
+func (r *targetResolver) matcher(term selectorTerm) (func(Client) bool, error) {
+	value := term.Value
+	switch term.Kind {
+	case "all":
+		return func(Client) bool { return true }, nil
+	case "client":
+		return func(c Client) bool { return c.ID == value }, nil
+	case "host":
+		return func(c Client) bool { return matchesHostname(value, c.Hostname) }, nil
+	case "subnet":
+		return func(c Client) bool { return matchesSubnet(value, c.IP) }, nil
+	case "tag":
+		tags, err := r.loadTags()
+		if err != nil {
+			return nil, err
+		}
+		return func(c Client) bool { return tags.has(c.ID, value) }, nil
+	case "group":
+		return r.groupMatcher(value)
+	}
+	return nil, fmt.Errorf("unknown selector %q", term.Kind)
+}
+
+// groupMatcher loads a group and the data to match its members.
+func (r *targetResolver) groupMatcher(name string) (func(Client) bool, error) {
+	var group ClientGroup
+	if err := db.Where("name = ?", name).First(&group).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, fmt.Errorf("group %q not found", name)
+		}
+		return nil, err
+	}
+
+	var members []ClientGroupMember
+	if err := db.Where("group_id = ?", group.ID).Find(&members).Error; err != nil {
+		return nil, err
+	}
+	data := groupData{members: make(map[string]bool, len(members))}
+	for _, member := range members {
+		data.members[member.ClientID] = true
+	}
+	if group.Tag != "" {
+		tags, err := r.loadTags()
+		if err != nil {
+			return nil, err
+		}
+		data.tags = tags
+	}
+	if group.AttributeRule != "" {
+		rule, err := parseAttributeRule(group.AttributeRule)
+		if err != nil {
+			log.Printf("⚠️ Gruppe %s: %v", group.Name, err)
+			data.attributes = map[string]bool{}
+		} else if data.attributes, err = attributeMatches(rule); err != nil {
+			return nil, err
+		}
+	}
+	return func(c Client) bool { return groupContains(group, c, data) }, nil
+}
+
+// resolveTarget returns the connected clients selected by a target selector.
+//
+// A selector is a comma separated list of terms, the result is their union:
+//
+//	all | *            every connected client
+//	client:<id>        a single client
+//	group:<name>       members of a group (a bare name is treated as a group)
+//	tag:<tag>          clients carrying a tag
+//	host:<pattern>     hostname glob, e.g. host:BUHA-*
+//	subnet:<cidr>      IP subnet (a bare CIDR works as well)
+func resolveTarget(selector string) ([]Client, error) {
+	terms, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	clientsMutex.RLock()
+	connected := make([]Client, 0, len(clients))
+	for _, client := range clients {
+		connected = append(connected, client)
+	}
+	clientsMutex.RUnlock()
+
+	var resolver targetResolver
+	selected := make(map[string]Client)
+	for _, term := range terms {
+		match, err := resolver.matcher(term)
+		if err != nil {
+			return nil, err
+		}
+		for _, client := range connected {
+			if match(client) {
+				selected[client.ID] = client
+			}
+		}
+	}
+
+	result := make([]Client, 0, len(selected))
+	for _, client := range selected {
+		result = append(result, client)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// --- HTTP Handlers ---
+
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var groups []ClientGroup
+		if err := db.Order("name").Find(&groups).Error; err != nil {
+			log.Printf("Error loading groups: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		result := make([]map[string]interface{}, 0, len(groups))
+		for _, group := range groups {
+			var members []ClientGroupMember
+			db.Where("group_id = ?", group.ID).Find(&members)
+			memberIDs := make([]string, 0, len(members))
+			for _, member := range members {
+				memberIDs = append(memberIDs, member.ClientID)
+			}
+			result = append(result, map[string]interface{}{
+				"name":             group.Name,
+				"description":      group.Description,
+				"hostname_pattern": group.HostnamePattern,
+				"subnet":           group.Subnet,
+				"tag":              group.Tag,
+				"attribute_rule":   group.AttributeRule,
+				"members":          memberIDs,
+			})
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		group := ClientGroup{
+			Name:            strings.TrimSpace(r.FormValue("name")),
+			Description:     r.FormValue("description"),
+			HostnamePattern: strings.TrimSpace(r.FormValue("hostname_pattern")),
+			Subnet:          strings.TrimSpace(r.FormValue("subnet")),
+			Tag:             strings.TrimSpace(r.FormValue("tag")),
+			AttributeRule:   strings.TrimSpace(r.FormValue("attribute_rule")),
+		}
+		auditDetail(r, "group=%s", group.Name)
+		if err := validateGroup(group); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var existing ClientGroup
+		err := db.Where("name = ?", group.Name).First(&existing).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			log.Printf("Error loading group %s: %v", group.Name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			group.BaseModel = existing.BaseModel
+			err = db.Save(&group).Error
+		} else {
+			err = db.Create(&group).Error
+		}
+		if err != nil {
+			log.Printf("Error saving group %s: %v", group.Name, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("✅ Gruppe %s gespeichert", group.Name)
+		fmt.Fprint(w, `{"status": "success", "message": "Gruppe gespeichert"}`)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func deleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	auditDetail(r, "group=%s", r.FormValue("name"))
+	var group ClientGroup
+	if err := db.Where("name = ?", r.FormValue("name")).First(&group).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error loading group: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	tx := db.Begin()
+	if err := tx.Where("group_id = ?", group.ID).Delete(&ClientGroupMember{}).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error deleting members of group %s: %v", group.Name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Delete(&group).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Error deleting group %s: %v", group.Name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error deleting group %s: %v", group.Name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🗑️ Gruppe %s gelöscht", group.Name)
+	fmt.Fprint(w, `{"status": "success", "message": "Gruppe gelöscht"}`)
+}
+
+func groupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupName := r.FormValue("name")
+	clientID := r.FormValue("client_id")
+	operation := r.FormValue("op")
+	auditDetail(r, "group=%s op=%s", groupName, operation)
+	if groupName == "" || clientID == "" {
+		http.Error(w, "Group name or client ID missing", http.StatusBadRequest)
+		return
+	}
+
+	var group ClientGroup
+	if err := db.Where("name = ?", groupName).First(&group).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error loading group: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var err error
+	switch operation {
+	case "", "add":
+		var count int
+		db.Model(&ClientGroupMember{}).Where("group_id = ? AND client_id = ?", group.ID, clientID).Count(&count)
+		if count == 0 {
+			err = db.Create(&ClientGroupMember{GroupID: group.ID, ClientID: clientID}).Error
+		}
+	case "remove":
+		err = db.Where("group_id = ? AND client_id = ?", group.ID, clientID).Delete(&ClientGroupMember{}).Error
+	default:
+		http.Error(w, "Unknown operation", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating members of group %s: %v", group.Name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("👥 Gruppe %s: Mitglied %s (%s)", group.Name, clientID, operation)
+	fmt.Fprint(w, `{"status": "success", "message": "Gruppenmitglieder aktualisiert"}`)
+}
+
+func clientTagsHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.FormValue("client_id")
+	if clientID == "" {
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(clientTags(clientID))
+
+	case http.MethodPost:
+		tx := db.Begin()
+		if err := tx.Where("client_id = ?", clientID).Delete(&AssetTag{}).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error clearing tags of %s: %v", clientID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		seen := make(map[string]bool)
+		for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" || seen[strings.ToLower(tag)] {
+				continue
+			}
+			seen[strings.ToLower(tag)] = true
+			if err := tx.Create(&AssetTag{ClientID: clientID, Tag: tag}).Error; err != nil {
+				tx.Rollback()
+				log.Printf("Error saving tag %s for %s: %v", tag, clientID, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit().Error; err != nil {
+			log.Printf("Error saving tags of %s: %v", clientID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🏷️ Tags für %s gesetzt: %s", clientID, r.FormValue("tags"))
+		fmt.Fprint(w, `{"status": "success", "message": "Tags gespeichert"}`)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// resolveTargetHandler previews which connected clients a selector matches.
+func resolveTargetHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target is required", http.StatusBadRequest)
+		return
+	}
+
+	targets, err := resolveTarget(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := make(map[string]map[string]interface{})
+	for _, client := range targets {
+		result[client.ID] = map[string]interface{}{
+			"hostname": client.Hostname,
+			"ip":       client.IP,
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
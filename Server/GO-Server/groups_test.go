@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     []selectorTerm
+		wantErr  bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"all", []selectorTerm{{"all", "all"}}, false},
+		{"*", []selectorTerm{{"all", "*"}}, false},
+		{"client:abc-1", []selectorTerm{{"client", "abc-1"}}, false},
+		{"Buchhaltung", []selectorTerm{{"group", "Buchhaltung"}}, false},
+		{"group: Buchhaltung ", []selectorTerm{{"group", "Buchhaltung"}}, false},
+		{"TAG:kasse", []selectorTerm{{"tag", "kasse"}}, false},
+		{"host:BUHA-*,subnet:10.1.2.0/24", []selectorTerm{{"host", "BUHA-*"}, {"subnet", "10.1.2.0/24"}}, false},
+		{"10.1.0.0/16", []selectorTerm{{"subnet", "10.1.0.0/16"}}, false},
+		{"subnet:fd00::/8", []selectorTerm{{"subnet", "fd00::/8"}}, false},
+		{"host:[a-", nil, true},
+		{"subnet:10.1.2.0", nil, true},
+		{"subnet:10.1.2.0/33", nil, true},
+		{"subnet:fd00::/129", nil, true},
+		{"10.1.2.0/33", []selectorTerm{{"group", "10.1.2.0/33"}}, false}, // Not a CIDR, so a group name
+		{"user:admin", nil, true},
+		{"all,ip:10.0.0.1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSelector(tt.selector)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSelector(%q) = %v, %v, want %v, error %v", tt.selector, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseAttributeRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    attributeRule
+		wantErr bool
+	}{
+		{"usr_user_info.Department=Buchhaltung", attributeRule{"usr_user_info", "Department", "Buchhaltung"}, false},
+		{" usr_user_info.Department = Buchhaltung ", attributeRule{"usr_user_info", "Department", "Buchhaltung"}, false},
+		{"inv.Version=1.2=3", attributeRule{"inv", "Version", "1.2=3"}, false},
+		{"inv.Version=", attributeRule{"inv", "Version", ""}, false},
+		{"inv.Version", attributeRule{}, true},
+		{"Version=1", attributeRule{}, true},
+		{".Version=1", attributeRule{}, true},
+		{"inv.=1", attributeRule{}, true},
+		{"", attributeRule{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAttributeRule(tt.rule)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseAttributeRule(%q) = %+v, %v, want %+v, error %v", tt.rule, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRequiredColumns(t *testing.T) {
+	if got := requiredColumns(attributeRule{"inv", "client_id", "c1"}); got != 1 {
+		t.Errorf("requiredColumns(client_id) = %d, want 1", got)
+	}
+	if got := requiredColumns(attributeRule{"inv", "Dept", "BUHA"}); got != 2 {
+		t.Errorf("requiredColumns(Dept) = %d, want 2", got)
+	}
+}
+
+func TestMatchesHostname(t *testing.T) {
+	tests := []struct {
+		pattern, hostname string
+		want              bool
+	}{
+		{"BUHA-*", "BUHA-042", true},
+		{"buha-*", "BUHA-042", true},
+		{"BUHA-*", "buha-", true},
+		{"BUHA-*", "XBUHA-042", false},
+		{"BUHA-???", "BUHA-042", true},
+		{"BUHA-???", "BUHA-0421", false},
+		{"WS-[0-4]*", "WS-3A", true},
+		{"WS-[0-4]*", "WS-5A", false},
+		{"*", "", true},
+		{"", "", true},
+		{"", "WS-1", false},
+		{"*.corp", "ws1.corp", true},
+		{"*", "dept/ws1", false}, // * does not match a slash
+		{"[a-", "a", false},      // Malformed pattern
+	}
+	for _, tt := range tests {
+		if got := matchesHostname(tt.pattern, tt.hostname); got != tt.want {
+			t.Errorf("matchesHostname(%q, %q) = %v, want %v", tt.pattern, tt.hostname, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesSubnet(t *testing.T) {
+	tests := []struct {
+		cidr, ip string
+		want     bool
+	}{
+		{"10.1.2.0/24", "10.1.2.42", true},
+		{"10.1.2.0/24", "10.1.3.42", false},
+		{"10.1.2.7/24", "10.1.2.42", true}, // Host bits are ignored
+		{"0.0.0.0/0", "192.168.0.1", true},
+		{"10.1.2.0/24", "10.1.2.42:51234", false}, // Address with port
+		{"10.1.2.0/24", "", false},
+		{"10.1.2.0/24", "host.local", false},
+		{"10.1.2.0", "10.1.2.0", false},
+		{"10.1.2.0/33", "10.1.2.1", false},
+		{"", "10.1.2.1", false},
+		{"fd00::/8", "fd12:3456::1", true},
+		{"fd00::/8", "fe80::1", false},
+		{"::ffff:10.1.2.0/120", "10.1.2.42", true}, // IPv4-mapped
+		{"10.1.2.0/24", "::ffff:10.1.2.42", true},
+		{"fd00::/8", "10.1.2.42", false},
+	}
+	for _, tt := range tests {
+		if got := matchesSubnet(tt.cidr, tt.ip); got != tt.want {
+			t.Errorf("matchesSubnet(%q, %q) = %v, want %v", tt.cidr, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGroupContains(t *testing.T) {
+	client := Client{ID: "c1", Hostname: "BUHA-042", IP: "10.1.2.42"}
+	tags := tagIndex{"c1": {"kasse": true}}
+	tests := []struct {
+		name  string
+		group ClientGroup
+		data  groupData
+		want  bool
+	}{
+		{"no rules", ClientGroup{}, groupData{}, false},
+		{"static member", ClientGroup{HostnamePattern: "X-*"}, groupData{members: map[string]bool{"c1": true}}, true},
+		{"all rules", ClientGroup{HostnamePattern: "buha-*", Subnet: "10.1.2.0/24", Tag: "Kasse", AttributeRule: "inv.Dept=BUHA"},
+			groupData{tags: tags, attributes: map[string]bool{"c1": true}}, true},
+		{"wrong subnet", ClientGroup{HostnamePattern: "BUHA-*", Subnet: "10.1.3.0/24"}, groupData{}, false},
+		{"missing tag", ClientGroup{Tag: "lager"}, groupData{tags: tags}, false},
+		{"no attribute match", ClientGroup{AttributeRule: "inv.Dept=BUHA"}, groupData{attributes: map[string]bool{}}, false},
+	}
+	for _, tt := range tests {
+		if got := groupContains(tt.group, client, tt.data); got != tt.want {
+			t.Errorf("groupContains(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+// pageTemplates lists the templates that can be opened via /page/<name>.
+var pageTemplates = map[string]string{
+	"clients.html":     "clients.html",
+	"ProjectDocu.html": "ProjectDocu.html",
+	"table_logs.html":  "table_logs.html",
+}
+
+// pageTemplate maps a /page/ name to its template. Anything not listed,
+// including paths and other templates such as login.html, is rejected.
+func pageTemplate(name string) (string, bool) {
+	templateName, ok := pageTemplates[name]
+	return templateName, ok
+}
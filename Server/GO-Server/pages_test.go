@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestPageTemplate(t *testing.T) {
+	for name, want := range pageTemplates {
+		if got, ok := pageTemplate(name); !ok || got != want {
+			t.Errorf("pageTemplate(%q) = %q, %v, want %q", name, got, ok, want)
+		}
+	}
+
+	rejected := []string{
+		"",
+		"login.html",
+		"index.html",
+		"client_details.html",
+		"../templates/clients.html",
+		"./clients.html",
+		"clients.html/",
+		"/clients.html",
+		"..%2fclients.html",
+		"CLIENTS.HTML",
+		"../../GO-Server/settings.env",
+	}
+	for _, name := range rejected {
+		if got, ok := pageTemplate(name); ok {
+			t.Errorf("pageTemplate(%q) = %q, want rejection", name, got)
+		}
+	}
+}
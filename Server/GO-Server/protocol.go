@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"ondeso/protocol"
+)
+
+// errNotSupported marks payloads a client cannot handle.
+var errNotSupported = errors.New("not supported by the client")
+
+// clientProtocol is what a client announced at registration.
+type clientProtocol struct {
+	Version       int
+	ClientVersion string
+	Capabilities  map[string]bool
+	OS            string // Empty for clients that do not announce their platform
+	Arch          string
+	Staged        bool // New build a service checks before installing it
+}
+
+// parseClientProtocol reads protocol_version, client_version, capabilities
+// and platform from a register message. The transfer_modes and compression
+// fields of earlier builds count as capabilities as well.
+func parseClientProtocol(register *protocol.Register) (clientProtocol, error) {
+	announced := clientProtocol{Version: int(register.ProtocolVersion), ClientVersion: register.ClientVersion, Capabilities: make(map[string]bool),
+		OS: register.OS, Arch: register.Arch, Staged: register.Staged}
+	if announced.Version == 0 {
+		announced.Version = 1 // Clients without protocol_version
+	}
+
+	if announced.Version < 2 {
+		for _, capability := range protocol.LegacyCapabilities {
+			announced.Capabilities[capability] = true
+		}
+	}
+	for _, capability := range strings.Split(register.Capabilities, ",") {
+		if capability = strings.TrimSpace(capability); capability != "" {
+			announced.Capabilities[strings.ToLower(capability)] = true
+		}
+	}
+	if frames, compression := negotiateTransfer(register); frames {
+		announced.Capabilities[protocol.CapBinaryFrames] = true
+		if compression != "" {
+			announced.Capabilities[protocol.CapGzip] = true
+		}
+	}
+
+	if announced.Version > int(protocol.CurrentVersion) {
+		announced.Version = int(protocol.CurrentVersion) // Newer client: downgrade to ours
+	}
+	if min := getEnvInt("MIN_PROTOCOL_VERSION", 1); announced.Version < min {
+		return announced, fmt.Errorf("protocol version %d is no longer supported (minimum %d)", announced.Version, min)
+	}
+	return announced, nil
+}
+
+// capabilityList returns the capabilities sorted and comma-separated, as
+// stored on the asset.
+func (p clientProtocol) capabilityList() string {
+	list := make([]string, 0, len(p.Capabilities))
+	for capability := range p.Capabilities {
+		list = append(list, capability)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// platform returns the platform of the client build. Clients that do not
+// announce one predate Linux builds and run on Windows.
+func (p clientProtocol) platform() agentPlatform {
+	if p.OS == "" {
+		return defaultPlatform
+	}
+	return agentPlatform{OS: p.OS, Arch: p.Arch}
+}
+
+// supports reports whether a client announced a capability.
+func (c Client) supports(capability string) bool {
+	return c.Protocol.Capabilities[capability]
+}
+
+// compression returns the compression used for frame transfers to a client.
+func (c Client) compression() string {
+	if c.supports(protocol.CapGzip) {
+		return compressionGzip
+	}
+	return ""
+}
+
+// checkScriptSupport refuses scripts a client would run incorrectly: without
+// the parameters it needs or on the wrong operating system.
+func checkScriptSupport(client Client, script scriptPayload) error {
+	switch {
+	case !client.supports(protocol.CapScripts):
+		return fmt.Errorf("scripts: %w", errNotSupported)
+	case script.Arguments != "" && !client.supports(protocol.CapScriptParameters):
+		return fmt.Errorf("script parameters: %w", errNotSupported)
+	case script.TargetOS != "" && script.TargetOS != targetOSAny && !client.supports(protocol.CapTargetOS):
+		return fmt.Errorf("target_os %s: %w", script.TargetOS, errNotSupported)
+	}
+	return nil
+}
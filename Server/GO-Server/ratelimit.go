@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the tokens left for one key of a rateLimiter.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter per key (IP address or client ID).
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter allows perMinute events per key on average and up to burst
+// events at once.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for the key and reports whether one was available.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// cleanup drops buckets that have been refilled completely, so the map does
+// not grow with every address ever seen.
+func (l *rateLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Limiters of the ingress endpoints, created by initRateLimits.
+var (
+	inboxLimiter     *rateLimiter
+	wsConnLimiter    *rateLimiter
+	wsMessageLimiter *rateLimiter
+)
+
+// initRateLimits creates the limiters from the settings and removes idle
+// buckets periodically.
+func initRateLimits() {
+	inboxLimiter = newRateLimiter(getEnvInt("INBOX_RATE_PER_MINUTE", 60), getEnvInt("INBOX_BURST", 20))
+	wsConnLimiter = newRateLimiter(getEnvInt("WS_CONNECTIONS_PER_MINUTE", 30), getEnvInt("WS_CONNECTIONS_BURST", 10))
+	wsMessageLimiter = newRateLimiter(getEnvInt("WS_MESSAGES_PER_MINUTE", 1200), getEnvInt("WS_MESSAGES_BURST", 200))
+
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				inboxLimiter.cleanup()
+				wsConnLimiter.cleanup()
+				wsMessageLimiter.cleanup()
+			case <-appCtx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// rejectionCounters counts rejected requests and messages by reason for /metrics.
+var rejectionCounters = struct {
+	sync.Mutex
+	values map[string]uint64
+}{values: make(map[string]uint64)}
+
+// countRejection increments the counter of a rejection reason.
+func countRejection(reason string) {
+	rejectionCounters.Lock()
+	rejectionCounters.values[reason]++
+	rejectionCounters.Unlock()
+}
+
+// limitBody caps the request body of a handler at maxBytes.
+func limitBody(maxBytes int64, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			countRejection("http_body_too_large")
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// maxInboxClientID is the longest client ID used as a rate limit key.
+const maxInboxClientID = 64
+
+// inboxClientID returns the client ID an upload names in the X-Client-ID
+// header or the client_id query parameter, or "" if there is none. The body
+// is not read, so the limit applies before it is received.
+func inboxClientID(r *http.Request) string {
+	clientID := r.Header.Get("X-Client-ID")
+	if clientID == "" {
+		clientID = r.URL.Query().Get("client_id")
+	}
+	if len(clientID) > maxInboxClientID {
+		return ""
+	}
+	return clientID
+}
+
+// limitInbox applies the rate limits and the body size limit of /inbox. Each
+// upload counts against its IP address and, if it names one, its client ID,
+// so neither many clients behind one address nor one client from many
+// addresses can exceed INBOX_RATE_PER_MINUTE.
+func limitInbox(handler http.HandlerFunc) http.HandlerFunc {
+	maxBytes := int64(getEnvInt("INBOX_MAX_BYTES", 10<<20))
+	limited := limitBody(maxBytes, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := inboxLimiter.allow("ip:" + sourceIP(r))
+		if clientID := inboxClientID(r); allowed && clientID != "" {
+			allowed = inboxLimiter.allow("client:" + clientID)
+		}
+		if !allowed {
+			countRejection("inbox_rate_limited")
+			log.Printf("🚦 Inbox-Anfrage von %s (%s) wegen Ratenlimit abgelehnt", sourceIP(r), inboxClientID(r))
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	}
+}
+
+// allowWebSocketMessage applies the message rate limit of a connection, keyed
+// by client ID once registered and by IP address before.
+func allowWebSocketMessage(clientID, ip string) bool {
+	key := "client:" + clientID
+	if clientID == "" {
+		key = "ip:" + ip
+	}
+	if wsMessageLimiter.allow(key) {
+		return true
+	}
+	countRejection("ws_message_rate_limited")
+	return false
+}
+
+// metricsHandler exports the rejection counters and the number of connected
+// clients in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	rejectionCounters.Lock()
+	reasons := make([]string, 0, len(rejectionCounters.values))
+	for reason := range rejectionCounters.values {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	values := make([]uint64, len(reasons))
+	for i, reason := range reasons {
+		values[i] = rejectionCounters.values[reason]
+	}
+	rejectionCounters.Unlock()
+
+	clientsMutex.RLock()
+	connected := len(clients)
+	clientsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP ondeso_connected_clients Number of registered WebSocket clients.")
+	fmt.Fprintln(w, "# TYPE ondeso_connected_clients gauge")
+	fmt.Fprintf(w, "ondeso_connected_clients %d\n", connected)
+	fmt.Fprintln(w, "# HELP ondeso_rejected_total Requests and messages rejected by rate or size limits.")
+	fmt.Fprintln(w, "# TYPE ondeso_rejected_total counter")
+	for i, reason := range reasons {
+		fmt.Fprintf(w, "ondeso_rejected_total{reason=%q} %d\n", reason, values[i])
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	limiter := newRateLimiter(60, 3) // One token per second
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("a") {
+			t.Fatalf("request %d within the burst rejected", i+1)
+		}
+	}
+	if limiter.allow("a") {
+		t.Fatal("request beyond the burst allowed")
+	}
+	if !limiter.allow("b") {
+		t.Fatal("other key limited by the first one")
+	}
+
+	// Two seconds later two tokens are back, but no more.
+	limiter.buckets["a"].last = limiter.buckets["a"].last.Add(-2 * time.Second)
+	for i := 0; i < 2; i++ {
+		if !limiter.allow("a") {
+			t.Fatalf("request %d after refill rejected", i+1)
+		}
+	}
+	if limiter.allow("a") {
+		t.Fatal("refill exceeded the elapsed time")
+	}
+
+	// Long idle periods refill at most the burst.
+	limiter.buckets["a"].last = limiter.buckets["a"].last.Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("a") {
+			t.Fatalf("request %d after idle period rejected", i+1)
+		}
+	}
+	if limiter.allow("a") {
+		t.Fatal("idle period refilled more than the burst")
+	}
+}
+
+func TestRateLimiterCleanup(t *testing.T) {
+	limiter := newRateLimiter(60, 3)
+	limiter.allow("busy")
+	limiter.allow("busy")
+	limiter.allow("idle")
+	limiter.buckets["idle"].last = time.Now().Add(-time.Minute)
+
+	limiter.cleanup()
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Error("refilled bucket not removed")
+	}
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Error("bucket that is not refilled yet removed")
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	var readErr error
+	handler := limitBody(10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+		wantTooLarge  bool
+	}{
+		{"within limit", "0123456789", 10, http.StatusOK, false},
+		{"declared too large", "0123456789a", 11, http.StatusRequestEntityTooLarge, false},
+		{"chunked too large", "0123456789a", -1, http.StatusOK, true}, // The handler sees the error
+	}
+	for _, tt := range tests {
+		readErr = nil
+		r := httptest.NewRequest(http.MethodPost, "/inbox", strings.NewReader(tt.body))
+		r.ContentLength = tt.contentLength
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		var tooLarge *http.MaxBytesError
+		if got := errors.As(readErr, &tooLarge); got != tt.wantTooLarge {
+			t.Errorf("%s: read error %v, want MaxBytesError %v", tt.name, readErr, tt.wantTooLarge)
+		}
+	}
+}
+
+func TestLimitInbox(t *testing.T) {
+	t.Setenv("INBOX_MAX_BYTES", "16")
+	oldLimiter := inboxLimiter
+	t.Cleanup(func() { inboxLimiter = oldLimiter })
+	inboxLimiter = newRateLimiter(1, 2)
+	handler := limitInbox(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	post := func(ip, header, query, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/inbox"+query, strings.NewReader(body))
+		r.RemoteAddr = ip + ":50000"
+		if header != "" {
+			r.Header.Set("X-Client-ID", header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name              string
+		ip, header, query string
+		body              string
+		want              int
+	}{
+		{"first from IP", "10.0.0.1", "", "", "{}", http.StatusCreated},
+		{"second from IP", "10.0.0.1", "", "", "{}", http.StatusCreated},
+		{"IP burst used up", "10.0.0.1", "", "", "{}", http.StatusTooManyRequests},
+		{"client by header", "10.0.0.2", "c1", "", "{}", http.StatusCreated},
+		{"client by query", "10.0.0.3", "", "?client_id=c1", "{}", http.StatusCreated},
+		{"client burst used up from a new IP", "10.0.0.4", "c1", "", "{}", http.StatusTooManyRequests},
+		{"other client from a new IP", "10.0.0.5", "c2", "", "{}", http.StatusCreated},
+		{"oversize body", "10.0.0.6", "", "", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge},
+		{"overlong client ID ignored", "10.0.0.7", strings.Repeat("c", maxInboxClientID+1), "", "{}", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if got := post(tt.ip, tt.header, tt.query, tt.body); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
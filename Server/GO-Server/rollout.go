@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"ondeso/protocol"
+)
+
+// Rollout states.
+const (
+	rolloutRunning   = "running"
+	rolloutCompleted = "completed"
+	rolloutHalted    = "halted"
+)
+
+// Rollout target states.
+const (
+	targetPending     = "pending"
+	targetSent        = "sent"
+	targetSuccess     = "success"
+	targetFailed      = "failed"
+	targetTimeout     = "timeout"
+	targetUnreachable = "unreachable"
+)
+
+// Rollout is a staged script distribution. Wave 0 holds the canaries, the
+// remaining targets follow in waves once enough clients of the previous wave
+// reported a successful execution.
+type Rollout struct {
+	BaseModel
+	ScriptName        string `gorm:"column:script_name;size:255"`
+	ScriptType        string `gorm:"column:script_type;size:50"`
+	ScriptContent     string `gorm:"column:script_content;type:text"`
+	ScriptSHA256      string `gorm:"column:script_sha256;size:64"`
+	ScriptVersion     int    `gorm:"column:script_version"` // 0 = file of the script directory
+	TargetOS          string `gorm:"column:target_os;size:20"`
+	TimeoutSeconds    int    `gorm:"column:timeout_seconds"`
+	ScriptArguments   string `gorm:"column:script_arguments;type:text"` // JSON array of protocol.ScriptArgument
+	Target            string `gorm:"column:target;size:1024"`
+	CanaryPercent     int    `gorm:"column:canary_percent"`
+	CanaryClients     string `gorm:"column:canary_clients;type:text"`
+	WavePercent       int    `gorm:"column:wave_percent"`
+	MinSuccessPercent int    `gorm:"column:min_success_percent"`
+	MaxFailurePercent int    `gorm:"column:max_failure_percent"`
+	WaveTimeout       int    `gorm:"column:wave_timeout"` // seconds
+	Status            string `gorm:"column:status;size:50"`
+	CurrentWave       int    `gorm:"column:current_wave"`
+	TotalWaves        int    `gorm:"column:total_waves"`
+	Message           string `gorm:"column:message;size:1024"`
+}
+
+// RolloutTarget is a single client of a rollout.
+type RolloutTarget struct {
+	BaseModel
+	RolloutID   uint       `gorm:"column:rollout_id;index"`
+	ClientID    string     `gorm:"column:client_id;size:255"`
+	Wave        int        `gorm:"column:wave"`
+	ExecutionID string     `gorm:"column:execution_id;size:64;unique_index"`
+	Status      string     `gorm:"column:status;size:50"`
+	ExitCode    *int       `gorm:"column:exit_code"`
+	SentAt      *time.Time `gorm:"column:sent_at"`
+	FinishedAt  *time.Time `gorm:"column:finished_at"`
+}
+
+// formInt reads an integer form value within [min, max], falling back to def.
+func formInt(r *http.Request, key string, def, min, max int) (int, error) {
+	value := strings.TrimSpace(r.FormValue(key))
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be a number between %d and %d", key, min, max)
+	}
+	return n, nil
+}
+
+// planWaves splits the clients into a canary wave and following waves.
+func planWaves(clientIDs []string, canaries []string, canaryPercent, wavePercent int) [][]string {
+	isCanary := make(map[string]bool)
+	var waves [][]string
+	var canaryWave []string
+
+	if len(canaries) > 0 {
+		for _, id := range canaries {
+			isCanary[id] = true
+		}
+		for _, id := range clientIDs {
+			if isCanary[id] {
+				canaryWave = append(canaryWave, id)
+			}
+		}
+	} else {
+		count := (len(clientIDs)*canaryPercent + 99) / 100
+		if count < 1 {
+			count = 1
+		}
+		for _, id := range clientIDs[:count] {
+			isCanary[id] = true
+			canaryWave = append(canaryWave, id)
+		}
+	}
+	waves = append(waves, canaryWave)
+
+	waveSize := (len(clientIDs)*wavePercent + 99) / 100
+	if waveSize < 1 {
+		waveSize = 1
+	}
+	var wave []string
+	for _, id := range clientIDs {
+		if isCanary[id] {
+			continue
+		}
+		wave = append(wave, id)
+		if len(wave) == waveSize {
+			waves = append(waves, wave)
+			wave = nil
+		}
+	}
+	if len(wave) > 0 {
+		waves = append(waves, wave)
+	}
+	return waves
+}
+
+// startRollout stores a new rollout with its targets and starts the runner.
+func startRollout(ctx context.Context, rollout Rollout) (Rollout, error) {
+	targets, err := resolveTarget(rollout.Target)
+	if err != nil {
+		return rollout, err
+	}
+	if len(targets) == 0 {
+		return rollout, fmt.Errorf("target %q matches no connected client", rollout.Target)
+	}
+
+	clientIDs := make([]string, 0, len(targets))
+	for _, client := range targets {
+		clientIDs = append(clientIDs, client.ID)
+	}
+
+	var canaries []string
+	for _, id := range strings.Split(rollout.CanaryClients, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			canaries = append(canaries, id)
+		}
+	}
+	waves := planWaves(clientIDs, canaries, rollout.CanaryPercent, rollout.WavePercent)
+	if len(waves[0]) == 0 {
+		return rollout, fmt.Errorf("none of the canary clients is part of the target")
+	}
+
+	rollout.Status = rolloutRunning
+	rollout.TotalWaves = len(waves)
+
+	tx := db.Begin()
+	if err := tx.Create(&rollout).Error; err != nil {
+		tx.Rollback()
+		return rollout, err
+	}
+	for waveIndex, wave := range waves {
+		for _, clientID := range wave {
+			target := RolloutTarget{
+				RolloutID:   rollout.ID,
+				ClientID:    clientID,
+				Wave:        waveIndex,
+				ExecutionID: uuid.New().String(),
+				Status:      targetPending,
+			}
+			if err := tx.Create(&target).Error; err != nil {
+				tx.Rollback()
+				return rollout, err
+			}
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return rollout, err
+	}
+
+	log.Printf("🚦 Rollout %d gestartet: %s an %d Clients in %d Wellen", rollout.ID, rollout.ScriptName, len(clientIDs), len(waves))
+	go runRollout(ctx, rollout.ID)
+	return rollout, nil
+}
+
+// resumeRollouts restarts the runners of rollouts that were still running
+// when the server stopped.
+func resumeRollouts(ctx context.Context) {
+	var rollouts []Rollout
+	if err := db.Where("status = ?", rolloutRunning).Find(&rollouts).Error; err != nil {
+		log.Printf("❌ Fehler beim Laden laufender Rollouts: %v", err)
+		return
+	}
+	for _, rollout := range rollouts {
+		log.Printf("🔄 Setze Rollout %d fort (Welle %d/%d)", rollout.ID, rollout.CurrentWave+1, rollout.TotalWaves)
+		go runRollout(ctx, rollout.ID)
+	}
+}
+
+// setRolloutState updates the state of a rollout.
+func setRolloutState(id uint, status, message string) {
+	if err := db.Model(&Rollout{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":  status,
+		"message": message,
+	}).Error; err != nil {
+		log.Printf("❌ Fehler beim Aktualisieren von Rollout %d: %v", id, err)
+	}
+}
+
+// rolloutCounts counts the targets of a rollout by state, optionally
+// restricted to a wave (wave < 0 counts all waves).
+func rolloutCounts(rolloutID uint, wave int) map[string]int {
+	var targets []RolloutTarget
+	query := db.Where("rollout_id = ?", rolloutID)
+	if wave >= 0 {
+		query = query.Where("wave = ?", wave)
+	}
+	query.Find(&targets)
+
+	counts := make(map[string]int)
+	for _, target := range targets {
+		counts[target.Status]++
+	}
+	return counts
+}
+
+// failureRateExceeded reports whether the failed share of all finished
+// targets exceeds the limit of the rollout.
+func failureRateExceeded(rollout Rollout) (bool, int) {
+	return failureRate(rolloutCounts(rollout.ID, -1), rollout.MaxFailurePercent)
+}
+
+// failureRate computes the failed share of the finished targets in counts.
+// Pending and unreachable targets never ran the script and do not count.
+func failureRate(counts map[string]int, maxFailurePercent int) (bool, int) {
+	failed := counts[targetFailed] + counts[targetTimeout]
+	finished := failed + counts[targetSuccess]
+	if finished == 0 {
+		return false, 0
+	}
+	rate := failed * 100 / finished
+	return rate > maxFailurePercent, rate
+}
+
+// rolloutScript returns the script stored with a rollout.
+func rolloutScript(rollout Rollout) scriptPayload {
+	return scriptPayload{
+		Name:           rollout.ScriptName,
+		Type:           rollout.ScriptType,
+		Version:        rollout.ScriptVersion,
+		Content:        []byte(rollout.ScriptContent),
+		SHA256:         rollout.ScriptSHA256,
+		TargetOS:       rollout.TargetOS,
+		TimeoutSeconds: rollout.TimeoutSeconds,
+		Arguments:      rollout.ScriptArguments,
+	}
+}
+
+// pendingTargetStatus decides about a pending target of a wave: targetSent
+// if the script is to be sent to the client, targetPending while the client
+// is disconnected and the wave has not timed out, else the final status.
+func pendingTargetStatus(client Client, connected, timedOut bool) string {
+	switch {
+	case !connected || client.Conn == nil:
+		if !timedOut {
+			return targetPending
+		}
+		return targetUnreachable
+	case !client.supports(protocol.CapScriptResults):
+		// Without script_result the wave could never be evaluated.
+		return targetFailed
+	}
+	return targetSent
+}
+
+// waveWaiting reports whether a wave that has not timed out waits longer: for
+// disconnected targets to reconnect, or for results while too few succeeded.
+func waveWaiting(counts map[string]int, minSuccessPercent int) bool {
+	if counts[targetPending] > 0 {
+		return true
+	}
+	reached := counts[targetSent] + counts[targetSuccess] + counts[targetFailed] + counts[targetTimeout]
+	return counts[targetSent] > 0 && counts[targetSuccess]*100/reached < minSuccessPercent
+}
+
+// sendRolloutWave sends the script to the pending targets of a wave that are
+// connected. Disconnected targets stay pending, so they are still reached when
+// they reconnect (e.g. after a server restart); once the wave timed out they
+// are marked unreachable.
+func sendRolloutWave(rollout Rollout, wave int, timedOut bool) {
+	var targets []RolloutTarget
+	db.Where("rollout_id = ? AND wave = ? AND status = ?", rollout.ID, wave, targetPending).Find(&targets)
+
+	for _, target := range targets {
+		// Only the lookup holds clientsMutex; writes are serialized per
+		// connection, so a slow client does not block the others.
+		clientsMutex.RLock()
+		client, ok := clients[target.ClientID]
+		clientsMutex.RUnlock()
+		status := pendingTargetStatus(client, ok, timedOut)
+		switch status {
+		case targetPending:
+			continue
+		case targetFailed:
+			log.Printf("⚠️ Rollout %d: %s meldet keine Skriptergebnisse, übersprungen", rollout.ID, target.ClientID)
+		case targetSent:
+			if err := sendScriptChunks(client, rolloutScript(rollout), target.ExecutionID); err != nil {
+				log.Printf("❌ Rollout %d: Fehler beim Senden an %s: %v", rollout.ID, target.ClientID, err)
+				status = targetUnreachable
+				if errors.Is(err, errNotSupported) {
+					status = targetFailed
+				}
+			}
+		}
+
+		now := time.Now()
+		db.Model(&target).Updates(map[string]interface{}{"status": status, "sent_at": now})
+		log.Printf("📤 Rollout %d, Welle %d: %s -> %s", rollout.ID, wave+1, target.ClientID, status)
+	}
+}
+
+// runRollout drives a rollout wave by wave until it completes or halts.
+func runRollout(ctx context.Context, rolloutID uint) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		var rollout Rollout
+		if err := db.First(&rollout, rolloutID).Error; err != nil {
+			log.Printf("❌ Rollout %d konnte nicht geladen werden: %v", rolloutID, err)
+			return
+		}
+		if rollout.Status != rolloutRunning {
+			log.Printf("⏹️ Rollout %d beendet mit Status %s", rollout.ID, rollout.Status)
+			return
+		}
+		if rollout.CurrentWave >= rollout.TotalWaves {
+			setRolloutState(rollout.ID, rolloutCompleted, "Alle Wellen abgeschlossen")
+			log.Printf("✅ Rollout %d abgeschlossen", rollout.ID)
+			return
+		}
+
+		wave := rollout.CurrentWave
+		sendRolloutWave(rollout, wave, false)
+		deadline := time.Now().Add(time.Duration(rollout.WaveTimeout) * time.Second)
+
+	waitLoop:
+		for {
+			select {
+			case <-ctx.Done():
+				log.Printf("Rollout %d exiting due to context cancellation", rollout.ID)
+				return
+			case <-ticker.C:
+			}
+
+			var current Rollout
+			if err := db.First(&current, rolloutID).Error; err == nil && current.Status != rolloutRunning {
+				log.Printf("⏹️ Rollout %d beendet mit Status %s", current.ID, current.Status)
+				return
+			}
+
+			if exceeded, rate := failureRateExceeded(rollout); exceeded {
+				setRolloutState(rollout.ID, rolloutHalted, fmt.Sprintf("Fehlerrate %d%% überschreitet Grenze von %d%%", rate, rollout.MaxFailurePercent))
+				log.Printf("🛑 Rollout %d automatisch angehalten (Fehlerrate %d%%)", rollout.ID, rate)
+				return
+			}
+
+			timedOut := time.Now().After(deadline)
+			counts := rolloutCounts(rollout.ID, wave)
+			if counts[targetPending] > 0 {
+				sendRolloutWave(rollout, wave, timedOut)
+				counts = rolloutCounts(rollout.ID, wave)
+			}
+			reached := counts[targetSent] + counts[targetSuccess] + counts[targetFailed] + counts[targetTimeout]
+
+			if !timedOut && waveWaiting(counts, rollout.MinSuccessPercent) {
+				continue
+			}
+
+			if timedOut && counts[targetSent] > 0 {
+				db.Model(&RolloutTarget{}).Where("rollout_id = ? AND wave = ? AND status = ?", rollout.ID, wave, targetSent).
+					Update("status", targetTimeout)
+				counts = rolloutCounts(rollout.ID, wave)
+				if exceeded, rate := failureRateExceeded(rollout); exceeded {
+					setRolloutState(rollout.ID, rolloutHalted, fmt.Sprintf("Fehlerrate %d%% überschreitet Grenze von %d%%", rate, rollout.MaxFailurePercent))
+					log.Printf("🛑 Rollout %d automatisch angehalten (Fehlerrate %d%%)", rollout.ID, rate)
+					return
+				}
+			}
+
+			if reached == 0 {
+				setRolloutState(rollout.ID, rolloutHalted, fmt.Sprintf("Kein Client der Welle %d erreichbar", wave+1))
+				log.Printf("🛑 Rollout %d angehalten: Welle %d nicht erreichbar", rollout.ID, wave+1)
+				return
+			}
+			if counts[targetSuccess]*100/reached < rollout.MinSuccessPercent {
+				setRolloutState(rollout.ID, rolloutHalted, fmt.Sprintf("Welle %d: nur %d von %d erfolgreich", wave+1, counts[targetSuccess], reached))
+				log.Printf("🛑 Rollout %d angehalten: zu wenige Erfolge in Welle %d", rollout.ID, wave+1)
+				return
+			}
+			break waitLoop
+		}
+
+		log.Printf("🌊 Rollout %d: Welle %d/%d abgeschlossen", rollout.ID, wave+1, rollout.TotalWaves)
+		db.Model(&Rollout{}).Where("id = ?", rollout.ID).Update("current_wave", wave+1)
+	}
+}
+
+// recordScriptResult stores an execution result reported by a client.
+func recordScriptResult(clientID string, result *protocol.ScriptResult) {
+	executionID, scriptName, status, exitCode := result.ExecutionID, result.ScriptName, result.Status, result.ExitCode
+
+	log.Printf("🏁 Skriptergebnis von %s: %s (Exit-Code: %d, Status: %s)", clientID, scriptName, exitCode, status)
+	if executionID == "" {
+		return
+	}
+
+	var target RolloutTarget
+	if err := db.Where("execution_id = ? AND client_id = ?", executionID, clientID).First(&target).Error; err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			log.Printf("❌ Fehler beim Laden des Rollout-Ziels %s: %v", executionID, err)
+		}
+		return
+	}
+
+	targetStatus := targetFailed
+	if status == "success" && exitCode == 0 {
+		targetStatus = targetSuccess
+	}
+	now := time.Now()
+	if err := db.Model(&target).Updates(map[string]interface{}{
+		"status":      targetStatus,
+		"exit_code":   exitCode,
+		"finished_at": now,
+	}).Error; err != nil {
+		log.Printf("❌ Fehler beim Speichern des Skriptergebnisses %s: %v", executionID, err)
+	}
+}
+
+// --- HTTP Handlers ---
+
+func rolloutsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var rollouts []Rollout
+		if err := db.Order("id desc").Find(&rollouts).Error; err != nil {
+			log.Printf("Error loading rollouts: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]interface{}, 0, len(rollouts))
+		for _, rollout := range rollouts {
+			result = append(result, rolloutSummary(rollout))
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		scriptName := r.FormValue("script_name")
+		scriptType := r.FormValue("script_type")
+		target := r.FormValue("target")
+		if scriptName == "" || target == "" {
+			http.Error(w, "Script name or target missing", http.StatusBadRequest)
+			return
+		}
+
+		rollout := Rollout{Target: target, CanaryClients: r.FormValue("canary_clients")}
+		var err error
+		for _, field := range []struct {
+			key      string
+			dest     *int
+			def, min int
+			max      int
+		}{
+			{"canary_percent", &rollout.CanaryPercent, 10, 1, 100},
+			{"wave_percent", &rollout.WavePercent, 25, 1, 100},
+			{"min_success_percent", &rollout.MinSuccessPercent, 90, 0, 100},
+			{"max_failure_percent", &rollout.MaxFailurePercent, 10, 0, 100},
+			{"wave_timeout", &rollout.WaveTimeout, 600, 10, 86400},
+		} {
+			if *field.dest, err = formInt(r, field.key, field.def, field.min, field.max); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// The rollout keeps its own copy, so later uploads don't change it.
+		script, err := loadScript(scriptName)
+		if err == errScriptNotFound {
+			http.Error(w, "Script not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading script: %v", err)
+			http.Error(w, "Error reading script", http.StatusInternalServerError)
+			return
+		}
+		if scriptType != "" {
+			script.Type = scriptType
+		}
+		if err := script.bindArguments(r.FormValue("parameters")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		auditPayload(r, script.Content)
+		auditDetail(r, "script=%s type=%s target=%s parameters=%s", script.ref(), script.Type, target, script.Arguments)
+		rollout.ScriptName = script.Name
+		rollout.ScriptType = script.Type
+		rollout.ScriptVersion = script.Version
+		rollout.ScriptContent = string(script.Content)
+		rollout.ScriptSHA256 = script.SHA256
+		rollout.TargetOS = script.TargetOS
+		rollout.TimeoutSeconds = script.TimeoutSeconds
+		rollout.ScriptArguments = script.Arguments
+
+		rollout, err = startRollout(appCtx, rollout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rolloutSummary(rollout))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rolloutSummary returns the API representation of a rollout.
+func rolloutSummary(rollout Rollout) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                  rollout.ID,
+		"script_name":         rollout.ScriptName,
+		"script_type":         rollout.ScriptType,
+		"script_sha256":       rollout.ScriptSHA256,
+		"script_version":      rollout.ScriptVersion,
+		"timeout_seconds":     rollout.TimeoutSeconds,
+		"parameters":          rollout.ScriptArguments,
+		"target":              rollout.Target,
+		"status":              rollout.Status,
+		"message":             rollout.Message,
+		"current_wave":        rollout.CurrentWave,
+		"total_waves":         rollout.TotalWaves,
+		"canary_percent":      rollout.CanaryPercent,
+		"canary_clients":      rollout.CanaryClients,
+		"wave_percent":        rollout.WavePercent,
+		"min_success_percent": rollout.MinSuccessPercent,
+		"max_failure_percent": rollout.MaxFailurePercent,
+		"wave_timeout":        rollout.WaveTimeout,
+		"created_at":          rollout.CreatedAt,
+		"counts":              rolloutCounts(rollout.ID, -1),
+	}
+}
+
+func rolloutStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Rollout ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var rollout Rollout
+	if err := db.First(&rollout, id).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			http.Error(w, "Rollout not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error loading rollout %d: %v", id, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var targets []RolloutTarget
+	db.Where("rollout_id = ?", rollout.ID).Order("wave, client_id").Find(&targets)
+
+	waves := make([]map[string]int, rollout.TotalWaves)
+	for i := range waves {
+		waves[i] = rolloutCounts(rollout.ID, i)
+	}
+
+	result := rolloutSummary(rollout)
+	result["waves"] = waves
+	result["targets"] = targets
+	json.NewEncoder(w).Encode(result)
+}
+
+func haltRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Rollout ID is required", http.StatusBadRequest)
+		return
+	}
+
+	auditTargets(r, "rollout:"+strconv.Itoa(id))
+	result := db.Model(&Rollout{}).Where("id = ? AND status = ?", id, rolloutRunning).Updates(map[string]interface{}{
+		"status":  rolloutHalted,
+		"message": "Manuell angehalten",
+	})
+	if result.Error != nil {
+		log.Printf("Error halting rollout %d: %v", id, result.Error)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Rollout not found or not running", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("🛑 Rollout %d manuell angehalten", id)
+	fmt.Fprint(w, `{"status": "success", "message": "Rollout angehalten"}`)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"ondeso/protocol"
+)
+
+func TestPlanWaves(t *testing.T) {
+	clients := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+
+	tests := []struct {
+		name          string
+		clientIDs     []string
+		canaries      []string
+		canaryPercent int
+		wavePercent   int
+		want          [][]string
+	}{
+		{
+			name:          "canary percentage rounds up",
+			clientIDs:     clients,
+			canaryPercent: 15,
+			wavePercent:   40,
+			want:          [][]string{{"a", "b"}, {"c", "d", "e", "f"}, {"g", "h", "i", "j"}},
+		},
+		{
+			name:          "at least one canary",
+			clientIDs:     clients[:3],
+			canaryPercent: 1,
+			wavePercent:   100,
+			want:          [][]string{{"a"}, {"b", "c"}},
+		},
+		{
+			name:          "explicit canaries keep target order",
+			clientIDs:     clients[:5],
+			canaries:      []string{"d", "b"},
+			canaryPercent: 50,
+			wavePercent:   20,
+			want:          [][]string{{"b", "d"}, {"a"}, {"c"}, {"e"}},
+		},
+		{
+			name:          "canaries outside the target are ignored",
+			clientIDs:     clients[:2],
+			canaries:      []string{"x"},
+			canaryPercent: 10,
+			wavePercent:   50,
+			want:          [][]string{nil, {"a"}, {"b"}},
+		},
+		{
+			name:          "single client",
+			clientIDs:     clients[:1],
+			canaryPercent: 10,
+			wavePercent:   25,
+			want:          [][]string{{"a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planWaves(tt.clientIDs, tt.canaries, tt.canaryPercent, tt.wavePercent)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planWaves() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormInt(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    int
+		wantErr bool
+	}{
+		{"", 25, false},
+		{"n=", 25, false},
+		{"n=+7", 7, false},
+		{"n=%2010%20", 10, false},
+		{"n=1", 1, false},
+		{"n=100", 100, false},
+		{"n=0", 0, true},
+		{"n=101", 0, true},
+		{"n=-5", 0, true},
+		{"n=ten", 0, true},
+		{"n=1.5", 0, true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/rollouts?"+tt.query, nil)
+		got, err := formInt(r, "n", 25, 1, 100)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("formInt(%q) = %d, %v, want %d, error %v", tt.query, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestWaveWithDisconnectedTargets(t *testing.T) {
+	connected := Client{ID: "a", Conn: &clientConn{}, Protocol: clientProtocol{Capabilities: map[string]bool{protocol.CapScriptResults: true}}}
+	legacy := Client{ID: "b", Conn: &clientConn{}, Protocol: clientProtocol{Capabilities: map[string]bool{}}}
+	disconnected := Client{ID: "c"}
+
+	tests := []struct {
+		name      string
+		client    Client
+		connected bool
+		timedOut  bool
+		want      string
+	}{
+		{"connected", connected, true, false, targetSent},
+		{"connected after timeout", connected, true, true, targetSent},
+		{"without script results", legacy, true, false, targetFailed},
+		{"disconnected", disconnected, false, false, targetPending},
+		{"registered without connection", disconnected, true, false, targetPending},
+		{"disconnected after timeout", disconnected, false, true, targetUnreachable},
+	}
+	for _, tt := range tests {
+		if got := pendingTargetStatus(tt.client, tt.connected, tt.timedOut); got != tt.want {
+			t.Errorf("pendingTargetStatus(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Before the timeout: one target succeeded, one is still disconnected.
+	before := map[string]int{targetSuccess: 1, targetPending: 1}
+	if !waveWaiting(before, 100) {
+		t.Error("wave with a disconnected target did not wait for it")
+	}
+	if exceeded, rate := failureRate(before, 0); exceeded || rate != 0 {
+		t.Errorf("failureRate(before timeout) = %v, %d, want pending targets not to count", exceeded, rate)
+	}
+
+	// After the timeout the disconnected target is unreachable, which does
+	// not count as a failure either.
+	after := map[string]int{targetSuccess: 1, targetUnreachable: 1}
+	if waveWaiting(after, 100) {
+		t.Error("wave waits without pending targets and with all results in")
+	}
+	if exceeded, rate := failureRate(after, 0); exceeded || rate != 0 {
+		t.Errorf("failureRate(after timeout) = %v, %d, want unreachable targets not to count", exceeded, rate)
+	}
+
+	if exceeded, rate := failureRate(map[string]int{targetSuccess: 1, targetFailed: 1, targetTimeout: 1, targetUnreachable: 5}, 50); !exceeded || rate != 66 {
+		t.Errorf("failureRate(failed and timed out) = %v, %d, want true, 66", exceeded, rate)
+	}
+	if !waveWaiting(map[string]int{targetSuccess: 1, targetSent: 1}, 100) {
+		t.Error("wave below the success minimum did not wait for outstanding results")
+	}
+}
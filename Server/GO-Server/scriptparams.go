@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"ondeso/protocol"
+)
+
+// maxScriptParameters limits the parameters sent with a script; the length
+// of each value is limited by protocol.MaxArgumentValue.
+const maxScriptParameters = 32
+
+// Parameter types of a schema.
+const (
+	parameterString = "string"
+	parameterInt    = "int"
+	parameterBool   = "bool"
+)
+
+// scriptParameter describes a parameter a script expects. Values are passed
+// to the script as arguments (PowerShell -Name value, or -Name:$true for bool
+// so [switch] parameters work; positional for the other types in declaration
+// order) and as environment variables ONDESO_PARAM_<Name>.
+type scriptParameter struct {
+	Name        string `json:"name"`
+	Required    bool   `json:"required"`
+	Type        string `json:"type,omitempty"`    // string (default), int or bool
+	Pattern     string `json:"pattern,omitempty"` // regular expression the whole value must match
+	Default     string `json:"default,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// validate checks a value against the declared type and pattern and returns
+// it in normalized form.
+func (p scriptParameter) validate(value string) (string, error) {
+	if err := protocol.CheckArgumentValue(p.Name, value); err != nil {
+		return "", err
+	}
+	switch p.Type {
+	case "", parameterString:
+	case parameterInt:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("parameter %s must be an integer", p.Name)
+		}
+		value = strconv.Itoa(number)
+	case parameterBool:
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("parameter %s must be true or false", p.Name)
+		}
+		value = strconv.FormatBool(flag)
+	}
+	if p.Pattern != "" {
+		pattern, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+		if err != nil {
+			return "", fmt.Errorf("parameter %s has an invalid pattern", p.Name)
+		}
+		if !pattern.MatchString(value) {
+			return "", fmt.Errorf("parameter %s does not match %s", p.Name, p.Pattern)
+		}
+	}
+	return value, nil
+}
+
+// parseScriptParameters validates the "parameters" form field of an upload,
+// a JSON array like [{"name":"Server","required":true,"pattern":"[a-z0-9.-]+"}].
+func parseScriptParameters(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "[]", nil
+	}
+	var parameters []scriptParameter
+	if err := json.Unmarshal([]byte(value), &parameters); err != nil {
+		return "", fmt.Errorf("invalid parameters: %v", err)
+	}
+	if len(parameters) > maxScriptParameters {
+		return "", fmt.Errorf("at most %d parameters are allowed", maxScriptParameters)
+	}
+	seen := make(map[string]bool)
+	for _, parameter := range parameters {
+		if !protocol.ValidArgumentName(parameter.Name) {
+			return "", fmt.Errorf("invalid parameter name %q", parameter.Name)
+		}
+		if seen[strings.ToLower(parameter.Name)] {
+			return "", fmt.Errorf("duplicate parameter %q", parameter.Name)
+		}
+		seen[strings.ToLower(parameter.Name)] = true
+
+		switch parameter.Type {
+		case "", parameterString, parameterInt, parameterBool:
+		default:
+			return "", fmt.Errorf("parameter %s has unknown type %q", parameter.Name, parameter.Type)
+		}
+		if parameter.Pattern != "" {
+			if _, err := regexp.Compile(parameter.Pattern); err != nil {
+				return "", fmt.Errorf("parameter %s has an invalid pattern: %v", parameter.Name, err)
+			}
+		}
+		if parameter.Default != "" {
+			if _, err := parameter.validate(parameter.Default); err != nil {
+				return "", fmt.Errorf("invalid default: %v", err)
+			}
+		}
+	}
+	normalized, _ := json.Marshal(parameters)
+	return string(normalized), nil
+}
+
+// decodeParameterValues reads a JSON object of strings and keeps the order of
+// its keys, since json.Unmarshal into a map would lose it.
+func decodeParameterValues(raw string) ([]protocol.ScriptArgument, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	errObject := fmt.Errorf("parameters must be a JSON object of strings")
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errObject
+	}
+	var values []protocol.ScriptArgument
+	seen := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, errObject
+		}
+		name := token.(string) // Object keys are always strings
+		var value string
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("%v: %v", errObject, err)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		seen[name] = true
+		values = append(values, protocol.ScriptArgument{Name: name, Value: value})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, errObject
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errObject
+	}
+	return values, nil
+}
+
+// bindArguments validates the values of the send endpoints' "parameters" form
+// field, a JSON object like {"Server":"files01"}, and stores them in the
+// payload. Managed scripts only accept their declared parameters, passed in
+// the order of the schema; files of the script directory have no schema,
+// accept any valid name and get their values in the order of the object.
+//
+// Only PowerShell receives named parameters, all other script types receive
+// the values by position. An optional parameter without value and default is
+// therefore sent as an empty value if later parameters follow, so they keep
+// their position; PowerShell scripts do not receive it at all.
+func (s *scriptPayload) bindArguments(raw string) error {
+	ordered, err := decodeParameterValues(raw)
+	if err != nil {
+		return err
+	}
+	if len(ordered) > maxScriptParameters {
+		return fmt.Errorf("at most %d parameters are allowed", maxScriptParameters)
+	}
+
+	var arguments []protocol.ScriptArgument
+	if s.Schema == nil {
+		for _, argument := range ordered {
+			if !protocol.ValidArgumentName(argument.Name) {
+				return fmt.Errorf("invalid parameter name %q", argument.Name)
+			}
+			if err := protocol.CheckArgumentValue(argument.Name, argument.Value); err != nil {
+				return err
+			}
+			arguments = append(arguments, argument)
+		}
+	} else {
+		values := make(map[string]string, len(ordered))
+		for _, argument := range ordered {
+			values[argument.Name] = argument.Value
+		}
+		positional := s.Type != "powershell"
+		var gaps []protocol.ScriptArgument // Unset parameters since the last value
+		for _, parameter := range s.Schema {
+			value, ok := values[parameter.Name]
+			delete(values, parameter.Name)
+			if !ok {
+				if parameter.Default != "" {
+					value = parameter.Default
+				} else if parameter.Required {
+					return fmt.Errorf("parameter %s is required", parameter.Name)
+				} else {
+					if positional {
+						gaps = append(gaps, protocol.ScriptArgument{Name: parameter.Name})
+					}
+					continue
+				}
+			}
+			value, err := parameter.validate(value)
+			if err != nil {
+				return err
+			}
+			argument := protocol.ScriptArgument{Name: parameter.Name, Value: value}
+			if parameter.Type == parameterBool {
+				argument.Type = protocol.ArgumentBool
+			}
+			arguments = append(append(arguments, gaps...), argument)
+			gaps = nil
+		}
+		for _, argument := range ordered {
+			if _, unknown := values[argument.Name]; unknown {
+				return fmt.Errorf("unknown parameter %s for %s", argument.Name, s.ref())
+			}
+		}
+	}
+
+	s.Arguments = protocol.EncodeArguments(arguments)
+	return nil
+}
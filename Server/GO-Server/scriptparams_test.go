@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"ondeso/protocol"
+)
+
+func TestScriptParameterValidate(t *testing.T) {
+	tests := []struct {
+		parameter scriptParameter
+		value     string
+		want      string
+		wantErr   bool
+	}{
+		{scriptParameter{Name: "Server"}, "files01", "files01", false},
+		{scriptParameter{Name: "Server"}, "", "", false},
+		{scriptParameter{Name: "Path"}, `C:\Temp\x y`, `C:\Temp\x y`, false},
+		{scriptParameter{Name: "Count", Type: parameterInt}, "007", "7", false},
+		{scriptParameter{Name: "Count", Type: parameterInt}, "-3", "-3", false},
+		{scriptParameter{Name: "Count", Type: parameterInt}, "3.5", "", true},
+		{scriptParameter{Name: "Count", Type: parameterInt}, "1e3", "", true},
+		{scriptParameter{Name: "Force", Type: parameterBool}, "1", "true", false},
+		{scriptParameter{Name: "Force", Type: parameterBool}, "FALSE", "false", false},
+		{scriptParameter{Name: "Force", Type: parameterBool}, "yes", "", true},
+		{scriptParameter{Name: "Host", Pattern: "[a-z0-9.-]+"}, "files01.example", "files01.example", false},
+		{scriptParameter{Name: "Host", Pattern: "[a-z0-9.-]+"}, "files01 extra", "", true},
+		{scriptParameter{Name: "Host", Pattern: "a|b"}, "ab", "", true}, // the whole value must match
+		{scriptParameter{Name: "Host", Pattern: "("}, "x", "", true},
+		{scriptParameter{Name: "Count", Type: parameterInt, Pattern: "[0-9]"}, "+5", "5", false}, // pattern sees the normalized value
+		{scriptParameter{Name: "Name"}, "a & calc", "", true},
+		{scriptParameter{Name: "Name"}, "a | calc", "", true},
+		{scriptParameter{Name: "Name"}, `a" -Evil "`, "", true},
+		{scriptParameter{Name: "Name"}, "%PATH%", "", true},
+		{scriptParameter{Name: "Name"}, "^x", "", true},
+		{scriptParameter{Name: "Name"}, "a > b", "", true},
+		{scriptParameter{Name: "Name"}, "!x!", "", true},
+		{scriptParameter{Name: "Name"}, "line\nbreak", "", true},
+		{scriptParameter{Name: "Name"}, "tab\there", "", true},
+		{scriptParameter{Name: "Name"}, "del\x7f", "", true},
+		{scriptParameter{Name: "Name"}, strings.Repeat("x", protocol.MaxArgumentValue), strings.Repeat("x", protocol.MaxArgumentValue), false},
+		{scriptParameter{Name: "Name"}, strings.Repeat("x", protocol.MaxArgumentValue+1), "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.parameter.validate(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%+v.validate(%q) = %q, %v, want %q, error %v", tt.parameter, tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseScriptParameters(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "[]", false},
+		{"  ", "[]", false},
+		{`[{"name":"Server","required":true,"pattern":"[a-z]+"}]`, `[{"name":"Server","required":true,"pattern":"[a-z]+"}]`, false},
+		{`[{"name":"Force","type":"bool","default":"true"}]`, `[{"name":"Force","required":false,"type":"bool","default":"true"}]`, false},
+		{`{"name":"Server"}`, "", true},
+		{`[{"name":"1abc"}]`, "", true},
+		{`[{"name":"a-b"}]`, "", true},
+		{`[{"name":""}]`, "", true},
+		{`[{"name":"Server"},{"name":"server"}]`, "", true},
+		{`[{"name":"Server","type":"float"}]`, "", true},
+		{`[{"name":"Server","pattern":"("}]`, "", true},
+		{`[{"name":"Count","type":"int","default":"many"}]`, "", true},
+		{`[{"name":"Server","default":"a&b"}]`, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseScriptParameters(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseScriptParameters(%q) = %q, %v, want %q, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	var many []string
+	for i := 0; i <= maxScriptParameters; i++ {
+		many = append(many, `{"name":"p`+strings.Repeat("x", i)+`"}`)
+	}
+	if _, err := parseScriptParameters("[" + strings.Join(many, ",") + "]"); err == nil {
+		t.Errorf("parseScriptParameters() accepted %d parameters", len(many))
+	}
+}
+
+func TestBindArguments(t *testing.T) {
+	schema := []scriptParameter{
+		{Name: "Server", Required: true},
+		{Name: "Count", Type: parameterInt, Default: "1"},
+		{Name: "Force", Type: parameterBool},
+		{Name: "Comment"},
+	}
+
+	tests := []struct {
+		name    string
+		schema  []scriptParameter
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"no schema, no values", nil, "", "", false},
+		{"no schema keeps object order", nil, `{"zeta":"1","alpha":"2","Mid":"3"}`, `[{"name":"zeta","value":"1"},{"name":"alpha","value":"2"},{"name":"Mid","value":"3"}]`, false},
+		{"no schema, invalid name", nil, `{"a b":"1"}`, "", true},
+		{"no schema, forbidden value", nil, `{"x":"a&b"}`, "", true},
+		{"no schema, duplicate name", nil, `{"x":"1","x":"2"}`, "", true},
+		{"schema, invalid bool", schema, `{"Force":"yes","Server":"files01"}`, "", true},
+		{"schema order, bool typed", schema, `{"Force":"1","Server":"files01"}`, `[{"name":"Server","value":"files01"},{"name":"Count","value":"1"},{"name":"Force","value":"true","type":"bool"}]`, false},
+		{"schema normalizes int", schema, `{"Server":"s","Count":"+5","Comment":"hi"}`, `[{"name":"Server","value":"s"},{"name":"Count","value":"5"},{"name":"Comment","value":"hi"}]`, false},
+		{"schema, missing required", schema, `{"Count":"2"}`, "", true},
+		{"schema, unknown parameter", schema, `{"Server":"s","Other":"x"}`, "", true},
+		{"schema, wrong case is unknown", schema, `{"server":"s"}`, "", true},
+		{"schema, empty object", []scriptParameter{}, `{}`, "", false},
+		{"not an object", nil, `["a","b"]`, "", true},
+		{"null", nil, `null`, "", true},
+		{"number value", nil, `{"x":1}`, "", true},
+		{"nested value", nil, `{"x":{"y":"z"}}`, "", true},
+		{"trailing data", nil, `{"x":"1"} {"y":"2"}`, "", true},
+		{"truncated", nil, `{"x":"1"`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := scriptPayload{Name: "test.ps1", Type: "powershell", Schema: tt.schema}
+			err := payload.bindArguments(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bindArguments(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			}
+			if err == nil && payload.Arguments != tt.want {
+				t.Errorf("bindArguments(%q) = %s, want %s", tt.raw, payload.Arguments, tt.want)
+			}
+		})
+	}
+
+	var many []string
+	for i := 0; i <= maxScriptParameters; i++ {
+		many = append(many, `"p`+strings.Repeat("x", i)+`":"v"`)
+	}
+	payload := scriptPayload{Name: "test.ps1"}
+	if err := payload.bindArguments("{" + strings.Join(many, ",") + "}"); err == nil {
+		t.Errorf("bindArguments() accepted %d values", len(many))
+	}
+}
+
+func TestBindArgumentsKeepsPositions(t *testing.T) {
+	schema := []scriptParameter{
+		{Name: "Server", Required: true},
+		{Name: "Comment"},
+		{Name: "Force", Type: parameterBool},
+		{Name: "Count", Type: parameterInt},
+		{Name: "Tail"},
+	}
+	tests := []struct {
+		scriptType string
+		raw        string
+		want       string
+	}{
+		{"bat", `{"Server":"s","Count":"3"}`, `[{"name":"Server","value":"s"},{"name":"Comment","value":""},{"name":"Force","value":""},{"name":"Count","value":"3"}]`},
+		{"python", `{"Server":"s","Force":"true"}`, `[{"name":"Server","value":"s"},{"name":"Comment","value":""},{"name":"Force","value":"true","type":"bool"}]`},
+		{"linuxshell", `{"Server":"s"}`, `[{"name":"Server","value":"s"}]`},
+		{"linuxshell", `{"Server":"s","Tail":"t"}`, `[{"name":"Server","value":"s"},{"name":"Comment","value":""},{"name":"Force","value":""},{"name":"Count","value":""},{"name":"Tail","value":"t"}]`},
+		{"powershell", `{"Server":"s","Count":"3"}`, `[{"name":"Server","value":"s"},{"name":"Count","value":"3"}]`},
+	}
+	for _, tt := range tests {
+		payload := scriptPayload{Name: "test", Type: tt.scriptType, Schema: schema}
+		if err := payload.bindArguments(tt.raw); err != nil || payload.Arguments != tt.want {
+			t.Errorf("bindArguments(%s, %s) = %s, %v, want %s", tt.scriptType, tt.raw, payload.Arguments, err, tt.want)
+		}
+		if _, err := protocol.DecodeArguments(payload.Arguments); err != nil {
+			t.Errorf("client rejects the arguments of %s: %v", tt.scriptType, err)
+		}
+	}
+}
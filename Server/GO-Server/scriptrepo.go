@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errScriptNotFound is returned for names that are not in the repository
+// index, including every attempt to escape the script directory.
+var errScriptNotFound = errors.New("script not found")
+
+// scriptEntry is one script offered by the repository.
+type scriptEntry struct {
+	Name string `json:"name"` // Relative path with forward slashes
+	Type string `json:"type"`
+	path string
+}
+
+// scriptRepository indexes the scripts below a root directory. Names from
+// requests are only ever looked up in the index and never joined onto the
+// root, so "../" or absolute paths cannot reach other files.
+type scriptRepository struct {
+	root       string
+	extensions map[string]string // File extension to type
+}
+
+var scriptRepo = newScriptRepository(scriptDir)
+
+func newScriptRepository(root string) *scriptRepository {
+	return &scriptRepository{root: root, extensions: scriptExtensions}
+}
+
+// scriptExtensions maps the file extensions offered to operators to their
+// script type.
+var scriptExtensions = map[string]string{
+	".ps1": "powershell",
+	".bat": "bat",
+	".py":  "python",
+	".sh":  "linuxshell",
+	".txt": "text",
+}
+
+// ignoredScriptDirs are not offered, e.g. old versions of scripts.
+var ignoredScriptDirs = map[string]bool{
+	"_obsolete_": true,
+}
+
+// list returns the scripts in the root directory and one level of
+// subdirectories. Symbolic links are skipped so they cannot point outside.
+func (s *scriptRepository) list() ([]scriptEntry, error) {
+	if _, err := os.Stat(s.root); err != nil {
+		return nil, err
+	}
+
+	var entries []scriptEntry
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err // Prevent walking into a directory we can't access
+		}
+
+		relPath, err := filepath.Rel(s.root, path)
+		if err != nil || relPath == "." { // Skip the root script directory itself
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		parts := strings.Split(relPath, string(filepath.Separator))
+		if info.IsDir() {
+			if ignoredScriptDirs[parts[0]] || len(parts) > 1 {
+				return filepath.SkipDir // Only one level of subdirectories
+			}
+			return nil
+		}
+
+		scriptType, ok := s.extensions[filepath.Ext(relPath)]
+		if !ok || !info.Mode().IsRegular() {
+			return nil
+		}
+		// Use forward slashes for consistency, even on Windows.
+		entries = append(entries, scriptEntry{Name: filepath.ToSlash(relPath), Type: scriptType, path: path})
+		return nil
+	})
+	return entries, err
+}
+
+// resolve returns the indexed script with exactly the given name.
+func (s *scriptRepository) resolve(name string) (scriptEntry, error) {
+	entries, err := s.list()
+	if err != nil {
+		return scriptEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, nil
+		}
+	}
+	return scriptEntry{}, errScriptNotFound
+}
+
+// read resolves a script name and returns its content.
+func (s *scriptRepository) read(name string) (scriptEntry, []byte, error) {
+	entry, err := s.resolve(name)
+	if err != nil {
+		return entry, nil, err
+	}
+	content, err := ioutil.ReadFile(entry.path)
+	return entry, content, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// newTestRepository creates a script directory with a secret file next to it.
+func newTestRepository(t *testing.T) (*scriptRepository, string) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "scriptfile")
+
+	files := map[string]string{
+		"inventory.ps1":           "Get-ComputerInfo",
+		"maintenance/cleanup.bat": "del /q %TEMP%\\*",
+		"maintenance/deep/x.ps1":  "too deep",
+		"_obsolete_/old.ps1":      "old",
+		"notes.md":                "not a script",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, "secret.ps1"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return newScriptRepository(root), base
+}
+
+func TestScriptRepositoryList(t *testing.T) {
+	repo, _ := newTestRepository(t)
+
+	entries, err := repo.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, entry := range entries {
+		got[entry.Name] = entry.Type
+	}
+	want := map[string]string{
+		"inventory.ps1":           "powershell",
+		"maintenance/cleanup.bat": "bat",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("list() = %v, want %v", got, want)
+	}
+	for name, scriptType := range want {
+		if got[name] != scriptType {
+			t.Errorf("list()[%q] = %q, want %q", name, got[name], scriptType)
+		}
+	}
+}
+
+func TestScriptRepositoryRead(t *testing.T) {
+	repo, _ := newTestRepository(t)
+
+	entry, content, err := repo.read("maintenance/cleanup.bat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Type != "bat" || string(content) != "del /q %TEMP%\\*" {
+		t.Errorf("read() = %+v, %q", entry, content)
+	}
+}
+
+func TestScriptRepositoryRejectsTraversal(t *testing.T) {
+	repo, base := newTestRepository(t)
+
+	names := []string{
+		"../secret.ps1",
+		"..\\secret.ps1",
+		"maintenance/../../secret.ps1",
+		"./inventory.ps1",
+		"maintenance//cleanup.bat",
+		"maintenance\\cleanup.bat",
+		"/inventory.ps1",
+		filepath.Join(base, "secret.ps1"),
+		"maintenance/deep/x.ps1",
+		"_obsolete_/old.ps1",
+		"notes.md",
+		"%2e%2e/secret.ps1",
+		"",
+		".",
+		"..",
+	}
+	for _, name := range names {
+		if _, _, err := repo.read(name); err != errScriptNotFound {
+			t.Errorf("read(%q) error = %v, want errScriptNotFound", name, err)
+		}
+	}
+}
+
+func TestScriptRepositorySkipsSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+	repo, base := newTestRepository(t)
+
+	link := filepath.Join(repo.root, "link.ps1")
+	if err := os.Symlink(filepath.Join(base, "secret.ps1"), link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(base, filepath.Join(repo.root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"link.ps1", "escape/secret.ps1"} {
+		if _, _, err := repo.read(name); err != errScriptNotFound {
+			t.Errorf("read(%q) error = %v, want errScriptNotFound", name, err)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"ondeso/protocol"
+)
+
+// Target operating systems of a managed script.
+const (
+	targetOSAny     = "any"
+	targetOSWindows = "windows"
+	targetOSLinux   = "linux"
+)
+
+// maxScriptTimeout caps the default timeout of a script version (one day).
+const maxScriptTimeout = 86400
+
+// ScriptVersion is one immutable version of a script uploaded through
+// /scripts. Uploading a script with an existing name creates the next version.
+type ScriptVersion struct {
+	BaseModel
+	Name           string `gorm:"column:name;size:255;unique_index:idx_script_name_version"`
+	Version        int    `gorm:"column:version;unique_index:idx_script_name_version"`
+	ScriptType     string `gorm:"column:script_type;size:50"`
+	Content        string `gorm:"column:content;type:text"`
+	SHA256         string `gorm:"column:sha256;size:64"`
+	Description    string `gorm:"column:description;size:1024"`
+	Parameters     string `gorm:"column:parameters;type:text"` // JSON array of scriptParameter
+	TargetOS       string `gorm:"column:target_os;size:20"`
+	DefaultTimeout int    `gorm:"column:default_timeout"` // seconds, 0 = client policy only
+	CreatedBy      string `gorm:"column:created_by;size:255"`
+}
+
+// BeforeUpdate keeps script versions immutable.
+func (ScriptVersion) BeforeUpdate() error {
+	return fmt.Errorf("script versions cannot be modified")
+}
+
+// BeforeDelete keeps script versions immutable.
+func (ScriptVersion) BeforeDelete() error {
+	return fmt.Errorf("script versions cannot be deleted")
+}
+
+// scriptPayload is a resolved script ready to be sent to clients, either a
+// managed version or a file of the script directory (Version 0).
+type scriptPayload struct {
+	Name           string
+	Type           string
+	Version        int
+	Content        []byte
+	SHA256         string
+	TargetOS       string
+	TimeoutSeconds int
+	Schema         []scriptParameter // nil for files of the script directory
+	Arguments      string            // JSON array of protocol.ScriptArgument, set by bindArguments
+}
+
+// ref returns the name@version reference of the payload.
+func (s scriptPayload) ref() string {
+	if s.Version == 0 {
+		return s.Name
+	}
+	return fmt.Sprintf("%s@%d", s.Name, s.Version)
+}
+
+// meta returns the version metadata of a script message.
+func (s scriptPayload) meta(executionID string) protocol.ScriptMeta {
+	meta := protocol.ScriptMeta{
+		TimeoutSeconds: s.TimeoutSeconds,
+		Parameters:     s.Arguments,
+		ExecutionID:    executionID,
+	}
+	if s.Version > 0 {
+		meta.ScriptVersion = s.Version
+		meta.ScriptSHA256 = s.SHA256
+	}
+	if s.TargetOS != targetOSAny {
+		meta.TargetOS = s.TargetOS
+	}
+	return meta
+}
+
+// sign signs the script together with its arguments.
+func (s scriptPayload) sign() payloadSignature {
+	return signPayloadWithParameters(s.Content, s.Name, s.Type, s.Arguments)
+}
+
+// payloadFromVersion converts a stored version.
+func payloadFromVersion(version ScriptVersion) scriptPayload {
+	schema := []scriptParameter{}
+	json.Unmarshal([]byte(version.Parameters), &schema)
+	return scriptPayload{
+		Name:           version.Name,
+		Type:           version.ScriptType,
+		Version:        version.Version,
+		Content:        []byte(version.Content),
+		SHA256:         version.SHA256,
+		TargetOS:       version.TargetOS,
+		TimeoutSeconds: version.DefaultTimeout,
+		Schema:         schema,
+	}
+}
+
+// scriptNamePattern allows the names the script directory offers: one
+// optional subdirectory and a file name with a known extension.
+var scriptNamePattern = regexp.MustCompile(`^([A-Za-z0-9_\-][A-Za-z0-9_.\-]*/)?[A-Za-z0-9_\-][A-Za-z0-9_.\-]*$`)
+
+// validScriptName checks the name of an uploaded script and returns its type.
+func validScriptName(name string) (string, error) {
+	if !scriptNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid script name %q", name)
+	}
+	if dir := strings.SplitN(name, "/", 2); len(dir) == 2 && ignoredScriptDirs[dir[0]] {
+		return "", fmt.Errorf("invalid script directory %q", dir[0])
+	}
+	scriptType, ok := scriptExtensions[path.Ext(name)]
+	if !ok {
+		return "", fmt.Errorf("unsupported script extension %q", path.Ext(name))
+	}
+	return scriptType, nil
+}
+
+// splitScriptRef splits "name@version" into name and version ("" if absent).
+func splitScriptRef(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// latestScriptVersion returns the newest version of a managed script.
+func latestScriptVersion(name string) (ScriptVersion, error) {
+	var version ScriptVersion
+	err := db.Where("name = ?", name).Order("version desc").First(&version).Error
+	return version, err
+}
+
+// loadScript resolves a script reference of the send endpoints:
+// "name@3" is version 3, "name@latest" the newest version, and a plain name
+// the newest version or, if the script is not managed, the file of the
+// script directory.
+func loadScript(ref string) (scriptPayload, error) {
+	name, versionRef := splitScriptRef(ref)
+	if name == "" {
+		return scriptPayload{}, errScriptNotFound
+	}
+
+	var version ScriptVersion
+	var err error
+	switch versionRef {
+	case "", "latest":
+		version, err = latestScriptVersion(name)
+	default:
+		number, convErr := strconv.Atoi(versionRef)
+		if convErr != nil || number <= 0 {
+			return scriptPayload{}, errScriptNotFound
+		}
+		err = db.Where("name = ? AND version = ?", name, number).First(&version).Error
+	}
+	if err == nil {
+		return payloadFromVersion(version), nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return scriptPayload{}, err
+	}
+	if versionRef != "" {
+		return scriptPayload{}, errScriptNotFound
+	}
+
+	entry, content, err := scriptRepo.read(name)
+	if err != nil {
+		return scriptPayload{}, err
+	}
+	hash := sha256.Sum256(content)
+	return scriptPayload{Name: entry.Name, Type: entry.Type, Content: content, SHA256: hex.EncodeToString(hash[:])}, nil
+}
+
+// scriptVersionSummary is the JSON representation of a version without content.
+func scriptVersionSummary(version ScriptVersion) map[string]interface{} {
+	parameters := []scriptParameter{}
+	json.Unmarshal([]byte(version.Parameters), &parameters)
+	return map[string]interface{}{
+		"name":            version.Name,
+		"version":         version.Version,
+		"ref":             fmt.Sprintf("%s@%d", version.Name, version.Version),
+		"type":            version.ScriptType,
+		"sha256":          version.SHA256,
+		"description":     version.Description,
+		"parameters":      parameters,
+		"target_os":       version.TargetOS,
+		"default_timeout": version.DefaultTimeout,
+		"created_by":      version.CreatedBy,
+		"created_at":      version.CreatedAt,
+	}
+}
+
+// managedScripts returns the newest version of every managed script.
+func managedScripts() ([]ScriptVersion, error) {
+	var versions []ScriptVersion
+	err := db.Where("version = (SELECT MAX(v.version) FROM script_versions v WHERE v.name = script_versions.name)").
+		Order("name").Find(&versions).Error
+	return versions, err
+}
+
+// readUploadedScript returns the content of the "file" upload or, if no
+// file was sent, of the "content" form field.
+func readUploadedScript(r *http.Request) ([]byte, error) {
+	file, _, err := r.FormFile("file")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return []byte(r.FormValue("content")), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// knownScriptType reports whether scriptType is one of the types of
+// scriptExtensions.
+func knownScriptType(scriptType string) bool {
+	for _, known := range scriptExtensions {
+		if scriptType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// isUniqueViolation reports whether err is a unique index or primary key
+// violation of SQL Server (errors 2601 and 2627).
+func isUniqueViolation(err error) bool {
+	var sqlErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &sqlErr) {
+		number := sqlErr.SQLErrorNumber()
+		return number == 2601 || number == 2627
+	}
+	return false
+}
+
+// scriptsHandler lists the managed scripts (GET, ?name= for all versions of
+// one script) and uploads a new version (POST).
+func scriptsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var versions []ScriptVersion
+		var err error
+		if name := r.URL.Query().Get("name"); name != "" {
+			err = db.Where("name = ?", name).Order("version desc").Find(&versions).Error
+		} else {
+			versions, err = managedScripts()
+		}
+		if err != nil {
+			log.Printf("Error loading script versions: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result := make([]map[string]interface{}, 0, len(versions))
+		for _, version := range versions {
+			result = append(result, scriptVersionSummary(version))
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		name := strings.TrimSpace(r.FormValue("name"))
+		scriptType, err := validScriptName(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if requested := r.FormValue("script_type"); requested != "" {
+			if !knownScriptType(requested) {
+				http.Error(w, fmt.Sprintf("Unknown script_type %q", requested), http.StatusBadRequest)
+				return
+			}
+			scriptType = requested
+		}
+		content, err := readUploadedScript(r)
+		if err != nil {
+			http.Error(w, "Error reading upload", http.StatusBadRequest)
+			return
+		}
+		if len(content) == 0 {
+			http.Error(w, "Script content missing", http.StatusBadRequest)
+			return
+		}
+		parameters, err := parseScriptParameters(r.FormValue("parameters"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targetOS := r.FormValue("target_os")
+		switch targetOS {
+		case "":
+			targetOS = targetOSAny
+		case targetOSAny, targetOSWindows, targetOSLinux:
+		default:
+			http.Error(w, "target_os must be any, windows or linux", http.StatusBadRequest)
+			return
+		}
+		timeout, err := formInt(r, "default_timeout", 0, 0, maxScriptTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hash := sha256.Sum256(content)
+		version := ScriptVersion{
+			Name:           name,
+			ScriptType:     scriptType,
+			Content:        string(content),
+			SHA256:         hex.EncodeToString(hash[:]),
+			Description:    r.FormValue("description"),
+			Parameters:     parameters,
+			TargetOS:       targetOS,
+			DefaultTimeout: timeout,
+		}
+		if user := currentOperator(r); user != nil {
+			version.CreatedBy = user.Username
+		}
+		auditPayload(r, content)
+
+		// Versions are numbered per name; a concurrent upload of the same name
+		// fails on the unique index and is reported as a conflict.
+		latest, err := latestScriptVersion(name)
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			log.Printf("Error loading script versions: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil && latest.SHA256 == version.SHA256 && latest.ScriptType == version.ScriptType &&
+			latest.Description == version.Description && latest.Parameters == version.Parameters &&
+			latest.TargetOS == version.TargetOS && latest.DefaultTimeout == version.DefaultTimeout {
+			auditDetail(r, "script=%s@%d unchanged", name, latest.Version)
+			json.NewEncoder(w).Encode(scriptVersionSummary(latest))
+			return
+		}
+		version.Version = latest.Version + 1
+		if err := db.Create(&version).Error; err != nil {
+			log.Printf("Error saving script version %s@%d: %v", name, version.Version, err)
+			if isUniqueViolation(err) {
+				http.Error(w, "Script version could not be saved, retry the upload", http.StatusConflict)
+			} else {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		auditDetail(r, "script=%s@%d sha256=%s", name, version.Version, version.SHA256)
+		log.Printf("📜 Skript %s@%d hochgeladen (%d Bytes)", name, version.Version, len(content))
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(scriptVersionSummary(version))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -3,20 +3,23 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,6 +28,7 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/mssql"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"github.com/joho/godotenv"
+	"ondeso/protocol"
 )
 
 // Constants
@@ -38,7 +42,38 @@ type Client struct {
 	ID       string
 	Hostname string
 	IP       string
-	Conn     *websocket.Conn
+	Conn     *clientConn
+	Protocol clientProtocol // Announced at registration
+}
+
+// clientConn is the WebSocket connection of a client. gorilla/websocket
+// allows only one concurrent writer, but handleClient, the HTTP handlers and
+// the background senders (rollouts, distributions, resends) all write to it,
+// so every write takes writeMu.
+type clientConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+	closed  atomic.Bool // Set once handleClient stops reading
+}
+
+// WriteMessage writes one message, serialized with all other writers. A
+// peer that does not read for WS_WRITE_TIMEOUT_SECONDS fails the write and
+// the connection is closed, so a dead client cannot hang its writers.
+func (c *clientConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout()))
+	err := c.Conn.WriteMessage(messageType, data)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.Conn.Close() // handleClient's read fails and removes the client
+	}
+	return err
+}
+
+// writeTimeout is how long a single write to a client may take.
+func writeTimeout() time.Duration {
+	return time.Duration(getEnvInt("WS_WRITE_TIMEOUT_SECONDS", 30)) * time.Second
 }
 
 // Global variables
@@ -50,9 +85,7 @@ var (
 	upgrader        = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins.  For production, be more restrictive.
-		},
+		CheckOrigin:     checkWebSocketOrigin, // ALLOWED_ORIGINS, agents send no Origin
 	}
 	appCtx    context.Context // For passing context to functions.
 	templates *template.Template
@@ -86,6 +119,11 @@ type Asset struct {
 	Hostname  string     `gorm:"column:hostname;size:255"`
 	IPAddress string     `gorm:"column:ip_address;size:50"`
 	LastSeen  time.Time  `gorm:"column:last_seen"`
+	ProtocolVersion int    `gorm:"column:protocol_version"`
+	ClientVersion   string `gorm:"column:client_version;size:50"`
+	Capabilities    string `gorm:"column:capabilities;size:1024"`
+	OS              string `gorm:"column:os;size:20"`   // GOOS announced by the client
+	Arch            string `gorm:"column:arch;size:20"` // GOARCH announced by the client
 }
 
 type ClientUser struct {
@@ -102,17 +140,75 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvInt returns a positive integer setting, or fallback if it is unset or invalid.
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// getSecret returns a secret from the file named by KEY_FILE (e.g.
+// DB_PASSWORD_FILE for Docker or Kubernetes secrets) or from KEY itself.
+func getSecret(key string) (string, error) {
+	if file := getEnv(key+"_FILE", ""); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("reading %s_FILE: %v", key, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return getEnv(key, ""), nil
+}
+
+// dbConnString builds the SQL Server connection string. DB_AUTH selects the
+// authentication: "sql" (DB_USER and DB_PASSWORD, the default), "integrated"
+// (Windows authentication of the service account) or "ntlm" (DB_USER as
+// DOMAIN\user with DB_PASSWORD). There are no default credentials.
+func dbConnString() (string, error) {
+	query := url.Values{}
+	query.Set("database", getEnv("DB_NAME", "mydatabase"))
+	connURL := url.URL{
+		Scheme: "sqlserver",
+		Host:   net.JoinHostPort(getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "1433")),
+	}
+
+	switch auth := getEnv("DB_AUTH", "sql"); auth {
+	case "integrated":
+		// No user in the URL: the driver uses the credentials of the process.
+	case "sql", "ntlm":
+		user := getEnv("DB_USER", "")
+		password, err := getSecret("DB_PASSWORD")
+		if err != nil {
+			return "", err
+		}
+		if user == "" || password == "" {
+			return "", fmt.Errorf("DB_USER and DB_PASSWORD (or DB_PASSWORD_FILE) must be set for DB_AUTH=%s", auth)
+		}
+		if auth == "ntlm" && !strings.Contains(user, "\\") {
+			return "", fmt.Errorf("DB_USER must have the form DOMAIN\\user for DB_AUTH=ntlm")
+		}
+		connURL.User = url.UserPassword(user, password)
+	default:
+		return "", fmt.Errorf("unknown DB_AUTH %q (sql, integrated or ntlm)", auth)
+	}
+
+	if encrypt := getEnv("DB_ENCRYPT", ""); encrypt != "" {
+		query.Set("encrypt", encrypt)
+	}
+	connURL.RawQuery = query.Encode()
+	return connURL.String(), nil
+}
+
 // initDB initializes the database connection.
 func initDB() *gorm.DB {
-	connString := fmt.Sprintf("sqlserver://%s:%s@%s:%s?database=%s",
-		getEnv("DB_USER", "sa"),
-		getEnv("DB_PASSWORD", "MyStrongPassword123!"),
-		getEnv("DB_HOST", "localhost"),
-		getEnv("DB_PORT", "1433"),
-		getEnv("DB_NAME", "mydatabase"),
-	)
+	connString, err := dbConnString()
+	if err != nil {
+		log.Fatalf("Invalid database configuration: %v", err)
+	}
+	log.Printf("Connecting to database %s on %s:%s (auth: %s)", getEnv("DB_NAME", "mydatabase"), getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "1433"), getEnv("DB_AUTH", "sql"))
 
-	var err error
 	var db *gorm.DB
 
 	for i := 0; i < 10; i++ {
@@ -130,7 +226,7 @@ func initDB() *gorm.DB {
 		panic(err)
 	}
 
-	db.AutoMigrate(&Inbox{}, &Asset{}, &ClientUser{})
+	db.AutoMigrate(&Inbox{}, &Asset{}, &ClientUser{}, &ClientGroup{}, &ClientGroupMember{}, &AssetTag{}, &Rollout{}, &RolloutTarget{}, &EnrollmentToken{}, &ClientCredential{}, &OperatorUser{}, &OperatorSession{}, &APIToken{}, &AuditEntry{}, &BinaryDistribution{}, &BinaryDelivery{}, &ScriptVersion{}, &FetchedFile{}, &ShellSession{}, &ConfigProfile{}, &ConfigChange{}, &AgentUpdate{})
 	db.LogMode(true)
 	return db
 }
@@ -393,7 +489,8 @@ func checkForRefresh() {
 		clientsMutex.RLock()
 		for _, client := range clients {
 			if client.Conn != nil && !isClosed(client.Conn) {
-				err := client.Conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"refresh"}`))
+				refresh, _ := protocol.Encode(&protocol.Refresh{})
+				err := client.Conn.WriteMessage(websocket.TextMessage, refresh)
 				if err != nil {
 					log.Printf("Error sending refresh to %s: %v", client.ID, err)
 				}
@@ -403,18 +500,30 @@ func checkForRefresh() {
 	}
 }
 
-// isClosed checks if a WebSocket connection is closed.
-func isClosed(conn *websocket.Conn) bool {
-	conn.SetReadDeadline(time.Now())
-	_, _, err := conn.ReadMessage()
-	conn.SetReadDeadline(time.Time{})
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return false
-		}
-		return true
+// isClosed checks if a WebSocket connection is closed. Only handleClient
+// reads from the connection; it marks the connection when the read fails.
+func isClosed(conn *clientConn) bool {
+	return conn.closed.Load()
+}
+
+// connectedClient looks up a connected client. Only the lookup holds
+// clientsMutex; callers write to the returned connection without it, as
+// writes are serialized per connection.
+func connectedClient(clientID string) (Client, bool) {
+	clientsMutex.RLock()
+	client, ok := clients[clientID]
+	clientsMutex.RUnlock()
+	return client, ok && client.Conn != nil && !isClosed(client.Conn)
+}
+
+// removeClient removes a client that is no longer connected, unless it has
+// registered again with a new connection in the meantime.
+func removeClient(client Client) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	if current, ok := clients[client.ID]; ok && current.Conn == client.Conn {
+		delete(clients, client.ID)
 	}
-	return false
 }
 
 // --- HTTP Handlers ---
@@ -446,12 +555,11 @@ func showClientsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func loadPageHandler(w http.ResponseWriter, r *http.Request) {
-	filename := filepath.Clean(r.URL.Path[len("/page/"):]) // Extract filename, sanitize
-	if filename == "" {
+	templateName, ok := pageTemplate(strings.TrimPrefix(r.URL.Path, "/page/"))
+	if !ok {
 		http.NotFound(w, r)
 		return
 	}
-	templateName := filename
 
 	clientsMutex.RLock()
 	tmplData := map[string]interface{}{
@@ -617,6 +725,12 @@ func inboxHandler(w http.ResponseWriter, r *http.Request) {
 
 	var data map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			countRejection("inbox_body_too_large")
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
@@ -662,6 +776,40 @@ func inboxHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// reprocessInboxHandler queues a processed or failed inbox entry again.
+func reprocessInboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Inbox ID is required", http.StatusBadRequest)
+		return
+	}
+	auditTargets(r, "inbox:"+strconv.Itoa(id))
+
+	result := db.Model(&Inbox{}).
+		Where("acx_inbox_id = ? AND acx_inbox_processing_state <> ?", id, "running").
+		Updates(map[string]interface{}{
+			"acx_inbox_processing_state": "pending",
+			"acx_inbox_processing_log":   "",
+		})
+	if result.Error != nil {
+		log.Printf("Error requeueing inbox entry %d: %v", id, result.Error)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Inbox entry not found or still running", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("🔁 Inbox-ID %d zur erneuten Verarbeitung eingereiht", id)
+	fmt.Fprint(w, `{"status": "success", "message": "Eintrag wird erneut verarbeitet"}`)
+}
+
 
 
 func getClientsHandler(w http.ResponseWriter, r *http.Request) {
@@ -689,10 +837,18 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
     clientID := r.FormValue("client_id")
     message := r.FormValue("message")
 
+    // A target selector instead of a client ID sends to every matching client.
+    if clientID == "" && r.FormValue("target") != "" {
+        sendMessageAllHandler(w, r)
+        return
+    }
+
     if clientID == "" || message == "" {
         http.Error(w, "Client-ID or message missing", http.StatusBadRequest)
         return
     }
+    auditTargets(r, clientID)
+    auditPayload(r, []byte(message))
 
     clientsMutex.Lock() // Lock for writing
     client, ok := clients[clientID]
@@ -709,11 +865,7 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    messageData := map[string]interface{}{
-        "action":  "message",
-        "content": message,
-    }
-    msgJSON, _ := json.Marshal(messageData) // Ignoring marshal error for brevity
+    msgJSON, _ := protocol.Encode(&protocol.ContentMessage{Content: message}) // Ignoring encode error for brevity
 
     err := client.Conn.WriteMessage(websocket.TextMessage, msgJSON)
     clientsMutex.Unlock() // Unlock after writing
@@ -744,40 +896,66 @@ func sendMessageAllHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    log.Printf("📤 Nachricht an alle Clients senden: %s", message)
+    target := r.FormValue("target")
+    if target == "" {
+        target = "all"
+    }
+    targets, err := resolveTarget(target)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    log.Printf("📤 Nachricht an %d Clients (%s) senden: %s", len(targets), target, message)
+    auditClients(r, targets)
+    auditPayload(r, []byte(message))
+    auditDetail(r, "target=%s", target)
+
+    msgJSON, _ := protocol.Encode(&protocol.ContentMessage{Content: message}) // Simplified error handling
 
-    messageData := map[string]interface{}{
-        "action":  "message",
-        "content": message,
+    errors := sendToClients(targets, msgJSON)
+
+    if errors == 0 {
+        w.WriteHeader(http.StatusOK)
+        fmt.Fprint(w, `{"status": "success", "message": "Nachricht erfolgreich an alle gesendet"}`)
+    } else {
+        w.WriteHeader(http.StatusPartialContent) // 207 Partial Content
+        fmt.Fprintf(w, `{"status": "partial_success", "message": "Nachricht an einige Clients fehlgeschlagen (%d Fehler)"}`, errors)
     }
-    msgJSON, _ := json.Marshal(messageData) // Simplified error handling
+}
 
-    clientsMutex.Lock() // Lock for iterating and writing
-    defer clientsMutex.Unlock()
+// sendToClient encodes a message and sends it to a connected client.
+func sendToClient(clientID string, msg protocol.Message) error {
+	data, err := protocol.Encode(msg)
+	if err != nil {
+		return err
+	}
+	client, ok := connectedClient(clientID)
+	if !ok {
+		return fmt.Errorf("client not connected")
+	}
+	return client.Conn.WriteMessage(websocket.TextMessage, data)
+}
 
+// sendToClients writes a message to each of the given clients and removes the
+// ones that are no longer connected. It returns the number of failed sends.
+func sendToClients(targets []Client, payload []byte) int {
     var errors int
-    for clientID, client := range clients {
+    for _, client := range targets {
         if client.Conn != nil && !isClosed(client.Conn) {
-            err := client.Conn.WriteMessage(websocket.TextMessage, msgJSON)
+            err := client.Conn.WriteMessage(websocket.TextMessage, payload) // Serialized per connection
             if err != nil {
-                log.Printf("❌ Fehler beim Senden an %s: %v", clientID, err)
+                log.Printf("❌ Fehler beim Senden an %s: %v", client.ID, err)
                 errors++
             } else {
-                log.Printf("✅ Nachricht an %s gesendet.", clientID)
+                log.Printf("✅ Nachricht an %s gesendet.", client.ID)
             }
         } else {
-            log.Printf("⚠️ Client %s nicht mehr verbunden, entferne ihn.", clientID)
-            delete(clients, clientID) // Remove disconnected clients
+            log.Printf("⚠️ Client %s nicht mehr verbunden, entferne ihn.", client.ID)
+            removeClient(client)
         }
     }
-
-    if errors == 0 {
-        w.WriteHeader(http.StatusOK)
-        fmt.Fprint(w, `{"status": "success", "message": "Nachricht erfolgreich an alle gesendet"}`)
-    } else {
-        w.WriteHeader(http.StatusPartialContent) // 207 Partial Content
-        fmt.Fprintf(w, `{"status": "partial_success", "message": "Nachricht an einige Clients fehlgeschlagen (%d Fehler)"}`, errors)
-    }
+    return errors
 }
 
 
@@ -788,43 +966,135 @@ func sendScriptHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     clientID := r.FormValue("client_id")
+    target := r.FormValue("target")
     scriptName := r.FormValue("script_name")
     scriptType := r.FormValue("script_type")
 
-    if clientID == "" || scriptName == "" || scriptType == "" {
-        http.Error(w, "Client-ID, script name, or script type missing", http.StatusBadRequest)
+    if (clientID == "" && target == "") || scriptName == "" {
+        http.Error(w, "Client-ID or script name missing", http.StatusBadRequest)
         return
     }
 
-    scriptPath := filepath.Join(scriptDir, filepath.Clean(scriptName)) // Prevent path traversal
-    if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+    script, err := loadScript(scriptName) // name@version, only indexed files, no path traversal
+    if err == errScriptNotFound {
         http.Error(w, "Script not found", http.StatusNotFound)
         return
     }
+    if err != nil {
+        log.Printf("Error reading script: %v", err)
+        http.Error(w, "Error reading script", http.StatusInternalServerError)
+        return
+    }
+    if scriptType != "" {
+        script.Type = scriptType
+    }
+    if err := script.bindArguments(r.FormValue("parameters")); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    auditPayload(r, script.Content)
+    auditDetail(r, "script=%s type=%s parameters=%s", script.ref(), script.Type, script.Arguments)
 
-    clientsMutex.Lock() // Lock for writing
-    defer clientsMutex.Unlock()
+    if clientID == "" {
+        targets, err := resolveTarget(target)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        auditClients(r, targets)
 
+        errors := sendScriptToClients(targets, script)
+        if errors == 0 {
+            w.WriteHeader(http.StatusOK)
+            fmt.Fprintf(w, "Skript in Chunks an %d Clients gesendet", len(targets))
+        } else {
+            w.WriteHeader(http.StatusPartialContent)
+            fmt.Fprintf(w, "Skript an einige Clients fehlgeschlagen (%d Fehler)", errors)
+        }
+        return
+    }
+
+    clientsMutex.RLock()
     client, ok := clients[clientID]
+    clientsMutex.RUnlock()
     if !ok {
         http.Error(w, "Client not found", http.StatusNotFound)
         return
     }
     if client.Conn == nil || isClosed(client.Conn) {
-        delete(clients, clientID)
+        removeClient(client)
         http.Error(w, "Client not connected", http.StatusGone)
         return
     }
 
-    scriptContent, err := ioutil.ReadFile(scriptPath)
-    if err != nil {
-        log.Printf("Error reading script: %v", err)
-        http.Error(w, "Error reading script", http.StatusInternalServerError)
+    if err := sendScriptChunks(client, script, ""); err != nil {
+        log.Printf("Error sending chunk to %s: %v", clientID, err)
+        http.Error(w, "Error sending script chunk", http.StatusInternalServerError)
         return
     }
-	scriptContentBase64 := base64.StdEncoding.EncodeToString(scriptContent)
+     w.WriteHeader(http.StatusOK)
+     fmt.Fprint(w, "Skript in Chunks gesendet") // No need for JSON if no error
+}
+
+// sendScriptToClients sends a script to each of the given clients and
+// returns the number of failed sends. Disconnected clients are removed.
+func sendScriptToClients(targets []Client, script scriptPayload) int {
+	var errors int
+	for _, target := range targets {
+		// Look up the current registration; the transfer itself runs
+		// without clientsMutex, writes are serialized per connection.
+		clientsMutex.RLock()
+		client, ok := clients[target.ID]
+		clientsMutex.RUnlock()
+		if !ok || client.Conn == nil || isClosed(client.Conn) {
+			log.Printf("⚠️ Client %s nicht mehr verbunden, entferne ihn.", target.ID)
+			if ok {
+				removeClient(client)
+			}
+			continue
+		}
+		if err := sendScriptChunks(client, script, ""); err != nil {
+			log.Printf("Error sending script to %s: %v", client.ID, err)
+			errors++
+		}
+	}
+	return errors
+}
+
+// sendScriptChunks sends a script to a client as base64 encoded
+// upload_script_chunk messages. A non-empty executionID is echoed back by the
+// client in its script_result. Writes are serialized per connection, so the
+// caller does not need to hold clientsMutex.
+func sendScriptChunks(client Client, script scriptPayload, executionID string) error {
+	scriptContentBase64 := base64.StdEncoding.EncodeToString(script.Content)
     totalChunks := (len(scriptContentBase64) + chunkSize - 1) / chunkSize
+    signature := script.sign()
+    transferUUID := uuid.New()
+    transferID := transferUUID.String() // Keys the transfer on the client, also for resend requests
+
+    if err := checkScriptSupport(client, script); err != nil {
+        return err
+    }
+    if script.TimeoutSeconds > 0 && !client.supports(protocol.CapScriptTimeout) {
+        log.Printf("⚠️ Client %s kennt timeout_seconds nicht, %s läuft ohne Zeitlimit", client.ID, script.ref())
+    }
+
+    if client.supports(protocol.CapBinaryFrames) {
+        start := protocol.TransferStart{
+            Kind:             protocol.KindScript,
+            ScriptName:       script.Name,
+            ScriptType:       script.Type,
+            ScriptMeta:       script.meta(executionID),
+            PayloadSignature: signature.message(),
+        }
+        transfer, err := buildFrameTransfer(transferUUID, start, script.Content, client.compression())
+        if err != nil {
+            return err
+        }
+        return sendFrameTransfer(client.Conn.WriteMessage, client.ID, transferUUID, script.Name, transfer)
+    }
 
+    chunks := make([][]byte, totalChunks)
     for i := 0; i < totalChunks; i++ {
         start := i * chunkSize
         end := start + chunkSize
@@ -833,26 +1103,36 @@ func sendScriptHandler(w http.ResponseWriter, r *http.Request) {
         }
         chunk := scriptContentBase64[start:end]
 
-        chunkMessage := map[string]interface{}{
-            "action":       "upload_script_chunk",
-            "script_name":  scriptName,
-            "chunk_index":  i,
-            "total_chunks": totalChunks,
-            "script_chunk": chunk,
-            "script_type":  scriptType,
+        chunkJSON, err := protocol.Encode(&protocol.ScriptChunk{
+            ScriptName:  script.Name,
+            ScriptType:  script.Type,
+            ScriptChunk: chunk,
+            ChunkInfo: protocol.ChunkInfo{
+                ChunkIndex:  i,
+                TotalChunks: totalChunks,
+                TransferID:  transferID,
+                ChunkSHA256: chunkSHA256(chunk),
+            },
+            ScriptMeta:       script.meta(executionID),
+            PayloadSignature: signature.message(),
+        })
+        if err != nil {
+            return err
         }
-        chunkJSON, _ := json.Marshal(chunkMessage) // Simplified error handling
+        chunks[i] = chunkJSON
+    }
+    if client.supports(protocol.CapTransferResume) {
+        registerTransfer(transferID, client.ID, script.Name, chunks, false, signature.ExpiresAt)
+    }
 
+    for i, chunkJSON := range chunks {
         err := client.Conn.WriteMessage(websocket.TextMessage, chunkJSON)
         if err != nil {
-            log.Printf("Error sending chunk to %s: %v", clientID, err)
-             http.Error(w, "Error sending script chunk", http.StatusInternalServerError)
-            return // Stop sending if there is error
+            return err // Stop sending if there is error, the client can resume
         }
-        log.Printf("📤 Gesendet: Chunk %d/%d (%d Bytes) an Client: %s", i+1, totalChunks, len(chunk), clientID)
+        log.Printf("📤 Gesendet: Chunk %d/%d (%d Bytes) an Client: %s", i+1, totalChunks, len(chunkJSON), client.ID)
     }
-     w.WriteHeader(http.StatusOK)
-     fmt.Fprint(w, "Skript in Chunks gesendet") // No need for JSON if no error
+    return nil
 }
 
 
@@ -865,134 +1145,108 @@ func sendScriptAllHandler(w http.ResponseWriter, r *http.Request) {
 	scriptName := r.FormValue("script_name")
 	scriptType := r.FormValue("script_type")
 
-	if scriptName == "" || scriptType == "" {
-		http.Error(w, "Script name or script type missing", http.StatusBadRequest)
+	if scriptName == "" {
+		http.Error(w, "Script name missing", http.StatusBadRequest)
 		return
 	}
-	scriptPath := filepath.Join(scriptDir, filepath.Clean(scriptName))
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+	script, err := loadScript(scriptName)
+	if err == errScriptNotFound {
 		http.Error(w, "Script not found", http.StatusNotFound)
 		return
 	}
-
-	scriptContent, err := ioutil.ReadFile(scriptPath)
 	if err != nil {
 		log.Printf("Error reading script: %v", err)
 		http.Error(w, "Error reading script", http.StatusInternalServerError)
 		return
 	}
-	scriptContentBase64 := base64.StdEncoding.EncodeToString(scriptContent)
-
-	scriptMessage := map[string]interface{}{
-		"action":       "execute_script",
-		"script_name":  scriptName,
-		"script_content": scriptContentBase64,
-		"script_type":  scriptType,
+	if scriptType != "" {
+		script.Type = scriptType
+	}
+	if err := script.bindArguments(r.FormValue("parameters")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	scriptJSON, _ := json.Marshal(scriptMessage)
-
-	clientsMutex.Lock() // Lock for the entire client iteration
-	defer clientsMutex.Unlock()
 
-	for clientID, client := range clients {
-		if client.Conn != nil && !isClosed(client.Conn) {
-			err := client.Conn.WriteMessage(websocket.TextMessage, scriptJSON)
-			if err != nil {
-				log.Printf("❌ Fehler beim Senden an %s: %v", clientID, err)
-			} else {
-				log.Printf("✅ Skript an %s gesendet.", clientID)
-			}
-		} else { // Remove client if connection is closed.
-			log.Printf("⚠️ Client %s nicht mehr verbunden, entferne ihn.", clientID)
-			delete(clients,clientID)
-		}
+	target := r.FormValue("target")
+	if target == "" {
+		target = "all"
+	}
+	targets, err := resolveTarget(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK) // Indicate success
-	fmt.Fprint(w, "Skript an alle gesendet")
+	log.Printf("📤 Skript %s an %d Clients (%s) senden", script.ref(), len(targets), target)
+	auditClients(r, targets)
+	auditPayload(r, script.Content)
+	auditDetail(r, "script=%s type=%s target=%s parameters=%s", script.ref(), script.Type, target, script.Arguments)
+	// Same chunked transfer as sendScriptHandler; clients do not handle
+	// execute_script.
+	errors := sendScriptToClients(targets, script)
+
+	switch {
+	case errors == 0:
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Skript an %d Clients gesendet", len(targets))
+	case errors == len(targets):
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Skript an keinen Client gesendet (%d Fehler)", errors)
+	default:
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, "Skript an einige Clients fehlgeschlagen (%d Fehler)", errors)
+	}
 }
 
 func getScriptsHandler(w http.ResponseWriter, r *http.Request) {
-	allowedExtensions := map[string]bool{
-		".ps1": true, ".bat": true, ".py": true, ".sh": true, ".txt": true,
-	}
-	ignoredDirs := map[string]bool{
-		"_obsolete_": true,
-	}
-
-	if _, err := os.Stat(scriptDir); os.IsNotExist(err) {
+	entries, err := scriptRepo.list()
+	if os.IsNotExist(err) {
 		http.Error(w, "Script directory not found", http.StatusInternalServerError)
 		return
 	}
-
-	var scripts []map[string]string
-	err := filepath.Walk(scriptDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err // Prevent walking into a directory we can't access
-		}
-
-		relPath, _ := filepath.Rel(scriptDir, path) // Relative path
-		if relPath == "." { // Skip the root script directory itself
-			return nil
-		}
-
-        dir, file := filepath.Split(relPath)
-        dir = strings.TrimSuffix(dir, string(filepath.Separator)) // Remove trailing slash
-
-        if ignoredDirs[dir] {
-            if info.IsDir(){
-                return filepath.SkipDir // Skip entire ignored directory
-            }
-            return nil
-        }
-
-        if dir != "" { // Check for subdirectories
-            parts := strings.Split(dir, string(filepath.Separator))
-            if len(parts) > 1 { // If in subdirectory > 1 deep
-              return nil // Skip it.
-            }
-        }
-
-
-		ext := filepath.Ext(file)
-		if !info.IsDir() && allowedExtensions[ext] {
-			scriptType := "text"
-			switch ext {
-			case ".ps1":
-				scriptType = "powershell"
-			case ".bat":
-				scriptType = "bat"
-			case ".py":
-				scriptType = "python"
-			case ".sh":
-				scriptType = "linuxshell"
-			}
-
-            // Use forward slashes for consistency, even on Windows.
-            normalizedPath := strings.ReplaceAll(relPath, "\\", "/")
-            scripts = append(scripts, map[string]string{"name": normalizedPath, "type": scriptType})
-		}
-		return nil
-	})
-
 	if err != nil {
 		log.Printf("Error walking the script directory: %v", err)
 		http.Error(w, "Error retrieving scripts", http.StatusInternalServerError)
 		return
 	}
 
+	// Managed scripts take precedence over files with the same name, as in loadScript.
+	versions, err := managedScripts()
+	if err != nil {
+		log.Printf("Error loading script versions: %v", err)
+		http.Error(w, "Error retrieving scripts", http.StatusInternalServerError)
+		return
+	}
+	managed := make(map[string]bool, len(versions))
+	scripts := make([]map[string]interface{}, 0, len(entries)+len(versions))
+	for _, version := range versions {
+		managed[version.Name] = true
+		scripts = append(scripts, map[string]interface{}{
+			"name":        version.Name,
+			"type":        version.ScriptType,
+			"version":     version.Version,
+			"description": version.Description,
+		})
+	}
+	for _, entry := range entries {
+		if !managed[entry.Name] {
+			scripts = append(scripts, map[string]interface{}{"name": entry.Name, "type": entry.Type})
+		}
+	}
 	json.NewEncoder(w).Encode(scripts)
 }
 
 
 
 // --- WebSocket Handling ---
-async def handleClient(websocket): # the Python-signature
-func handleClient(conn *websocket.Conn) {
+func handleClient(wsConn *websocket.Conn, certClientID string) {
+	conn := &clientConn{Conn: wsConn}
 	clientIP := conn.RemoteAddr().String()
 	log.Printf("🔌 Neuer Client verbunden von %s", clientIP)
+	registeredID := "" // Client ID of this connection after registration
 
 	defer func() { // Ensure client is removed on disconnect
+		conn.closed.Store(true)
 		conn.Close() // Close the connection
 
         clientsMutex.Lock()
@@ -1018,6 +1272,9 @@ func handleClient(conn *websocket.Conn) {
             }
         }
         clientsMutex.Unlock()
+		for _, clientID := range disconnectedClientIDs {
+			closeClientShells(clientID)
+		}
 		checkForRefresh() // Check after removing client.
 		log.Println("🛑 Client-Entfernung abgeschlossen.")
 	}()
@@ -1026,72 +1283,152 @@ func handleClient(conn *websocket.Conn) {
 	for {
 		messageType, message, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if err == websocket.ErrReadLimit {
+				countRejection("ws_message_too_large")
+				log.Printf("🚨 Nachricht von %s überschreitet WS_MAX_MESSAGE_BYTES, Verbindung getrennt", clientIP)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("❌ WebSocket-Verbindung mit %s geschlossen: %v", clientIP, err)
 			}
 			break // Exit loop on connection close/error
 		}
 
-		if messageType == websocket.TextMessage {
-			log.Printf("📩 Eingehende Nachricht von %s: %s", clientIP, message)
+		if !allowWebSocketMessage(registeredID, clientIP) {
+			log.Printf("🚦 Nachricht von %s wegen Ratenlimit verworfen", clientIP)
+			conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Rate limit exceeded"))
+			continue
+		}
 
-			var data map[string]interface{}
-			if err := json.Unmarshal(message, &data); err != nil {
-				log.Printf("🚨 Ungültiges JSON von %s: %s", clientIP, message)
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"status": "error", "message": "Invalid JSON"}`))
+		if messageType == websocket.TextMessage {
+			// Messages carry enrollment tokens, shell output and file
+			// contents, so only the action is logged, never the message.
+			msg, err := protocol.Decode(message)
+			if errors.Is(err, protocol.ErrMalformed) {
+				log.Printf("🚨 Ungültiges JSON von %s (%d Bytes)", clientIP, len(message))
+				conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Invalid JSON"))
 				continue // Continue to the next message
 			}
-
-			action, ok := data["action"].(string)
-			if !ok {
-				log.Printf("⚠️ Unbekannte Aktion von %s: %v", clientIP, data)
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"status": "error", "message": "Unknown action"}`))
+			if errors.Is(err, protocol.ErrUnknownAction) {
+				log.Printf("⚠️ Unbekannte Aktion von %s: %v", clientIP, err)
+				conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Unknown action"))
 				continue
 			}
-			if action == "register" {
-				clientID, _ := data["client_id"].(string)
-				hostname, _ := data["hostname"].(string)
-				ipAddress, _ := data["ip"].(string)
-
-				if clientID == "" || hostname == "" || ipAddress == "" {
-					log.Printf("⚠️ Ungültige Registrierungsdaten von %s: %v", clientIP, data)
-					conn.WriteMessage(websocket.TextMessage, []byte(`{"status": "error", "message": "Invalid registration data"}`))
+			log.Printf("📩 Eingehende Nachricht von %s (%s): %s", clientIP, registeredID, msg.Action())
+			if err != nil {
+				log.Printf("⚠️ Ungültige Nachricht von %s: %v", clientIP, err)
+				if _, isRegister := msg.(*protocol.Register); isRegister {
+					conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Invalid registration data"))
+				} else {
+					conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Invalid message"))
+				}
+				continue
+			}
+
+			if register, ok := msg.(*protocol.Register); ok {
+				clientID, hostname, ipAddress := register.ClientID, register.Hostname, register.IP
+
+				negotiated, err := parseClientProtocol(register)
+				if err != nil {
+					log.Printf("🚫 Registrierung von %s (%s) abgelehnt: %v", clientID, clientIP, err)
+					conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Unsupported protocol version"))
+					continue
+				}
+
+				var clientSecret string
+				if certClientID != "" {
+					// A verified client certificate already proves the identity.
+					if certClientID != clientID {
+						err = fmt.Errorf("client certificate was issued for %s", certClientID)
+					}
+				} else {
+					clientSecret, err = authenticateClient(conn, clientID, register)
+				}
+				if err != nil {
+					log.Printf("🚫 Registrierung von %s (%s) abgelehnt: %v", clientID, clientIP, err)
+					conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Authentication failed"))
 					continue
 				}
 
+				client := Client{ID: clientID, Hostname: hostname, IP: ipAddress, Conn: conn, Protocol: negotiated}
 				clientsMutex.Lock()
-				clients[clientID] = Client{ID: clientID, Hostname: hostname, IP: ipAddress, Conn: conn}
+				clients[clientID] = client
 				clientsMutex.Unlock()
+				registeredID = clientID
 
                 log.Printf("📥 Neuer Client zwischengespeichert: %s (%s, %s)", clientID, hostname, ipAddress)
 
 				// Database operations within a function, using appCtx
-				err = updateOrRegisterClient(appCtx, clientID, hostname, ipAddress)
+				err = updateOrRegisterClient(appCtx, clientID, hostname, ipAddress, negotiated)
                 if err != nil {
                     log.Printf("❌ Fehler bei DB Operation für %s: %v", clientID, err)
                     // Send error to client, *but* continue (don't break the connection)
-                    conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"status": "error", "message": "Database error: %v"}`, err)))
+                    conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse(fmt.Sprintf("Database error: %v", err)))
                    continue
                 }
 
                 // Send success response.
-                response := map[string]string{"status": "registered"}
-                responseJSON, _ := json.Marshal(response) // Ignore marshal error
+                response := protocol.Response{
+                    Status:          protocol.StatusRegistered,
+                    ClientSecret:    clientSecret, // Issued once at enrollment
+                    ProtocolVersion: protocol.Version(negotiated.Version),
+                }
+                if client.supports(protocol.CapBinaryFrames) {
+                    response.TransferMode = protocol.TransferModeFrames
+                    response.Compression = client.compression()
+                }
+                responseJSON, _ := protocol.EncodeResponse(response) // Ignore encode error
                 conn.WriteMessage(websocket.TextMessage, responseJSON)
 
 
+				if !negotiated.Staged { // A staged build is not installed yet
+					confirmAgentUpdate(clientID, negotiated.ClientVersion)
+				}
 				checkForRefresh()
 				log.Printf("📤 Registrierungsbestätigung an %s (%s) gesendet", hostname, ipAddress)
-            } else {
-				log.Printf("⚠️ Unbekannte Aktion von %s: %v", clientIP, data)
-				conn.WriteMessage(websocket.TextMessage, []byte(`{"status": "error", "message": "Unknown action"}`))
+				continue
+			}
+			if registeredID == "" {
+				log.Printf("⚠️ Aktion %s von %s vor der Registrierung", msg.Action(), clientIP)
+				conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Unknown action"))
+				continue
+			}
+
+			switch msg := msg.(type) {
+			case *protocol.ScriptResult:
+				recordScriptResult(registeredID, msg)
+			case *protocol.BinaryResult:
+				recordBinaryResult(registeredID, msg)
+			case *protocol.PayloadRejected:
+				recordPayloadRejection(registeredID, msg)
+			case *protocol.ResendChunks:
+				if err := resendChunks(registeredID, msg); err != nil {
+					log.Printf("⚠️ Chunks für %s nicht erneut gesendet: %v", registeredID, err)
+					response, _ := protocol.Encode(&protocol.TransferUnavailable{TransferID: msg.TransferID, Message: err.Error()})
+					conn.WriteMessage(websocket.TextMessage, response)
+				}
+			case *protocol.TransferComplete:
+				completeTransfer(registeredID, msg.TransferID)
+			case *protocol.FileChunk:
+				receiveFileChunk(registeredID, msg)
+			case *protocol.FetchFailed:
+				recordFetchFailure(registeredID, msg)
+			case *protocol.ShellOutput:
+				receiveShellOutput(registeredID, msg)
+			case *protocol.ShellClosed:
+				recordShellClosed(registeredID, msg)
+			case *protocol.ConfigResult:
+				recordConfigResult(registeredID, msg)
+			case *protocol.AgentUpdateStatus:
+				recordAgentUpdateStatus(registeredID, msg)
+			default:
+				log.Printf("⚠️ Unbekannte Aktion von %s: %s", clientIP, msg.Action())
+				conn.WriteMessage(websocket.TextMessage, protocol.ErrorResponse("Unknown action"))
 			}
 		}
 	}
 }
 
 
-func updateOrRegisterClient(ctx context.Context, clientID, hostname, ipAddress string) error {
+func updateOrRegisterClient(ctx context.Context, clientID, hostname, ipAddress string, protocol clientProtocol) error {
     // Use a transaction to ensure atomicity
     tx := db.Begin()
     if tx.Error != nil {
@@ -1114,7 +1451,9 @@ func updateOrRegisterClient(ctx context.Context, clientID, hostname, ipAddress s
 
     if gorm.IsRecordNotFoundError(err) {
         log.Printf("🆕 Neues Asset wird erstellt für Client %s (%s, %s)", clientID, hostname, ipAddress)
-        newAsset := Asset{ClientID: clientID, Hostname: hostname, IPAddress: ipAddress, LastSeen: time.Now()} // Set LastSeen on creation
+        newAsset := Asset{ClientID: clientID, Hostname: hostname, IPAddress: ipAddress, LastSeen: time.Now(), // Set LastSeen on creation
+            ProtocolVersion: protocol.Version, ClientVersion: protocol.ClientVersion, Capabilities: protocol.capabilityList(),
+            OS: protocol.OS, Arch: protocol.Arch}
         if err := tx.Create(&newAsset).Error; err != nil {
              tx.Rollback()
             return err
@@ -1124,6 +1463,11 @@ func updateOrRegisterClient(ctx context.Context, clientID, hostname, ipAddress s
         existingAsset.LastSeen = time.Now() // Update LastSeen
         existingAsset.Hostname = hostname     // Update Hostname
         existingAsset.IPAddress = ipAddress   // Update IPAddress
+        existingAsset.ProtocolVersion = protocol.Version
+        existingAsset.ClientVersion = protocol.ClientVersion
+        existingAsset.Capabilities = protocol.capabilityList()
+        existingAsset.OS = protocol.OS
+        existingAsset.Arch = protocol.Arch
         if err := tx.Save(&existingAsset).Error; err != nil { //Use Save for updating
              tx.Rollback()
             return err
@@ -1140,19 +1484,68 @@ func updateOrRegisterClient(ctx context.Context, clientID, hostname, ipAddress s
 // --- Route Setup ---
 
 func setupRoutes() {
-	http.HandleFunc("/", indexHandler)
-    http.HandleFunc("/showdocu", showClientsHandler) // Corrected handler name
-	http.HandleFunc("/page/", loadPageHandler)
-	http.HandleFunc("/client/", clientDetailsHandler)
-	http.HandleFunc("/get_tables", getTablesAPIHandler)
-	http.HandleFunc("/table/", tableDataHandler)
-	http.HandleFunc("/inbox", inboxHandler)
-	http.HandleFunc("/clients", getClientsHandler)
-	http.HandleFunc("/send_message", sendMessageHandler)
-	http.HandleFunc("/send_message_all", sendMessageAllHandler)
-	http.HandleFunc("/send_script", sendScriptHandler)
-	http.HandleFunc("/send_script_all", sendScriptAllHandler)
-	http.HandleFunc("/get_scripts", getScriptsHandler)
+	// Login and OIDC, reachable without a session
+	http.HandleFunc("/login", audited("login", loginHandler))
+	http.HandleFunc("/logout", audited("logout", logoutHandler))
+	http.HandleFunc("/auth/oidc/login", oidcLoginHandler)
+	http.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
+
+	// Used by the inventory scripts on the clients, not by operators
+	http.HandleFunc("/inbox", limitInbox(inboxHandler))
+
+	// viewer: read-only access
+	http.HandleFunc("/", requireRole(roleViewer, indexHandler))
+	http.HandleFunc("/showdocu", requireRole(roleViewer, showClientsHandler)) // Corrected handler name
+	http.HandleFunc("/page/", requireRole(roleViewer, loadPageHandler))
+	http.HandleFunc("/client/", requireRole(roleViewer, clientDetailsHandler))
+	http.HandleFunc("/get_tables", requireRole(roleViewer, getTablesAPIHandler))
+	http.HandleFunc("/table/", requireRole(roleViewer, tableDataHandler))
+	http.HandleFunc("/clients", requireRole(roleViewer, getClientsHandler))
+	http.HandleFunc("/get_scripts", requireRole(roleViewer, getScriptsHandler))
+	http.HandleFunc("/scripts", requireRoles(roleViewer, roleOperator, audited("upload_script", scriptsHandler)))
+	http.HandleFunc("/get_binaries", requireRole(roleViewer, getBinariesHandler))
+	http.HandleFunc("/binary_distributions", requireRole(roleViewer, binaryDistributionsHandler))
+	http.HandleFunc("/files", requireRole(roleViewer, filesHandler))
+	http.HandleFunc("/targets", requireRole(roleViewer, resolveTargetHandler))
+	http.HandleFunc("/rollouts/status", requireRole(roleViewer, rolloutStatusHandler))
+	http.HandleFunc("/signing_key", requireRole(roleViewer, signingKeyHandler))
+	http.HandleFunc("/api_tokens", requireRole(roleViewer, audited("create_api_token", apiTokensHandler)))
+	http.HandleFunc("/api_tokens/revoke", requireRole(roleViewer, audited("revoke_api_token", revokeAPITokenHandler)))
+
+	// operator: sending messages and scripts, managing groups and rollouts
+	http.HandleFunc("/send_message", requireRole(roleOperator, audited("send_message", sendMessageHandler)))
+	http.HandleFunc("/send_message_all", requireRole(roleOperator, audited("send_message_all", sendMessageAllHandler)))
+	http.HandleFunc("/send_script", requireRole(roleOperator, audited("send_script", sendScriptHandler)))
+	http.HandleFunc("/send_script_all", requireRole(roleOperator, audited("send_script_all", sendScriptAllHandler)))
+	http.HandleFunc("/send_binary", requireRole(roleOperator, audited("send_binary", sendBinaryHandler)))
+	http.HandleFunc("/files/fetch", requireRole(roleOperator, audited("fetch_file", fetchFileHandler)))
+	http.HandleFunc("/files/download", requireRole(roleOperator, downloadFileHandler))
+	http.HandleFunc("/shell", requireRole(roleOperator, shellPageHandler))
+	http.HandleFunc("/shell/ws", requireRole(roleOperator, shellSocketHandler)) // Audits open_shell itself
+	http.HandleFunc("/groups", requireRoles(roleViewer, roleOperator, audited("save_group", groupsHandler)))
+	http.HandleFunc("/groups/delete", requireRole(roleOperator, audited("delete_group", deleteGroupHandler)))
+	http.HandleFunc("/groups/members", requireRole(roleOperator, audited("change_group_members", groupMembersHandler)))
+	http.HandleFunc("/clients/tags", requireRoles(roleViewer, roleOperator, audited("set_client_tags", clientTagsHandler)))
+	http.HandleFunc("/rollouts", requireRoles(roleViewer, roleOperator, audited("start_rollout", rolloutsHandler)))
+	http.HandleFunc("/rollouts/halt", requireRole(roleOperator, audited("halt_rollout", haltRolloutHandler)))
+	http.HandleFunc("/inbox/reprocess", requireRole(roleOperator, audited("reprocess_inbox", reprocessInboxHandler)))
+
+	// admin: client credentials, configuration and updates, operator accounts and the audit trail
+	http.HandleFunc("/enrollment_tokens", requireRole(roleAdmin, audited("create_enrollment_token", enrollmentTokensHandler)))
+	http.HandleFunc("/clients/revoke", requireRole(roleAdmin, audited("revoke_client", revokeClientHandler)))
+	http.HandleFunc("/users", requireRole(roleAdmin, audited("save_user", usersHandler)))
+	http.HandleFunc("/users/delete", requireRole(roleAdmin, audited("delete_user", deleteUserHandler)))
+	http.HandleFunc("/audit", requireRole(roleAdmin, auditHandler))
+	http.HandleFunc("/shell/sessions", requireRole(roleAdmin, shellSessionsHandler))
+	http.HandleFunc("/shell/transcript", requireRole(roleAdmin, shellTranscriptHandler))
+	http.HandleFunc("/config/profiles", requireRoles(roleViewer, roleAdmin, audited("save_config_profile", configProfilesHandler)))
+	http.HandleFunc("/config/profiles/delete", requireRole(roleAdmin, audited("delete_config_profile", deleteConfigProfileHandler)))
+	http.HandleFunc("/config/apply", requireRole(roleAdmin, audited("apply_config", applyConfigHandler)))
+	http.HandleFunc("/config/changes", requireRole(roleViewer, configChangesHandler))
+	http.HandleFunc("/agent/builds", requireRole(roleViewer, agentBuildsHandler))
+	http.HandleFunc("/agent/update", requireRole(roleAdmin, audited("update_agent", updateAgentHandler)))
+	http.HandleFunc("/agent/updates", requireRole(roleViewer, agentUpdatesHandler))
+	http.HandleFunc("/metrics", requireRole(roleViewer, metricsHandler))
 
 	// Serve static files (Optional - if you need to serve CSS/JS locally)
 	// http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
@@ -1191,22 +1584,83 @@ func main() {
         panic(err) // Use panic for fatal errors in main
 	}
 
+	// Load TLS certificates, if configured
+	var reloader *certReloader
+	if certFile := getEnv("TLS_CERT_FILE", ""); certFile != "" {
+		reloader, err = newCertReloader(certFile, getEnv("TLS_KEY_FILE", ""), getEnv("TLS_CLIENT_CA_FILE", ""))
+		if err != nil {
+			log.Fatalf("Error loading TLS certificates: %v", err)
+		}
+		go reloader.watch()
+		log.Println("🔐 TLS aktiviert für WebSocket- und HTTP-Server")
+	}
+	wsClientAuth, err := clientAuthType(getEnv("TLS_CLIENT_AUTH", "none"))
+	if err != nil {
+		log.Fatalf("Error in TLS configuration: %v", err)
+	}
+	if wsClientAuth != tls.NoClientCert && (reloader == nil || getEnv("TLS_CLIENT_CA_FILE", "") == "") {
+		log.Fatal("TLS_CLIENT_AUTH requires TLS_CERT_FILE, TLS_KEY_FILE and TLS_CLIENT_CA_FILE")
+	}
+
+	// Load the payload signing key, if configured
+	if keyFile := getEnv("SIGNING_KEY_FILE", ""); keyFile != "" {
+		signingKey, err = loadSigningKey(keyFile)
+		if err != nil {
+			log.Fatalf("Error loading signing key: %v", err)
+		}
+		log.Println("🔏 Skripte und Binärdateien werden signiert")
+	} else {
+		log.Println("⚠️ Kein SIGNING_KEY_FILE gesetzt, Skripte werden unsigniert gesendet")
+	}
+
+	checkClientAuthSettings()
+
+	// Rate limits for /inbox and the WebSocket
+	initRateLimits()
+
+	// Binaries offered by /get_binaries and /send_binary
+	binaryRepo = newBinaryRepository(getEnv("BINARY_DIR", "binaryfile"))
+	fetchDir = getEnv("FETCH_DIR", "fetchedfiles")
+	shellDir = getEnv("SHELL_DIR", "shelltranscripts")
+	agentBuildDir = getEnv("AGENT_BUILD_DIR", "agentbuilds")
+
+	// Create the first admin account, if none exists
+	ensureAdminUser()
+
 	// Setup routes
 	setupRoutes()
 
 	// Start the inbox processing goroutine
 	go processInbox(appCtx)
 
+	// Drop chunk transfers the clients never confirmed
+	go expireTransfers(appCtx)
+	go expireDeliveries(appCtx)
+	go expireFetches(appCtx)
+	go expireShells(appCtx)
+
+	// Continue rollouts interrupted by a restart
+	resumeRollouts(appCtx)
+
 	// Start the WebSocket server in a goroutine
 	go func() {
-		http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		// Own mux, so /ws is not reachable on the HTTP port without the client certificate check.
+		wsMux := http.NewServeMux()
+		wsMux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+			if !wsConnLimiter.allow(sourceIP(r)) {
+				countRejection("ws_connect_rate_limited")
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
 				log.Println("Upgrade error:", err)
 				return
 			}
-			handleClient(conn)
+			conn.SetReadLimit(int64(getEnvInt("WS_MAX_MESSAGE_BYTES", 1<<20)))
+			handleClient(conn, certificateClientID(r))
 		})
+		wsMux.HandleFunc("/agent/download", agentDownloadHandler)
 
 		if isPortInUse(8765) {
 			log.Fatal("❌ FEHLER: Port 8765 ist bereits belegt! WebSocket-Server kann nicht gestartet werden.")
@@ -1214,7 +1668,7 @@ func main() {
 		}
 		log.Println("✅ WebSocket-Server läuft auf Port 8765...")
 		log.Println("🟢 WebSocket-Server wartet auf Clients...")
-		if err := http.ListenAndServe(":8765", nil); err != nil {
+		if err := listenAndServe(&http.Server{Addr: ":8765", Handler: wsMux}, reloader, wsClientAuth); err != nil {
 			log.Fatal("ListenAndServe (WebSocket): ", err)
             panic(err)
 		}
@@ -1222,7 +1676,8 @@ func main() {
 
 	// Start the main HTTP server
 	log.Println("✅ HTTP-Server läuft auf Port 5001...")
-	if err := http.ListenAndServe(":5001", nil); err != nil {
+	httpHandler := limitBody(int64(getEnvInt("HTTP_MAX_BODY_BYTES", 32<<20)), http.DefaultServeMux)
+	if err := listenAndServe(&http.Server{Addr: ":5001", Handler: httpHandler}, reloader, tls.NoClientCert); err != nil {
 		log.Fatal("ListenAndServe (HTTP): ", err)
         panic(err)
 	}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWriteTimeout(t *testing.T) {
+	t.Setenv("WS_WRITE_TIMEOUT_SECONDS", "1")
+	results := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			results <- err
+			return
+		}
+		conn := &clientConn{Conn: wsConn}
+		payload := make([]byte, 1<<20)
+		for i := 0; i < 256; i++ { // More than the socket buffers hold
+			if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+				results <- err
+				return
+			}
+		}
+		results <- nil
+	}))
+	defer server.Close()
+
+	// The client connects but never reads.
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsConn.Close()
+
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Fatal("writes to a client that does not read succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write to a client that does not read did not time out")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
+	"ondeso/protocol"
+)
+
+// Shell session states.
+const (
+	shellOpen   = "open"
+	shellClosed = "closed"
+)
+
+// ShellSession is a remote shell an operator opened on a client from the
+// terminal page. The transcript is stored as SHELL_DIR/<session ID>.jsonl.
+type ShellSession struct {
+	BaseModel
+	SessionID   string     `gorm:"column:session_id;size:64;unique_index"`
+	ClientID    string     `gorm:"column:client_id;size:255;index"`
+	Shell       string     `gorm:"column:shell;size:50"`
+	OpenedBy    string     `gorm:"column:opened_by;size:255;index"`
+	SourceIP    string     `gorm:"column:source_ip;size:64"`
+	Status      string     `gorm:"column:status;size:50"`
+	ExitCode    *int       `gorm:"column:exit_code"`
+	CloseReason string     `gorm:"column:close_reason;size:1024"`
+	BytesIn     int64      `gorm:"column:bytes_in"`
+	BytesOut    int64      `gorm:"column:bytes_out"`
+	ClosedAt    *time.Time `gorm:"column:closed_at"`
+}
+
+// shellDir holds the transcripts (SHELL_DIR), set up in main.
+var shellDir string
+
+// shellIdleTimeout ends sessions without input or output (SHELL_IDLE_TIMEOUT_SECONDS).
+func shellIdleTimeout() time.Duration {
+	return time.Duration(getEnvInt("SHELL_IDLE_TIMEOUT_SECONDS", 600)) * time.Second
+}
+
+// shellAllowed reports whether an operator is on SHELL_OPERATORS, the
+// comma-separated list of users who may open shells. Without a list nobody
+// may.
+func shellAllowed(username string) bool {
+	for _, allowed := range strings.Split(getEnv("SHELL_OPERATORS", ""), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// transcriptEntry is one line of a transcript. Stream is "in" for operator
+// input, "out" for shell output and "event" for opening and closing.
+type transcriptEntry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Data   string    `json:"data"`
+}
+
+// liveShell connects a browser terminal with the shell on a client.
+type liveShell struct {
+	id       string
+	clientID string
+	browser  *websocket.Conn
+
+	mu         sync.Mutex // Guards the fields below and writes to browser
+	transcript *os.File
+	lastActive time.Time
+	bytesIn    int64
+	bytesOut   int64
+	closed     bool
+}
+
+// liveShells holds the open sessions by session ID.
+var liveShells = struct {
+	sync.Mutex
+	byID map[string]*liveShell
+}{byID: make(map[string]*liveShell)}
+
+// transcriptPath returns where the transcript of a session is stored.
+func transcriptPath(sessionID string) string {
+	return filepath.Join(shellDir, sessionID+".jsonl")
+}
+
+// record appends an entry to the transcript. The caller holds s.mu.
+func (s *liveShell) record(stream string, data []byte) {
+	s.lastActive = time.Now()
+	line, _ := json.Marshal(transcriptEntry{Time: s.lastActive, Stream: stream, Data: string(data)})
+	if _, err := s.transcript.Write(append(line, '\n')); err != nil {
+		log.Printf("❌ Fehler beim Schreiben des Protokolls von Shell %s: %v", s.id, err)
+	}
+}
+
+// notifyBrowser sends a status message to the terminal page. The caller
+// holds s.mu.
+func (s *liveShell) notifyBrowser(status, message string) {
+	data, _ := json.Marshal(map[string]string{"status": status, "message": message})
+	s.browser.WriteMessage(websocket.TextMessage, data)
+}
+
+// finish ends a session: the transcript is closed, the result stored and
+// the terminal page disconnected. It returns false if the session was
+// already finished.
+func (s *liveShell) finish(exitCode *int, reason string) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	s.closed = true
+	s.record("event", []byte("closed: "+reason))
+	s.transcript.Close()
+	s.notifyBrowser(shellClosed, reason)
+	s.browser.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	s.browser.Close()
+	bytesIn, bytesOut := s.bytesIn, s.bytesOut
+	s.mu.Unlock()
+
+	liveShells.Lock()
+	delete(liveShells.byID, s.id)
+	liveShells.Unlock()
+
+	now := time.Now()
+	db.Model(&ShellSession{}).Where("session_id = ?", s.id).Updates(map[string]interface{}{
+		"status":       shellClosed,
+		"exit_code":    exitCode,
+		"close_reason": reason,
+		"bytes_in":     bytesIn,
+		"bytes_out":    bytesOut,
+		"closed_at":    now,
+	})
+	log.Printf("🐚 Shell %s auf %s beendet: %s", s.id, s.clientID, reason)
+	return true
+}
+
+// closeShell finishes a session and tells the client to end the shell.
+func closeShell(s *liveShell, reason string) {
+	if !s.finish(nil, reason) {
+		return
+	}
+	if err := sendToClient(s.clientID, &protocol.ShellClose{SessionID: s.id, Reason: reason}); err != nil {
+		log.Printf("⚠️ shell_close für %s nicht an %s gesendet: %v", s.id, s.clientID, err)
+	}
+}
+
+// findShell returns the open session of a client.
+func findShell(clientID, sessionID string) *liveShell {
+	liveShells.Lock()
+	defer liveShells.Unlock()
+	if s, ok := liveShells.byID[sessionID]; ok && s.clientID == clientID {
+		return s
+	}
+	return nil
+}
+
+// receiveShellOutput forwards shell_output of a client to the terminal page.
+func receiveShellOutput(clientID string, output *protocol.ShellOutput) {
+	s := findShell(clientID, output.SessionID)
+	if s == nil {
+		log.Printf("⚠️ Ausgabe von %s für unbekannte Shell %s verworfen", clientID, output.SessionID)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.record("out", output.Data)
+	s.bytesOut += int64(len(output.Data))
+	if err := s.browser.WriteMessage(websocket.BinaryMessage, output.Data); err != nil {
+		log.Printf("⚠️ Ausgabe von Shell %s nicht an das Terminal gesendet: %v", s.id, err)
+	}
+}
+
+// recordShellClosed finishes a session the client ended.
+func recordShellClosed(clientID string, closed *protocol.ShellClosed) {
+	s := findShell(clientID, closed.SessionID)
+	if s == nil {
+		return
+	}
+	reason := closed.Reason
+	if reason == "" && closed.ExitCode != nil {
+		reason = fmt.Sprintf("shell exited with code %d", *closed.ExitCode)
+	}
+	s.finish(closed.ExitCode, reason)
+}
+
+// closeClientShells finishes the sessions of a disconnected client.
+func closeClientShells(clientID string) {
+	var sessions []*liveShell
+	liveShells.Lock()
+	for _, s := range liveShells.byID {
+		if s.clientID == clientID {
+			sessions = append(sessions, s)
+		}
+	}
+	liveShells.Unlock()
+	for _, s := range sessions {
+		s.finish(nil, "client disconnected")
+	}
+}
+
+// expireShells closes sessions idle for longer than SHELL_IDLE_TIMEOUT_SECONDS.
+func expireShells(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var idle []*liveShell
+			now := time.Now()
+			liveShells.Lock()
+			for _, s := range liveShells.byID {
+				s.mu.Lock()
+				if now.Sub(s.lastActive) > shellIdleTimeout() {
+					idle = append(idle, s)
+				}
+				s.mu.Unlock()
+			}
+			liveShells.Unlock()
+			for _, s := range idle {
+				closeShell(s, "idle timeout")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// --- HTTP Handlers ---
+
+// shellPageHandler shows the terminal page for a client.
+func shellPageHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.FormValue("client_id")
+	if clientID == "" {
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		return
+	}
+	if user := currentOperator(r); user == nil || !shellAllowed(user.Username) {
+		http.Error(w, "Not allowed to open shells", http.StatusForbidden)
+		return
+	}
+
+	clientsMutex.RLock()
+	client, ok := clients[clientID]
+	clientsMutex.RUnlock()
+	if !ok {
+		http.Error(w, "Client not connected", http.StatusNotFound)
+		return
+	}
+
+	err := templates.ExecuteTemplate(w, "shell.html", map[string]interface{}{
+		"client_id": clientID,
+		"hostname":  client.Hostname,
+		"supported": client.supports(protocol.CapShell),
+	})
+	if err != nil {
+		log.Printf("Error rendering shell.html: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// shellSocketHandler opens a session on a client and connects it with the
+// terminal page over a WebSocket: text messages from the page are input,
+// binary messages to the page are output and text messages to the page
+// report the status. The upgrade rules out audited(), so opening is
+// audited here.
+func shellSocketHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentOperator(r)
+	clientID := r.FormValue("client_id")
+	shell := r.FormValue("shell")
+	entry := AuditEntry{
+		Actor:    user.Username,
+		SourceIP: sourceIP(r),
+		Action:   "open_shell",
+		Targets:  clientID,
+	}
+
+	fail := func(status int, message string) {
+		entry.Outcome, entry.StatusCode, entry.Detail = auditFailure, status, message
+		if status == http.StatusForbidden {
+			entry.Outcome = auditDenied
+		}
+		writeAudit(entry)
+		http.Error(w, message, status)
+	}
+	if !shellAllowed(user.Username) {
+		log.Printf("🚫 %s darf keine Shell öffnen (SHELL_OPERATORS)", user.Username)
+		fail(http.StatusForbidden, "Not allowed to open shells")
+		return
+	}
+	open := &protocol.ShellOpen{SessionID: uuid.New().String(), Shell: shell}
+	if err := open.Validate(); err != nil || clientID == "" {
+		fail(http.StatusBadRequest, "Client ID or shell invalid")
+		return
+	}
+	clientsMutex.RLock()
+	client, ok := clients[clientID]
+	clientsMutex.RUnlock()
+	if !ok {
+		fail(http.StatusGone, "Client not connected")
+		return
+	}
+	if !client.supports(protocol.CapShell) {
+		fail(http.StatusConflict, "Client does not support shell sessions")
+		return
+	}
+	open.PayloadSignature = signPayload(protocol.ShellOpenContent(open.SessionID, clientID), shell, "shell").message()
+
+	if err := os.MkdirAll(shellDir, 0750); err != nil {
+		log.Printf("Error creating %s: %v", shellDir, err)
+		fail(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	transcript, err := os.OpenFile(transcriptPath(open.SessionID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		log.Printf("Error creating transcript: %v", err)
+		fail(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	browser, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		transcript.Close()
+		os.Remove(transcriptPath(open.SessionID))
+		log.Println("Upgrade error:", err)
+		return
+	}
+	browser.SetReadLimit(64 * 1024)
+
+	session := ShellSession{
+		SessionID: open.SessionID,
+		ClientID:  clientID,
+		Shell:     shell,
+		OpenedBy:  user.Username,
+		SourceIP:  sourceIP(r),
+		Status:    shellOpen,
+	}
+	if err := db.Create(&session).Error; err != nil {
+		log.Printf("Error saving shell session: %v", err)
+	}
+	entry.Outcome, entry.StatusCode, entry.Detail = auditSuccess, http.StatusSwitchingProtocols, "session="+open.SessionID
+	writeAudit(entry)
+
+	s := &liveShell{id: open.SessionID, clientID: clientID, browser: browser, transcript: transcript, lastActive: time.Now()}
+	s.record("event", []byte(fmt.Sprintf("opened by %s on %s (%s)", user.Username, clientID, shell)))
+	liveShells.Lock()
+	liveShells.byID[s.id] = s
+	liveShells.Unlock()
+
+	if err := sendToClient(clientID, open); err != nil {
+		s.finish(nil, "shell_open not sent: "+err.Error())
+		return
+	}
+	log.Printf("🐚 Shell %s auf %s von %s geöffnet", s.id, clientID, user.Username)
+	s.mu.Lock()
+	s.notifyBrowser(shellOpen, open.SessionID)
+	s.mu.Unlock()
+
+	for {
+		_, data, err := browser.ReadMessage()
+		if err != nil {
+			closeShell(s, "terminal closed")
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		s.record("in", data)
+		s.bytesIn += int64(len(data))
+		s.mu.Unlock()
+		if err := sendToClient(clientID, &protocol.ShellInput{SessionID: s.id, Data: data}); err != nil {
+			s.finish(nil, "input not sent: "+err.Error())
+			return
+		}
+	}
+}
+
+// shellSessionsHandler lists recent sessions, optionally of one client.
+func shellSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := db.Order("id desc").Limit(100)
+	if clientID := r.FormValue("client_id"); clientID != "" {
+		query = query.Where("client_id = ?", clientID)
+	}
+	var sessions []ShellSession
+	if err := query.Find(&sessions).Error; err != nil {
+		log.Printf("Error loading shell sessions: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// shellTranscriptHandler returns the transcript of a session as JSON lines.
+func shellTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	var session ShellSession
+	err := db.Where("session_id = ?", r.FormValue("id")).First(&session).Error
+	if gorm.IsRecordNotFoundError(err) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading shell session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(transcriptPath(session.SessionID))
+	if err != nil {
+		log.Printf("Error opening transcript %s: %v", session.SessionID, err)
+		http.Error(w, "Transcript not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "shell-"+session.SessionID+".jsonl"))
+	http.ServeContent(w, r, "", session.UpdatedAt, file)
+}
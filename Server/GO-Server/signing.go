@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"ondeso/protocol"
+)
+
+// signingKey signs scripts and binaries sent to clients. Without a key
+// (SIGNING_KEY_FILE unset) payloads are sent unsigned.
+var signingKey ed25519.PrivateKey
+
+// payloadSignature is attached to every chunk of a signed payload.
+type payloadSignature struct {
+	SHA256    string `json:"content_sha256"`
+	ExpiresAt int64  `json:"expires_at"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// loadSigningKey reads an Ed25519 private key in PKCS#8 PEM form, as written
+// by "openssl genpkey -algorithm ed25519".
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// signPayload hashes a payload and signs hash, name, type and expiry.
+func signPayload(content []byte, name, payloadType string) payloadSignature {
+	return signPayloadWithParameters(content, name, payloadType, "")
+}
+
+// signPayloadWithParameters also signs the parameters sent with a script.
+func signPayloadWithParameters(content []byte, name, payloadType, parameters string) payloadSignature {
+	sum := sha256.Sum256(content)
+	validity := getEnvInt("SIGNATURE_VALIDITY_MINUTES", 60)
+	signature := payloadSignature{
+		SHA256:    hex.EncodeToString(sum[:]),
+		ExpiresAt: time.Now().Add(time.Duration(validity) * time.Minute).Unix(),
+	}
+	if signingKey != nil {
+		message := protocol.SignedPayloadMessage(signature.SHA256, name, payloadType, signature.ExpiresAt, parameters)
+		signature.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, message))
+	}
+	return signature
+}
+
+// message returns the signature fields of a chunk or transfer_start message.
+func (s payloadSignature) message() protocol.PayloadSignature {
+	return protocol.PayloadSignature{SHA256: s.SHA256, ExpiresAt: s.ExpiresAt, Signature: s.Signature}
+}
+
+// recordPayloadRejection logs a payload a client refused to run, because of
+// its signature or the client's execution policy, and marks a rollout
+// execution as failed.
+func recordPayloadRejection(clientID string, rejection *protocol.PayloadRejected) {
+	if rejection.RefusedBy == protocol.RefusedByPolicy {
+		log.Printf("⛔ Client %s hat %s wegen seiner Ausführungsrichtlinie verweigert: %s", clientID, rejection.Name, rejection.Reason)
+	} else {
+		log.Printf("🚨 Client %s hat Payload %s abgelehnt: %s", clientID, rejection.Name, rejection.Reason)
+	}
+
+	if rejection.Type == "binary" {
+		recordBinaryResult(clientID, &protocol.BinaryResult{
+			TransferID: rejection.ExecutionID,
+			BinaryName: rejection.Name,
+			Status:     deliveryRejected,
+			Error:      rejection.Reason,
+		})
+		return
+	}
+
+	if rejection.ExecutionID != "" {
+		recordScriptResult(clientID, &protocol.ScriptResult{
+			ExecutionID: rejection.ExecutionID,
+			ScriptName:  rejection.Name,
+			Status:      "rejected",
+			ExitCode:    -1,
+		})
+	}
+}
+
+// signingKeyHandler returns the public key clients pin in signing_public_key.
+func signingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if signingKey == nil {
+		http.Error(w, "No signing key configured", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"algorithm":  "ed25519",
+		"public_key": base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+	})
+}
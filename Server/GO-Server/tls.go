@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves the server certificate and the client CA pool from
+// disk and picks up changed files without a restart.
+type certReloader struct {
+	certFile, keyFile, clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// newCertReloader loads the certificate files once and returns the reloader.
+func newCertReloader(certFile, keyFile, clientCAFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload reads the certificate, key and client CA bundle from disk.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+
+	var pool *x509.CertPool
+	if c.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.clientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCAs = pool
+	c.modTimes = c.currentModTimes()
+	c.mu.Unlock()
+	return nil
+}
+
+// currentModTimes returns the modification times of the watched files.
+func (c *certReloader) currentModTimes() map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, file := range []string{c.certFile, c.keyFile, c.clientCAFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			times[file] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// changed reports whether a watched file was modified since the last reload.
+func (c *certReloader) changed() bool {
+	current := c.currentModTimes()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for file, modTime := range current {
+		if !modTime.Equal(c.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates when the files change or on SIGHUP.
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+		case <-hup:
+		case <-appCtx.Done():
+			return
+		}
+
+		if err := c.reload(); err != nil {
+			log.Printf("❌ Zertifikate konnten nicht neu geladen werden, verwende bisherige: %v", err)
+			continue
+		}
+		log.Println("🔐 TLS-Zertifikate neu geladen")
+	}
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// tlsConfig returns a TLS configuration using the reloader. With clientAuth
+// set, every handshake uses the current client CA pool.
+func (c *certReloader) tlsConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}
+	if clientAuth == tls.NoClientCert {
+		return config
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: c.getCertificate,
+			ClientAuth:     clientAuth,
+			ClientCAs:      c.clientCAs,
+		}, nil
+	}
+	return config
+}
+
+// clientAuthType maps TLS_CLIENT_AUTH to the TLS client authentication mode:
+// "none" (default), "optional" (verify a certificate if one is sent) or
+// "require".
+func clientAuthType(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown TLS_CLIENT_AUTH mode %q", mode)
+}
+
+// certificateClientID returns the client ID a verified client certificate
+// was issued for (its common name), or "" without a verified certificate.
+func certificateClientID(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// listenAndServe starts a listener, using TLS when a reloader is configured.
+func listenAndServe(server *http.Server, reloader *certReloader, clientAuth tls.ClientAuthType) error {
+	if reloader == nil {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = reloader.tlsConfig(clientAuth)
+	return server.ListenAndServeTLS("", "")
+}
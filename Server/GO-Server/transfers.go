@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ondeso/protocol"
+)
+
+// outgoingTransfer keeps the chunk messages of a script or binary until the
+// client confirms the transfer, so missing or damaged chunks can be sent
+// again, also after a reconnect. Transfers of a distribution share the
+// transfer ID and the chunks.
+type outgoingTransfer struct {
+	clientID    string
+	name        string
+	chunks      [][]byte // Encoded chunk messages or frames by index, not modified
+	frames      bool     // Chunks are binary frames
+	expires     time.Time
+	signedUntil time.Time // Expiry of the payload signature the chunks carry
+	resends     int       // Answered resend requests
+}
+
+// transferKey identifies the transfer of a payload to one client.
+type transferKey struct {
+	clientID   string
+	transferID string
+}
+
+// outgoingTransfers holds the unconfirmed transfers.
+var outgoingTransfers = struct {
+	sync.Mutex
+	byKey map[transferKey]*outgoingTransfer
+}{byKey: make(map[transferKey]*outgoingTransfer)}
+
+// transferTTL is how long unconfirmed transfers are kept (TRANSFER_TTL_MINUTES).
+func transferTTL() time.Duration {
+	return time.Duration(getEnvInt("TRANSFER_TTL_MINUTES", 10)) * time.Minute
+}
+
+// maxResends is how many resend requests one transfer is answered
+// (TRANSFER_MAX_RESENDS).
+func maxResends() int {
+	return getEnvInt("TRANSFER_MAX_RESENDS", 20)
+}
+
+// chunkSHA256 is the checksum of a chunk as transmitted (the base64 text).
+func chunkSHA256(chunk string) string {
+	sum := sha256.Sum256([]byte(chunk))
+	return hex.EncodeToString(sum[:])
+}
+
+// registerTransfer remembers the chunk messages or frames of a transfer.
+// signedUntil is the expires_at of the payload signature in the chunks; the
+// transfer is not kept beyond it, since the client would reject the chunks.
+func registerTransfer(transferID, clientID, name string, chunks [][]byte, frames bool, signedUntil int64) {
+	outgoingTransfers.Lock()
+	transfer := &outgoingTransfer{
+		clientID:    clientID,
+		name:        name,
+		chunks:      chunks,
+		frames:      frames,
+		signedUntil: time.Unix(signedUntil, 0),
+	}
+	transfer.extend(time.Now())
+	outgoingTransfers.byKey[transferKey{clientID, transferID}] = transfer
+	outgoingTransfers.Unlock()
+}
+
+// extend keeps a transfer for another TTL, but not beyond its signature.
+func (t *outgoingTransfer) extend(now time.Time) {
+	t.expires = now.Add(transferTTL())
+	if t.expires.After(t.signedUntil) {
+		t.expires = t.signedUntil
+	}
+}
+
+// completeTransfer drops a transfer the client received completely.
+func completeTransfer(clientID string, transferID string) {
+	outgoingTransfers.Lock()
+	defer outgoingTransfers.Unlock()
+	key := transferKey{clientID, transferID}
+	if transfer, ok := outgoingTransfers.byKey[key]; ok {
+		delete(outgoingTransfers.byKey, key)
+		log.Printf("✅ Übertragung %s (%s) von %s bestätigt", transferID, transfer.name, clientID)
+	}
+}
+
+// resendChunks answers a client's resend_chunks request (a NACK for damaged
+// chunks or a resume after a reconnect) with the requested chunks.
+func resendChunks(clientID string, request *protocol.ResendChunks) error {
+	transferID := request.TransferID
+
+	key := transferKey{clientID, transferID}
+	now := time.Now()
+	outgoingTransfers.Lock()
+	transfer, ok := outgoingTransfers.byKey[key]
+	var err error
+	switch {
+	case !ok || !now.Before(transfer.expires):
+		err = fmt.Errorf("unknown or expired transfer %q", transferID)
+	case transfer.resends >= maxResends():
+		err = fmt.Errorf("transfer %q was sent again %d times", transferID, transfer.resends)
+	default:
+		transfer.resends++
+		transfer.extend(now) // Still in progress
+	}
+	if err != nil && ok {
+		delete(outgoingTransfers.byKey, key)
+	}
+	outgoingTransfers.Unlock()
+	if err != nil {
+		return err
+	}
+
+	indexes := request.Chunks
+	for _, index := range indexes {
+		if index >= len(transfer.chunks) {
+			return fmt.Errorf("invalid chunk index %d", index)
+		}
+	}
+	if len(indexes) == 0 { // Nothing listed: send everything again
+		for i := range transfer.chunks {
+			indexes = append(indexes, i)
+		}
+	}
+
+	messageType := websocket.TextMessage
+	if transfer.frames {
+		messageType = websocket.BinaryMessage
+	}
+	client, ok := connectedClient(clientID)
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	for _, index := range indexes {
+		if err := client.Conn.WriteMessage(messageType, transfer.chunks[index]); err != nil {
+			return err
+		}
+	}
+	log.Printf("🔁 %d Chunks von %s (%s) erneut an %s gesendet", len(indexes), transfer.name, transferID, clientID)
+	return nil
+}
+
+// expireTransfers drops unconfirmed transfers after their TTL.
+func expireTransfers(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			outgoingTransfers.Lock()
+			for key, transfer := range outgoingTransfers.byKey {
+				if now.After(transfer.expires) {
+					delete(outgoingTransfers.byKey, key)
+					log.Printf("⌛ Übertragung %s (%s) an %s nicht bestätigt, verworfen", key.transferID, transfer.name, transfer.clientID)
+				}
+			}
+			outgoingTransfers.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ScriptArgument is a bound parameter value of a script. The server sends
+// them as a JSON array in the "parameters" field; the client passes them as
+// arguments and as environment variables ONDESO_PARAM_<Name>.
+type ScriptArgument struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Type  string `json:"type,omitempty"` // ArgumentBool for parameters declared as bool
+}
+
+// ArgumentBool marks arguments of bool parameters. PowerShell receives them
+// as -Name:$true so [switch] parameters work.
+const ArgumentBool = "bool"
+
+// MaxArgumentValue is the longest value of an argument.
+const MaxArgumentValue = 1024
+
+// ForbiddenArgumentChars are interpreted by cmd.exe, which starts the
+// scripts on Windows clients, and are therefore not allowed in values.
+const ForbiddenArgumentChars = "\"&|<>^%!"
+
+// argumentName allows names that are valid as PowerShell parameters and
+// environment variables.
+var argumentName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// ValidArgumentName reports whether a parameter name is allowed.
+func ValidArgumentName(name string) bool {
+	return argumentName.MatchString(name)
+}
+
+// CheckArgumentValue applies the rules every value must follow.
+func CheckArgumentValue(name, value string) error {
+	if len(value) > MaxArgumentValue {
+		return invalid("parameter %s is longer than %d characters", name, MaxArgumentValue)
+	}
+	for _, c := range value {
+		if c < 0x20 || c == 0x7f {
+			return invalid("parameter %s contains control characters", name)
+		}
+	}
+	if strings.ContainsAny(value, ForbiddenArgumentChars) {
+		return invalid("parameter %s must not contain any of %s", name, ForbiddenArgumentChars)
+	}
+	return nil
+}
+
+// Validate checks name, type and value of an argument.
+func (a ScriptArgument) Validate() error {
+	if !ValidArgumentName(a.Name) {
+		return invalid("parameter name %q", a.Name)
+	}
+	switch a.Type {
+	case "":
+	case ArgumentBool:
+		if a.Value != "true" && a.Value != "false" {
+			return invalid("parameter %s is not a bool value", a.Name)
+		}
+	default:
+		return invalid("parameter %s has unknown type %q", a.Name, a.Type)
+	}
+	return CheckArgumentValue(a.Name, a.Value)
+}
+
+// EncodeArguments returns the "parameters" field for arguments, empty if
+// there are none.
+func EncodeArguments(arguments []ScriptArgument) string {
+	if len(arguments) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(arguments)
+	return string(encoded)
+}
+
+// DecodeArguments reads and validates a "parameters" field.
+func DecodeArguments(raw string) ([]ScriptArgument, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var arguments []ScriptArgument
+	if err := json.Unmarshal([]byte(raw), &arguments); err != nil {
+		return nil, fmt.Errorf("%w: parameters: %v", ErrMalformed, err)
+	}
+	for _, argument := range arguments {
+		if err := argument.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return arguments, nil
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeArguments(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []ScriptArgument
+		wantErr bool
+	}{
+		{"", nil, false},
+		{`[]`, []ScriptArgument{}, false},
+		{`[{"name":"Server","value":"files01"},{"name":"Force","value":"true","type":"bool"}]`,
+			[]ScriptArgument{{Name: "Server", Value: "files01"}, {Name: "Force", Value: "true", Type: "bool"}}, false},
+		{`[{"name":"Path","value":"C:\\Temp\\a b"}]`, []ScriptArgument{{Name: "Path", Value: `C:\Temp\a b`}}, false},
+		{`{"name":"x"}`, nil, true},
+		{`[{"name":"-Evil","value":"x"}]`, nil, true},
+		{`[{"name":"a b","value":"x"}]`, nil, true},
+		{`[{"name":"","value":"x"}]`, nil, true},
+		{`[{"name":"x","value":"a & calc"}]`, nil, true},
+		{`[{"name":"x","value":"a | calc"}]`, nil, true},
+		{`[{"name":"x","value":"a\" -b \""}]`, nil, true},
+		{`[{"name":"x","value":"%COMSPEC%"}]`, nil, true},
+		{`[{"name":"x","value":"a > b"}]`, nil, true},
+		{`[{"name":"x","value":"^!"}]`, nil, true},
+		{`[{"name":"x","value":"a\nb"}]`, nil, true},
+		{`[{"name":"x","value":"a\u007fb"}]`, nil, true},
+		{`[{"name":"Force","value":"(calc)","type":"bool"}]`, nil, true},
+		{`[{"name":"Force","value":"1","type":"bool"}]`, nil, true},
+		{`[{"name":"x","value":"1","type":"int"}]`, nil, true},
+		{`[{"name":"x","value":"` + strings.Repeat("a", MaxArgumentValue+1) + `"}]`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := DecodeArguments(tt.raw)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DecodeArguments(%q) = %+v, %v, want %+v, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package protocol
+
+// CurrentVersion is the newest protocol version. Clients announce theirs at
+// registration; the server uses the lower of both.
+//
+//	1  register with client_id, hostname and ip; scripts and binaries as
+//	   base64 JSON chunks (clients without protocol_version)
+//	2  capabilities, script results, parameters, resumable transfers
+const CurrentVersion Version = 2
+
+// Capabilities a client can announce in the comma-separated "capabilities"
+// field of register. The server only sends what a client announced.
+const (
+	CapScripts          = "scripts"           // upload_script_chunk
+	CapBinaries         = "binaries"          // upload_binary_chunk
+	CapScriptResults    = "script_results"    // script_result with execution_id
+	CapBinaryResults    = "binary_results"    // binary_result with transfer_id
+	CapScriptParameters = "script_parameters" // arguments and ONDESO_PARAM_ variables
+	CapTargetOS         = "target_os"         // refuses scripts for other systems
+	CapScriptTimeout    = "script_timeout"    // honors timeout_seconds
+	CapTransferResume   = "transfer_resume"   // chunk checksums, resend_chunks, transfer_complete
+	CapBinaryFrames     = "binary_frames"     // transfer_start and binary frames
+	CapGzip             = "gzip"              // gzip-compressed frames
+	CapFetchFile        = "fetch_file"        // fetch_file, file_chunk and fetch_failed
+	CapShell            = "shell"             // shell_open, shell_input, shell_close and their answers
+	CapSetConfig        = "set_config"        // set_config and config_result
+	CapUpdateAgent      = "update_agent"      // update_agent, agent transfers and agent_update_status
+)
+
+// LegacyCapabilities are assumed for clients that predate protocol version 2.
+var LegacyCapabilities = []string{CapScripts, CapBinaries}
+
+// TransferModeFrames is the binary-frame mode in the transfer_modes field of
+// earlier builds and in the transfer_mode of a registration response.
+const TransferModeFrames = "binary-frames"
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	// ErrMalformed marks data that is not a JSON object of the expected
+	// shape, e.g. a string field holding a number.
+	ErrMalformed = errors.New("malformed message")
+	// ErrUnknownAction marks messages without or with an unknown action.
+	ErrUnknownAction = errors.New("unknown action")
+)
+
+// envelope reads the action of a message.
+type envelope struct {
+	Action string `json:"action"`
+}
+
+// Decode parses and validates a message. The result is a pointer to one of
+// the message types of this package; it is also returned if only the
+// validation fails, so the caller can tell what was invalid.
+func Decode(data []byte) (Message, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	create, ok := newMessage[env.Action]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownAction, env.Action)
+	}
+	msg := create()
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrMalformed, env.Action, err)
+	}
+	if err := msg.Validate(); err != nil {
+		return msg, fmt.Errorf("%s: %w", env.Action, err)
+	}
+	return msg, nil
+}
+
+// Encode validates a message and returns its JSON with the action as the
+// first field.
+func Encode(msg Message) ([]byte, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", msg.Action(), err)
+	}
+	fields, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	action, _ := json.Marshal(envelope{Action: msg.Action()})
+	if bytes.Equal(fields, []byte("{}")) {
+		return action, nil
+	}
+	// {"action":"..."} + "," + the fields without their opening brace
+	encoded := append(action[:len(action)-1:len(action)-1], ',')
+	return append(encoded, fields[1:]...), nil
+}
+
+// Version is a protocol version. It is sent as a string; numbers are
+// accepted as well.
+type Version int
+
+func (v Version) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.Itoa(int(v)))
+}
+
+func (v *Version) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		var number int
+		if err := json.Unmarshal(data, &number); err != nil {
+			return fmt.Errorf("protocol version %s", data)
+		}
+		*v = Version(number)
+		return nil
+	}
+	if text == "" {
+		*v = 0
+		return nil
+	}
+	number, err := strconv.Atoi(text)
+	if err != nil {
+		return fmt.Errorf("protocol version %q", text)
+	}
+	*v = Version(number)
+	return nil
+}
+
+// Statuses of a Response.
+const (
+	StatusRegistered = "registered"
+	StatusChallenge  = "challenge"
+	StatusError      = "error"
+)
+
+// Response answers register and authenticate, or reports an error. A
+// challenge carries the nonce to authenticate with; a registration the
+// negotiated protocol and, once at enrollment, the client secret.
+type Response struct {
+	Status          string  `json:"status"`
+	Message         string  `json:"message,omitempty"`
+	Nonce           string  `json:"nonce,omitempty"`
+	ClientSecret    string  `json:"client_secret,omitempty"`
+	ProtocolVersion Version `json:"protocol_version,omitempty"`
+	TransferMode    string  `json:"transfer_mode,omitempty"`
+	Compression     string  `json:"compression,omitempty"`
+}
+
+// ErrorResponse returns the encoded error response with a message.
+func ErrorResponse(message string) []byte {
+	data, _ := json.Marshal(Response{Status: StatusError, Message: message})
+	return data
+}
+
+// Validate checks the status and the nonce of a challenge.
+func (r *Response) Validate() error {
+	switch r.Status {
+	case StatusRegistered, StatusError:
+		return nil
+	case StatusChallenge:
+		return required("nonce", r.Nonce)
+	default:
+		return invalid("status %q", r.Status)
+	}
+}
+
+// EncodeResponse validates and encodes a response.
+func EncodeResponse(response Response) ([]byte, error) {
+	if err := response.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+// DecodeResponse parses and validates a response.
+func DecodeResponse(data []byte) (Response, error) {
+	var response Response
+	if err := json.Unmarshal(data, &response); err != nil {
+		return response, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return response, response.Validate()
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Settings of the [CLIENT] section that set_config may change. TLS, the
+// signing key and the execution policy can only be changed on the client.
+const (
+	ConfigLogging          = "logging"          // off, normal or debug
+	ConfigOldLogfiles      = "oldLogfiles"      // Number of log files kept, at least 1
+	ConfigWebsockServer    = "websockserver"    // ws:// or wss:// URL, applied by reconnecting
+	ConfigHideScriptWindow = "HideScriptWindow" // 1, 0, true or false
+)
+
+// Statuses of a ConfigResult.
+const (
+	ConfigApplied  = "applied"
+	ConfigRejected = "rejected" // Invalid settings, nothing was changed
+	ConfigFailed   = "failed"   // The settings could not be written
+)
+
+// configValidators check the value of each settable key.
+var configValidators = map[string]func(string) error{
+	ConfigLogging: func(value string) error {
+		switch value {
+		case "off", "normal", "debug":
+			return nil
+		}
+		return invalid("logging %q", value)
+	},
+	ConfigOldLogfiles: func(value string) error {
+		if number, err := strconv.Atoi(value); err != nil || number < 1 {
+			return invalid("oldLogfiles %q", value)
+		}
+		return nil
+	},
+	ConfigWebsockServer: func(value string) error {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return invalid("websockserver %q", value)
+		}
+		return nil
+	},
+	ConfigHideScriptWindow: func(value string) error {
+		switch value {
+		case "1", "0", "true", "false":
+			return nil
+		}
+		return invalid("HideScriptWindow %q", value)
+	},
+}
+
+// ConfigKeys returns the keys set_config may change, sorted.
+func ConfigKeys() []string {
+	keys := make([]string, 0, len(configValidators))
+	for key := range configValidators {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValidateConfig checks that settings only holds settable keys with valid
+// values.
+func ValidateConfig(settings map[string]string) error {
+	if len(settings) == 0 {
+		return invalid("settings missing")
+	}
+	for _, key := range sortedKeys(settings) {
+		validate, ok := configValidators[key]
+		if !ok {
+			return invalid("setting %q cannot be changed remotely", key)
+		}
+		if err := validate(settings[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckServerChange rejects a websockserver change from wss:// to ws://,
+// which would drop TLS and the pinned server certificate. A client checks
+// set_config against its current URL with it before applying anything.
+func CheckServerChange(currentURL string, settings map[string]string) error {
+	newURL, ok := settings[ConfigWebsockServer]
+	if !ok {
+		return nil
+	}
+	current, err := url.Parse(currentURL)
+	if err != nil || current.Scheme != "wss" {
+		return nil
+	}
+	if u, err := url.Parse(newURL); err != nil || u.Scheme != "wss" {
+		return invalid("websockserver %q would drop TLS, the current server uses wss://", newURL)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of settings in order, so errors are stable.
+func sortedKeys(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
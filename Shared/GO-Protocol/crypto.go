@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// PayloadSignatureVersion prefixes the message covered by a payload
+// signature. Changing the message format requires a new version.
+const PayloadSignatureVersion = "ondeso-payload-v1"
+
+// ClientProof computes the answer to an authentication challenge: the
+// hex-encoded HMAC-SHA256 of "<nonce>:<client_id>" keyed with the client
+// secret.
+func ClientProof(secret, nonce, clientID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce + ":" + clientID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ShellOpenContent is the content signed for a shell_open. It binds the
+// session to the client, so the message cannot be replayed to other clients.
+func ShellOpenContent(sessionID, clientID string) []byte {
+	return []byte(sessionID + "\n" + clientID)
+}
+
+// SignedPayloadMessage is the byte string covered by the Ed25519 signature
+// of a script, binary, agent build or shell_open: version, SHA-256 of the
+// content, name, type and expiry, one per line. Script parameters, if any, are covered by
+// their SHA-256 on an additional line.
+func SignedPayloadMessage(sha256Hex, name, payloadType string, expiresAt int64, parameters string) []byte {
+	message := fmt.Sprintf("%s\n%s\n%s\n%s\n%d", PayloadSignatureVersion, sha256Hex, name, payloadType, expiresAt)
+	if parameters != "" {
+		sum := sha256.Sum256([]byte(parameters))
+		message += "\n" + hex.EncodeToString(sum[:])
+	}
+	return []byte(message)
+}
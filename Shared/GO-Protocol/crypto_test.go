@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+// The vectors below were computed independently (openssl, sha256sum); server
+// and client must keep producing them.
+
+func TestClientProofVector(t *testing.T) {
+	got := ClientProof("s3cr3t-client-secret", "b7c1e0f2a9d34e5f", "2f1c9a4e-5b7d-4c1a-9e3f-8a6b0d2c4e1f")
+	want := "6143d18aa3b4cae21cdda95b918afb7e7083e885438feec68a82e82c76c934b1"
+	if got != want {
+		t.Errorf("ClientProof() = %s, want %s", got, want)
+	}
+}
+
+// signingSeed is the Ed25519 seed 00 01 02 ... 1f.
+func signingSeed() []byte {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	return seed
+}
+
+func TestSignedPayloadMessageVectors(t *testing.T) {
+	const contentSHA256 = "29e7d0e96e3f04cfd28789351cafac7cb79e998c08cbeeddf1d035a27f79274d" // "Write-Output 'Hallo'\r\n"
+
+	tests := []struct {
+		name       string
+		parameters string
+		message    string
+		signature  string
+	}{
+		{
+			name:       "without parameters",
+			parameters: "",
+			message:    "ondeso-payload-v1\n" + contentSHA256 + "\ninventory.ps1\npowershell\n1767225600",
+			signature:  "837TkX7JFeG5ks7b4aQmT+qse2MJ6gcNj3Qd+GyE19GdMcHszbze+APXEt71KoN0jkvyOIrlHpsgqv4C1XqkCg==",
+		},
+		{
+			name:       "with parameters",
+			parameters: `[{"name":"Path","value":"C:\\Temp"}]`,
+			message: "ondeso-payload-v1\n" + contentSHA256 + "\ninventory.ps1\npowershell\n1767225600\n" +
+				"4df7b8f1cad98d3be53bb772bc13bd50bd1fc94f1af16e24f723b07301298fa9",
+			signature: "wlKvpCpLdBjnMqtH0l0Hu3L/ZexL9ecP96fL/z00WIwiieCd4CutL+w0GqTotETP9gO2mjtX3B9favCjnU5NBg==",
+		},
+	}
+
+	key := ed25519.NewKeyFromSeed(signingSeed())
+	if got := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)); got != "A6EHv/POEL4dcN0Y50vAmWfk1jCbpQ1fHdyGZBJVMbg=" {
+		t.Fatalf("public key = %s", got)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := SignedPayloadMessage(contentSHA256, "inventory.ps1", "powershell", 1767225600, tt.parameters)
+			if string(message) != tt.message {
+				t.Errorf("SignedPayloadMessage() = %q, want %q", message, tt.message)
+			}
+			if got := base64.StdEncoding.EncodeToString(ed25519.Sign(key, message)); got != tt.signature {
+				t.Errorf("signature = %s, want %s", got, tt.signature)
+			}
+		})
+	}
+}
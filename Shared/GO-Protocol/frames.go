@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Layout of a transfer frame: a 64 byte header followed by the data.
+//
+//	0  2  magic "OT"
+//	2  1  version (1)
+//	3  1  flags (reserved)
+//	4  16 transfer ID (UUID)
+//	20 4  chunk index, big endian
+//	24 8  offset of the data in the (compressed) payload, big endian
+//	32 32 SHA-256 of the data
+const (
+	FrameMagic      = "OT"
+	FrameVersion    = 1
+	FrameHeaderSize = 64
+)
+
+// Frame is a decoded transfer frame.
+type Frame struct {
+	TransferID [16]byte
+	Index      int
+	Offset     int64
+	SHA256     [32]byte
+	Data       []byte
+}
+
+// EncodeFrame builds one transfer frame.
+func EncodeFrame(transferID [16]byte, index int, offset int64, data []byte) []byte {
+	frame := make([]byte, FrameHeaderSize, FrameHeaderSize+len(data))
+	copy(frame[0:2], FrameMagic)
+	frame[2] = FrameVersion
+	copy(frame[4:20], transferID[:])
+	binary.BigEndian.PutUint32(frame[20:24], uint32(index))
+	binary.BigEndian.PutUint64(frame[24:32], uint64(offset))
+	sum := sha256.Sum256(data)
+	copy(frame[32:64], sum[:])
+	return append(frame, data...)
+}
+
+// IsFrame reports whether a binary message is a transfer frame; other binary
+// messages hold JSON.
+func IsFrame(msg []byte) bool {
+	return len(msg) >= FrameHeaderSize && string(msg[0:2]) == FrameMagic
+}
+
+// DecodeFrame reads a transfer frame. The data is not copied, and its
+// checksum is left to Verify so the receiver can request the chunk again.
+func DecodeFrame(msg []byte) (Frame, error) {
+	if !IsFrame(msg) {
+		return Frame{}, fmt.Errorf("%w: not a transfer frame", ErrMalformed)
+	}
+	if msg[2] != FrameVersion {
+		return Frame{}, fmt.Errorf("%w: frame version %d", ErrMalformed, msg[2])
+	}
+	var frame Frame
+	copy(frame.TransferID[:], msg[4:20])
+	frame.Index = int(binary.BigEndian.Uint32(msg[20:24]))
+	frame.Offset = int64(binary.BigEndian.Uint64(msg[24:32]))
+	copy(frame.SHA256[:], msg[32:64])
+	frame.Data = msg[FrameHeaderSize:]
+	return frame, nil
+}
+
+// Verify reports whether the data matches the checksum of the header.
+func (f Frame) Verify() bool {
+	sum := sha256.Sum256(f.Data)
+	return bytes.Equal(sum[:], f.SHA256[:])
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	transferID := [16]byte{0x2f, 0x1c, 0x9a, 0x4e}
+	data := []byte("chunk data")
+	encoded := EncodeFrame(transferID, 3, 786432, data)
+	if len(encoded) != FrameHeaderSize+len(data) || !IsFrame(encoded) {
+		t.Fatalf("EncodeFrame() returned %d bytes, IsFrame %v", len(encoded), IsFrame(encoded))
+	}
+
+	frame, err := DecodeFrame(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.TransferID != transferID || frame.Index != 3 || frame.Offset != 786432 || !bytes.Equal(frame.Data, data) || !frame.Verify() {
+		t.Errorf("DecodeFrame() = %+v", frame)
+	}
+
+	encoded[len(encoded)-1] ^= 1
+	if frame, _ := DecodeFrame(encoded); frame.Verify() {
+		t.Error("Verify() accepted corrupted data")
+	}
+}
+
+func TestDecodeFrameRejects(t *testing.T) {
+	valid := EncodeFrame([16]byte{1}, 0, 0, nil)
+	wrongVersion := append([]byte(nil), valid...)
+	wrongVersion[2] = FrameVersion + 1
+	for name, msg := range map[string][]byte{
+		"short":         valid[:FrameHeaderSize-1],
+		"json":          []byte(`{"action":"refresh"}` + string(make([]byte, FrameHeaderSize))),
+		"wrong version": wrongVersion,
+	} {
+		if _, err := DecodeFrame(msg); !errors.Is(err, ErrMalformed) {
+			t.Errorf("DecodeFrame(%s) error = %v, want ErrMalformed", name, err)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module ondeso/protocol
+
+go 1.24.0
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoClientSecret is returned by ClientHandshake when the server sends a
+// challenge but the client has not enrolled yet.
+var ErrNoClientSecret = errors.New("server requires authentication, but there is no client secret")
+
+// ErrRegistrationRejected is returned by ClientHandshake when the server
+// refuses the registration.
+var ErrRegistrationRejected = errors.New("registration rejected")
+
+// ClientHandshake runs the client side of a registration: it sends register,
+// answers a challenge with the proof of secret and returns the final
+// response. Clients without secret set register.EnrollmentToken instead; the
+// response then carries the ClientSecret to store for later registrations.
+func ClientHandshake(register *Register, secret string, send func(Message) error, receive func() (Response, error)) (Response, error) {
+	if err := send(register); err != nil {
+		return Response{}, err
+	}
+	response, err := receive()
+	if err != nil {
+		return response, err
+	}
+
+	if response.Status == StatusChallenge {
+		if secret == "" {
+			return response, ErrNoClientSecret
+		}
+		if err := send(&Authenticate{Proof: ClientProof(secret, response.Nonce, register.ClientID)}); err != nil {
+			return response, err
+		}
+		if response, err = receive(); err != nil {
+			return response, err
+		}
+	}
+
+	if response.Status != StatusRegistered {
+		return response, fmt.Errorf("%w: %s", ErrRegistrationRejected, response.Message)
+	}
+	return response, nil
+}
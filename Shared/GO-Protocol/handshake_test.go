@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+// handshakeServer answers the messages of ClientHandshake like the server:
+// with challenge it requires the proof of secret, without it registers.
+type handshakeServer struct {
+	challenge bool
+	secret    string
+	sent      []Message
+}
+
+func (s *handshakeServer) send(msg Message) error {
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func (s *handshakeServer) receive() (Response, error) {
+	switch msg := s.sent[len(s.sent)-1].(type) {
+	case *Register:
+		if s.challenge {
+			return Response{Status: StatusChallenge, Nonce: "b7c1e0f2a9d34e5f"}, nil
+		}
+		if msg.EnrollmentToken != "" {
+			return Response{Status: StatusRegistered, ClientSecret: "issued-secret"}, nil
+		}
+		return Response{Status: StatusError, Message: "Client not enrolled"}, nil
+	case *Authenticate:
+		if msg.Proof != ClientProof(s.secret, "b7c1e0f2a9d34e5f", "client-1") {
+			return Response{Status: StatusError, Message: "Authentication failed"}, nil
+		}
+		return Response{Status: StatusRegistered}, nil
+	}
+	return Response{}, errors.New("unexpected message")
+}
+
+func TestClientHandshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		server     handshakeServer
+		token      string
+		secret     string
+		wantErr    error
+		wantSecret string
+		wantSent   int
+	}{
+		{"enrollment", handshakeServer{}, "token-1", "", nil, "issued-secret", 1},
+		{"not enrolled", handshakeServer{}, "", "", ErrRegistrationRejected, "", 1},
+		{"challenge", handshakeServer{challenge: true, secret: "s3cr3t"}, "", "s3cr3t", nil, "", 2},
+		{"wrong secret", handshakeServer{challenge: true, secret: "s3cr3t"}, "", "other", ErrRegistrationRejected, "", 2},
+		{"challenge without secret", handshakeServer{challenge: true, secret: "s3cr3t"}, "", "", ErrNoClientSecret, "", 1},
+	}
+	for _, tt := range tests {
+		server := tt.server
+		register := &Register{ClientID: "client-1", Hostname: "WS-1", IP: "10.0.0.1", EnrollmentToken: tt.token}
+		response, err := ClientHandshake(register, tt.secret, server.send, server.receive)
+		if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if response.ClientSecret != tt.wantSecret {
+			t.Errorf("%s: client secret %q, want %q", tt.name, response.ClientSecret, tt.wantSecret)
+		}
+		if len(server.sent) != tt.wantSent {
+			t.Errorf("%s: sent %d messages, want %d", tt.name, len(server.sent), tt.wantSent)
+		}
+	}
+}
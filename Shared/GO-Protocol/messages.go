@@ -0,0 +1,387 @@
+// Package protocol defines the WebSocket messages exchanged between the
+// server and its clients. Every message is a JSON object whose "action"
+// field selects one of the types below; register, authenticate and their
+// responses are the only messages without a registered client.
+package protocol
+
+// Actions sent by clients.
+const (
+	ActionRegister         = "register"
+	ActionAuthenticate     = "authenticate"
+	ActionScriptResult     = "script_result"
+	ActionBinaryResult     = "binary_result"
+	ActionPayloadRejected  = "payload_rejected"
+	ActionResendChunks     = "resend_chunks"
+	ActionTransferComplete = "transfer_complete"
+	ActionFileChunk        = "file_chunk"
+	ActionFetchFailed      = "fetch_failed"
+	ActionShellOutput      = "shell_output"
+	ActionShellClosed      = "shell_closed"
+	ActionConfigResult     = "config_result"
+	ActionAgentUpdate      = "agent_update_status"
+)
+
+// Actions sent by the server.
+const (
+	ActionMessage             = "message"
+	ActionRefresh             = "refresh"
+	ActionUploadScriptChunk   = "upload_script_chunk"
+	ActionUploadBinaryChunk   = "upload_binary_chunk"
+	ActionExecuteScript       = "execute_script"
+	ActionTransferStart       = "transfer_start"
+	ActionTransferUnavailable = "transfer_unavailable"
+	ActionFetchFile           = "fetch_file"
+	ActionShellOpen           = "shell_open"
+	ActionShellInput          = "shell_input"
+	ActionShellClose          = "shell_close"
+	ActionSetConfig           = "set_config"
+	ActionUpdateAgent         = "update_agent"
+)
+
+// Transfer kinds of transfer_start. KindAgent carries a client build
+// announced with update_agent.
+const (
+	KindScript = "script"
+	KindBinary = "binary"
+	KindAgent  = "agent"
+)
+
+// Statuses of an AgentUpdateStatus. The client reports UpdateInstalled
+// after registering with the new build, UpdateRolledBack after the new
+// build failed to register and the previous one was restored. A service
+// checks the new build as a staged build first, which registers with staged
+// and reports UpdateInstalling; UpdateInstalled follows from the installed
+// build after the service swapped the files.
+const (
+	UpdateDownloading = "downloading"
+	UpdateInstalling  = "installing"
+	UpdateInstalled   = "installed"
+	UpdateRolledBack  = "rolled_back"
+	UpdateRejected    = "rejected" // Refused by policy or signature
+	UpdateFailed      = "failed"
+)
+
+// EncodingGzip marks gzip-compressed frame transfers.
+const EncodingGzip = "gzip"
+
+// RefusedByPolicy marks payloads a client refused because of its execution
+// policy rather than their signature.
+const RefusedByPolicy = "policy"
+
+// Message is implemented by every message type.
+type Message interface {
+	// Action returns the value of the "action" field.
+	Action() string
+	// Validate checks the fields the receiver relies on.
+	Validate() error
+}
+
+// Register announces a client. ProtocolVersion, ClientVersion and
+// Capabilities are missing for clients of protocol version 1; TransferModes
+// and Compression were sent by earlier builds instead of capabilities.
+type Register struct {
+	ClientID        string  `json:"client_id"`
+	Hostname        string  `json:"hostname"`
+	IP              string  `json:"ip"`
+	EnrollmentToken string  `json:"enrollment_token,omitempty"`
+	ProtocolVersion Version `json:"protocol_version,omitempty"`
+	ClientVersion   string  `json:"client_version,omitempty"`
+	Capabilities    string  `json:"capabilities,omitempty"` // Comma-separated
+	TransferModes   string  `json:"transfer_modes,omitempty"`
+	Compression     string  `json:"compression,omitempty"`
+	OS              string  `json:"os,omitempty"`     // GOOS of the client build
+	Arch            string  `json:"arch,omitempty"`   // GOARCH of the client build
+	Staged          bool    `json:"staged,omitempty"` // New build checked by a service before it is installed
+}
+
+// Authenticate answers the challenge of a registration with an HMAC proof
+// of the client secret.
+type Authenticate struct {
+	Proof string `json:"proof"`
+}
+
+// ScriptResult reports the outcome of a script execution.
+type ScriptResult struct {
+	ExecutionID string `json:"execution_id,omitempty"`
+	ScriptName  string `json:"script_name"`
+	ExitCode    int    `json:"exit_code"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// BinaryResult reports the state of a binary delivery.
+type BinaryResult struct {
+	TransferID string `json:"transfer_id"`
+	BinaryName string `json:"binary_name"`
+	Status     string `json:"status"`
+	ExitCode   *int   `json:"exit_code,omitempty"` // Only once the binary has exited
+	Error      string `json:"error,omitempty"`
+}
+
+// PayloadRejected reports a script or binary the client refused to run.
+// ExecutionID holds the transfer ID for binaries.
+type PayloadRejected struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	ExecutionID string `json:"execution_id"`
+	Reason      string `json:"reason"`
+	RefusedBy   string `json:"refused_by,omitempty"`
+}
+
+// ResendChunks requests chunks or frames of a transfer again. An empty list
+// requests all of them.
+type ResendChunks struct {
+	TransferID string `json:"transfer_id"`
+	Chunks     []int  `json:"chunks"`
+}
+
+// TransferComplete confirms a transfer the client received completely.
+type TransferComplete struct {
+	TransferID string `json:"transfer_id"`
+}
+
+// FileChunk carries one base64 chunk of a file requested with fetch_file.
+// Size and SHA256 describe the whole file and are the same in every chunk.
+type FileChunk struct {
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	FileChunk string `json:"file_chunk"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	ChunkInfo
+}
+
+// FetchFailed reports a fetch_file request the client could not or would
+// not answer.
+type FetchFailed struct {
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	Reason    string `json:"reason"`
+}
+
+// ShellOutput carries output of a shell session. Data holds stdout and
+// stderr as they were read and is base64 encoded in JSON.
+type ShellOutput struct {
+	SessionID string `json:"session_id"`
+	Data      []byte `json:"data"`
+}
+
+// ShellClosed reports the end of a shell session, either because the shell
+// exited or because it could not be started.
+type ShellClosed struct {
+	SessionID string `json:"session_id"`
+	ExitCode  *int   `json:"exit_code,omitempty"` // Only if the shell was started
+	Reason    string `json:"reason,omitempty"`
+}
+
+// ConfigResult answers set_config. Reconnect is set if the client connects
+// to a new server URL after answering.
+type ConfigResult struct {
+	RequestID string `json:"request_id"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+	Reconnect bool   `json:"reconnect,omitempty"`
+}
+
+// AgentUpdateStatus reports the progress of an update_agent.
+type AgentUpdateStatus struct {
+	UpdateID string `json:"update_id"`
+	Version  string `json:"version"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+}
+
+// ContentMessage is a text message for the client. "STOP" ends the client.
+type ContentMessage struct {
+	Content string `json:"content"`
+}
+
+// Refresh tells a client the list of connected clients has changed.
+type Refresh struct{}
+
+// PayloadSignature holds the hash, expiry and Ed25519 signature of a script
+// or binary. It is sent with every chunk and with transfer_start.
+type PayloadSignature struct {
+	SHA256    string `json:"content_sha256,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// ScriptMeta holds the optional fields of a script payload.
+type ScriptMeta struct {
+	ScriptVersion  int    `json:"script_version,omitempty"`
+	ScriptSHA256   string `json:"script_sha256,omitempty"`
+	TargetOS       string `json:"target_os,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+	Parameters     string `json:"parameters,omitempty"` // JSON array of name/value arguments
+	ExecutionID    string `json:"execution_id,omitempty"`
+}
+
+// ChunkInfo places a chunk within its transfer. TransferID and ChunkSHA256
+// are missing from servers that predate resumable transfers.
+type ChunkInfo struct {
+	ChunkIndex  int    `json:"chunk_index"`
+	TotalChunks int    `json:"total_chunks"`
+	TransferID  string `json:"transfer_id,omitempty"`
+	ChunkSHA256 string `json:"chunk_sha256,omitempty"` // Of the base64 text
+}
+
+// ScriptChunk carries one base64 chunk of a script.
+type ScriptChunk struct {
+	ScriptName  string `json:"script_name"`
+	ScriptType  string `json:"script_type"`
+	ScriptChunk string `json:"script_chunk"`
+	ChunkInfo
+	ScriptMeta
+	PayloadSignature
+}
+
+// BinaryChunk carries one base64 chunk of a binary.
+type BinaryChunk struct {
+	BinaryName  string `json:"binary_name"`
+	BinaryChunk string `json:"binary_chunk"`
+	ChunkInfo
+	PayloadSignature
+}
+
+// ExecuteScript carries a whole base64 encoded script.
+type ExecuteScript struct {
+	ScriptName    string `json:"script_name"`
+	ScriptType    string `json:"script_type"`
+	ScriptContent string `json:"script_content"`
+	ScriptMeta
+	PayloadSignature
+}
+
+// TransferStart announces a transfer in binary frames. Size is the size of
+// the payload, EncodedSize the size of the (compressed) data in the frames.
+type TransferStart struct {
+	Kind        string `json:"kind"`
+	TransferID  string `json:"transfer_id"`
+	TotalChunks int    `json:"total_chunks"`
+	ChunkSize   int    `json:"chunk_size"`
+	Size        int64  `json:"size"`
+	EncodedSize int64  `json:"encoded_size"`
+	Encoding    string `json:"encoding,omitempty"`
+	ScriptName  string `json:"script_name,omitempty"`
+	ScriptType  string `json:"script_type,omitempty"`
+	BinaryName  string `json:"binary_name,omitempty"`
+	ScriptMeta
+	PayloadSignature
+}
+
+// FetchFile asks a client for a file below its workplace directory. Path is
+// relative to the workplace and uses forward slashes; larger files than
+// MaxSize are refused by the client.
+type FetchFile struct {
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	MaxSize   int64  `json:"max_size,omitempty"`
+}
+
+// ShellOpen starts a shell session in the workplace of a client. Shell
+// selects the interpreter ("cmd", "powershell", "sh"); empty means the
+// default of the client's system. The signature covers ShellOpenContent with
+// the shell as name and "shell" as type.
+type ShellOpen struct {
+	SessionID string `json:"session_id"`
+	Shell     string `json:"shell,omitempty"`
+	PayloadSignature
+}
+
+// ShellInput is written to the standard input of a shell session.
+type ShellInput struct {
+	SessionID string `json:"session_id"`
+	Data      []byte `json:"data"`
+}
+
+// ShellClose ends a shell session and its processes.
+type ShellClose struct {
+	SessionID string `json:"session_id"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// SetConfig changes settings of the [CLIENT] section of client_config.ini,
+// see ConfigKeys. All settings are checked before any is written.
+type SetConfig struct {
+	RequestID string            `json:"request_id"`
+	Settings  map[string]string `json:"settings"`
+}
+
+// UpdateAgent offers a new client build. The build is downloaded from URL
+// or follows as a transfer of kind KindAgent with TransferID. The signature
+// covers the build with AgentBuildName of the version and the client's
+// platform as name and "agent" as type. The new build must register within
+// ConfirmSeconds or the client rolls back.
+type UpdateAgent struct {
+	UpdateID       string `json:"update_id"`
+	Version        string `json:"version"`
+	Size           int64  `json:"size"`
+	URL            string `json:"url,omitempty"`
+	TransferID     string `json:"transfer_id,omitempty"`
+	ConfirmSeconds int    `json:"confirm_seconds,omitempty"`
+	PayloadSignature
+}
+
+// TransferUnavailable tells a client a transfer cannot be resumed.
+type TransferUnavailable struct {
+	TransferID string `json:"transfer_id"`
+	Message    string `json:"message"`
+}
+
+func (*Register) Action() string            { return ActionRegister }
+func (*Authenticate) Action() string        { return ActionAuthenticate }
+func (*ScriptResult) Action() string        { return ActionScriptResult }
+func (*BinaryResult) Action() string        { return ActionBinaryResult }
+func (*PayloadRejected) Action() string     { return ActionPayloadRejected }
+func (*ResendChunks) Action() string        { return ActionResendChunks }
+func (*TransferComplete) Action() string    { return ActionTransferComplete }
+func (*FileChunk) Action() string           { return ActionFileChunk }
+func (*FetchFailed) Action() string         { return ActionFetchFailed }
+func (*ShellOutput) Action() string         { return ActionShellOutput }
+func (*ShellClosed) Action() string         { return ActionShellClosed }
+func (*ConfigResult) Action() string        { return ActionConfigResult }
+func (*AgentUpdateStatus) Action() string   { return ActionAgentUpdate }
+func (*ContentMessage) Action() string      { return ActionMessage }
+func (*Refresh) Action() string             { return ActionRefresh }
+func (*ScriptChunk) Action() string         { return ActionUploadScriptChunk }
+func (*BinaryChunk) Action() string         { return ActionUploadBinaryChunk }
+func (*ExecuteScript) Action() string       { return ActionExecuteScript }
+func (*TransferStart) Action() string       { return ActionTransferStart }
+func (*TransferUnavailable) Action() string { return ActionTransferUnavailable }
+func (*FetchFile) Action() string           { return ActionFetchFile }
+func (*ShellOpen) Action() string           { return ActionShellOpen }
+func (*ShellInput) Action() string          { return ActionShellInput }
+func (*ShellClose) Action() string          { return ActionShellClose }
+func (*SetConfig) Action() string           { return ActionSetConfig }
+func (*UpdateAgent) Action() string         { return ActionUpdateAgent }
+
+// newMessage returns an empty message for an action.
+var newMessage = map[string]func() Message{
+	ActionRegister:            func() Message { return new(Register) },
+	ActionAuthenticate:        func() Message { return new(Authenticate) },
+	ActionScriptResult:        func() Message { return new(ScriptResult) },
+	ActionBinaryResult:        func() Message { return new(BinaryResult) },
+	ActionPayloadRejected:     func() Message { return new(PayloadRejected) },
+	ActionResendChunks:        func() Message { return new(ResendChunks) },
+	ActionTransferComplete:    func() Message { return new(TransferComplete) },
+	ActionFileChunk:           func() Message { return new(FileChunk) },
+	ActionFetchFailed:         func() Message { return new(FetchFailed) },
+	ActionShellOutput:         func() Message { return new(ShellOutput) },
+	ActionShellClosed:         func() Message { return new(ShellClosed) },
+	ActionConfigResult:        func() Message { return new(ConfigResult) },
+	ActionAgentUpdate:         func() Message { return new(AgentUpdateStatus) },
+	ActionMessage:             func() Message { return new(ContentMessage) },
+	ActionRefresh:             func() Message { return new(Refresh) },
+	ActionUploadScriptChunk:   func() Message { return new(ScriptChunk) },
+	ActionUploadBinaryChunk:   func() Message { return new(BinaryChunk) },
+	ActionExecuteScript:       func() Message { return new(ExecuteScript) },
+	ActionTransferStart:       func() Message { return new(TransferStart) },
+	ActionTransferUnavailable: func() Message { return new(TransferUnavailable) },
+	ActionFetchFile:           func() Message { return new(FetchFile) },
+	ActionShellOpen:           func() Message { return new(ShellOpen) },
+	ActionShellInput:          func() Message { return new(ShellInput) },
+	ActionShellClose:          func() Message { return new(ShellClose) },
+	ActionSetConfig:           func() Message { return new(SetConfig) },
+	ActionUpdateAgent:         func() Message { return new(UpdateAgent) },
+}
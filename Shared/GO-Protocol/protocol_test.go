@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var signature = PayloadSignature{
+	SHA256:    "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	ExpiresAt: 1767225600,
+	Signature: "c2lnbmF0dXJl",
+}
+
+// goldenMessages are encoded into testdata/<name>.json.
+var goldenMessages = map[string]Message{
+	"register": &Register{
+		ClientID:        "2f1c9a4e-5b7d-4c1a-9e3f-8a6b0d2c4e1f",
+		Hostname:        "WS-0042",
+		IP:              "10.0.0.42",
+		ProtocolVersion: 2,
+		ClientVersion:   "1.0.0",
+		Capabilities:    "scripts,binaries,script_results",
+		OS:              "windows",
+		Arch:            "amd64",
+	},
+	"register_enrollment": &Register{
+		ClientID:        "2f1c9a4e-5b7d-4c1a-9e3f-8a6b0d2c4e1f",
+		Hostname:        "WS-0042",
+		IP:              "10.0.0.42",
+		EnrollmentToken: "enroll-token",
+	},
+	"authenticate":      &Authenticate{Proof: "6d2c4e"},
+	"script_result":     &ScriptResult{ExecutionID: "exec-1", ScriptName: "inventory.ps1", ExitCode: 1, Status: "failed", Error: "exit status 1"},
+	"binary_result":     &BinaryResult{TransferID: "transfer-1", BinaryName: "setup.exe", Status: "finished", ExitCode: new(int)},
+	"payload_rejected":  &PayloadRejected{Name: "setup.exe", Type: "binary", ExecutionID: "transfer-1", Reason: "Payload ist nicht signiert", RefusedBy: RefusedByPolicy},
+	"resend_chunks":     &ResendChunks{TransferID: "transfer-1", Chunks: []int{2, 5}},
+	"resend_all":        &ResendChunks{TransferID: "transfer-1", Chunks: []int{}},
+	"transfer_complete": &TransferComplete{TransferID: "transfer-1"},
+	"message":           &ContentMessage{Content: "Hallo"},
+	"refresh":           &Refresh{},
+	"script_chunk": &ScriptChunk{
+		ScriptName:  "maintenance/cleanup.bat",
+		ScriptType:  "bat",
+		ScriptChunk: "ZGVsIC9x",
+		ChunkInfo:   ChunkInfo{ChunkIndex: 0, TotalChunks: 2, TransferID: "transfer-1", ChunkSHA256: "0a1b"},
+		ScriptMeta: ScriptMeta{
+			ScriptVersion:  3,
+			ScriptSHA256:   "3c4d",
+			TargetOS:       "windows",
+			TimeoutSeconds: 600,
+			Parameters:     `[{"name":"Path","value":"C:\\Temp"}]`,
+			ExecutionID:    "exec-1",
+		},
+		PayloadSignature: signature,
+	},
+	"script_chunk_legacy": &ScriptChunk{
+		ScriptName:  "inventory.ps1",
+		ScriptType:  "powershell",
+		ScriptChunk: "R2V0",
+		ChunkInfo:   ChunkInfo{ChunkIndex: 0, TotalChunks: 1},
+	},
+	"binary_chunk": &BinaryChunk{
+		BinaryName:       "setup.exe",
+		BinaryChunk:      "TVqQ",
+		ChunkInfo:        ChunkInfo{ChunkIndex: 1, TotalChunks: 3, TransferID: "transfer-1", ChunkSHA256: "5e6f"},
+		PayloadSignature: signature,
+	},
+	"execute_script": &ExecuteScript{
+		ScriptName:       "inventory.ps1",
+		ScriptType:       "powershell",
+		ScriptContent:    "R2V0LUNvbXB1dGVySW5mbw==",
+		PayloadSignature: signature,
+	},
+	"transfer_start": &TransferStart{
+		Kind:             KindBinary,
+		TransferID:       "2f1c9a4e-5b7d-4c1a-9e3f-8a6b0d2c4e1f",
+		TotalChunks:      4,
+		ChunkSize:        262144,
+		Size:             1048576,
+		EncodedSize:      786432,
+		Encoding:         EncodingGzip,
+		BinaryName:       "setup.exe",
+		PayloadSignature: signature,
+	},
+	"transfer_unavailable": &TransferUnavailable{TransferID: "transfer-1", Message: "unknown or expired transfer"},
+	"fetch_file":           &FetchFile{RequestID: "fetch-1", Path: "security/security_inventory.json", MaxSize: 52428800},
+	"file_chunk": &FileChunk{
+		RequestID: "fetch-1",
+		Path:      "logs/client_stream.log",
+		FileChunk: "WzEyOjAwXQ==",
+		Size:      300000,
+		SHA256:    "7a8b",
+		ChunkInfo: ChunkInfo{ChunkIndex: 1, TotalChunks: 2, ChunkSHA256: "9c0d"},
+	},
+	"shell_open":   &ShellOpen{SessionID: "shell-1", Shell: "powershell", PayloadSignature: signature},
+	"shell_input":  &ShellInput{SessionID: "shell-1", Data: []byte("dir\r\n")},
+	"shell_output": &ShellOutput{SessionID: "shell-1", Data: []byte(" Verzeichnis von C:\\ProgramData\r\n")},
+	"shell_close":  &ShellClose{SessionID: "shell-1", Reason: "idle timeout"},
+	"shell_closed": &ShellClosed{SessionID: "shell-1", ExitCode: new(int)},
+	"set_config": &SetConfig{RequestID: "config-1", Settings: map[string]string{
+		ConfigLogging:       "debug",
+		ConfigWebsockServer: "wss://ondeso.example.com:8765",
+	}},
+	"config_result": &ConfigResult{RequestID: "config-1", Status: ConfigApplied, Reconnect: true},
+	"fetch_failed":  &FetchFailed{RequestID: "fetch-1", Path: "../client_secret.key", Reason: "Pfad liegt außerhalb des Workplace"},
+}
+
+// goldenResponses are encoded into testdata/response_<name>.json.
+var goldenResponses = map[string]Response{
+	"registered": {Status: StatusRegistered, ClientSecret: "secret", ProtocolVersion: 2, TransferMode: "binary-frames", Compression: EncodingGzip},
+	"challenge":  {Status: StatusChallenge, Nonce: "nonce"},
+	"error":      {Status: StatusError, Message: "Authentication failed"},
+}
+
+// checkGolden compares encoded JSON with a golden file, or rewrites the file
+// with -update.
+func checkGolden(t *testing.T, name string, encoded []byte) []byte {
+	t.Helper()
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, encoded, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	indented.WriteByte('\n')
+
+	path := filepath.Join("testdata", name+".json")
+	if *update {
+		if err := os.WriteFile(path, indented.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(indented.Bytes(), golden) {
+		t.Errorf("%s: encoded\n%s\nwant\n%s", name, indented.Bytes(), golden)
+	}
+	return golden
+}
+
+func TestGoldenMessages(t *testing.T) {
+	for name, msg := range goldenMessages {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := Encode(msg)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			golden := checkGolden(t, name, encoded)
+
+			decoded, err := Decode(golden)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("Decode = %#v, want %#v", decoded, msg)
+			}
+		})
+	}
+}
+
+func TestGoldenResponses(t *testing.T) {
+	for name, response := range goldenResponses {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := EncodeResponse(response)
+			if err != nil {
+				t.Fatalf("EncodeResponse: %v", err)
+			}
+			golden := checkGolden(t, "response_"+name, encoded)
+
+			decoded, err := DecodeResponse(golden)
+			if err != nil {
+				t.Fatalf("DecodeResponse: %v", err)
+			}
+			if decoded != response {
+				t.Errorf("DecodeResponse = %#v, want %#v", decoded, response)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsBadInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"not json", `{"action":`, ErrMalformed},
+		{"array", `[]`, ErrMalformed},
+		{"no action", `{"client_id":"a"}`, ErrUnknownAction},
+		{"unknown action", `{"action":"format_disk"}`, ErrUnknownAction},
+		{"action not a string", `{"action":1}`, ErrMalformed},
+		{"name not a string", `{"action":"upload_script_chunk","script_name":1,"script_type":"bat","chunk_index":0,"total_chunks":1}`, ErrMalformed},
+		{"missing script name", `{"action":"upload_script_chunk","script_type":"bat","chunk_index":0,"total_chunks":1}`, ErrInvalidMessage},
+		{"missing script type", `{"action":"upload_script_chunk","script_name":"a.bat","chunk_index":0,"total_chunks":1}`, ErrInvalidMessage},
+		{"index out of range", `{"action":"upload_binary_chunk","binary_name":"a.exe","chunk_index":3,"total_chunks":3}`, ErrInvalidMessage},
+		{"no chunks", `{"action":"upload_binary_chunk","binary_name":"a.exe","chunk_index":0,"total_chunks":0}`, ErrInvalidMessage},
+		{"register without ip", `{"action":"register","client_id":"a","hostname":"b"}`, ErrInvalidMessage},
+		{"register with bad os", `{"action":"register","client_id":"a","hostname":"b","ip":"c","os":"../win","arch":"amd64"}`, ErrInvalidMessage},
+		{"register without arch", `{"action":"register","client_id":"a","hostname":"b","ip":"c","os":"linux"}`, ErrInvalidMessage},
+		{"bad protocol version", `{"action":"register","client_id":"a","hostname":"b","ip":"c","protocol_version":"two"}`, ErrMalformed},
+		{"negative chunk", `{"action":"resend_chunks","transfer_id":"t","chunks":[-1]}`, ErrInvalidMessage},
+		{"unknown kind", `{"action":"transfer_start","kind":"driver","transfer_id":"t","total_chunks":1,"chunk_size":1}`, ErrInvalidMessage},
+		{"fetch without path", `{"action":"fetch_file","request_id":"r"}`, ErrInvalidMessage},
+		{"file chunk out of range", `{"action":"file_chunk","request_id":"r","path":"a.log","chunk_index":1,"total_chunks":1}`, ErrInvalidMessage},
+		{"unknown shell", `{"action":"shell_open","session_id":"s","shell":"bash"}`, ErrInvalidMessage},
+		{"shell input without session", `{"action":"shell_input","data":"ZGly"}`, ErrInvalidMessage},
+		{"config key not settable", `{"action":"set_config","request_id":"r","settings":{"signing_public_key":"x"}}`, ErrInvalidMessage},
+		{"config server not websocket", `{"action":"set_config","request_id":"r","settings":{"websockserver":"http://evil"}}`, ErrInvalidMessage},
+		{"config without settings", `{"action":"set_config","request_id":"r"}`, ErrInvalidMessage},
+		{"unknown config status", `{"action":"config_result","request_id":"r","status":"done"}`, ErrInvalidMessage},
+		{"update without source", `{"action":"update_agent","update_id":"u","version":"1.1","size":1,"content_sha256":"ab"}`, ErrInvalidMessage},
+		{"update version with path", `{"action":"update_agent","update_id":"u","version":"../1.1","size":1,"content_sha256":"ab","transfer_id":"t"}`, ErrInvalidMessage},
+		{"update url not http", `{"action":"update_agent","update_id":"u","version":"1.1","size":1,"content_sha256":"ab","url":"file:///c:/a.exe"}`, ErrInvalidMessage},
+		{"update without hash", `{"action":"update_agent","update_id":"u","version":"1.1","size":1,"transfer_id":"t"}`, ErrInvalidMessage},
+		{"unknown encoding", `{"action":"transfer_start","kind":"binary","binary_name":"a.exe","transfer_id":"t","total_chunks":1,"chunk_size":1,"encoding":"zstd"}`, ErrInvalidMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Decode([]byte(tt.input))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Decode(%s) = %v, %v, want %v", tt.input, msg, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeNumericProtocolVersion(t *testing.T) {
+	msg, err := Decode([]byte(`{"action":"register","client_id":"a","hostname":"b","ip":"c","protocol_version":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := msg.(*Register).ProtocolVersion; version != 2 {
+		t.Errorf("ProtocolVersion = %d, want 2", version)
+	}
+}
+
+func TestEncodeValidates(t *testing.T) {
+	if _, err := Encode(&BinaryChunk{ChunkInfo: ChunkInfo{TotalChunks: 1}}); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Encode without binary_name = %v, want %v", err, ErrInvalidMessage)
+	}
+	if _, err := DecodeResponse([]byte(`{"status":"challenge"}`)); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("DecodeResponse of a challenge without nonce = %v, want %v", err, ErrInvalidMessage)
+	}
+}
+
+func TestCheckServerChange(t *testing.T) {
+	tests := []struct {
+		current  string
+		settings map[string]string
+		wantErr  bool
+	}{
+		{"wss://old.example.com:8765", map[string]string{ConfigWebsockServer: "wss://new.example.com:8765"}, false},
+		{"wss://old.example.com:8765", map[string]string{ConfigWebsockServer: "ws://new.example.com:8765"}, true},
+		{"WSS://old.example.com:8765", map[string]string{ConfigWebsockServer: "ws://old.example.com:8765"}, true},
+		{"wss://old.example.com:8765", map[string]string{ConfigLogging: "debug"}, false},
+		{"ws://old.example.com:8765", map[string]string{ConfigWebsockServer: "ws://new.example.com:8765"}, false},
+		{"ws://old.example.com:8765", map[string]string{ConfigWebsockServer: "wss://new.example.com:8765"}, false},
+	}
+	for _, tt := range tests {
+		err := CheckServerChange(tt.current, tt.settings)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckServerChange(%q, %v) = %v, want error %v", tt.current, tt.settings, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAgentBuildName(t *testing.T) {
+	tests := []struct {
+		version, os, arch string
+		want              string
+	}{
+		{"1.2.3", "windows", "amd64", "websock-client-1.2.3-windows-amd64.exe"},
+		{"1.2.3", "linux", "arm64", "websock-client-1.2.3-linux-arm64"},
+		{"2.0.0-rc1", "darwin", "arm64", "websock-client-2.0.0-rc1-darwin-arm64"},
+	}
+	for _, tt := range tests {
+		if got := AgentBuildName(tt.version, tt.os, tt.arch); got != tt.want {
+			t.Errorf("AgentBuildName(%q, %q, %q) = %q, want %q", tt.version, tt.os, tt.arch, got, tt.want)
+		}
+	}
+}
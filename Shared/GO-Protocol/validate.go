@@ -0,0 +1,275 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// ErrInvalidMessage is wrapped by all validation errors.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// invalid returns a validation error.
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidMessage, fmt.Sprintf(format, args...))
+}
+
+// required checks that none of the named fields is empty.
+func required(fields ...string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			return invalid("%s missing", fields[i])
+		}
+	}
+	return nil
+}
+
+func (m *Register) Validate() error {
+	if err := required("client_id", m.ClientID, "hostname", m.Hostname, "ip", m.IP); err != nil {
+		return err
+	}
+	if m.ProtocolVersion < 0 {
+		return invalid("protocol_version %d", m.ProtocolVersion)
+	}
+	if (m.OS != "" || m.Arch != "") && !ValidPlatform(m.OS, m.Arch) {
+		return invalid("os %q, arch %q", m.OS, m.Arch)
+	}
+	return nil
+}
+
+func (m *Authenticate) Validate() error {
+	return required("proof", m.Proof)
+}
+
+func (m *ScriptResult) Validate() error {
+	return required("script_name", m.ScriptName, "status", m.Status)
+}
+
+func (m *BinaryResult) Validate() error {
+	return required("transfer_id", m.TransferID, "status", m.Status)
+}
+
+func (m *PayloadRejected) Validate() error {
+	return required("name", m.Name, "type", m.Type, "reason", m.Reason)
+}
+
+func (m *ResendChunks) Validate() error {
+	if err := required("transfer_id", m.TransferID); err != nil {
+		return err
+	}
+	for _, index := range m.Chunks {
+		if index < 0 {
+			return invalid("chunk index %d", index)
+		}
+	}
+	return nil
+}
+
+func (m *TransferComplete) Validate() error {
+	return required("transfer_id", m.TransferID)
+}
+
+func (m *FileChunk) Validate() error {
+	if err := required("request_id", m.RequestID, "path", m.Path); err != nil {
+		return err
+	}
+	if m.Size < 0 {
+		return invalid("size %d", m.Size)
+	}
+	return m.ChunkInfo.validate()
+}
+
+func (m *FetchFailed) Validate() error {
+	return required("request_id", m.RequestID, "reason", m.Reason)
+}
+
+func (m *ShellOutput) Validate() error {
+	return required("session_id", m.SessionID)
+}
+
+func (m *ShellClosed) Validate() error {
+	return required("session_id", m.SessionID)
+}
+
+func (m *ConfigResult) Validate() error {
+	if err := required("request_id", m.RequestID); err != nil {
+		return err
+	}
+	switch m.Status {
+	case ConfigApplied, ConfigRejected, ConfigFailed:
+		return nil
+	}
+	return invalid("status %q", m.Status)
+}
+
+func (m *AgentUpdateStatus) Validate() error {
+	if err := required("update_id", m.UpdateID, "status", m.Status); err != nil {
+		return err
+	}
+	switch m.Status {
+	case UpdateDownloading, UpdateInstalling, UpdateInstalled, UpdateRolledBack, UpdateRejected, UpdateFailed:
+		return nil
+	}
+	return invalid("status %q", m.Status)
+}
+
+func (m *ContentMessage) Validate() error { return nil }
+
+func (m *Refresh) Validate() error { return nil }
+
+// validate checks that the chunk lies within its transfer.
+func (c ChunkInfo) validate() error {
+	if c.TotalChunks < 1 || c.ChunkIndex < 0 || c.ChunkIndex >= c.TotalChunks {
+		return invalid("chunk %d of %d", c.ChunkIndex, c.TotalChunks)
+	}
+	return nil
+}
+
+// validate checks the optional script fields that are set.
+func (s ScriptMeta) validate() error {
+	if s.ScriptVersion < 0 || s.TimeoutSeconds < 0 {
+		return invalid("script_version %d, timeout_seconds %d", s.ScriptVersion, s.TimeoutSeconds)
+	}
+	return nil
+}
+
+func (m *ScriptChunk) Validate() error {
+	if err := required("script_name", m.ScriptName, "script_type", m.ScriptType); err != nil {
+		return err
+	}
+	if err := m.ChunkInfo.validate(); err != nil {
+		return err
+	}
+	return m.ScriptMeta.validate()
+}
+
+func (m *BinaryChunk) Validate() error {
+	if err := required("binary_name", m.BinaryName); err != nil {
+		return err
+	}
+	return m.ChunkInfo.validate()
+}
+
+func (m *ExecuteScript) Validate() error {
+	if err := required("script_name", m.ScriptName, "script_type", m.ScriptType); err != nil {
+		return err
+	}
+	return m.ScriptMeta.validate()
+}
+
+func (m *TransferStart) Validate() error {
+	if err := required("transfer_id", m.TransferID); err != nil {
+		return err
+	}
+	switch m.Kind {
+	case KindScript:
+		if err := required("script_name", m.ScriptName, "script_type", m.ScriptType); err != nil {
+			return err
+		}
+	case KindBinary, KindAgent:
+		if err := required("binary_name", m.BinaryName); err != nil {
+			return err
+		}
+	default:
+		return invalid("kind %q", m.Kind)
+	}
+	if m.Encoding != "" && m.Encoding != EncodingGzip {
+		return invalid("encoding %q", m.Encoding)
+	}
+	if m.TotalChunks < 1 || m.ChunkSize < 1 || m.Size < 0 || m.EncodedSize < 0 {
+		return invalid("total_chunks %d, chunk_size %d, size %d", m.TotalChunks, m.ChunkSize, m.Size)
+	}
+	return m.ScriptMeta.validate()
+}
+
+func (m *FetchFile) Validate() error {
+	if err := required("request_id", m.RequestID, "path", m.Path); err != nil {
+		return err
+	}
+	if m.MaxSize < 0 {
+		return invalid("max_size %d", m.MaxSize)
+	}
+	return nil
+}
+
+func (m *ShellOpen) Validate() error {
+	if err := required("session_id", m.SessionID); err != nil {
+		return err
+	}
+	switch m.Shell {
+	case "", "cmd", "powershell", "sh":
+		return nil
+	}
+	return invalid("shell %q", m.Shell)
+}
+
+func (m *ShellInput) Validate() error {
+	return required("session_id", m.SessionID)
+}
+
+func (m *ShellClose) Validate() error {
+	return required("session_id", m.SessionID)
+}
+
+func (m *SetConfig) Validate() error {
+	if err := required("request_id", m.RequestID); err != nil {
+		return err
+	}
+	return ValidateConfig(m.Settings)
+}
+
+// agentVersion matches the versions of client builds, e.g. "1.2.3".
+var agentVersion = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._-]{0,63}$`)
+
+// ValidAgentVersion reports whether a client build version is well-formed.
+// Versions become part of file names on both sides.
+func ValidAgentVersion(version string) bool {
+	return agentVersion.MatchString(version)
+}
+
+// platformPart matches a GOOS or GOARCH value, e.g. "linux" or "arm64".
+var platformPart = regexp.MustCompile(`^[a-z][a-z0-9]{0,15}$`)
+
+// ValidPlatform reports whether os and arch of a client build are
+// well-formed. Like versions, they become part of build file names.
+func ValidPlatform(os, arch string) bool {
+	return platformPart.MatchString(os) && platformPart.MatchString(arch)
+}
+
+// AgentBuildName returns the file name of a client build,
+// websock-client-<version>-<os>-<arch>, with .exe on Windows. Agent builds
+// are signed under this name, so a build for another platform fails the
+// signature check.
+func AgentBuildName(version, os, arch string) string {
+	name := "websock-client-" + version + "-" + os + "-" + arch
+	if os == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func (m *UpdateAgent) Validate() error {
+	if err := required("update_id", m.UpdateID, "version", m.Version, "content_sha256", m.SHA256); err != nil {
+		return err
+	}
+	if !ValidAgentVersion(m.Version) {
+		return invalid("version %q", m.Version)
+	}
+	if (m.URL == "") == (m.TransferID == "") {
+		return invalid("exactly one of url and transfer_id required")
+	}
+	if m.URL != "" {
+		if u, err := url.Parse(m.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return invalid("url %q", m.URL)
+		}
+	}
+	if m.Size < 1 || m.ConfirmSeconds < 0 {
+		return invalid("size %d, confirm_seconds %d", m.Size, m.ConfirmSeconds)
+	}
+	return nil
+}
+
+func (m *TransferUnavailable) Validate() error {
+	return required("transfer_id", m.TransferID)
+}